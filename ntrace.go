@@ -7,6 +7,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/zhengyuli/ntrace/ipdefrag"
 	"github.com/zhengyuli/ntrace/layers"
+	"github.com/zhengyuli/ntrace/proto/analyzer/tls"
 	"github.com/zhengyuli/ntrace/sniffer"
 	"github.com/zhengyuli/ntrace/sniffer/driver"
 	"github.com/zhengyuli/ntrace/tcpassembly"
@@ -291,8 +292,9 @@ func tcpProcessService(tcpDispatchChannel chan *layers.Packet, tcpAssemblyChanne
 	}
 }
 
-func tcpAssemblyService(index int, tcpAssemblyChannel chan *layers.Packet, sessionBreakdownDumpChannel chan interface{}, wg *sync.WaitGroup) {
+func tcpAssemblyService(index int, tcpAssemblyChannel chan *layers.Packet, sessionBreakdownDumpChannel chan interface{}, pcapExport *tcpassembly.PcapExportConfig, wg *sync.WaitGroup) {
 	assembler := tcpassembly.NewAssembler()
+	assembler.PcapExport = pcapExport
 
 	defer func() {
 		log.Infof("tcpAssemblyService: %d got %d tcp streams.", index, assembler.Count)
@@ -356,6 +358,12 @@ func main() {
 	logFile := flag.String("logFile", "ntrace", "Log file")
 	tmpLogLevel := flag.String("logLevel", "info", "Log level: debug|info|warn|error|fatal|panic")
 	singleRoutine := flag.Bool("singleRoutine", false, "Run in debug mode")
+	pcapExportDir := flag.String("pcapExportDir", "", "Directory to export packets of flagged sessions, disabled if empty")
+	pcapExportStatusCodes := flag.String("pcapExportStatusCodes", "500-599", "Status code range of sessions to export")
+	pcapExportLatency := flag.Uint("pcapExportLatency", 0, "Latency in milliseconds of sessions to export, disabled if 0")
+	pcapExportRetransmits := flag.Uint("pcapExportRetransmits", 0, "Retransmitted packets of sessions to export, disabled if 0")
+	pcapExportReset := flag.Bool("pcapExportReset", false, "Export sessions which are reset")
+	sslKeyLogFile := flag.String("sslKeyLogFile", os.Getenv("SSLKEYLOGFILE"), "SSL key log file to decrypt TLS sessions, disabled if empty")
 	flag.Parse()
 
 	if os.Geteuid() != 0 {
@@ -380,6 +388,36 @@ func main() {
 	}
 	defer out.Close()
 
+	var pcapExport *tcpassembly.PcapExportConfig
+	if *pcapExportDir != "" {
+		if err := os.MkdirAll(*pcapExportDir, 0755); err != nil {
+			fmt.Printf("Create pcap export directory with error: %s.\n", err)
+			os.Exit(1)
+		}
+
+		pcapExport = &tcpassembly.PcapExportConfig{
+			Dir:            *pcapExportDir,
+			MinLatency:     *pcapExportLatency,
+			MinRetransmits: *pcapExportRetransmits,
+			Reset:          *pcapExportReset,
+		}
+		if *pcapExportStatusCodes != "" {
+			pcapExport.MinStatusCode, pcapExport.MaxStatusCode, err = tcpassembly.ParseStatusCodeRange(*pcapExportStatusCodes)
+			if err != nil {
+				fmt.Printf("Wrong argument: %s.\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *sslKeyLogFile != "" {
+		if err := tls.LoadKeyLog(*sslKeyLogFile); err != nil {
+			fmt.Printf("Load SSL key log file with error: %s.\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Decrypt TLS sessions with key log file %s.", *sslKeyLogFile)
+	}
+
 	cpuNum := runtime.NumCPU()
 	if *singleRoutine {
 		log.Info("Run in single routine mode.")
@@ -423,7 +461,7 @@ func main() {
 
 	for i := 0; i < cpuNum; i++ {
 		wg.Add(1)
-		go tcpAssemblyService(i, tcpAssemblyChannels[i], sessionBreakdownDumpChannel, &wg)
+		go tcpAssemblyService(i, tcpAssemblyChannels[i], sessionBreakdownDumpChannel, pcapExport, &wg)
 	}
 
 	wg.Add(1)
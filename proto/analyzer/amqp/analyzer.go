@@ -0,0 +1,601 @@
+package amqp
+
+import (
+	"container/list"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"sort"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseComplete
+	responseError
+	messageSent
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "AMQPRequestSent"
+
+	case responseComplete:
+		return "AMQPResponseComplete"
+
+	case responseError:
+		return "AMQPResponseError"
+
+	case messageSent:
+		return "AMQPMessageSent"
+
+	default:
+		return "InvalidAMQPSessionState"
+	}
+}
+
+// replySuccess reply code of close without error.
+const replySuccess = 200
+
+// session state of one synchronous method or one message.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	channel   uint16
+	method    methodID
+	// fromClient request or message is sent by client
+	fromClient bool
+	exchange   string
+	routingKey string
+	queue      string
+	// consumerTag and noAck consumer of consume method or deliver method
+	consumerTag string
+	noAck       bool
+	// deliveryTag delivery tag of deliver, sequence number of publish in
+	// confirm mode
+	deliveryTag uint64
+	bodySize    uint64
+	reply       string
+	replyCode   uint16
+	replyText   string
+	reqTime     time.Time
+	respTime    time.Time
+}
+
+// SessionBreakdown AMQP analyzer session breakdown of one synchronous
+// method or one message.
+type SessionBreakdown struct {
+	SessionState string `json:"amqp_session_state"`
+	Channel      uint16 `json:"amqp_channel"`
+	Method       string `json:"amqp_method"`
+	Exchange     string `json:"amqp_exchange,omitempty"`
+	RoutingKey   string `json:"amqp_routing_key,omitempty"`
+	Queue        string `json:"amqp_queue,omitempty"`
+	DeliveryTag  uint64 `json:"amqp_delivery_tag,omitempty"`
+	BodySize     uint64 `json:"amqp_body_size"`
+	Reply        string `json:"amqp_reply,omitempty"`
+	ReplyCode    uint16 `json:"amqp_reply_code,omitempty"`
+	ReplyText    string `json:"amqp_reply_text,omitempty"`
+	// ServerLatency latency of reply or confirm to request or message sent
+	// by client
+	ServerLatency uint `json:"amqp_server_latency"`
+	// ClientLatency latency of reply or acknowledgement to request or
+	// message sent by server
+	ClientLatency uint `json:"amqp_client_latency"`
+}
+
+// ApplicationLatency get AMQP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.ClientLatency) * time.Millisecond
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Channel = s.channel
+	sb.Method = s.method.String()
+	sb.Exchange = s.exchange
+	sb.RoutingKey = s.routingKey
+	sb.Queue = s.queue
+	sb.DeliveryTag = s.deliveryTag
+	sb.BodySize = s.bodySize
+	sb.Reply = s.reply
+	sb.ReplyCode = s.replyCode
+	sb.ReplyText = s.replyText
+
+	if s.respTime.After(s.reqTime) {
+		latency := uint(s.respTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+		if s.fromClient {
+			sb.ServerLatency = latency
+		} else {
+			sb.ClientLatency = latency
+		}
+	}
+
+	return sb
+}
+
+// channel state of one channel.
+type channel struct {
+	// confirm publisher confirms are enabled
+	confirm bool
+	// publishSeq sequence number of the last message published in confirm
+	// mode
+	publishSeq uint64
+	// clientRPC and serverRPC synchronous methods sent by client or server
+	// waiting for replies
+	clientRPC *session
+	serverRPC *session
+	// publishing and delivering messages waiting for content header
+	publishing *session
+	delivering *session
+	// confirms messages published waiting for confirms in order
+	confirms list.List
+	// deliveries messages delivered waiting for acknowledgements in order
+	deliveries list.List
+	// noAckConsumers no-ack flags of consumers by consumer tag
+	noAckConsumers map[string]bool
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of body frame not received yet
+	skip int
+}
+
+// Analyzer AMQP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	client    halfConn
+	server    halfConn
+	channels  map[uint16]*channel
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init AMQP analyzer init function.
+func (a *Analyzer) Init() {
+	a.channels = make(map[uint16]*channel)
+}
+
+func (a *Analyzer) getChannel(id uint16) *channel {
+	ch := a.channels[id]
+	if ch == nil {
+		ch = &channel{noAckConsumers: make(map[string]bool)}
+		ch.confirms.Init()
+		ch.deliveries.Init()
+		a.channels[id] = ch
+	}
+
+	return ch
+}
+
+// complete complete session with reply and queue its session breakdown.
+func (a *Analyzer) complete(s *session, reply methodID, failed bool) {
+	s.reply = reply.String()
+	s.respTime = a.timestamp
+	if failed {
+		s.state = responseError
+	} else {
+		s.state = responseComplete
+	}
+	a.Push(s.toBreakdown())
+}
+
+// acknowledge complete messages acknowledged by delivery tag.
+func (a *Analyzer) acknowledge(messages *list.List, deliveryTag uint64, multiple bool, reply methodID) {
+	for e := messages.Front(); e != nil; {
+		next := e.Next()
+
+		s := e.Value.(*session)
+		if s.deliveryTag == deliveryTag || (multiple && (deliveryTag == 0 || s.deliveryTag < deliveryTag)) {
+			messages.Remove(e)
+			// Message returned as unroutable is failed even if confirmed
+			a.complete(s, reply, reply != basicAck || s.replyCode != 0)
+		}
+		e = next
+	}
+}
+
+// closeChannel fail synchronous method of peer and messages waiting on
+// channel closed.
+func (a *Analyzer) closeChannel(ch *channel, close *session) {
+	peerRPC := &ch.clientRPC
+	if close.fromClient {
+		peerRPC = &ch.serverRPC
+	}
+	if s := *peerRPC; s != nil {
+		*peerRPC = nil
+		s.replyCode = close.replyCode
+		s.replyText = close.replyText
+		a.complete(s, close.method, true)
+	}
+
+	for _, messages := range []*list.List{&ch.confirms, &ch.deliveries} {
+		for e := messages.Front(); e != nil; e = messages.Front() {
+			messages.Remove(e)
+			a.complete(e.Value.(*session), close.method, true)
+		}
+	}
+}
+
+// sortedChannels ids of channels in order.
+func (a *Analyzer) sortedChannels() []uint16 {
+	var ids []uint16
+	for id := range a.channels {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// handleReply handle reply to synchronous method.
+func (a *Analyzer) handleReply(ch *channel, s *session, m methodID, r *reader) {
+	switch m {
+	case queueDeclareOk:
+		// Queue named by server
+		s.queue = r.shortstr()
+
+	case basicConsumeOk:
+		s.consumerTag = r.shortstr()
+		ch.noAckConsumers[s.consumerTag] = s.noAck
+
+	case confirmSelectOk:
+		ch.confirm = true
+
+	case channelCloseOk:
+		delete(a.channels, s.channel)
+
+	case connectionCloseOk:
+		a.channels = make(map[uint16]*channel)
+	}
+
+	a.complete(s, m, s.replyCode != 0 && s.replyCode != replySuccess)
+}
+
+// handleMethod handle method frame of channel.
+func (a *Analyzer) handleMethod(fromClient bool, id uint16, m methodID, r *reader) {
+	ch := a.getChannel(id)
+
+	// Reply to synchronous method of peer
+	peerRPC := &ch.clientRPC
+	if fromClient {
+		peerRPC = &ch.serverRPC
+	}
+	if s := *peerRPC; s != nil && isReply(s.method, m) {
+		*peerRPC = nil
+		a.handleReply(ch, s, m, r)
+		return
+	}
+
+	s := &session{
+		state:      requestSent,
+		channel:    id,
+		method:     m,
+		fromClient: fromClient,
+		reqTime:    a.timestamp,
+	}
+
+	var noWait bool
+	switch m {
+	case basicPublish:
+		// Reserved short
+		r.uint16()
+		s.exchange = r.shortstr()
+		s.routingKey = r.shortstr()
+		ch.publishing = s
+		return
+
+	case basicDeliver:
+		s.consumerTag = r.shortstr()
+		s.deliveryTag = r.uint64()
+		// Redelivered
+		r.uint8()
+		s.exchange = r.shortstr()
+		s.routingKey = r.shortstr()
+		s.noAck = ch.noAckConsumers[s.consumerTag]
+		ch.delivering = s
+		return
+
+	case basicAck, basicNack, basicReject:
+		deliveryTag := r.uint64()
+		multiple := m != basicReject && r.uint8()&1 != 0
+		if fromClient {
+			a.acknowledge(&ch.deliveries, deliveryTag, multiple, m)
+		} else {
+			a.acknowledge(&ch.confirms, deliveryTag, multiple, m)
+		}
+		return
+
+	case basicReturn:
+		replyCode := r.uint16()
+		replyText := r.shortstr()
+		exchange := r.shortstr()
+		routingKey := r.shortstr()
+		for e := ch.confirms.Front(); e != nil; e = e.Next() {
+			if p := e.Value.(*session); p.replyCode == 0 && p.exchange == exchange && p.routingKey == routingKey {
+				p.replyCode = replyCode
+				p.replyText = replyText
+				break
+			}
+		}
+		return
+
+	case connectionClose, channelClose:
+		s.replyCode = r.uint16()
+		s.replyText = r.shortstr()
+		if m == connectionClose {
+			for _, id := range a.sortedChannels() {
+				a.closeChannel(a.channels[id], s)
+			}
+		} else {
+			a.closeChannel(ch, s)
+		}
+
+	case exchangeDeclare:
+		r.uint16()
+		s.exchange = r.shortstr()
+		// Type
+		r.shortstr()
+		noWait = r.uint8()&0x10 != 0
+
+	case exchangeDelete:
+		r.uint16()
+		s.exchange = r.shortstr()
+		noWait = r.uint8()&0x02 != 0
+
+	case exchangeBind, exchangeUnbind:
+		r.uint16()
+		// Destination and source
+		s.exchange = r.shortstr()
+		r.shortstr()
+		s.routingKey = r.shortstr()
+		noWait = r.uint8()&0x01 != 0
+
+	case queueDeclare:
+		r.uint16()
+		s.queue = r.shortstr()
+		noWait = r.uint8()&0x10 != 0
+
+	case queueBind:
+		r.uint16()
+		s.queue = r.shortstr()
+		s.exchange = r.shortstr()
+		s.routingKey = r.shortstr()
+		noWait = r.uint8()&0x01 != 0
+
+	case queueUnbind:
+		r.uint16()
+		s.queue = r.shortstr()
+		s.exchange = r.shortstr()
+		s.routingKey = r.shortstr()
+
+	case queuePurge:
+		r.uint16()
+		s.queue = r.shortstr()
+		noWait = r.uint8()&0x01 != 0
+
+	case queueDelete:
+		r.uint16()
+		s.queue = r.shortstr()
+		noWait = r.uint8()&0x04 != 0
+
+	case basicConsume:
+		r.uint16()
+		s.queue = r.shortstr()
+		s.consumerTag = r.shortstr()
+		bits := r.uint8()
+		s.noAck = bits&0x02 != 0
+		noWait = bits&0x08 != 0
+		if noWait {
+			ch.noAckConsumers[s.consumerTag] = s.noAck
+		}
+
+	case basicCancel:
+		s.consumerTag = r.shortstr()
+		noWait = r.uint8()&0x01 != 0
+
+	case basicGet:
+		r.uint16()
+		s.queue = r.shortstr()
+
+	case confirmSelect:
+		noWait = r.uint8()&0x01 != 0
+		if noWait {
+			ch.confirm = true
+		}
+	}
+
+	if r.failed {
+		log.Errorf("AMQP Analyzer: invalid arguments of method %s.", m)
+		return
+	}
+
+	if _, ok := syncReplies[m]; ok && !noWait {
+		if fromClient {
+			ch.clientRPC = s
+		} else {
+			ch.serverRPC = s
+		}
+	}
+}
+
+// handleContentHeader handle content header frame of message published or
+// delivered.
+func (a *Analyzer) handleContentHeader(fromClient bool, id uint16, r *reader) {
+	ch := a.getChannel(id)
+
+	var s *session
+	if fromClient {
+		s, ch.publishing = ch.publishing, nil
+	} else {
+		s, ch.delivering = ch.delivering, nil
+	}
+	// Content of get-ok and return is not tracked
+	if s == nil {
+		return
+	}
+
+	// Class id and weight
+	r.bytes(4)
+	s.bodySize = r.uint64()
+
+	switch {
+	case s.method == basicPublish && ch.confirm:
+		ch.publishSeq++
+		s.deliveryTag = ch.publishSeq
+		ch.confirms.PushBack(s)
+
+	case s.method == basicDeliver && !s.noAck:
+		ch.deliveries.PushBack(s)
+
+	default:
+		s.state = messageSent
+		a.Push(s.toBreakdown())
+	}
+}
+
+// HandleEstb AMQP analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("AMQP Analyzer: HandleEstb.")
+}
+
+// HandleData AMQP analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.Len() == 0 && parsed < len(payload) {
+		data := payload[parsed:]
+
+		if hc.skip > 0 {
+			n := len(data)
+			if n > hc.skip {
+				n = hc.skip
+			}
+			hc.skip -= n
+			parsed += n
+			continue
+		}
+
+		// Protocol header of client or server rejecting protocol version
+		if data[0] == 'A' {
+			if len(data) < protocolHeaderLen {
+				break
+			}
+			parsed += protocolHeaderLen
+			continue
+		}
+
+		if len(data) < frameHeaderLen {
+			break
+		}
+		frameType := data[0]
+		id := binary.BigEndian.Uint16(data[1:])
+		size := int(binary.BigEndian.Uint32(data[3:]))
+
+		if frameType == frameBody {
+			parsed += frameHeaderLen
+			hc.skip = size + 1
+			continue
+		}
+		if size > maxFrameLen {
+			log.Errorf("AMQP Analyzer: invalid frame length %d.", size)
+			a.broken = true
+			break
+		}
+		if len(data) < frameHeaderLen+size+1 {
+			break
+		}
+		if data[frameHeaderLen+size] != frameEnd {
+			log.Error("AMQP Analyzer: invalid frame end.")
+			a.broken = true
+			break
+		}
+		parsed += frameHeaderLen + size + 1
+
+		r := &reader{data: data[frameHeaderLen : frameHeaderLen+size]}
+		switch frameType {
+		case frameMethod:
+			m := methodID{r.uint16(), r.uint16()}
+			a.handleMethod(fromClient, id, m, r)
+
+		case frameHeader:
+			a.handleContentHeader(fromClient, id, r)
+
+		case frameHeartbeat:
+
+		default:
+			log.Errorf("AMQP Analyzer: unknown frame type %d.", frameType)
+			a.broken = true
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset AMQP analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("AMQP Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("AMQP Analyzer: HandleReset from server.")
+	}
+
+	for _, id := range a.sortedChannels() {
+		ch := a.channels[id]
+
+		var pending []*session
+		if ch.clientRPC != nil {
+			pending = append(pending, ch.clientRPC)
+		}
+		if ch.serverRPC != nil {
+			pending = append(pending, ch.serverRPC)
+		}
+		for _, messages := range []*list.List{&ch.confirms, &ch.deliveries} {
+			for e := messages.Front(); e != nil; e = e.Next() {
+				pending = append(pending, e.Value.(*session))
+			}
+		}
+
+		for _, s := range pending {
+			s.resetFlag = true
+			a.Push(s.toBreakdown())
+		}
+	}
+	a.channels = make(map[uint16]*channel)
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin AMQP analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("AMQP Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("AMQP Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
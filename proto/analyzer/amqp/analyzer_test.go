@@ -0,0 +1,153 @@
+package amqp
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func u16(v uint16) string {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return string(b[:])
+}
+
+func u32(v uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return string(b[:])
+}
+
+func u64(v uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return string(b[:])
+}
+
+func shortstr(s string) string {
+	return string([]byte{byte(len(s))}) + s
+}
+
+func frame(frameType uint8, channel uint16, payload string) string {
+	return string([]byte{frameType}) + u16(channel) + u32(uint32(len(payload))) + payload + string([]byte{frameEnd})
+}
+
+func method(channel uint16, m methodID, args string) string {
+	return frame(frameMethod, channel, u16(m.class)+u16(m.method)+args)
+}
+
+// content build content header and body frames.
+func content(channel uint16, body string) string {
+	return frame(frameHeader, channel, u16(60)+u16(0)+u64(uint64(len(body)))+u16(0)) + frame(frameBody, channel, body)
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	publish := method(1, basicPublish, u16(0)+shortstr("")+shortstr("tasks")+"\x00") + content(1, "hello")
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("AMQP\x00\x00\x09\x01"),
+		analyzertest.FromServer(method(0, methodID{10, 10}, "\x00\x09"+u32(0)+u32(5)+"PLAIN"+u32(5)+"en_US")),
+		analyzertest.FromClient(method(0, methodID{10, 11}, u32(0)+shortstr("PLAIN")+u32(0)+shortstr("en_US"))),
+		analyzertest.FromClient(method(1, methodID{20, 10}, shortstr(""))),
+		analyzertest.FromServer(method(1, methodID{20, 11}, u32(0))),
+		analyzertest.FromClient(method(1, queueDeclare, u16(0)+shortstr("tasks")+"\x02"+u32(0))),
+		analyzertest.FromServer(method(1, queueDeclareOk, shortstr("tasks")+u32(0)+u32(0))),
+		analyzertest.FromClient(method(1, confirmSelect, "\x00")),
+		analyzertest.FromServer(method(1, confirmSelectOk, "")),
+		analyzertest.FromClient(publish + publish),
+		analyzertest.FromServer(method(0, methodID{10, 60}, shortstr("low memory")) + method(1, basicAck, u64(2)+"\x01")),
+		analyzertest.FromClient(method(1, basicConsume, u16(0)+shortstr("tasks")+shortstr("")+"\x00"+u32(0))),
+		analyzertest.FromServer(method(1, basicConsumeOk, shortstr("ctag-1"))),
+		analyzertest.FromServer(frame(frameHeartbeat, 0, "") + method(1, basicDeliver, shortstr("ctag-1")+u64(1)+"\x00"+shortstr("")+
+			shortstr("tasks")) + content(1, strings.Repeat("x", 3000))),
+		analyzertest.FromClient(method(1, basicNack, u64(1)+"\x02")),
+		analyzertest.FromClient(method(1, queueDeclare, u16(0)+shortstr("tasks")+"\x01"+u32(0))),
+		analyzertest.FromServer(method(1, channelClose, u16(406)+shortstr("PRECONDITION_FAILED")+u16(50)+u16(10))),
+		analyzertest.FromClient(method(1, channelCloseOk, "")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "AMQPResponseComplete", Method: "connection.start", Reply: "connection.start-ok"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "channel.open", Reply: "channel.open-ok"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "queue.declare", Queue: "tasks",
+			Reply: "queue.declare-ok"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "confirm.select", Reply: "confirm.select-ok"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "basic.publish", RoutingKey: "tasks",
+			DeliveryTag: 1, BodySize: 5, Reply: "basic.ack"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "basic.publish", RoutingKey: "tasks",
+			DeliveryTag: 2, BodySize: 5, Reply: "basic.ack"},
+		{SessionState: "AMQPResponseComplete", Channel: 1, Method: "basic.consume", Queue: "tasks",
+			Reply: "basic.consume-ok"},
+		{SessionState: "AMQPResponseError", Channel: 1, Method: "basic.deliver", RoutingKey: "tasks",
+			DeliveryTag: 1, BodySize: 3000, Reply: "basic.nack"},
+		{SessionState: "AMQPResponseError", Channel: 1, Method: "queue.declare", Queue: "tasks",
+			Reply: "channel.close", ReplyCode: 406, ReplyText: "PRECONDITION_FAILED"},
+		{SessionState: "AMQPResponseError", Channel: 1, Method: "channel.close", Reply: "channel.close-ok",
+			ReplyCode: 406, ReplyText: "PRECONDITION_FAILED"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("AMQP Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	if breakdowns[0].ClientLatency != 10 || breakdowns[4].ServerLatency != 10 {
+		t.Errorf("AMQP Analyzer: get wrong direction of latency.")
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency+sb.ClientLatency != 10 {
+			t.Errorf("AMQP Analyzer: session breakdown %d get wrong latency %d/%d.", i, sb.ServerLatency, sb.ClientLatency)
+		}
+		sb.ServerLatency = 0
+		sb.ClientLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("AMQP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("AMQP Analyzer: get session breakdown %v on reset without pending method.", sb)
+	}
+}
+
+func TestAnalyzerWithoutConfirm(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("AMQP\x00\x00\x09\x01"),
+		analyzertest.FromClient(method(2, basicPublish, u16(0)+shortstr("logs")+shortstr("app.info")+"\x00") + content(2, "")),
+		analyzertest.FromClient(method(2, basicConsume, u16(0)+shortstr("audit")+shortstr("ctag-2")+"\x0a"+u32(0))),
+		analyzertest.FromServer(method(2, basicDeliver, shortstr("ctag-2")+u64(1)+"\x00"+shortstr("logs")+shortstr("app.warn")) +
+			content(2, "disk")),
+		analyzertest.FromClient(method(2, methodID{90, 10}, "")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "AMQPMessageSent", Channel: 2, Method: "basic.publish", Exchange: "logs", RoutingKey: "app.info"},
+		{SessionState: "AMQPMessageSent", Channel: 2, Method: "basic.deliver", Exchange: "logs", RoutingKey: "app.warn",
+			DeliveryTag: 1, BodySize: 4},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("AMQP Analyzer: get %d session breakdowns without confirm, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if *sb != expected[i] {
+			t.Errorf("AMQP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	sb, ok := a.HandleReset(true, time.Now()).(*SessionBreakdown)
+	if !ok || sb.SessionState != "Reset:AMQPRequestSent" || sb.Method != "tx.select" {
+		t.Errorf("AMQP Analyzer: get wrong session breakdown %v on reset.", sb)
+	}
+}
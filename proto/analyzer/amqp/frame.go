@@ -0,0 +1,243 @@
+package amqp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Frame types.
+const (
+	frameMethod    uint8 = 1
+	frameHeader    uint8 = 2
+	frameBody      uint8 = 3
+	frameHeartbeat uint8 = 8
+)
+
+// frameEnd octet ending each frame.
+const frameEnd uint8 = 0xce
+
+// frameHeaderLen length of frame type, channel and size.
+const frameHeaderLen = 7
+
+// protocolHeaderLen length of protocol header beginning connection.
+const protocolHeaderLen = 8
+
+// maxFrameLen max length of method and content header frames buffered, body
+// frames are skipped whatever their length.
+const maxFrameLen = 1024 * 1024
+
+// methodID class id and method id of method.
+type methodID struct {
+	class  uint16
+	method uint16
+}
+
+// Methods of interest.
+var (
+	connectionClose   = methodID{10, 50}
+	connectionCloseOk = methodID{10, 51}
+	channelClose      = methodID{20, 40}
+	channelCloseOk    = methodID{20, 41}
+	exchangeDeclare   = methodID{40, 10}
+	exchangeDelete    = methodID{40, 20}
+	exchangeBind      = methodID{40, 30}
+	exchangeUnbind    = methodID{40, 40}
+	queueDeclare      = methodID{50, 10}
+	queueDeclareOk    = methodID{50, 11}
+	queueBind         = methodID{50, 20}
+	queuePurge        = methodID{50, 30}
+	queueDelete       = methodID{50, 40}
+	queueUnbind       = methodID{50, 50}
+	basicConsume      = methodID{60, 20}
+	basicConsumeOk    = methodID{60, 21}
+	basicCancel       = methodID{60, 30}
+	basicPublish      = methodID{60, 40}
+	basicReturn       = methodID{60, 50}
+	basicDeliver      = methodID{60, 60}
+	basicGet          = methodID{60, 70}
+	basicAck          = methodID{60, 80}
+	basicReject       = methodID{60, 90}
+	basicNack         = methodID{60, 120}
+	confirmSelect     = methodID{85, 10}
+	confirmSelectOk   = methodID{85, 11}
+)
+
+var classNames = map[uint16]string{
+	10: "connection",
+	20: "channel",
+	40: "exchange",
+	50: "queue",
+	60: "basic",
+	85: "confirm",
+	90: "tx",
+}
+
+var methodNames = map[methodID]string{
+	{10, 10}:  "start",
+	{10, 11}:  "start-ok",
+	{10, 20}:  "secure",
+	{10, 21}:  "secure-ok",
+	{10, 30}:  "tune",
+	{10, 31}:  "tune-ok",
+	{10, 40}:  "open",
+	{10, 41}:  "open-ok",
+	{10, 50}:  "close",
+	{10, 51}:  "close-ok",
+	{10, 60}:  "blocked",
+	{10, 61}:  "unblocked",
+	{20, 10}:  "open",
+	{20, 11}:  "open-ok",
+	{20, 20}:  "flow",
+	{20, 21}:  "flow-ok",
+	{20, 40}:  "close",
+	{20, 41}:  "close-ok",
+	{40, 10}:  "declare",
+	{40, 11}:  "declare-ok",
+	{40, 20}:  "delete",
+	{40, 21}:  "delete-ok",
+	{40, 30}:  "bind",
+	{40, 31}:  "bind-ok",
+	{40, 40}:  "unbind",
+	{40, 51}:  "unbind-ok",
+	{50, 10}:  "declare",
+	{50, 11}:  "declare-ok",
+	{50, 20}:  "bind",
+	{50, 21}:  "bind-ok",
+	{50, 30}:  "purge",
+	{50, 31}:  "purge-ok",
+	{50, 40}:  "delete",
+	{50, 41}:  "delete-ok",
+	{50, 50}:  "unbind",
+	{50, 51}:  "unbind-ok",
+	{60, 10}:  "qos",
+	{60, 11}:  "qos-ok",
+	{60, 20}:  "consume",
+	{60, 21}:  "consume-ok",
+	{60, 30}:  "cancel",
+	{60, 31}:  "cancel-ok",
+	{60, 40}:  "publish",
+	{60, 50}:  "return",
+	{60, 60}:  "deliver",
+	{60, 70}:  "get",
+	{60, 71}:  "get-ok",
+	{60, 72}:  "get-empty",
+	{60, 80}:  "ack",
+	{60, 90}:  "reject",
+	{60, 100}: "recover-async",
+	{60, 110}: "recover",
+	{60, 111}: "recover-ok",
+	{60, 120}: "nack",
+	{85, 10}:  "select",
+	{85, 11}:  "select-ok",
+	{90, 10}:  "select",
+	{90, 11}:  "select-ok",
+	{90, 20}:  "commit",
+	{90, 21}:  "commit-ok",
+	{90, 30}:  "rollback",
+	{90, 31}:  "rollback-ok",
+}
+
+func (m methodID) String() string {
+	class, ok := classNames[m.class]
+	if !ok {
+		return fmt.Sprintf("%d.%d", m.class, m.method)
+	}
+
+	if name, ok := methodNames[m]; ok {
+		return class + "." + name
+	}
+
+	return fmt.Sprintf("%s.%d", class, m.method)
+}
+
+// syncReplies method ids of replies to synchronous methods in the same
+// class.
+var syncReplies = map[methodID][]uint16{
+	{10, 10}:  {11},
+	{10, 20}:  {21},
+	{10, 30}:  {31},
+	{10, 40}:  {41},
+	{10, 50}:  {51},
+	{20, 10}:  {11},
+	{20, 20}:  {21},
+	{20, 40}:  {41},
+	{40, 10}:  {11},
+	{40, 20}:  {21},
+	{40, 30}:  {31},
+	{40, 40}:  {51},
+	{50, 10}:  {11},
+	{50, 20}:  {21},
+	{50, 30}:  {31},
+	{50, 40}:  {41},
+	{50, 50}:  {51},
+	{60, 10}:  {11},
+	{60, 20}:  {21},
+	{60, 30}:  {31},
+	{60, 70}:  {71, 72},
+	{60, 110}: {111},
+	{85, 10}:  {11},
+	{90, 10}:  {11},
+	{90, 20}:  {21},
+	{90, 30}:  {31},
+}
+
+// isReply return true if method is reply to synchronous method request.
+func isReply(request methodID, m methodID) bool {
+	if request.class != m.class {
+		return false
+	}
+
+	for _, reply := range syncReplies[request] {
+		if reply == m.method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reader bounds checked big endian reader of method arguments, any read out
+// of bounds marks reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (r *reader) shortstr() string {
+	return string(r.bytes(int(r.uint8())))
+}
@@ -2,12 +2,34 @@ package analyzer
 
 import (
 	"github.com/zhengyuli/ntrace/proto"
+	"github.com/zhengyuli/ntrace/proto/analyzer/amqp"
+	"github.com/zhengyuli/ntrace/proto/analyzer/cql"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ftp"
 	"github.com/zhengyuli/ntrace/proto/analyzer/http"
+	"github.com/zhengyuli/ntrace/proto/analyzer/http2"
+	"github.com/zhengyuli/ntrace/proto/analyzer/imap"
+	"github.com/zhengyuli/ntrace/proto/analyzer/kafka"
+	"github.com/zhengyuli/ntrace/proto/analyzer/kerberos"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ldap"
+	"github.com/zhengyuli/ntrace/proto/analyzer/memcached"
+	"github.com/zhengyuli/ntrace/proto/analyzer/mongodb"
+	"github.com/zhengyuli/ntrace/proto/analyzer/mqtt"
+	"github.com/zhengyuli/ntrace/proto/analyzer/mysql"
+	"github.com/zhengyuli/ntrace/proto/analyzer/nfs"
+	"github.com/zhengyuli/ntrace/proto/analyzer/pop3"
+	"github.com/zhengyuli/ntrace/proto/analyzer/postgresql"
+	"github.com/zhengyuli/ntrace/proto/analyzer/redis"
+	"github.com/zhengyuli/ntrace/proto/analyzer/smb"
+	"github.com/zhengyuli/ntrace/proto/analyzer/smtp"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ssh"
 	"github.com/zhengyuli/ntrace/proto/analyzer/tcp"
+	"github.com/zhengyuli/ntrace/proto/analyzer/tls"
 	"time"
 )
 
-// Analyzer interface of TCP application layer protocol analyzer.
+// Analyzer interface of TCP application layer protocol analyzer. HandleData
+// may return before consuming the whole payload once a session breakdown is
+// generated, the rest of payload will be fed again.
 type Analyzer interface {
 	Init()
 	HandleEstb(timestamp time.Time)
@@ -16,6 +38,39 @@ type Analyzer interface {
 	HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{})
 }
 
+// SessionBreakdownQueue optional interface of analyzer which may generate
+// more than one session breakdown by one call, the rest of session
+// breakdowns are popped after each call until nil is returned.
+type SessionBreakdownQueue interface {
+	PopSessionBreakdown() (sessionBreakdown interface{})
+}
+
+// ConnAddrSetter optional interface of analyzer which needs addresses of TCP
+// connection, it is called once right after analyzer is created.
+type ConnAddrSetter interface {
+	SetConnAddr(clientIP string, clientPort uint16, serverIP string, serverPort uint16)
+}
+
+// ProtoRegistrySetter optional interface of analyzer which announces
+// protocol of other TCP connections like FTP data connection, it is called
+// once right after analyzer is created with functions adding and removing
+// protocol expected on server ip:port.
+type ProtoRegistrySetter interface {
+	SetProtoRegistry(addProto func(protoName string, ip string, port uint16), removeProto func(ip string, port uint16))
+}
+
+// SessionBreakdownStatusCode optional interface of session breakdown which
+// has application status code.
+type SessionBreakdownStatusCode interface {
+	ApplicationStatusCode() uint16
+}
+
+// SessionBreakdownLatency optional interface of session breakdown which
+// has application latency.
+type SessionBreakdownLatency interface {
+	ApplicationLatency() time.Duration
+}
+
 // NewAnalyzerFunc create new analyzer function.
 type NewAnalyzerFunc func() Analyzer
 
@@ -42,6 +97,174 @@ func init() {
 		return a
 	}
 
+	// Register HTTP/2 Analyzer
+	newAnalyzerFuncs[proto.HTTP2ProtoName] = func() Analyzer {
+		a := new(http2.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register TLS Analyzer
+	newAnalyzerFuncs[proto.TLSProtoName] = func() Analyzer {
+		a := new(tls.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register MySQL Analyzer
+	newAnalyzerFuncs[proto.MySQLProtoName] = func() Analyzer {
+		a := new(mysql.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register PostgreSQL Analyzer
+	newAnalyzerFuncs[proto.PostgreSQLProtoName] = func() Analyzer {
+		a := new(postgresql.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register Redis Analyzer
+	newAnalyzerFuncs[proto.RedisProtoName] = func() Analyzer {
+		a := new(redis.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register memcached Analyzer
+	newAnalyzerFuncs[proto.MemcachedProtoName] = func() Analyzer {
+		a := new(memcached.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register MongoDB Analyzer
+	newAnalyzerFuncs[proto.MongoDBProtoName] = func() Analyzer {
+		a := new(mongodb.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register Kafka Analyzer
+	newAnalyzerFuncs[proto.KafkaProtoName] = func() Analyzer {
+		a := new(kafka.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register AMQP Analyzer
+	newAnalyzerFuncs[proto.AMQPProtoName] = func() Analyzer {
+		a := new(amqp.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register MQTT Analyzer
+	newAnalyzerFuncs[proto.MQTTProtoName] = func() Analyzer {
+		a := new(mqtt.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register SMTP Analyzer
+	newAnalyzerFuncs[proto.SMTPProtoName] = func() Analyzer {
+		a := new(smtp.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register IMAP Analyzer
+	newAnalyzerFuncs[proto.IMAPProtoName] = func() Analyzer {
+		a := new(imap.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register POP3 Analyzer
+	newAnalyzerFuncs[proto.POP3ProtoName] = func() Analyzer {
+		a := new(pop3.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register FTP Analyzer
+	newAnalyzerFuncs[proto.FTPProtoName] = func() Analyzer {
+		a := new(ftp.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register FTP data connection Analyzer
+	newAnalyzerFuncs[proto.FTPDataProtoName] = func() Analyzer {
+		a := new(ftp.DataAnalyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register SSH Analyzer
+	newAnalyzerFuncs[proto.SSHProtoName] = func() Analyzer {
+		a := new(ssh.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register LDAP Analyzer
+	newAnalyzerFuncs[proto.LDAPProtoName] = func() Analyzer {
+		a := new(ldap.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register Kerberos Analyzer
+	newAnalyzerFuncs[proto.KerberosProtoName] = func() Analyzer {
+		a := new(kerberos.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register NFS Analyzer
+	newAnalyzerFuncs[proto.NFSProtoName] = func() Analyzer {
+		a := new(nfs.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register SMB Analyzer
+	newAnalyzerFuncs[proto.SMBProtoName] = func() Analyzer {
+		a := new(smb.Analyzer)
+		a.Init()
+
+		return a
+	}
+
+	// Register CQL Analyzer
+	newAnalyzerFuncs[proto.CQLProtoName] = func() Analyzer {
+		a := new(cql.Analyzer)
+		a.Init()
+
+		return a
+	}
+
 	// Register TCP Analyzer
 	newAnalyzerFuncs[proto.TCPProtoName] = func() Analyzer {
 		a := new(tcp.Analyzer)
@@ -0,0 +1,177 @@
+package ber
+
+import (
+	"errors"
+)
+
+// Classes of tag.
+const (
+	ClassUniversal   = 0
+	ClassApplication = 1
+	ClassContext     = 2
+	ClassPrivate     = 3
+)
+
+// Universal tags.
+const (
+	TagBoolean     = 1
+	TagInteger     = 2
+	TagBitString   = 3
+	TagOctetString = 4
+	TagEnumerated  = 10
+	TagSequence    = 16
+	TagSet         = 17
+)
+
+// maxTagBytes max bytes of high tag number.
+const maxTagBytes = 4
+
+// maxLengthBytes max bytes of long form length.
+const maxLengthBytes = 4
+
+var (
+	// ErrIncomplete data ends before the end of element.
+	ErrIncomplete = errors.New("ber: incomplete element")
+	// ErrInvalid element is not valid BER or uses indefinite length.
+	ErrInvalid = errors.New("ber: invalid element")
+)
+
+// Element BER element.
+type Element struct {
+	Class       int
+	Constructed bool
+	Tag         int
+	// Content content octets of element
+	Content []byte
+}
+
+// header parse identifier and length octets, it returns element without
+// content, length of header and length of content.
+func header(data []byte) (Element, int, int, error) {
+	var e Element
+	if len(data) < 2 {
+		return e, 0, 0, ErrIncomplete
+	}
+
+	e.Class = int(data[0] >> 6)
+	e.Constructed = data[0]&0x20 != 0
+	e.Tag = int(data[0] & 0x1f)
+	offset := 1
+
+	// High tag number
+	if e.Tag == 0x1f {
+		e.Tag = 0
+		for i := 0; ; i++ {
+			if offset >= len(data) {
+				return e, 0, 0, ErrIncomplete
+			}
+			if i == maxTagBytes {
+				return e, 0, 0, ErrInvalid
+			}
+			b := data[offset]
+			offset++
+			e.Tag = e.Tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	if offset >= len(data) {
+		return e, 0, 0, ErrIncomplete
+	}
+	length := int(data[offset])
+	offset++
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		// Indefinite length is not allowed in LDAP and DER
+		if n == 0 || n > maxLengthBytes {
+			return e, 0, 0, ErrInvalid
+		}
+		if offset+n > len(data) {
+			return e, 0, 0, ErrIncomplete
+		}
+
+		length = 0
+		for _, b := range data[offset : offset+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+		if length < 0 {
+			return e, 0, 0, ErrInvalid
+		}
+	}
+
+	return e, offset, length, nil
+}
+
+// Len get total length of the first element of data, only identifier and
+// length octets are required.
+func Len(data []byte) (int, error) {
+	_, headerLen, contentLen, err := header(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return headerLen + contentLen, nil
+}
+
+// Parse parse the first element of data, it returns element and the rest of
+// data.
+func Parse(data []byte) (Element, []byte, error) {
+	e, headerLen, contentLen, err := header(data)
+	if err != nil {
+		return e, nil, err
+	}
+	if len(data)-headerLen < contentLen {
+		return e, nil, ErrIncomplete
+	}
+
+	e.Content = data[headerLen : headerLen+contentLen]
+	return e, data[headerLen+contentLen:], nil
+}
+
+// Children parse content of constructed element as elements.
+func (e Element) Children() ([]Element, error) {
+	if !e.Constructed {
+		return nil, ErrInvalid
+	}
+
+	var children []Element
+	for rest := e.Content; len(rest) > 0; {
+		child, next, err := Parse(rest)
+		if err != nil {
+			// Children must not exceed parent
+			return nil, ErrInvalid
+		}
+		children = append(children, child)
+		rest = next
+	}
+
+	return children, nil
+}
+
+// Is return true if element has class and tag.
+func (e Element) Is(class int, tag int) bool {
+	return e.Class == class && e.Tag == tag
+}
+
+// Int get content as two's complement integer, content longer than 8 bytes
+// is invalid.
+func (e Element) Int() (int64, error) {
+	if len(e.Content) == 0 || len(e.Content) > 8 {
+		return 0, ErrInvalid
+	}
+
+	v := int64(int8(e.Content[0]))
+	for _, b := range e.Content[1:] {
+		v = v<<8 | int64(b)
+	}
+
+	return v, nil
+}
+
+// String get content as string.
+func (e Element) String() string {
+	return string(e.Content)
+}
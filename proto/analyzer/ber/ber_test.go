@@ -0,0 +1,54 @@
+package ber
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	// SEQUENCE { INTEGER -2, [APPLICATION 3] { OCTET STRING "dc" } }, high tag
+	// number [CONTEXT 31] and long form length
+	data := []byte{
+		0x30, 0x09,
+		0x02, 0x01, 0xfe,
+		0x63, 0x04, 0x04, 0x02, 'd', 'c',
+		0x9f, 0x1f, 0x81, 0x01, 0x00,
+	}
+
+	if n, err := Len(data[:2]); err != nil || n != 11 {
+		t.Errorf("Len() = %d, %v, expected 11.", n, err)
+	}
+	if _, err := Len(data[:1]); err != ErrIncomplete {
+		t.Errorf("Len() of incomplete header get error %v.", err)
+	}
+	if _, _, err := Parse(data[:10]); err != ErrIncomplete {
+		t.Errorf("Parse() of incomplete element get error %v.", err)
+	}
+
+	seq, rest, err := Parse(data)
+	if err != nil || !seq.Is(ClassUniversal, TagSequence) || !seq.Constructed {
+		t.Fatalf("Parse() = %+v, %v, expected sequence.", seq, err)
+	}
+	children, err := seq.Children()
+	if err != nil || len(children) != 2 {
+		t.Fatalf("Children() = %+v, %v, expected 2 children.", children, err)
+	}
+	if v, err := children[0].Int(); err != nil || v != -2 {
+		t.Errorf("Int() = %d, %v, expected -2.", v, err)
+	}
+	if !children[1].Is(ClassApplication, 3) {
+		t.Errorf("Child %+v is not [APPLICATION 3].", children[1])
+	}
+	grandchildren, err := children[1].Children()
+	if err != nil || len(grandchildren) != 1 || grandchildren[0].String() != "dc" {
+		t.Errorf("Children() = %+v, %v, expected \"dc\".", grandchildren, err)
+	}
+
+	high, _, err := Parse(rest)
+	if err != nil || !high.Is(ClassContext, 31) || len(high.Content) != 1 {
+		t.Errorf("Parse() = %+v, %v, expected [CONTEXT 31] with 1 byte.", high, err)
+	}
+
+	if _, err := Len([]byte{0x30, 0x80}); err != ErrInvalid {
+		t.Errorf("Len() of indefinite length get error %v.", err)
+	}
+}
@@ -0,0 +1,31 @@
+package breakdown
+
+// Queue FIFO queue of session breakdowns not returned yet, analyzer which
+// may generate more than one session breakdown by one call embeds it to
+// implement SessionBreakdownQueue.
+type Queue struct {
+	pending []interface{}
+}
+
+// Push append session breakdown to the end of queue.
+func (q *Queue) Push(sessionBreakdown interface{}) {
+	q.pending = append(q.pending, sessionBreakdown)
+}
+
+// Len get count of session breakdowns not returned yet.
+func (q *Queue) Len() int {
+	return len(q.pending)
+}
+
+// PopSessionBreakdown pop the first session breakdown not returned yet,
+// nil is returned if queue is empty.
+func (q *Queue) PopSessionBreakdown() (sessionBreakdown interface{}) {
+	if len(q.pending) == 0 {
+		return nil
+	}
+
+	sessionBreakdown = q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	return sessionBreakdown
+}
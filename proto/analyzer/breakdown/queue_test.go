@@ -0,0 +1,28 @@
+package breakdown
+
+import (
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	var q Queue
+	if q.PopSessionBreakdown() != nil {
+		t.Error("Queue: pop from empty queue should return nil.")
+	}
+
+	q.Push(1)
+	q.Push(2)
+	if q.Len() != 2 {
+		t.Errorf("Queue: get wrong length %d.", q.Len())
+	}
+
+	for _, want := range []int{1, 2} {
+		if got := q.PopSessionBreakdown(); got != want {
+			t.Errorf("Queue: pop %v, want %d.", got, want)
+		}
+	}
+
+	if q.Len() != 0 || q.PopSessionBreakdown() != nil {
+		t.Error("Queue: should be empty after popping all session breakdowns.")
+	}
+}
@@ -0,0 +1,413 @@
+package cql
+
+import (
+	"container/list"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/sql"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "CQLRequestSent"
+
+	case responseComplete:
+		return "CQLResponseComplete"
+
+	case responseError:
+		return "CQLResponseError"
+
+	default:
+		return "InvalidCQLSessionState"
+	}
+}
+
+// maxPreparedStatements max prepared statements tracked of one connection.
+const maxPreparedStatements = 4096
+
+// session state of one request.
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	version          byte
+	stream           int16
+	opcode           byte
+	query            string
+	preparedID       string
+	batchType        string
+	batchSize        int
+	consistency      string
+	compression      string
+	resultKind       string
+	rows             int
+	errorCode        int32
+	errorMessage     string
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Version = s.version
+	sb.StreamID = s.stream
+	sb.Opcode = opcodeName(s.opcode)
+	// CQL quotes strings and identifiers like PostgreSQL
+	if s.query != "" {
+		sb.Query = sql.Normalize(s.query, sql.PostgreSQL)
+	}
+	sb.PreparedID = s.preparedID
+	sb.BatchType = s.batchType
+	sb.BatchSize = s.batchSize
+	sb.Consistency = s.consistency
+	sb.Compression = s.compression
+	sb.ResultKind = s.resultKind
+	sb.Rows = s.rows
+	if s.state == responseError {
+		sb.ErrorCode = s.errorCode
+		sb.Error = errorName(s.errorCode)
+		sb.ErrorMessage = s.errorMessage
+	}
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown CQL analyzer session breakdown of one request.
+type SessionBreakdown struct {
+	SessionState string `json:"cql_session_state"`
+	Version      byte   `json:"cql_version"`
+	StreamID     int16  `json:"cql_stream_id"`
+	Opcode       string `json:"cql_opcode"`
+	// Query normalized CQL of QUERY, PREPARE, EXECUTE of statement prepared
+	// on this connection, or the first statement of BATCH
+	Query string `json:"cql_query,omitempty"`
+	// PreparedID hex ID of prepared statement
+	PreparedID  string `json:"cql_prepared_id,omitempty"`
+	BatchType   string `json:"cql_batch_type,omitempty"`
+	BatchSize   int    `json:"cql_batch_size"`
+	Consistency string `json:"cql_consistency,omitempty"`
+	// Compression frame compression negotiated by STARTUP
+	Compression     string `json:"cql_compression,omitempty"`
+	ResultKind      string `json:"cql_result_kind,omitempty"`
+	Rows            int    `json:"cql_rows"`
+	ErrorCode       int32  `json:"cql_error_code"`
+	Error           string `json:"cql_error,omitempty"`
+	ErrorMessage    string `json:"cql_error_message,omitempty"`
+	ServerLatency   uint   `json:"cql_server_latency"`
+	DownloadLatency uint   `json:"cql_download_latency"`
+}
+
+// ApplicationLatency get CQL latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	frames frameReader
+	// framed frames are wrapped in segments of protocol v5
+	framed bool
+}
+
+// Analyzer Cassandra CQL native protocol analyzer.
+type Analyzer struct {
+	timestamp   time.Time
+	client      halfConn
+	server      halfConn
+	version     byte
+	compression string
+	// sessions requests waiting for responses
+	sessions list.List
+	// prepared statements by hex ID
+	prepared map[string]string
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init CQL analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+	a.prepared = make(map[string]string)
+}
+
+// findSession find session by stream ID.
+func (a *Analyzer) findSession(stream int16) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).stream == stream {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// parseRequest parse request message.
+func (a *Analyzer) parseRequest(s *session, r *reader) {
+	switch s.opcode {
+	case opStartup:
+		options := r.stringMap()
+		a.compression = strings.ToLower(options["COMPRESSION"])
+
+	case opQuery:
+		s.query = r.longString()
+		s.consistency = consistencyName(r.short())
+
+	case opPrepare:
+		s.query = r.longString()
+
+	case opExecute:
+		id := hex.EncodeToString(r.shortBytes())
+		s.preparedID = id
+		s.query = a.prepared[id]
+		if s.version >= version5 {
+			// Result metadata ID
+			r.shortBytes()
+		}
+		s.consistency = consistencyName(r.short())
+
+	case opBatch:
+		if batchType := int(r.byte()); batchType < len(batchTypeNames) {
+			s.batchType = batchTypeNames[batchType]
+		}
+		s.batchSize = int(r.short())
+		for i := 0; i < s.batchSize && !r.failed; i++ {
+			var query string
+			if r.byte() == 0 {
+				query = r.longString()
+			} else {
+				query = a.prepared[hex.EncodeToString(r.shortBytes())]
+			}
+			if i == 0 {
+				s.query = query
+			}
+
+			values := int(r.short())
+			for j := 0; j < values && !r.failed; j++ {
+				r.value()
+			}
+		}
+		s.consistency = consistencyName(r.short())
+	}
+}
+
+func (a *Analyzer) handleRequest(f *frame) {
+	a.version = f.version
+
+	s := &session{
+		state:       requestSent,
+		version:     f.version,
+		stream:      f.stream,
+		opcode:      f.opcode,
+		compression: a.compression,
+		reqTime:     a.timestamp,
+	}
+
+	r, err := decodeBody(f, a.compression)
+	if err == nil {
+		a.parseRequest(s, r)
+		s.compression = a.compression
+	}
+	if err != nil || r.failed {
+		log.Errorf("CQL Analyzer: parse %s request error.", opcodeName(f.opcode))
+	}
+
+	// Stream ID is reused only after response
+	if e := a.findSession(f.stream); e != nil {
+		log.Debugf("CQL Analyzer: stream %d is reused before response.", f.stream)
+		a.sessions.Remove(e)
+	}
+	a.sessions.PushBack(s)
+}
+
+// parseResponse parse response message.
+func (a *Analyzer) parseResponse(s *session, opcode byte, r *reader) {
+	switch opcode {
+	case opError:
+		s.state = responseError
+		s.errorCode = r.int()
+		s.errorMessage = r.string()
+
+	case opResult:
+		kind := r.int()
+		s.resultKind = resultKindName(kind)
+		switch kind {
+		case resultRows:
+			s.rows = r.rowsCount()
+
+		case resultPrepared:
+			id := hex.EncodeToString(r.shortBytes())
+			s.preparedID = id
+			if s.opcode == opPrepare && !r.failed && len(a.prepared) < maxPreparedStatements {
+				a.prepared[id] = s.query
+			}
+		}
+
+	case opReady, opAuthenticate:
+		// Segment framing begins after response of STARTUP since v5
+		if s.opcode == opStartup && s.version >= version5 {
+			a.client.framed = true
+			a.server.framed = true
+		}
+	}
+}
+
+func (a *Analyzer) handleResponse(f *frame) {
+	// Events are pushed by server with stream -1
+	if f.opcode == opEvent {
+		return
+	}
+
+	e := a.findSession(f.stream)
+	if e == nil {
+		log.Debugf("CQL Analyzer: response of unknown stream %d.", f.stream)
+		return
+	}
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.state = responseComplete
+	s.respBeginTime = f.beginTime
+	s.respCompleteTime = a.timestamp
+
+	r, err := decodeBody(f, a.compression)
+	if err == nil {
+		a.parseResponse(s, f.opcode, r)
+	}
+	// Rows beyond kept head are not counted
+	if err != nil || (r.failed && !f.truncated) {
+		log.Errorf("CQL Analyzer: parse %s response error.", opcodeName(f.opcode))
+	}
+
+	a.Push(s.toBreakdown())
+}
+
+func (a *Analyzer) handleFrame(f *frame) {
+	if f.response {
+		a.handleResponse(f)
+	} else {
+		a.handleRequest(f)
+	}
+}
+
+// readFrames read frames from data, it returns bytes consumed. Frames of
+// unframed stream are handled one by one while all frames of segment payload
+// are handled together.
+func (a *Analyzer) readFrames(hc *halfConn, data []byte, all bool) int {
+	var parsed int
+	for !a.broken && parsed < len(data) {
+		n, f, err := hc.frames.read(data[parsed:], a.timestamp)
+		parsed += n
+		if err != nil {
+			log.Errorf("CQL Analyzer: %v.", err)
+			a.broken = true
+			break
+		}
+		if f != nil {
+			a.handleFrame(f)
+			if !all {
+				break
+			}
+		}
+	}
+
+	return parsed
+}
+
+// HandleEstb CQL analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("CQL Analyzer: HandleEstb.")
+}
+
+// HandleData CQL analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.Len() == 0 && parsed < len(payload) {
+		if !hc.framed {
+			parsed += a.readFrames(hc, payload[parsed:], false)
+			continue
+		}
+
+		n, segment, err := parseSegment(payload[parsed:], a.compression == compressionLZ4)
+		if err != nil {
+			log.Errorf("CQL Analyzer: invalid segment, %v.", err)
+			a.broken = true
+			break
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+		a.readFrames(hc, segment, true)
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset CQL analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("CQL Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("CQL Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin CQL analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("CQL Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("CQL Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package cql
+
+import (
+	"encoding/binary"
+	"github.com/golang/snappy"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func short(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func integer(v int32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(v))
+	return data
+}
+
+func str(s string) []byte {
+	return append(short(uint16(len(s))), s...)
+}
+
+func longStr(s string) []byte {
+	return append(integer(int32(len(s))), s...)
+}
+
+func shortBytes(b []byte) []byte {
+	return append(short(uint16(len(b))), b...)
+}
+
+func join(parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+
+	return data
+}
+
+// lz4Literals encode data as LZ4 block of literals only.
+func lz4Literals(data []byte) []byte {
+	n := len(data)
+	if n < 15 {
+		return append([]byte{byte(n << 4)}, data...)
+	}
+
+	block := []byte{0xf0}
+	for n -= 15; n >= 255; n -= 255 {
+		block = append(block, 255)
+	}
+	block = append(block, byte(n))
+	return append(block, data...)
+}
+
+// encodeFrame encode frame of version with response bit.
+func encodeFrame(version byte, flags byte, stream int16, opcode byte, body []byte) []byte {
+	header := []byte{version, flags, byte(uint16(stream) >> 8), byte(stream), opcode}
+	return join(header, integer(int32(len(body))), body)
+}
+
+// segment encode LZ4 compressed segment of protocol v5 framing.
+func segment(payload []byte) []byte {
+	compressed := lz4Literals(payload)
+	header := uint64(len(compressed)) | uint64(len(payload))<<17 | 1<<34
+	data := make([]byte, compressedSegmentHeaderLen)
+	for i := 0; i < 5; i++ {
+		data[i] = byte(header >> (8 * uint(i)))
+	}
+
+	return join(data, compressed, make([]byte, segmentTrailerLen))
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func check(t *testing.T, breakdowns []*SessionBreakdown, expected []SessionBreakdown) {
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("CQL Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("CQL Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("CQL Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzer(t *testing.T) {
+	const req = 0x04
+	const resp = 0x84
+
+	// LZ4 compressed body is preceded by uncompressed length
+	lz4 := func(body []byte) []byte {
+		return join(integer(int32(len(body))), lz4Literals(body))
+	}
+
+	// Rows of columns name text and scores list<int> of global table spec
+	rows := join(integer(resultRows), integer(rowsGlobalTablesSpec), integer(2), str("ks"), str("users"),
+		str("name"), short(0x000d), str("scores"), short(typeList), short(0x0009),
+		integer(3), integer(1), []byte("a"), integer(0), integer(-1), integer(1), []byte("c"), integer(-1))
+
+	var pipelined []byte
+	pipelined = append(pipelined, encodeFrame(req, flagCompression, 6, opQuery,
+		lz4(join(longStr("SELECT * FROM missing"), short(1), []byte{0})))...)
+	pipelined = append(pipelined, encodeFrame(req, flagCompression, 7, opQuery,
+		lz4(join(longStr("TRUNCATE ks.users"), short(5), []byte{0})))...)
+
+	var pipelinedResults []byte
+	pipelinedResults = append(pipelinedResults, encodeFrame(resp, flagCompression, 7, opResult, lz4(integer(1)))...)
+	pipelinedResults = append(pipelinedResults, encodeFrame(resp, flagCompression|flagWarning, 6, opError,
+		lz4(join(short(1), str("warning"), integer(0x2200), str("unconfigured table missing"))))...)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(encodeFrame(req, 0, 0, opOptions, nil)),
+		analyzertest.FromServerBytes(encodeFrame(resp, 0, 0, opSupported, join(short(1), str("COMPRESSION"), short(2), str("lz4"), str("snappy")))),
+		analyzertest.FromClientBytes(encodeFrame(req, 0, 1, opStartup, join(short(2), str("CQL_VERSION"), str("3.0.0"), str("COMPRESSION"), str("lz4")))),
+		analyzertest.FromServerBytes(encodeFrame(resp, 0, 1, opReady, nil)),
+		analyzertest.FromClientBytes(encodeFrame(req, flagCompression, 2, opQuery,
+			lz4(join(longStr("SELECT * FROM users WHERE id = 42"), short(6), []byte{0})))),
+		analyzertest.FromServerBytes(encodeFrame(resp, flagCompression, 2, opResult, lz4(rows))),
+		analyzertest.FromClientBytes(encodeFrame(req, flagCompression, 3, opPrepare, lz4(longStr("INSERT INTO users (id, name) VALUES (?, ?)")))),
+		analyzertest.FromServerBytes(encodeFrame(resp, flagCompression, 3, opResult,
+			lz4(join(integer(resultPrepared), shortBytes([]byte{0xca, 0xfe}), integer(0), integer(2))))),
+		analyzertest.FromClientBytes(encodeFrame(req, flagCompression, 4, opExecute,
+			lz4(join(shortBytes([]byte{0xca, 0xfe}), short(4), []byte{0x01}, short(2), longStr("1"), longStr("x"))))),
+		analyzertest.FromServerBytes(encodeFrame(resp, flagCompression, 4, opResult, lz4(integer(1)))),
+		analyzertest.FromClientBytes(encodeFrame(req, flagCompression, 5, opBatch, lz4(join([]byte{0}, short(2),
+			[]byte{1}, shortBytes([]byte{0xca, 0xfe}), short(2), longStr("2"), longStr("y"),
+			[]byte{0}, longStr("UPDATE users SET name = 'x' WHERE id = 1"), short(0),
+			short(1), []byte{0})))),
+		analyzertest.FromServerBytes(encodeFrame(resp, flagCompression, 5, opError,
+			lz4(join(integer(0x1100), str("Operation timed out"), short(1), integer(0), integer(1), str("BATCH_LOG"))))),
+		analyzertest.FromClientBytes(pipelined),
+		analyzertest.FromServerBytes(pipelinedResults),
+	})
+
+	check(t, breakdowns, []SessionBreakdown{
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 0, Opcode: "OPTIONS"},
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 1, Opcode: "STARTUP", Compression: "lz4"},
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 2, Opcode: "QUERY",
+			Query: "SELECT * FROM users WHERE id = ?", Consistency: "LOCAL_QUORUM", Compression: "lz4",
+			ResultKind: "Rows", Rows: 3},
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 3, Opcode: "PREPARE",
+			Query: "INSERT INTO users (id, name) VALUES (?)", PreparedID: "cafe", Compression: "lz4",
+			ResultKind: "Prepared"},
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 4, Opcode: "EXECUTE",
+			Query: "INSERT INTO users (id, name) VALUES (?)", PreparedID: "cafe", Consistency: "QUORUM",
+			Compression: "lz4", ResultKind: "Void"},
+		{SessionState: "CQLResponseError", Version: 4, StreamID: 5, Opcode: "BATCH",
+			Query: "INSERT INTO users (id, name) VALUES (?)", BatchType: "LOGGED", BatchSize: 2, Consistency: "ONE",
+			Compression: "lz4", ErrorCode: 0x1100, Error: "Write_timeout", ErrorMessage: "Operation timed out"},
+		{SessionState: "CQLResponseComplete", Version: 4, StreamID: 7, Opcode: "QUERY",
+			Query: "TRUNCATE ks.users", Consistency: "ALL", Compression: "lz4", ResultKind: "Void"},
+		{SessionState: "CQLResponseError", Version: 4, StreamID: 6, Opcode: "QUERY",
+			Query: "SELECT * FROM missing", Consistency: "ONE", Compression: "lz4",
+			ErrorCode: 0x2200, Error: "Invalid", ErrorMessage: "unconfigured table missing"},
+	})
+}
+
+func TestAnalyzerSnappy(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(encodeFrame(0x03, 0, 1, opStartup, join(short(2), str("CQL_VERSION"), str("3.0.0"), str("COMPRESSION"), str("snappy")))),
+		analyzertest.FromServerBytes(encodeFrame(0x83, 0, 1, opReady, nil)),
+		analyzertest.FromClientBytes(encodeFrame(0x03, flagCompression, 2, opQuery,
+			snappy.Encode(nil, join(longStr("SELECT now() FROM system.local"), short(10), []byte{0})))),
+		analyzertest.FromServerBytes(encodeFrame(0x83, flagCompression, 2, opResult, snappy.Encode(nil, join(integer(resultRows),
+			integer(rowsNoMetadata), integer(1), integer(1), integer(16), make([]byte, 16))))),
+	})
+
+	check(t, breakdowns, []SessionBreakdown{
+		{SessionState: "CQLResponseComplete", Version: 3, StreamID: 1, Opcode: "STARTUP", Compression: "snappy"},
+		{SessionState: "CQLResponseComplete", Version: 3, StreamID: 2, Opcode: "QUERY",
+			Query: "SELECT now() FROM system.local", Consistency: "LOCAL_ONE", Compression: "snappy",
+			ResultKind: "Rows", Rows: 1},
+	})
+}
+
+func TestAnalyzerSegments(t *testing.T) {
+	const req = 0x05
+	const resp = 0x85
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(encodeFrame(req, 0, 1, opStartup, join(short(2), str("CQL_VERSION"), str("3.0.0"), str("COMPRESSION"), str("lz4")))),
+		analyzertest.FromServerBytes(encodeFrame(resp, 0, 1, opReady, nil)),
+		analyzertest.FromClientBytes(segment(join(
+			encodeFrame(req, 0, 2, opQuery, join(longStr("SELECT * FROM t WHERE k IN (1, 2, 3)"), short(1), integer(0))),
+			encodeFrame(req, 0, 3, opExecute, join(shortBytes([]byte{0x01}), shortBytes([]byte{0x02}), short(4), integer(0)))))),
+		analyzertest.FromServerBytes(segment(join(
+			encodeFrame(resp, 0, 3, opError, join(integer(0x2500), str("Prepared query not found"), shortBytes([]byte{0x01}))),
+			encodeFrame(resp, 0, 2, opResult, integer(1))))),
+	})
+
+	check(t, breakdowns, []SessionBreakdown{
+		{SessionState: "CQLResponseComplete", Version: 5, StreamID: 1, Opcode: "STARTUP", Compression: "lz4"},
+		{SessionState: "CQLResponseError", Version: 5, StreamID: 3, Opcode: "EXECUTE", PreparedID: "01",
+			Consistency: "QUORUM", Compression: "lz4", ErrorCode: 0x2500, Error: "Unprepared",
+			ErrorMessage: "Prepared query not found"},
+		{SessionState: "CQLResponseComplete", Version: 5, StreamID: 2, Opcode: "QUERY",
+			Query: "SELECT * FROM t WHERE k IN (?)", Consistency: "ONE", Compression: "lz4", ResultKind: "Void"},
+	})
+
+	if sb := a.HandleReset(true, time.Now()); sb != nil {
+		t.Errorf("CQL Analyzer: get session breakdown %+v on reset without pending request.", sb)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(join(
+			encodeFrame(0x04, 0, 1, opQuery, join(longStr("SELECT * FROM a"), short(1), []byte{0})),
+			encodeFrame(0x04, 0, 2, opQuery, join(longStr("SELECT * FROM b"), short(1), []byte{0})))),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].StreamID != 1 || breakdowns[1].StreamID != 2 {
+		t.Fatalf("CQL Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("CQL Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
+
+func TestLZ4Decode(t *testing.T) {
+	// Literals "abc" followed by overlapping match of offset 3 and length 9
+	data, err := lz4Decode([]byte{0x35, 'a', 'b', 'c', 0x03, 0x00}, 12)
+	if err != nil || string(data) != "abcabcabcabc" {
+		t.Errorf("CQL Analyzer: LZ4 decode get %q, %v.", data, err)
+	}
+
+	if _, err := lz4Decode([]byte{0x35, 'a', 'b', 'c', 0x04, 0x00}, 12); err == nil {
+		t.Error("CQL Analyzer: LZ4 decode accepts invalid offset.")
+	}
+
+	if _, err := lz4Decode([]byte{0x35, 'a', 'b', 'c', 0x03, 0x00}, 255*6+1); err == nil {
+		t.Error("CQL Analyzer: LZ4 decode accepts size beyond maximum expansion.")
+	}
+	if _, err := lz4Decode(make([]byte, maxCompressedLen), maxCompressedLen+1); err == nil {
+		t.Error("CQL Analyzer: LZ4 decode accepts size beyond limit.")
+	}
+}
+
+func TestDecodeBodySnappy(t *testing.T) {
+	// Varint header claims decoded length beyond limit
+	f := &frame{flags: flagCompression, body: []byte{0x80, 0x80, 0x80, 0x80, 0x01}}
+	if _, err := decodeBody(f, compressionSnappy); err != errInvalidSnappy {
+		t.Errorf("CQL Analyzer: decode Snappy body get %v, expected %v.", err, errInvalidSnappy)
+	}
+}
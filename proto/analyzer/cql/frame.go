@@ -0,0 +1,224 @@
+package cql
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/golang/snappy"
+	"time"
+)
+
+// maxHeadLen max leading bytes of frame body kept, rows of result beyond it
+// are skipped.
+const maxHeadLen = 64 * 1024
+
+// maxCompressedLen max length of compressed frame body kept for
+// decompression.
+const maxCompressedLen = 16 * 1024 * 1024
+
+// Compression algorithms negotiated by STARTUP.
+const (
+	compressionLZ4    = "lz4"
+	compressionSnappy = "snappy"
+)
+
+var (
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errTruncatedFrame     = errors.New("truncated compressed frame")
+	errUnknownCompression = errors.New("unknown compression")
+	errInvalidFrame       = errors.New("invalid frame length")
+	errInvalidSnappy      = errors.New("invalid Snappy block")
+)
+
+// frame frame of protocol v3 and later, which is called envelope since v5.
+type frame struct {
+	version  byte
+	response bool
+	flags    byte
+	stream   int16
+	opcode   byte
+	length   int
+	// body leading bytes of body, whole body if compressed
+	body []byte
+	// truncated body is beyond kept bytes
+	truncated bool
+	beginTime time.Time
+}
+
+// frameReader reassemble frames from stream of one direction, stream is TCP
+// payload before v5 and payload of segments since v5.
+type frameReader struct {
+	header []byte
+	frame  *frame
+	// left bytes of frame body not read yet
+	left int
+	// keep bytes of frame body to keep
+	keep int
+}
+
+// read read data, it returns bytes consumed and frame once it completes.
+func (r *frameReader) read(data []byte, timestamp time.Time) (int, *frame, error) {
+	var n int
+
+	if r.frame == nil {
+		if len(r.header) == 0 && len(data) > 0 && data[0]&^responseVersion < minVersion {
+			return 0, nil, errUnsupportedVersion
+		}
+
+		size := frameHeaderLen - len(r.header)
+		if size > len(data) {
+			size = len(data)
+		}
+		if len(r.header) == 0 {
+			r.header = make([]byte, 0, frameHeaderLen)
+		}
+		r.header = append(r.header, data[:size]...)
+		n += size
+		if len(r.header) < frameHeaderLen {
+			return n, nil, nil
+		}
+
+		f := &frame{
+			version:   r.header[0] &^ responseVersion,
+			response:  r.header[0]&responseVersion != 0,
+			flags:     r.header[1],
+			stream:    int16(binary.BigEndian.Uint16(r.header[2:])),
+			opcode:    r.header[4],
+			length:    int(int32(binary.BigEndian.Uint32(r.header[5:]))),
+			beginTime: timestamp,
+		}
+		r.header = r.header[:0]
+		if f.length < 0 {
+			return n, nil, errInvalidFrame
+		}
+
+		r.frame = f
+		r.left = f.length
+		r.keep = maxHeadLen
+		if f.flags&flagCompression != 0 {
+			r.keep = maxCompressedLen
+		}
+	}
+
+	size := len(data) - n
+	if size > r.left {
+		size = r.left
+	}
+	if keep := r.keep - len(r.frame.body); keep > 0 {
+		if keep > size {
+			keep = size
+		}
+		r.frame.body = append(r.frame.body, data[n:n+keep]...)
+	}
+	r.left -= size
+	n += size
+
+	if r.left > 0 {
+		return n, nil, nil
+	}
+
+	f := r.frame
+	r.frame = nil
+	f.truncated = len(f.body) < f.length
+	return n, f, nil
+}
+
+// decodeBody decompress frame body and skip tracing ID, warnings and custom
+// payload, it returns reader of message.
+func decodeBody(f *frame, compression string) (*reader, error) {
+	body := f.body
+	if f.flags&flagCompression != 0 {
+		if f.truncated {
+			return nil, errTruncatedFrame
+		}
+
+		var err error
+		switch compression {
+		case compressionLZ4:
+			// Uncompressed length precedes LZ4 block
+			if len(body) < 4 {
+				return nil, errInvalidLZ4
+			}
+			body, err = lz4Decode(body[4:], int(binary.BigEndian.Uint32(body)))
+
+		case compressionSnappy:
+			// Reject decoded length of varint header beyond limit before
+			// allocating
+			var n int
+			if n, err = snappy.DecodedLen(body); err == nil {
+				if n > maxCompressedLen {
+					err = errInvalidSnappy
+				} else {
+					body, err = snappy.Decode(nil, body)
+				}
+			}
+
+		default:
+			err = errUnknownCompression
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &reader{data: body}
+	if f.response && f.flags&flagTracing != 0 {
+		r.bytes(16)
+	}
+	if f.response && f.flags&flagWarning != 0 {
+		r.stringList()
+	}
+	if f.flags&flagCustomPayload != 0 {
+		r.bytesMap()
+	}
+
+	return r, nil
+}
+
+// Lengths of segment headers of protocol v5 framing, including CRC24.
+const (
+	segmentHeaderLen           = 6
+	compressedSegmentHeaderLen = 8
+	segmentTrailerLen          = 4
+)
+
+// segmentLengthMask mask of 17 bits payload length of segment header.
+const segmentLengthMask = 0x1ffff
+
+// parseSegment parse segment of protocol v5 framing, it returns bytes
+// consumed, 0 if more data is needed, and payload of segment. CRCs are not
+// verified.
+func parseSegment(data []byte, compressed bool) (int, []byte, error) {
+	if !compressed {
+		if len(data) < segmentHeaderLen {
+			return 0, nil, nil
+		}
+		header := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+		length := int(header & segmentLengthMask)
+		total := segmentHeaderLen + length + segmentTrailerLen
+		if len(data) < total {
+			return 0, nil, nil
+		}
+
+		return total, data[segmentHeaderLen : segmentHeaderLen+length], nil
+	}
+
+	if len(data) < compressedSegmentHeaderLen {
+		return 0, nil, nil
+	}
+	header := uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24 | uint64(data[4])<<32
+	length := int(header & segmentLengthMask)
+	uncompressedLength := int(header >> 17 & segmentLengthMask)
+	total := compressedSegmentHeaderLen + length + segmentTrailerLen
+	if len(data) < total {
+		return 0, nil, nil
+	}
+
+	payload := data[compressedSegmentHeaderLen : compressedSegmentHeaderLen+length]
+	// Uncompressed length 0 means payload is not compressed
+	if uncompressedLength == 0 {
+		return total, payload, nil
+	}
+
+	payload, err := lz4Decode(payload, uncompressedLength)
+	return total, payload, err
+}
@@ -0,0 +1,83 @@
+package cql
+
+import (
+	"errors"
+)
+
+var errInvalidLZ4 = errors.New("invalid LZ4 block")
+
+// lz4Length read extended length of LZ4 sequence.
+func lz4Length(src []byte, i int, n int) (int, int, error) {
+	if n != 15 {
+		return n, i, nil
+	}
+
+	for {
+		if i >= len(src) {
+			return 0, i, errInvalidLZ4
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
+
+// lz4Decode decode LZ4 block of uncompressed size.
+func lz4Decode(src []byte, size int) ([]byte, error) {
+	// Each byte of LZ4 block expands to at most 255 bytes, reject claimed
+	// size beyond it before allocating
+	if size < 0 || size > maxCompressedLen || size > 255*len(src) {
+		return nil, errInvalidLZ4
+	}
+	dst := make([]byte, 0, size)
+
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		var literals, match int
+		var err error
+		if literals, i, err = lz4Length(src, i, int(token>>4)); err != nil {
+			return nil, err
+		}
+		if literals > len(src)-i || len(dst)+literals > size {
+			return nil, errInvalidLZ4
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+
+		// The last sequence has literals only
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errInvalidLZ4
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+
+		if match, i, err = lz4Length(src, i, int(token&0x0f)); err != nil {
+			return nil, err
+		}
+		match += 4
+		if offset == 0 || offset > len(dst) || len(dst)+match > size {
+			return nil, errInvalidLZ4
+		}
+
+		// Match may overlap bytes it produces
+		start := len(dst) - offset
+		for k := 0; k < match; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+
+	if len(dst) != size {
+		return nil, errInvalidLZ4
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,339 @@
+package cql
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol versions supported.
+const (
+	minVersion = 3
+	// version5 version of segment framing and result metadata ID
+	version5 = 5
+)
+
+// frameHeaderLen length of frame header of protocol v3 and later.
+const frameHeaderLen = 9
+
+// Frame flags.
+const (
+	flagCompression   = 0x01
+	flagTracing       = 0x02
+	flagCustomPayload = 0x04
+	flagWarning       = 0x08
+)
+
+// responseVersion direction bit of version of response frame.
+const responseVersion = 0x80
+
+// Opcodes.
+const (
+	opError         = 0x00
+	opStartup       = 0x01
+	opReady         = 0x02
+	opAuthenticate  = 0x03
+	opOptions       = 0x05
+	opSupported     = 0x06
+	opQuery         = 0x07
+	opResult        = 0x08
+	opPrepare       = 0x09
+	opExecute       = 0x0a
+	opRegister      = 0x0b
+	opEvent         = 0x0c
+	opBatch         = 0x0d
+	opAuthChallenge = 0x0e
+	opAuthResponse  = 0x0f
+	opAuthSuccess   = 0x10
+)
+
+var opcodeNames = map[byte]string{
+	opError:         "ERROR",
+	opStartup:       "STARTUP",
+	opReady:         "READY",
+	opAuthenticate:  "AUTHENTICATE",
+	opOptions:       "OPTIONS",
+	opSupported:     "SUPPORTED",
+	opQuery:         "QUERY",
+	opResult:        "RESULT",
+	opPrepare:       "PREPARE",
+	opExecute:       "EXECUTE",
+	opRegister:      "REGISTER",
+	opEvent:         "EVENT",
+	opBatch:         "BATCH",
+	opAuthChallenge: "AUTH_CHALLENGE",
+	opAuthResponse:  "AUTH_RESPONSE",
+	opAuthSuccess:   "AUTH_SUCCESS",
+}
+
+func opcodeName(opcode byte) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", opcode)
+}
+
+var consistencyNames = []string{
+	"ANY",
+	"ONE",
+	"TWO",
+	"THREE",
+	"QUORUM",
+	"ALL",
+	"LOCAL_QUORUM",
+	"EACH_QUORUM",
+	"SERIAL",
+	"LOCAL_SERIAL",
+	"LOCAL_ONE",
+}
+
+func consistencyName(consistency uint16) string {
+	if int(consistency) < len(consistencyNames) {
+		return consistencyNames[consistency]
+	}
+
+	return fmt.Sprintf("%d", consistency)
+}
+
+var batchTypeNames = []string{
+	"LOGGED",
+	"UNLOGGED",
+	"COUNTER",
+}
+
+// Result kinds.
+const (
+	resultRows     = 2
+	resultPrepared = 4
+)
+
+var resultKindNames = map[int32]string{
+	1: "Void",
+	2: "Rows",
+	3: "Set_keyspace",
+	4: "Prepared",
+	5: "Schema_change",
+}
+
+func resultKindName(kind int32) string {
+	if name, ok := resultKindNames[kind]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", kind)
+}
+
+var errorNames = map[int32]string{
+	0x0000: "Server_error",
+	0x000a: "Protocol_error",
+	0x0100: "Bad_credentials",
+	0x1000: "Unavailable",
+	0x1001: "Overloaded",
+	0x1002: "Is_bootstrapping",
+	0x1003: "Truncate_error",
+	0x1100: "Write_timeout",
+	0x1200: "Read_timeout",
+	0x1300: "Read_failure",
+	0x1400: "Function_failure",
+	0x1500: "Write_failure",
+	0x1600: "CDC_write_failure",
+	0x1700: "CAS_write_unknown",
+	0x2000: "Syntax_error",
+	0x2100: "Unauthorized",
+	0x2200: "Invalid",
+	0x2300: "Config_error",
+	0x2400: "Already_exists",
+	0x2500: "Unprepared",
+}
+
+func errorName(code int32) string {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", code)
+}
+
+// Rows metadata flags.
+const (
+	rowsGlobalTablesSpec = 0x01
+	rowsHasMorePages     = 0x02
+	rowsNoMetadata       = 0x04
+	rowsMetadataChanged  = 0x08
+)
+
+// Option IDs of column types with parameters.
+const (
+	typeCustom = 0x0000
+	typeList   = 0x0020
+	typeMap    = 0x0021
+	typeSet    = 0x0022
+	typeUDT    = 0x0030
+	typeTuple  = 0x0031
+)
+
+// maxTypeDepth max nesting depth of column type.
+const maxTypeDepth = 16
+
+// reader bounds checked big endian reader of CQL notation types, any read out
+// of bounds marks reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) short() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *reader) int() int32 {
+	if b := r.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+// string read [string] of short length.
+func (r *reader) string() string {
+	return string(r.bytes(int(r.short())))
+}
+
+// longString read [long string] of int length.
+func (r *reader) longString() string {
+	return string(r.bytes(int(r.int())))
+}
+
+// shortBytes read [short bytes].
+func (r *reader) shortBytes() []byte {
+	return r.bytes(int(r.short()))
+}
+
+// value read [bytes] of int length, negative length means null.
+func (r *reader) value() []byte {
+	n := int(r.int())
+	if n < 0 {
+		return nil
+	}
+
+	return r.bytes(n)
+}
+
+// stringList read [string list].
+func (r *reader) stringList() []string {
+	n := int(r.short())
+	list := make([]string, 0, n)
+	for i := 0; i < n && !r.failed; i++ {
+		list = append(list, r.string())
+	}
+
+	return list
+}
+
+// stringMap read [string map].
+func (r *reader) stringMap() map[string]string {
+	n := int(r.short())
+	m := make(map[string]string, n)
+	for i := 0; i < n && !r.failed; i++ {
+		key := r.string()
+		m[key] = r.string()
+	}
+
+	return m
+}
+
+// bytesMap skip [bytes map] of custom payload.
+func (r *reader) bytesMap() {
+	n := int(r.short())
+	for i := 0; i < n && !r.failed; i++ {
+		r.string()
+		r.value()
+	}
+}
+
+// option skip [option] of column type.
+func (r *reader) option(depth int) {
+	if depth > maxTypeDepth {
+		r.failed = true
+		return
+	}
+
+	switch r.short() {
+	case typeCustom:
+		r.string()
+
+	case typeList, typeSet:
+		r.option(depth + 1)
+
+	case typeMap:
+		r.option(depth + 1)
+		r.option(depth + 1)
+
+	case typeUDT:
+		r.string()
+		r.string()
+		n := int(r.short())
+		for i := 0; i < n && !r.failed; i++ {
+			r.string()
+			r.option(depth + 1)
+		}
+
+	case typeTuple:
+		n := int(r.short())
+		for i := 0; i < n && !r.failed; i++ {
+			r.option(depth + 1)
+		}
+	}
+}
+
+// rowsCount read rows count of Rows result after kind.
+func (r *reader) rowsCount() int {
+	flags := r.int()
+	columns := int(r.int())
+	if flags&rowsHasMorePages != 0 {
+		r.value()
+	}
+	if flags&rowsMetadataChanged != 0 {
+		r.shortBytes()
+	}
+	if flags&rowsNoMetadata == 0 {
+		global := flags&rowsGlobalTablesSpec != 0
+		if global {
+			r.string()
+			r.string()
+		}
+		for i := 0; i < columns && !r.failed; i++ {
+			if !global {
+				r.string()
+				r.string()
+			}
+			r.string()
+			r.option(0)
+		}
+	}
+
+	return int(r.int())
+}
@@ -0,0 +1,514 @@
+package ftp
+
+import (
+	"container/list"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/textline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "FTPRequestSent"
+
+	case responseBegin:
+		return "FTPResponseBegin"
+
+	case responseComplete:
+		return "FTPResponseComplete"
+
+	case responseError:
+		return "FTPResponseError"
+
+	default:
+		return "InvalidFTPSessionState"
+	}
+}
+
+// transferCommands commands transferring file or listing by data connection.
+var transferCommands = map[string]bool{
+	"RETR": true,
+	"STOR": true,
+	"STOU": true,
+	"APPE": true,
+	"LIST": true,
+	"NLST": true,
+	"MLSD": true,
+}
+
+// session state of one command.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	command   string
+	args      string
+	replyCode int
+	// mode and dataAddr data connection announced or used by command
+	mode     string
+	dataAddr string
+	// transfer data connection used by transfer command
+	transfer *transfer
+	// transferBytes bytes of transfer
+	transferBytes uint
+	// transferTime duration of transfer
+	transferTime     time.Duration
+	authTLS          bool
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Command = s.command
+	if transferCommands[s.command] {
+		sb.FileName = s.args
+	}
+	sb.ReplyCode = s.replyCode
+	sb.DataMode = s.mode
+	sb.DataAddr = s.dataAddr
+	sb.TransferBytes = s.transferBytes
+	sb.Throughput = throughput(s.transferBytes, s.transferTime)
+	sb.AuthTLS = s.authTLS
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.TransferLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown FTP analyzer session breakdown of one command.
+type SessionBreakdown struct {
+	SessionState string `json:"ftp_session_state"`
+	Command      string `json:"ftp_command"`
+	FileName     string `json:"ftp_file_name,omitempty"`
+	ReplyCode    int    `json:"ftp_reply_code"`
+	// DataMode command announcing data connection, PASV, EPSV, PORT or EPRT
+	DataMode string `json:"ftp_data_mode,omitempty"`
+	// DataAddr address data connection connects to
+	DataAddr      string `json:"ftp_data_address,omitempty"`
+	TransferBytes uint   `json:"ftp_transfer_bytes"`
+	// Throughput bytes per second of transfer
+	Throughput uint `json:"ftp_throughput"`
+	// AuthTLS session is upgraded to TLS by AUTH command
+	AuthTLS         bool `json:"ftp_auth_tls"`
+	ServerLatency   uint `json:"ftp_server_latency"`
+	TransferLatency uint `json:"ftp_transfer_latency"`
+}
+
+// ApplicationLatency get FTP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.TransferLatency) * time.Millisecond
+}
+
+// Analyzer FTP control connection analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// controlAddr and serverIP address of control connection
+	controlAddr string
+	serverIP    string
+	// registry protocol registry of data connections announced
+	registry registry
+	// sessions commands waiting for replies in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// transfer data connection announced but not used by transfer command
+	transfer *transfer
+	// multilineCode code of multiline reply being received
+	multilineCode string
+	// upgraded session is upgraded to TLS and not parsable any more
+	upgraded bool
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init FTP analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// SetConnAddr FTP analyzer set control connection addresses function.
+func (a *Analyzer) SetConnAddr(clientIP string, clientPort uint16, serverIP string, serverPort uint16) {
+	a.controlAddr = fmt.Sprintf("%s:%d-%s:%d", clientIP, clientPort, serverIP, serverPort)
+	a.serverIP = serverIP
+}
+
+// SetProtoRegistry FTP analyzer set protocol registry function, data
+// connections announced are added to registry to be analyzed as FTP data
+// connection.
+func (a *Analyzer) SetProtoRegistry(addProto func(protoName string, ip string, port uint16), removeProto func(ip string, port uint16)) {
+	a.registry = registry{addProto: addProto, removeProto: removeProto}
+}
+
+// hostPort parse h1,h2,h3,h4,p1,p2 of PORT command and PASV reply.
+func hostPort(s string) (string, uint16, bool) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 6 {
+		return "", 0, false
+	}
+
+	var n [6]int
+	for i, f := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < 0 || v > 255 {
+			return "", 0, false
+		}
+		n[i] = v
+	}
+
+	return fmt.Sprintf("%d.%d.%d.%d", n[0], n[1], n[2], n[3]), uint16(n[4]<<8 | n[5]), true
+}
+
+// passiveAddr parse address of PASV reply like "Entering Passive Mode
+// (192,168,1,2,195,80)."
+func passiveAddr(text string) (string, uint16, bool) {
+	start := strings.IndexAny(text, "0123456789")
+	if start < 0 {
+		return "", 0, false
+	}
+
+	end := start
+	for end < len(text) && (text[end] == ',' || (text[end] >= '0' && text[end] <= '9')) {
+		end++
+	}
+
+	return hostPort(text[start:end])
+}
+
+// extendedAddr parse address of EPRT command and EPSV reply like
+// "|1|192.168.1.2|6275|" or "|||6446|", ip is empty if omitted.
+func extendedAddr(s string) (string, uint16, bool) {
+	if len(s) < 5 {
+		return "", 0, false
+	}
+
+	fields := strings.Split(s, s[:1])
+	if len(fields) != 5 {
+		return "", 0, false
+	}
+
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, false
+	}
+
+	return fields[2], uint16(port), true
+}
+
+// announcedSize parse transfer size of preliminary reply like "Opening
+// BINARY mode data connection for file (1024 bytes).", 0 if there is none.
+func announcedSize(text string) uint {
+	start := strings.LastIndexByte(text, '(')
+	if start < 0 {
+		return 0
+	}
+
+	fields := strings.Fields(text[start+1:])
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "bytes") {
+		return 0
+	}
+
+	size, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return uint(size)
+}
+
+// readLine read line without line break, it returns bytes of line including
+// line break, 0 if line is incomplete. Connection is broken if line is too
+// long.
+func (a *Analyzer) readLine(data []byte) (string, int) {
+	line, n, err := textline.Read(data)
+	if err != nil {
+		log.Errorf("FTP Analyzer: %s.", err)
+		a.broken = true
+	}
+
+	return line, n
+}
+
+// announce register data connection announced by session.
+func (a *Analyzer) announce(s *session, ip string, port uint16) {
+	if a.transfer != nil {
+		cancel(a.transfer)
+	}
+
+	a.transfer = &transfer{
+		controlAddr: a.controlAddr,
+		registry:    a.registry,
+		mode:        s.command,
+		ip:          ip,
+		port:        port,
+	}
+	expect(a.transfer)
+
+	s.mode = s.command
+	s.dataAddr = a.transfer.dataAddr()
+}
+
+func (a *Analyzer) handleClientData(data []byte) int {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+	if line == "" {
+		return n
+	}
+
+	command, args := line, ""
+	if space := strings.IndexByte(line, ' '); space >= 0 {
+		command, args = line[:space], strings.TrimSpace(line[space+1:])
+	}
+
+	s := &session{
+		state:   requestSent,
+		command: strings.ToUpper(command),
+		args:    args,
+		reqTime: a.timestamp,
+	}
+
+	// Transfer command uses the latest announced data connection
+	if transferCommands[s.command] && a.transfer != nil {
+		s.transfer = a.transfer
+		s.transfer.bind(s.command, s.args)
+		s.mode = s.transfer.mode
+		s.dataAddr = s.transfer.dataAddr()
+		a.transfer = nil
+	}
+
+	a.sessions.PushBack(s)
+
+	return n
+}
+
+// finishTransfer collect bytes and duration of transfer command.
+func (s *session) finishTransfer() {
+	if t := s.transfer; t != nil {
+		cancel(t)
+
+		// Data connection may be missed, keep size of preliminary reply then
+		t.lock.Lock()
+		if t.bytes > 0 {
+			s.transferBytes = t.bytes
+			s.transferTime = t.endTime.Sub(t.beginTime)
+		}
+		t.lock.Unlock()
+	}
+
+	if s.transferTime <= 0 {
+		s.transferTime = s.respCompleteTime.Sub(s.respBeginTime)
+	}
+}
+
+// handleReply handle reply of the oldest command.
+func (a *Analyzer) handleReply(code int, text string) *SessionBreakdown {
+	front := a.sessions.Front()
+	// Greeting and unsolicited reply
+	if front == nil {
+		return nil
+	}
+
+	s := front.Value.(*session)
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = a.timestamp
+	}
+
+	// Preliminary reply of transfer command
+	if code < 200 {
+		if size := announcedSize(text); size > 0 {
+			s.transferBytes = size
+		}
+		return nil
+	}
+
+	a.sessions.Remove(front)
+	s.replyCode = code
+	s.respCompleteTime = a.timestamp
+	if code < 400 {
+		s.state = responseComplete
+	} else {
+		s.state = responseError
+	}
+
+	switch s.command {
+	case "PASV":
+		if ip, port, ok := passiveAddr(text); code == 227 && ok {
+			a.announce(s, ip, port)
+		}
+
+	case "EPSV":
+		start, end := strings.IndexByte(text, '('), strings.LastIndexByte(text, ')')
+		if code == 229 && start >= 0 && end > start {
+			if _, port, ok := extendedAddr(text[start+1 : end]); ok {
+				a.announce(s, a.serverIP, port)
+			}
+		}
+
+	case "PORT":
+		if ip, port, ok := hostPort(s.args); code < 300 && ok {
+			a.announce(s, ip, port)
+		}
+
+	case "EPRT":
+		if ip, port, ok := extendedAddr(s.args); code < 300 && ok && ip != "" {
+			a.announce(s, ip, port)
+		}
+
+	case "AUTH":
+		if code == 234 {
+			s.authTLS = true
+			a.upgraded = true
+		}
+	}
+
+	if transferCommands[s.command] {
+		s.finishTransfer()
+	}
+
+	return s.toBreakdown()
+}
+
+// isReplyCode return true if line begins with three digits reply code.
+func isReplyCode(line string) bool {
+	return len(line) >= 3 &&
+		line[0] >= '1' && line[0] <= '5' &&
+		line[1] >= '0' && line[1] <= '9' &&
+		line[2] >= '0' && line[2] <= '9'
+}
+
+func (a *Analyzer) handleServerData(data []byte) (int, *SessionBreakdown) {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0, nil
+	}
+
+	// Lines of multiline reply until the line beginning with code and space
+	if a.multilineCode != "" {
+		if !strings.HasPrefix(line, a.multilineCode+" ") && line != a.multilineCode {
+			return n, nil
+		}
+		a.multilineCode = ""
+	} else if !isReplyCode(line) {
+		log.Errorf("FTP Analyzer: invalid reply line %q.", line)
+		return n, nil
+	} else if len(line) > 3 && line[3] == '-' {
+		a.multilineCode = line[:3]
+		return n, nil
+	}
+
+	code, _ := strconv.Atoi(line[:3])
+	var text string
+	if len(line) > 4 {
+		text = line[4:]
+	}
+
+	return n, a.handleReply(code, text)
+}
+
+// HandleEstb FTP analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("FTP Analyzer: HandleEstb.")
+}
+
+// HandleData FTP analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && !a.upgraded && parsed < len(payload) {
+		var n int
+		var sb *SessionBreakdown
+		if fromClient {
+			n = a.handleClientData(payload[parsed:])
+		} else {
+			n, sb = a.handleServerData(payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+
+		if sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	// Data after TLS upgrade is ignored
+	if a.broken || a.upgraded {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset FTP analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("FTP Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("FTP Analyzer: HandleReset from server.")
+	}
+
+	if a.transfer != nil {
+		cancel(a.transfer)
+		a.transfer = nil
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		if transferCommands[s.command] {
+			s.finishTransfer()
+		}
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin FTP analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("FTP Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("FTP Analyzer: HandleFin from server.")
+	}
+
+	if a.transfer != nil {
+		cancel(a.transfer)
+		a.transfer = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package ftp
+
+import (
+	"fmt"
+	"github.com/zhengyuli/ntrace/proto"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+// protoRegistry protocols expected on server ip:port.
+type protoRegistry map[string]string
+
+func (r protoRegistry) add(protoName string, ip string, port uint16) {
+	r[fmt.Sprintf("%s:%d", ip, port)] = protoName
+}
+
+func (r protoRegistry) remove(ip string, port uint16) {
+	delete(r, fmt.Sprintf("%s:%d", ip, port))
+}
+
+func (r protoRegistry) get(ip string, port uint16) string {
+	return r[fmt.Sprintf("%s:%d", ip, port)]
+}
+
+func TestAnalyzer(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	a.SetConnAddr("10.0.0.1", 40000, "10.0.0.2", 21)
+	protos := make(protoRegistry)
+	a.SetProtoRegistry(protos.add, protos.remove)
+
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("220 (vsFTPd 3.0.3)\r\n"),
+		analyzertest.FromClient("USER bob\r\n"),
+		analyzertest.FromServer("331 Please specify the password.\r\n"),
+		analyzertest.FromClient("PASS secret\r\n"),
+		analyzertest.FromServer("230 Login successful.\r\n"),
+		analyzertest.FromClient("FEAT\r\n"),
+		analyzertest.FromServer("211-Features:\r\n EPSV\r\n PASV\r\n211 End\r\n"),
+		analyzertest.FromClient("PASV\r\n"),
+		analyzertest.FromServer("227 Entering Passive Mode (10,0,0,2,195,80).\r\n"),
+	})
+	if name := protos.get("10.0.0.2", 50000); name != proto.FTPDataProtoName {
+		t.Fatalf("FTP Analyzer: get proto %q of data connection announced by PASV.", name)
+	}
+
+	// Data connection of RETR
+	timestamp := time.Now()
+	data := new(DataAnalyzer)
+	data.Init()
+	data.SetConnAddr("10.0.0.1", 40001, "10.0.0.2", 50000)
+	if name := protos.get("10.0.0.2", 50000); name != "" {
+		t.Errorf("FTP Analyzer: get proto %q of data connection after it is claimed.", name)
+	}
+	data.HandleEstb(timestamp)
+
+	breakdowns = append(breakdowns, run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("RETR pub/file.txt\r\n"),
+		analyzertest.FromServer("150 Opening BINARY mode data connection for pub/file.txt (2000 bytes).\r\n"),
+	})...)
+	data.HandleData([]byte(strings.Repeat("x", 1000)), false, timestamp)
+	data.HandleData([]byte(strings.Repeat("x", 1000)), false, timestamp.Add(100*time.Millisecond))
+	dataSb := data.HandleFin(false, timestamp.Add(200*time.Millisecond))
+	if sb := data.HandleFin(true, timestamp.Add(200*time.Millisecond)); sb != nil {
+		t.Errorf("FTP Analyzer: get session breakdown %v on the second fin of data connection.", sb)
+	}
+
+	expectedData := DataSessionBreakdown{
+		SessionState:    "FTPDataComplete",
+		ControlAddr:     "10.0.0.1:40000-10.0.0.2:21",
+		Mode:            "PASV",
+		Command:         "RETR",
+		FileName:        "pub/file.txt",
+		Bytes:           2000,
+		Throughput:      10000,
+		TransferLatency: 200,
+	}
+	if dataSb == nil || *dataSb.(*DataSessionBreakdown) != expectedData {
+		t.Errorf("FTP Analyzer: data session breakdown is %+v, expected %+v.", dataSb, expectedData)
+	}
+
+	breakdowns = append(breakdowns, run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("226 Transfer complete.\r\n"),
+		// Data connection announced by EPSV never comes
+		analyzertest.FromClient("EPSV\r\n"),
+		analyzertest.FromServer("229 Entering Extended Passive Mode (|||6446|)\r\n"),
+		analyzertest.FromClient("STOR upload.bin\r\n"),
+		analyzertest.FromServer("425 Failed to establish connection.\r\n"),
+		analyzertest.FromClient("PORT 10,0,0,1,4,1\r\n"),
+		analyzertest.FromServer("200 PORT command successful.\r\n"),
+	})...)
+	if name := protos.get("10.0.0.2", 6446); name != "" {
+		t.Errorf("FTP Analyzer: get proto %q of data connection after transfer failed.", name)
+	}
+	if name := protos.get("10.0.0.1", 1025); name != proto.FTPDataProtoName {
+		t.Errorf("FTP Analyzer: get proto %q of data connection announced by PORT.", name)
+	}
+
+	breakdowns = append(breakdowns, run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("LIST\r\n"),
+		analyzertest.FromServer("150 Here comes the directory listing.\r\n"),
+		analyzertest.FromServer("226 Directory send OK.\r\n"),
+		analyzertest.FromClient("CWD missing\r\n"),
+		analyzertest.FromServer("550 Failed to change directory.\r\n"),
+		analyzertest.FromClient("AUTH TLS\r\n"),
+		analyzertest.FromServer("234 Proceed with negotiation.\r\n"),
+		analyzertest.FromClient("\x16\x03\x01\x00\x05hello"),
+	})...)
+	if name := protos.get("10.0.0.1", 1025); name != "" {
+		t.Errorf("FTP Analyzer: get proto %q of data connection after transfer completed.", name)
+	}
+
+	expected := []SessionBreakdown{
+		{SessionState: "FTPResponseComplete", Command: "USER", ReplyCode: 331},
+		{SessionState: "FTPResponseComplete", Command: "PASS", ReplyCode: 230},
+		{SessionState: "FTPResponseComplete", Command: "FEAT", ReplyCode: 211},
+		{SessionState: "FTPResponseComplete", Command: "PASV", ReplyCode: 227, DataMode: "PASV",
+			DataAddr: "10.0.0.2:50000"},
+		{SessionState: "FTPResponseComplete", Command: "RETR", FileName: "pub/file.txt", ReplyCode: 226,
+			DataMode: "PASV", DataAddr: "10.0.0.2:50000", TransferBytes: 2000, Throughput: 20000},
+		{SessionState: "FTPResponseComplete", Command: "EPSV", ReplyCode: 229, DataMode: "EPSV",
+			DataAddr: "10.0.0.2:6446"},
+		{SessionState: "FTPResponseError", Command: "STOR", FileName: "upload.bin", ReplyCode: 425,
+			DataMode: "EPSV", DataAddr: "10.0.0.2:6446"},
+		{SessionState: "FTPResponseComplete", Command: "PORT", ReplyCode: 200, DataMode: "PORT",
+			DataAddr: "10.0.0.1:1025"},
+		{SessionState: "FTPResponseComplete", Command: "LIST", ReplyCode: 226, DataMode: "PORT",
+			DataAddr: "10.0.0.1:1025"},
+		{SessionState: "FTPResponseError", Command: "CWD", ReplyCode: 550},
+		{SessionState: "FTPResponseComplete", Command: "AUTH", ReplyCode: 234, AuthTLS: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("FTP Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("FTP Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		sb.TransferLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("FTP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("FTP Analyzer: get session breakdown %v on reset after TLS upgrade.", sb)
+	}
+}
+
+func TestDataAnalyzerNotAnnounced(t *testing.T) {
+	timestamp := time.Now()
+
+	a := new(DataAnalyzer)
+	a.Init()
+	a.SetConnAddr("10.0.0.3", 40000, "10.0.0.4", 30000)
+	a.HandleEstb(timestamp)
+	a.HandleData([]byte("hello"), true, timestamp)
+
+	sb := a.HandleReset(true, timestamp.Add(10*time.Millisecond))
+	expected := DataSessionBreakdown{
+		SessionState:    "Reset:FTPDataTransferring",
+		Bytes:           5,
+		Throughput:      500,
+		TransferLatency: 10,
+	}
+	if sb == nil || *sb.(*DataSessionBreakdown) != expected {
+		t.Errorf("FTP Analyzer: data session breakdown is %+v, expected %+v.", sb, expected)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	a.SetConnAddr("10.0.0.5", 40000, "10.0.0.6", 21)
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("220 ready\r\n"),
+		analyzertest.FromClient("USER bob\r\nPASS secret\r\n"),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Command != "USER" || breakdowns[1].Command != "PASS" {
+		t.Fatalf("FTP Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("FTP Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ftp
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+type dataSessionState uint16
+
+const (
+	dataConnected dataSessionState = iota
+	dataTransferring
+	dataComplete
+)
+
+func (s dataSessionState) String() string {
+	switch s {
+	case dataConnected:
+		return "FTPDataConnected"
+
+	case dataTransferring:
+		return "FTPDataTransferring"
+
+	case dataComplete:
+		return "FTPDataComplete"
+
+	default:
+		return "InvalidFTPDataSessionState"
+	}
+}
+
+// DataSessionBreakdown FTP data connection analyzer session breakdown of one
+// transfer.
+type DataSessionBreakdown struct {
+	SessionState string `json:"ftp_data_session_state"`
+	// ControlAddr address of control connection announcing data connection
+	ControlAddr string `json:"ftp_data_control_address,omitempty"`
+	Mode        string `json:"ftp_data_mode,omitempty"`
+	Command     string `json:"ftp_data_command,omitempty"`
+	FileName    string `json:"ftp_data_file_name,omitempty"`
+	Bytes       uint   `json:"ftp_data_bytes"`
+	// Throughput bytes per second of transfer
+	Throughput      uint `json:"ftp_data_throughput"`
+	TransferLatency uint `json:"ftp_data_transfer_latency"`
+}
+
+// ApplicationLatency get FTP data latency of session breakdown.
+func (sb *DataSessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.TransferLatency) * time.Millisecond
+}
+
+// DataAnalyzer FTP data connection analyzer, data connection is linked to
+// control connection announcing it.
+type DataAnalyzer struct {
+	state     dataSessionState
+	transfer  *transfer
+	estbTime  time.Time
+	completed bool
+}
+
+// Init FTP data connection analyzer init function.
+func (a *DataAnalyzer) Init() {
+	a.transfer = new(transfer)
+}
+
+// SetConnAddr FTP data connection analyzer set connection addresses
+// function, it claims transfer announced by control connection.
+func (a *DataAnalyzer) SetConnAddr(clientIP string, clientPort uint16, serverIP string, serverPort uint16) {
+	if t := claim(serverIP, serverPort); t != nil {
+		a.transfer = t
+	} else {
+		log.Debugf("FTP Analyzer: data connection to %s:%d is not announced.", serverIP, serverPort)
+	}
+}
+
+func (a *DataAnalyzer) toBreakdown(resetFlag bool, timestamp time.Time) *DataSessionBreakdown {
+	sb := new(DataSessionBreakdown)
+
+	if resetFlag {
+		sb.SessionState = "Reset:" + a.state.String()
+	} else {
+		sb.SessionState = a.state.String()
+	}
+
+	t := a.transfer
+	t.lock.Lock()
+	sb.ControlAddr = t.controlAddr
+	sb.Mode = t.mode
+	sb.Command = t.command
+	sb.FileName = t.fileName
+	sb.Bytes = t.bytes
+	sb.Throughput = throughput(t.bytes, timestamp.Sub(a.estbTime))
+	t.lock.Unlock()
+
+	if timestamp.After(a.estbTime) {
+		sb.TransferLatency = uint(timestamp.Sub(a.estbTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// HandleEstb FTP data connection analyzer handle TCP connection establishment
+// function.
+func (a *DataAnalyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("FTP Analyzer: HandleEstb of data connection.")
+
+	a.estbTime = timestamp
+}
+
+// HandleData FTP data connection analyzer handle TCP connection payload
+// function.
+func (a *DataAnalyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	if !a.completed {
+		a.state = dataTransferring
+		a.transfer.addBytes(len(payload), timestamp)
+	}
+
+	return uint(len(payload)), nil
+}
+
+// HandleReset FTP data connection analyzer handle TCP connection reset
+// function.
+func (a *DataAnalyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("FTP Analyzer: HandleReset of data connection from client.")
+	} else {
+		log.Debug("FTP Analyzer: HandleReset of data connection from server.")
+	}
+
+	if a.completed {
+		return nil
+	}
+	a.completed = true
+
+	return a.toBreakdown(true, timestamp)
+}
+
+// HandleFin FTP data connection analyzer handle TCP connection fin function,
+// transfer completes by the first fin.
+func (a *DataAnalyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("FTP Analyzer: HandleFin of data connection from client.")
+	} else {
+		log.Debug("FTP Analyzer: HandleFin of data connection from server.")
+	}
+
+	if a.completed {
+		return nil
+	}
+	a.completed = true
+	a.state = dataComplete
+
+	return a.toBreakdown(false, timestamp)
+}
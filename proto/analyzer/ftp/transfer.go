@@ -0,0 +1,125 @@
+package ftp
+
+import (
+	"fmt"
+	"github.com/zhengyuli/ntrace/proto"
+	"sync"
+	"time"
+)
+
+// registry functions adding and removing protocol expected on server
+// ip:port, they are set by caller of analyzer like TCP assembler.
+type registry struct {
+	addProto    func(protoName string, ip string, port uint16)
+	removeProto func(ip string, port uint16)
+}
+
+// transfer data connection announced by control connection, it is shared by
+// control and data connection analyzers which may run in different
+// goroutines.
+type transfer struct {
+	lock sync.Mutex
+	// controlAddr address of control connection
+	controlAddr string
+	// registry protocol registry of control connection
+	registry registry
+	// mode command announcing data connection, PASV, EPSV, PORT or EPRT
+	mode string
+	// ip and port data connection is expected to connect to
+	ip   string
+	port uint16
+	// command and fileName transfer command using data connection
+	command  string
+	fileName string
+	// bytes data bytes of both directions
+	bytes     uint
+	beginTime time.Time
+	endTime   time.Time
+}
+
+// dataAddr get address data connection is expected to connect to.
+func (t *transfer) dataAddr() string {
+	return fmt.Sprintf("%s:%d", t.ip, t.port)
+}
+
+// bind bind transfer command to transfer.
+func (t *transfer) bind(command string, fileName string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.command = command
+	t.fileName = fileName
+}
+
+// addBytes add data bytes received at timestamp.
+func (t *transfer) addBytes(n int, timestamp time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bytes == 0 {
+		t.beginTime = timestamp
+	}
+	t.bytes += uint(n)
+	t.endTime = timestamp
+}
+
+// throughput get bytes per second of transfer lasting duration.
+func throughput(bytes uint, duration time.Duration) uint {
+	if duration <= 0 {
+		return 0
+	}
+
+	return uint(float64(bytes) / duration.Seconds())
+}
+
+var expectedTransfersLock sync.Mutex
+
+// expectedTransfers transfers whose data connection is not established yet
+// by ip:port.
+var expectedTransfers = make(map[string]*transfer)
+
+// expect register data connection of transfer, the connection to ip:port is
+// analyzed as FTP data connection.
+func expect(t *transfer) {
+	expectedTransfersLock.Lock()
+	expectedTransfers[t.dataAddr()] = t
+	expectedTransfersLock.Unlock()
+
+	if t.registry.addProto != nil {
+		t.registry.addProto(proto.FTPDataProtoName, t.ip, t.port)
+	}
+}
+
+// claim claim expected transfer of data connection to ip:port, nil if there
+// is none.
+func claim(ip string, port uint16) *transfer {
+	addr := fmt.Sprintf("%s:%d", ip, port)
+
+	expectedTransfersLock.Lock()
+	t := expectedTransfers[addr]
+	delete(expectedTransfers, addr)
+	expectedTransfersLock.Unlock()
+
+	if t != nil && t.registry.removeProto != nil {
+		t.registry.removeProto(ip, port)
+	}
+
+	return t
+}
+
+// cancel cancel registration of transfer whose data connection is not
+// established.
+func cancel(t *transfer) {
+	addr := t.dataAddr()
+
+	expectedTransfersLock.Lock()
+	expected := expectedTransfers[addr] == t
+	if expected {
+		delete(expectedTransfers, addr)
+	}
+	expectedTransfersLock.Unlock()
+
+	if expected && t.registry.removeProto != nil {
+		t.registry.removeProto(t.ip, t.port)
+	}
+}
@@ -1,35 +1,12 @@
 package http
 
-/*
-#cgo CFLAGS: -I./http_parser/
-#cgo LDFLAGS: -L${SRCDIR}/http_parser -lhttp_parser
-
-#include <http_parser.h>
-
-extern int onReqMessageBegin_cgo(http_parser* parser);
-extern int onReqURL_cgo(http_parser* parser, const char *from, size_t length);
-extern int onReqHeaderField_cgo(http_parser* parser, const char *from, size_t length);
-extern int onReqHeaderValue_cgo(http_parser* parser, const char *from, size_t length);
-extern int onReqHeadersComplete_cgo(http_parser* parser);
-extern int onReqBody_cgo(http_parser* parser, const char *from, size_t length);
-extern int onReqMessageComplete_cgo(http_parser* parser);
-
-extern int onRespMessageBegin_cgo(http_parser* parser);
-extern int onRespURL_cgo(http_parser* parser, const char *from, size_t length);
-extern int onRespHeaderField_cgo(http_parser* parser, const char *from, size_t length);
-extern int onRespHeaderValue_cgo(http_parser* parser, const char *from, size_t length);
-extern int onRespHeadersComplete_cgo(http_parser* parser);
-extern int onRespBody_cgo(http_parser* parser, const char *from, size_t length);
-extern int onRespMessageComplete_cgo(http_parser* parser);
-*/
-import "C"
-
 import (
 	"container/list"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/http/parser"
 	"time"
-	"unsafe"
 )
 
 type sessionState uint16
@@ -88,17 +65,21 @@ type header struct {
 type session struct {
 	resetFlag        bool
 	state            sessionState
+	prevState        sessionState
+	interimResp      bool
 	reqVer           string
 	reqMethod        string
 	reqURI           string
 	reqHeaders       []header
 	reqHeaderBytes   uint
 	reqBodyBytes     uint
+	reqBody          *bodyCapture
 	respVer          string
 	respHeaders      []header
 	statusCode       uint16
 	respHeaderBytes  uint
 	respBodyBytes    uint
+	respBody         *bodyCapture
 	reqTime          time.Time
 	respBeginTime    time.Time
 	respCompleteTime time.Time
@@ -116,21 +97,22 @@ func (s session) session2Breakdown() *SessionBreakdown {
 	sb.ReqVer = s.reqVer
 	sb.ReqMethod = s.reqMethod
 	sb.ReqURI = s.reqURI
-	sb.ReqHeaders = make(map[string]string)
-	for _, h := range s.reqHeaders {
-		sb.ReqHeaders[h.name] = h.value
-	}
+	sb.ReqRoute, sb.ReqQuery = normalizeURI(s.reqURI)
+	sb.ReqHeaders, sb.ReqHeadersTruncated = headers2Breakdown(s.reqHeaders)
 	sb.ReqHeaderBytes = s.reqHeaderBytes
 	sb.ReqBodyBytes = s.reqBodyBytes
+	if s.reqBody != nil {
+		sb.ReqBody, sb.ReqBodyTruncated = s.reqBody.decode()
+	}
 
 	sb.RespVer = s.respVer
-	sb.RespHeaders = make(map[string]string)
-	for _, h := range s.respHeaders {
-		sb.RespHeaders[h.name] = h.value
-	}
+	sb.RespHeaders, sb.RespHeadersTruncated = headers2Breakdown(s.respHeaders)
 	sb.StatusCode = s.statusCode
 	sb.RespHeaderBytes = s.respHeaderBytes
 	sb.RespBodyBytes = s.respBodyBytes
+	if s.respBody != nil {
+		sb.RespBody, sb.RespBodyTruncated = s.respBody.decode()
+	}
 
 	if s.respBeginTime.After(s.reqTime) {
 		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
@@ -144,264 +126,302 @@ func (s session) session2Breakdown() *SessionBreakdown {
 
 // SessionBreakdown HTTP analyzer session breakdown.
 type SessionBreakdown struct {
-	SessionState    string            `json:"http_session_state"`
-	ReqVer          string            `json:"http_request_version"`
-	ReqMethod       string            `json:"http_request_method"`
-	ReqURI          string            `json:"http_request_uri"`
-	ReqHeaders      map[string]string `json:"http_request_headers"`
-	ReqHeaderBytes  uint              `json:"http_request_header_bytes"`
-	ReqBodyBytes    uint              `json:"http_request_body_bytes"`
-	RespVer         string            `json:"http_response_version"`
-	RespHeaders     map[string]string `json:"http_response_headers"`
-	StatusCode      uint16            `json:"http_response_status_code"`
-	RespHeaderBytes uint              `json:"http_response_header_bytes"`
-	RespBodyBytes   uint              `json:"http_response_body_bytes"`
-	ServerLatency   uint              `json:"http_server_latency"`
-	DownloadLatency uint              `json:"http_download_latency"`
+	SessionState         string              `json:"http_session_state"`
+	ReqVer               string              `json:"http_request_version"`
+	ReqMethod            string              `json:"http_request_method"`
+	ReqURI               string              `json:"http_request_uri"`
+	ReqRoute             string              `json:"http_request_route"`
+	ReqQuery             string              `json:"http_request_query,omitempty"`
+	ReqHeaders           map[string][]string `json:"http_request_headers"`
+	ReqHeadersTruncated  bool                `json:"http_request_headers_truncated,omitempty"`
+	ReqHeaderBytes       uint                `json:"http_request_header_bytes"`
+	ReqBodyBytes         uint                `json:"http_request_body_bytes"`
+	ReqBody              string              `json:"http_request_body,omitempty"`
+	ReqBodyTruncated     bool                `json:"http_request_body_truncated,omitempty"`
+	RespVer              string              `json:"http_response_version"`
+	RespHeaders          map[string][]string `json:"http_response_headers"`
+	RespHeadersTruncated bool                `json:"http_response_headers_truncated,omitempty"`
+	StatusCode           uint16              `json:"http_response_status_code"`
+	RespHeaderBytes      uint                `json:"http_response_header_bytes"`
+	RespBodyBytes        uint                `json:"http_response_body_bytes"`
+	RespBody             string              `json:"http_response_body,omitempty"`
+	RespBodyTruncated    bool                `json:"http_response_body_truncated,omitempty"`
+	ServerLatency        uint                `json:"http_server_latency"`
+	DownloadLatency      uint                `json:"http_download_latency"`
 }
 
-//export onReqMessageBegin
-func onReqMessageBegin(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
+// ApplicationStatusCode get HTTP status code of session breakdown.
+func (sb *SessionBreakdown) ApplicationStatusCode() uint16 {
+	return sb.StatusCode
+}
 
+// ApplicationLatency get HTTP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+func (a *Analyzer) onReqMessageBegin(p *parser.Parser) int {
 	currSession := new(session)
 	currSession.state = requestHeaderBegin
-	currSession.reqTime = analyzer.timestamp
-	analyzer.sessions.PushBack(currSession)
+	currSession.reqTime = a.timestamp
+	a.sessions.PushBack(currSession)
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqURL
-func onReqURL(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqURL(p *parser.Parser, data []byte) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 
-		currSession.reqMethod = C.GoString((*C.char)(C.http_method_str(C.enum_http_method(parser.method))))
-		currSession.reqURI = C.GoStringN(from, C.int(length))
+		currSession.reqMethod = p.Method
+		currSession.reqURI = string(data)
 	} else {
 		log.Error("http.Analyzer:onReqURL does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqHeaderField
-func onReqHeaderField(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqHeaderField(p *parser.Parser, data []byte) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 		currSession.state = requestHeaderBegin
-		headerName := C.GoStringN(from, C.int(length))
+		headerName := string(data)
 		currSession.reqHeaders = append(currSession.reqHeaders, header{name: headerName})
 	} else {
 		log.Error("http.Analyzer:onReqHeaderField does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqHeaderValue
-func onReqHeaderValue(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqHeaderValue(p *parser.Parser, data []byte) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 
-		headerValue := C.GoStringN(from, C.int(length))
+		headerValue := string(data)
 		currSession.reqHeaders[len(currSession.reqHeaders)-1].value = headerValue
 	} else {
 		log.Error("http.Analyzer:onReqHeaderValue does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqHeadersComplete
-func onReqHeadersComplete(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqHeadersComplete(p *parser.Parser) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 		currSession.state = requestHeaderComplete
 
-		currSession.reqVer = fmt.Sprintf("HTTP/%d.%d", parser.http_major, parser.http_minor)
-		currSession.reqHeaderBytes = uint(parser.nread)
+		currSession.reqVer = fmt.Sprintf("HTTP/%d.%d", p.HTTPMajor, p.HTTPMinor)
+		currSession.reqHeaderBytes = p.NRead
+		currSession.reqBody = newBodyCapture(currSession.reqHeaders)
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onReqHeadersComplete does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqBody
-func onReqBody(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqBody(p *parser.Parser, data []byte) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 		currSession.state = requestBodyBegin
 
-		currSession.reqBodyBytes += uint(length)
+		currSession.reqBodyBytes += uint(len(data))
+		if currSession.reqBody != nil {
+			currSession.reqBody.write(data)
+		}
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onReqBody does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onReqMessageComplete
-func onReqMessageComplete(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if back := analyzer.sessions.Back(); back != nil {
+func (a *Analyzer) onReqMessageComplete(p *parser.Parser) int {
+	if back := a.sessions.Back(); back != nil {
 		currSession := back.Value.(*session)
 		currSession.state = requestBodyComplete
+
+		if p.Upgrade {
+			a.upgradePending = true
+		}
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onReqMessageComplete does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onRespMessageBegin
-func onRespMessageBegin(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespMessageBegin(p *parser.Parser) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
 
-		currSession.respBeginTime = analyzer.timestamp
+		// Interim 1xx response will be dropped when it completes, so keep
+		// the request state to restore.
+		currSession.prevState = currSession.state
+		currSession.interimResp = false
+		currSession.respHeaders = nil
+		currSession.respBody = nil
+		currSession.respBeginTime = a.timestamp
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespMessageBegin does not find session.")
 	}
 
-	return C.int(0)
-}
-
-//export onRespURL
-func onRespURL(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	return C.int(0)
+	return 0
 }
 
-//export onRespHeaderField
-func onRespHeaderField(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespHeaderField(p *parser.Parser, data []byte) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
 		currSession.state = responseHeaderBegin
 
-		headerName := C.GoStringN(from, C.int(length))
+		headerName := string(data)
 		currSession.respHeaders = append(currSession.respHeaders, header{name: headerName})
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespHeaderField does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onRespHeaderValue
-func onRespHeaderValue(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespHeaderValue(p *parser.Parser, data []byte) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
 		currSession.state = responseHeaderBegin
 
-		headerValue := C.GoStringN(from, C.int(length))
+		headerValue := string(data)
 		currSession.respHeaders[len(currSession.respHeaders)-1].value = headerValue
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespHeaderValue does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onRespHeadersComplete
-func onRespHeadersComplete(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespHeadersComplete(p *parser.Parser) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
 		currSession.state = responseHeaderComplete
 
-		currSession.statusCode = uint16(parser.status_code)
-		currSession.respVer = fmt.Sprintf("HTTP/%d.%d", parser.http_major, parser.http_minor)
-		currSession.respHeaderBytes = uint(parser.nread)
+		currSession.statusCode = p.StatusCode
+		currSession.respVer = fmt.Sprintf("HTTP/%d.%d", p.HTTPMajor, p.HTTPMinor)
+		currSession.respHeaderBytes = p.NRead
+
+		switch {
+		// Protocol switched, the rest of connection is not HTTP
+		case currSession.statusCode == 101:
+			a.tunneled = true
+			a.upgraded = newUpgradedAnalyzer(currSession)
+
+		// Interim response, the final response will follow
+		case currSession.statusCode/100 == 1:
+			currSession.interimResp = true
+			return 0
+
+		// Tunnel established by CONNECT, response has no body
+		case currSession.reqMethod == "CONNECT" && currSession.statusCode/100 == 2:
+			a.tunneled = true
+			return 1
+
+		// Response to HEAD request has no body
+		case currSession.reqMethod == "HEAD":
+			return 1
+		}
+
+		currSession.respBody = newBodyCapture(currSession.respHeaders)
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespHeadersComplete does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onRespBody
-func onRespBody(parser *C.http_parser, from *C.char, length C.size_t) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespBody(p *parser.Parser, data []byte) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
 		currSession.state = responseBodyBegin
 
-		currSession.respBodyBytes += uint(length)
+		currSession.respBodyBytes += uint(len(data))
+		if currSession.respBody != nil {
+			currSession.respBody.write(data)
+		}
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespBody does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
-//export onRespMessageComplete
-func onRespMessageComplete(parser *C.http_parser) C.int {
-	analyzer := (*Analyzer)(unsafe.Pointer(uintptr(parser.customData)))
-
-	if front := analyzer.sessions.Front(); front != nil {
+func (a *Analyzer) onRespMessageComplete(p *parser.Parser) int {
+	if front := a.sessions.Front(); front != nil {
 		currSession := front.Value.(*session)
+
+		if currSession.interimResp {
+			currSession.interimResp = false
+			currSession.state = currSession.prevState
+			currSession.statusCode = 0
+			currSession.respVer = ""
+			currSession.respHeaders = nil
+			currSession.respHeaderBytes = 0
+			return 0
+		}
+
 		currSession.state = responseBodyComplete
+		currSession.respCompleteTime = a.timestamp
 
-		currSession.respCompleteTime = analyzer.timestamp
+		// Pause parser to return session breakdown of each response
+		p.Pause(true)
 	} else {
-		log.Error("http.Analyzer:onReqURL does not find session.")
+		log.Error("http.Analyzer:onRespMessageComplete does not find session.")
 	}
 
-	return C.int(0)
+	return 0
 }
 
 // Analyzer HTTP analyzer.
 type Analyzer struct {
 	timestamp          time.Time
-	reqParser          C.http_parser
-	reqParserSettings  C.http_parser_settings
-	respParser         C.http_parser
-	respParserSettings C.http_parser_settings
+	reqParser          parser.Parser
+	reqParserSettings  parser.Settings
+	respParser         parser.Parser
+	respParserSettings parser.Settings
 	sessions           list.List
+	// upgradePending request asks to switch protocols and waits for response
+	upgradePending bool
+	// tunneled connection switched protocols, the rest is not HTTP
+	tunneled bool
+	// upgraded analyzer of switched protocol, nil if it's not supported
+	upgraded upgradedAnalyzer
+	// pending session breakdowns generated on connection close
+	pending breakdown.Queue
 }
 
 // Init HTTP analyzer init function.
 func (a *Analyzer) Init() {
-	C.http_parser_init(&a.reqParser, C.HTTP_REQUEST)
-	a.reqParser.customData = C.uint64_t(uintptr(unsafe.Pointer(a)))
-	a.reqParserSettings.on_message_begin = C.http_cb(unsafe.Pointer(C.onReqMessageBegin_cgo))
-	a.reqParserSettings.on_url = C.http_data_cb(unsafe.Pointer(C.onReqURL_cgo))
-	a.reqParserSettings.on_header_field = C.http_data_cb(unsafe.Pointer(C.onReqHeaderField_cgo))
-	a.reqParserSettings.on_header_value = C.http_data_cb(unsafe.Pointer(C.onReqHeaderValue_cgo))
-	a.reqParserSettings.on_headers_complete = C.http_cb(unsafe.Pointer(C.onReqHeadersComplete_cgo))
-	a.reqParserSettings.on_body = C.http_data_cb(unsafe.Pointer(C.onReqBody_cgo))
-	a.reqParserSettings.on_message_complete = C.http_cb(unsafe.Pointer(C.onReqMessageComplete_cgo))
-
-	C.http_parser_init(&a.respParser, C.HTTP_RESPONSE)
-	a.respParser.customData = C.uint64_t(uintptr(unsafe.Pointer(a)))
-	a.respParserSettings.on_message_begin = C.http_cb(unsafe.Pointer(C.onRespMessageBegin_cgo))
-	a.respParserSettings.on_url = C.http_data_cb(unsafe.Pointer(C.onRespURL_cgo))
-	a.respParserSettings.on_header_field = C.http_data_cb(unsafe.Pointer(C.onRespHeaderField_cgo))
-	a.respParserSettings.on_header_value = C.http_data_cb(unsafe.Pointer(C.onRespHeaderValue_cgo))
-	a.respParserSettings.on_headers_complete = C.http_cb(unsafe.Pointer(C.onRespHeadersComplete_cgo))
-	a.respParserSettings.on_body = C.http_data_cb(unsafe.Pointer(C.onRespBody_cgo))
-	a.respParserSettings.on_message_complete = C.http_cb(unsafe.Pointer(C.onRespMessageComplete_cgo))
+	a.reqParser.Lenient = parser.LenientHeaders | parser.LenientChunkedLength | parser.LenientKeepAlive
+	a.reqParser.Init(parser.Request)
+	a.reqParserSettings = parser.Settings{
+		OnMessageBegin:    a.onReqMessageBegin,
+		OnURL:             a.onReqURL,
+		OnHeaderField:     a.onReqHeaderField,
+		OnHeaderValue:     a.onReqHeaderValue,
+		OnHeadersComplete: a.onReqHeadersComplete,
+		OnBody:            a.onReqBody,
+		OnMessageComplete: a.onReqMessageComplete,
+	}
+
+	a.respParser.Lenient = parser.LenientHeaders | parser.LenientChunkedLength | parser.LenientKeepAlive
+	a.respParser.Init(parser.Response)
+	a.respParserSettings = parser.Settings{
+		OnMessageBegin:    a.onRespMessageBegin,
+		OnHeaderField:     a.onRespHeaderField,
+		OnHeaderValue:     a.onRespHeaderValue,
+		OnHeadersComplete: a.onRespHeadersComplete,
+		OnBody:            a.onRespBody,
+		OnMessageComplete: a.onRespMessageComplete,
+	}
 
 	a.sessions.Init()
 }
@@ -415,31 +435,54 @@ func (a *Analyzer) HandleEstb(timestamp time.Time) {
 func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
 	a.timestamp = timestamp
 
-	var parsed C.size_t
-	var sessionElement *list.Element
-	var currSession *session
+	if a.tunneled {
+		if a.upgraded != nil {
+			return a.upgraded.HandleData(payload, fromClient, timestamp)
+		}
+		return uint(len(payload)), nil
+	}
+
 	if fromClient {
-		parsed = C.http_parser_execute(&a.reqParser, &a.reqParserSettings, (*C.char)(unsafe.Pointer(&payload[0])), C.size_t(len(payload)))
-		if sessionElement = a.sessions.Back(); sessionElement != nil {
-			currSession = sessionElement.Value.(*session)
-		} else {
-			currSession = nil
+		// Hold request data until server accepts or declines protocol switching
+		if a.upgradePending {
+			return 0, nil
 		}
-	} else {
-		parsed = C.http_parser_execute(&a.respParser, &a.respParserSettings, (*C.char)(unsafe.Pointer(&payload[0])), C.size_t(len(payload)))
-		if sessionElement = a.sessions.Front(); sessionElement != nil {
-			currSession = sessionElement.Value.(*session)
-		} else {
-			currSession = nil
+
+		parsed := a.reqParser.Execute(&a.reqParserSettings, payload)
+		if errno := a.reqParser.Errno(); errno != parser.OK {
+			log.Errorf("HTTP Analyzer: parse request error: %s.", errno)
+			a.tunneled = true
+			return uint(len(payload)), nil
 		}
-	}
 
-	if currSession == nil || currSession.state != responseBodyComplete {
 		return uint(parsed), nil
 	}
 
-	a.sessions.Remove(sessionElement)
-	return uint(parsed), currSession.session2Breakdown()
+	a.respParser.Pause(false)
+	parsed := a.respParser.Execute(&a.respParserSettings, payload)
+	switch errno := a.respParser.Errno(); errno {
+	case parser.OK:
+		return uint(parsed), nil
+
+	case parser.Paused:
+		front := a.sessions.Front()
+		if front == nil {
+			return uint(parsed), nil
+		}
+
+		currSession := front.Value.(*session)
+		a.sessions.Remove(front)
+		if !a.tunneled {
+			a.upgradePending = false
+		}
+
+		return uint(parsed), currSession.session2Breakdown()
+
+	default:
+		log.Errorf("HTTP Analyzer: parse response error: %s.", errno)
+		a.tunneled = true
+		return uint(len(payload)), nil
+	}
 }
 
 // HandleReset HTTP analyzer handle TCP connection reset function.
@@ -450,20 +493,25 @@ func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBre
 		log.Debug("HTTP Analyzer: HandleReset from server.")
 	}
 
-	if front := a.sessions.Front(); front != nil {
-		currSession := *front.Value.(*session)
-		if !fromClient && currSession.state == responseBodyBegin {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		currSession := e.Value.(*session)
+		if e == a.sessions.Front() && !fromClient && currSession.state == responseBodyBegin {
 			currSession.state = responseBodyComplete
 			currSession.respCompleteTime = timestamp
 		} else {
 			currSession.resetFlag = true
 		}
-		a.sessions.Remove(front)
+		a.pending.Push(currSession.session2Breakdown())
+	}
+	a.sessions.Init()
 
-		return currSession.session2Breakdown()
+	if a.upgraded != nil {
+		if sb := a.upgraded.HandleReset(fromClient, timestamp); sb != nil {
+			a.pending.Push(sb)
+		}
 	}
 
-	return nil
+	return a.PopSessionBreakdown()
 }
 
 // HandleFin HTTP analyzer handle TCP connection fin function.
@@ -474,15 +522,40 @@ func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreak
 		log.Debug("HTTP Analyzer: HandleFin from server.")
 	}
 
-	if front := a.sessions.Front(); front != nil && !fromClient {
-		if currSession := front.Value.(*session); currSession.state == responseBodyBegin {
-			currSession.state = responseBodyComplete
-			currSession.respCompleteTime = timestamp
-			a.sessions.Remove(front)
+	// Server may still respond after client closes, sessions are complete
+	// only when server closes.
+	if !fromClient {
+		for e := a.sessions.Front(); e != nil; e = e.Next() {
+			currSession := e.Value.(*session)
+			if e == a.sessions.Front() && currSession.state == responseBodyBegin {
+				currSession.state = responseBodyComplete
+				currSession.respCompleteTime = timestamp
+			}
+			a.pending.Push(currSession.session2Breakdown())
+		}
+		a.sessions.Init()
+	}
 
-			return currSession.session2Breakdown()
+	if a.upgraded != nil {
+		if sb := a.upgraded.HandleFin(fromClient, timestamp); sb != nil {
+			a.pending.Push(sb)
 		}
 	}
 
+	return a.PopSessionBreakdown()
+}
+
+// PopSessionBreakdown HTTP analyzer pop session breakdown function, sessions
+// pending on connection close and session breakdowns queued by upgraded
+// analyzer are returned one by one.
+func (a *Analyzer) PopSessionBreakdown() (sessionBreakdown interface{}) {
+	if sb := a.pending.PopSessionBreakdown(); sb != nil {
+		return sb
+	}
+
+	if queue, ok := a.upgraded.(sessionBreakdownQueue); ok {
+		return queue.PopSessionBreakdown()
+	}
+
 	return nil
 }
@@ -0,0 +1,231 @@
+package http
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/http2"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type expectedBreakdown struct {
+	method     string
+	uri        string
+	statusCode uint16
+	bodyBytes  uint
+}
+
+func TestAnalyzerPairing(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []analyzertest.Step
+		breakdowns []expectedBreakdown
+	}{
+		{
+			name: "keep-alive",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /a HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"),
+				analyzertest.FromClient("GET /b HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/a", 200, 5},
+				{"GET", "/b", 404, 0},
+			},
+		},
+		{
+			name: "pipelined",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /1 HTTP/1.1\r\nHost: test\r\n\r\n" +
+					"GET /2 HTTP/1.1\r\nHost: test\r\n\r\n" +
+					"GET /3 HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1" +
+					"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n22\r\n0\r\n\r\n" +
+					"HTTP/1.1 500 Internal Server Error\r\nContent-Length: 3\r\n\r\n333"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/1", 200, 1},
+				{"GET", "/2", 200, 2},
+				{"GET", "/3", 500, 3},
+			},
+		},
+		{
+			name: "pipelined split responses",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /1 HTTP/1.1\r\nHost: test\r\n\r\nGET /2 HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1HTTP/1.1 20"),
+				analyzertest.FromServer("1 Created\r\nContent-Length: 2\r\n\r\n22"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/1", 200, 1},
+				{"GET", "/2", 201, 2},
+			},
+		},
+		{
+			name: "100 continue",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 100 Continue\r\n\r\n"),
+				analyzertest.FromClient("data"),
+				analyzertest.FromServer("HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok"),
+				analyzertest.FromClient("GET /next HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"POST", "/upload", 201, 2},
+				{"GET", "/next", 200, 0},
+			},
+		},
+		{
+			name: "103 early hints",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /page HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\npage"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/page", 200, 4},
+			},
+		},
+		{
+			name: "HEAD without body",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("HEAD /file HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n"),
+				analyzertest.FromClient("GET /file HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"HEAD", "/file", 200, 0},
+				{"GET", "/file", 200, 2},
+			},
+		},
+		{
+			name: "204 and 304 without body",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("DELETE /item HTTP/1.1\r\nHost: test\r\n\r\nGET /item HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 204 No Content\r\n\r\nHTTP/1.1 304 Not Modified\r\n\r\n"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"DELETE", "/item", 204, 0},
+				{"GET", "/item", 304, 0},
+			},
+		},
+		{
+			name: "websocket upgrade",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"),
+				analyzertest.FromClient("\x81\x82abcd\x09\x0c"),
+				analyzertest.FromServer("\x81\x05HTTP/"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/ws", 101, 0},
+			},
+		},
+		{
+			name: "declined upgrade",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("GET /h2 HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+				analyzertest.FromClient("GET /next HTTP/1.1\r\nHost: test\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"GET", "/h2", 200, 2},
+				{"GET", "/next", 200, 0},
+			},
+		},
+		{
+			name: "CONNECT tunnel",
+			steps: []analyzertest.Step{
+				analyzertest.FromClient("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"),
+				analyzertest.FromServer("HTTP/1.1 200 Connection Established\r\n\r\n"),
+				analyzertest.FromClient("\x16\x03\x01\x00\x05hello"),
+				analyzertest.FromServer("\x16\x03\x03\x00\x05hello"),
+			},
+			breakdowns: []expectedBreakdown{
+				{"CONNECT", "example.com:443", 200, 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		a := new(Analyzer)
+		a.Init()
+
+		breakdowns := analyzertest.Replay(a, test.steps, false, time.Now())
+		if len(breakdowns) != len(test.breakdowns) {
+			t.Errorf("%s: get %d session breakdowns, expected %d.", test.name, len(breakdowns), len(test.breakdowns))
+			continue
+		}
+
+		for i, expected := range test.breakdowns {
+			sb := breakdowns[i].(*SessionBreakdown)
+			if sb.ReqMethod != expected.method || sb.ReqURI != expected.uri ||
+				sb.StatusCode != expected.statusCode || sb.RespBodyBytes != expected.bodyBytes {
+				t.Errorf("%s: session breakdown %d is %s %s %d %d, expected %s %s %d %d.",
+					test.name, i, sb.ReqMethod, sb.ReqURI, sb.StatusCode, sb.RespBodyBytes,
+					expected.method, expected.uri, expected.statusCode, expected.bodyBytes)
+			}
+			if sb.SessionState != responseBodyComplete.String() {
+				t.Errorf("%s: session breakdown %d in wrong state %s.", test.name, i, sb.SessionState)
+			}
+		}
+	}
+}
+
+func TestAnalyzerH2CUpgrade(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+
+	breakdowns := analyzertest.Replay(a, []analyzertest.Step{
+		analyzertest.FromClient("GET /h2 HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+			"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"),
+		// 101 followed by SETTINGS and HEADERS of stream 1 with indexed ":status: 200"
+		analyzertest.FromServer("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n" +
+			"\x00\x00\x00\x04\x00\x00\x00\x00\x00" +
+			"\x00\x00\x01\x01\x04\x00\x00\x00\x01\x88" +
+			"\x00\x00\x02\x00\x01\x00\x00\x00\x01ok"),
+		analyzertest.FromClient(http2.ClientPreface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"),
+	}, false, time.Now())
+	if len(breakdowns) != 2 {
+		t.Fatalf("h2c upgrade: get %d session breakdowns, expected 2.", len(breakdowns))
+	}
+
+	if sb := breakdowns[0].(*SessionBreakdown); sb.StatusCode != 101 {
+		t.Errorf("h2c upgrade: get status code %d of upgrade request.", sb.StatusCode)
+	}
+	if sb, ok := breakdowns[1].(*http2.SessionBreakdown); !ok ||
+		sb.StreamID != 1 || sb.ReqPath != "/h2" || sb.StatusCode != 200 || sb.RespBodyBytes != 2 {
+		t.Errorf("h2c upgrade: get wrong HTTP/2 session breakdown %+v.", breakdowns[1])
+	}
+}
+
+func TestAnalyzerResetPipelined(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+
+	breakdowns := analyzertest.Replay(a, []analyzertest.Step{
+		analyzertest.FromClient("GET /a HTTP/1.1\r\nHost: test\r\n\r\nGET /b HTTP/1.1\r\nHost: test\r\n\r\n"),
+		analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nab"),
+	}, false, time.Now())
+	if len(breakdowns) != 0 {
+		t.Fatalf("Reset pipelined: get %d session breakdowns before reset.", len(breakdowns))
+	}
+
+	for sb := a.HandleReset(true, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb)
+	}
+	if len(breakdowns) != 2 {
+		t.Fatalf("Reset pipelined: get %d session breakdowns, expected 2.", len(breakdowns))
+	}
+
+	for i, uri := range []string{"/a", "/b"} {
+		sb := breakdowns[i].(*SessionBreakdown)
+		if sb.ReqURI != uri || !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("Reset pipelined: session breakdown %d is %s in state %s.", i, sb.ReqURI, sb.SessionState)
+		}
+	}
+}
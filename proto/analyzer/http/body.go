@@ -0,0 +1,174 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bodyCaptureBytes max bytes of decoded HTTP body to capture, default is 0
+// which disables body capture, it can be changed by HTTP_BODY_CAPTURE_BYTES
+// env.
+var bodyCaptureBytes = 0
+
+// bodyCaptureContentTypes content types of HTTP body to capture, entry
+// ends with "/" matches media type prefix and entry begins with "+"
+// matches structured syntax suffix, it can be changed by comma separated
+// HTTP_BODY_CAPTURE_CONTENT_TYPES env.
+var bodyCaptureContentTypes = []string{
+	"application/json",
+	"+json",
+	"application/x-www-form-urlencoded",
+	"text/",
+}
+
+func init() {
+	if captureBytes, err := strconv.Atoi(os.Getenv("HTTP_BODY_CAPTURE_BYTES")); err == nil && captureBytes > 0 {
+		bodyCaptureBytes = captureBytes
+	}
+
+	if contentTypes := os.Getenv("HTTP_BODY_CAPTURE_CONTENT_TYPES"); contentTypes != "" {
+		bodyCaptureContentTypes = nil
+		for _, contentType := range strings.Split(contentTypes, ",") {
+			if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+				bodyCaptureContentTypes = append(bodyCaptureContentTypes, contentType)
+			}
+		}
+	}
+}
+
+// captureContentType return true if body of content type should be captured.
+func captureContentType(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+
+	for _, allowed := range bodyCaptureContentTypes {
+		switch {
+		case strings.HasSuffix(allowed, "/"):
+			if strings.HasPrefix(contentType, allowed) {
+				return true
+			}
+
+		case strings.HasPrefix(allowed, "+"):
+			if strings.HasSuffix(contentType, allowed) {
+				return true
+			}
+
+		case contentType == allowed:
+			return true
+		}
+	}
+
+	return false
+}
+
+// bodyCapture captured HTTP body, chunked body is decoded by parser and
+// content encoding is decoded when body completes.
+type bodyCapture struct {
+	encoding  string
+	raw       []byte
+	truncated bool
+}
+
+// newBodyCapture create body capture by message headers, returns nil if
+// body should not be captured.
+func newBodyCapture(headers []header) *bodyCapture {
+	if bodyCaptureBytes <= 0 {
+		return nil
+	}
+
+	var contentType, encoding string
+	for _, h := range headers {
+		switch strings.ToLower(h.name) {
+		case "content-type":
+			contentType = h.value
+
+		case "content-encoding":
+			encoding = strings.ToLower(strings.TrimSpace(h.value))
+		}
+	}
+
+	if !captureContentType(contentType) {
+		return nil
+	}
+
+	switch encoding {
+	case "", "identity", "gzip", "x-gzip", "deflate", "br":
+		return &bodyCapture{encoding: encoding}
+
+	default:
+		return nil
+	}
+}
+
+// encodedBodySlack extra raw bytes kept for encoded body, since small
+// compressed body could be longer than decoded one.
+const encodedBodySlack = 1024
+
+// write append body data, raw body is limited to bodyCaptureBytes plus
+// encodedBodySlack for encoded body.
+func (b *bodyCapture) write(data []byte) {
+	limit := bodyCaptureBytes
+	switch b.encoding {
+	case "", "identity":
+	default:
+		limit += encodedBodySlack
+	}
+
+	if left := limit - len(b.raw); len(data) > left {
+		data = data[:left]
+		b.truncated = true
+	}
+
+	b.raw = append(b.raw, data...)
+}
+
+// decode decode captured body by content encoding, truncated encoded body
+// is decoded as much as possible.
+func (b *bodyCapture) decode() (body string, truncated bool) {
+	var reader io.Reader
+	var err error
+
+	switch b.encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(b.raw))
+
+	case "deflate":
+		// Deflate is zlib wrapped by spec, but raw deflate is also seen
+		if reader, err = zlib.NewReader(bytes.NewReader(b.raw)); err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(b.raw)), nil
+		}
+
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(b.raw))
+
+	default:
+		return string(b.raw), b.truncated
+	}
+	if err != nil {
+		return "", true
+	}
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(bodyCaptureBytes)+1))
+	if err != nil {
+		truncated = true
+	}
+	if len(decoded) > bodyCaptureBytes {
+		decoded = decoded[:bodyCaptureBytes]
+		truncated = true
+	}
+
+	return string(decoded), truncated || b.truncated
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		captured    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/problem+json", true},
+		{"Text/Plain", true},
+		{"application/x-www-form-urlencoded", true},
+		{"image/png", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if captureContentType(test.contentType) != test.captured {
+			t.Errorf("Body capture: content type %q should be captured=%t.", test.contentType, test.captured)
+		}
+	}
+}
+
+func TestAnalyzerBodyCapture(t *testing.T) {
+	defer func(captureBytes int) { bodyCaptureBytes = captureBytes }(bodyCaptureBytes)
+	bodyCaptureBytes = 16
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write([]byte(`{"result":"ok"}`))
+	w.Close()
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := analyzertest.Replay(a, []analyzertest.Step{
+		analyzertest.FromClient("POST /form HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n4\r\na=1&\r\n3\r\nb=2\r\n0\r\n\r\n"),
+		analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Encoding: gzip\r\n" +
+			"Content-Length: " + strconv.Itoa(gzipped.Len()) + "\r\n\r\n" + gzipped.String()),
+		analyzertest.FromClient("GET /image HTTP/1.1\r\n\r\n"),
+		analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: 4\r\n\r\n\x89PNG"),
+		analyzertest.FromClient("GET /text HTTP/1.1\r\n\r\n"),
+		analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 20\r\n\r\n" + strings.Repeat("x", 20)),
+	}, false, time.Now())
+	if len(breakdowns) != 3 {
+		t.Fatalf("Body capture: get %d session breakdowns, expected 3.", len(breakdowns))
+	}
+
+	if sb := breakdowns[0].(*SessionBreakdown); sb.ReqBody != "a=1&b=2" || sb.ReqBodyTruncated || sb.RespBody != `{"result":"ok"}` || sb.RespBodyTruncated {
+		t.Errorf("Body capture: get request body %q and response body %q.", sb.ReqBody, sb.RespBody)
+	}
+	if sb := breakdowns[1].(*SessionBreakdown); sb.RespBody != "" {
+		t.Errorf("Body capture: image body should not be captured, get %q.", sb.RespBody)
+	}
+	if sb := breakdowns[2].(*SessionBreakdown); sb.RespBody != strings.Repeat("x", 16) || !sb.RespBodyTruncated {
+		t.Errorf("Body capture: get truncated body %q, truncated=%t.", sb.RespBody, sb.RespBodyTruncated)
+	}
+}
+
+func TestAnalyzerBodyCaptureBrotli(t *testing.T) {
+	defer func(captureBytes int) { bodyCaptureBytes = captureBytes }(bodyCaptureBytes)
+	bodyCaptureBytes = 64
+
+	var compressed bytes.Buffer
+	w := brotli.NewWriter(&compressed)
+	w.Write([]byte(`{"result":"ok"}`))
+	w.Close()
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := analyzertest.Replay(a, []analyzertest.Step{
+		analyzertest.FromClient("GET /json HTTP/1.1\r\n\r\n"),
+		analyzertest.FromServer("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Encoding: br\r\n" +
+			"Content-Length: " + strconv.Itoa(compressed.Len()) + "\r\n\r\n" + compressed.String()),
+	}, false, time.Now())
+	if len(breakdowns) != 1 {
+		t.Fatalf("Body capture: get %d session breakdowns, expected 1.", len(breakdowns))
+	}
+
+	if sb := breakdowns[0].(*SessionBreakdown); sb.RespBody != `{"result":"ok"}` {
+		t.Errorf("Body capture: get brotli response body %q.", sb.RespBody)
+	}
+}
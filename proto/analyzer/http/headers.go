@@ -0,0 +1,159 @@
+package http
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Header redact mode.
+const (
+	redactMask = "mask"
+	redactHash = "hash"
+	redactDrop = "drop"
+	redactShow = "show"
+)
+
+// headerAllowList lower case names of headers to record, empty list allows
+// all headers, it can be set by comma separated HTTP_HEADER_ALLOW env.
+var headerAllowList map[string]bool
+
+// headerDenyList lower case names of headers not to record, it can be set
+// by comma separated HTTP_HEADER_DENY env.
+var headerDenyList map[string]bool
+
+// headerRedactions redact mode of header values, it can be changed by comma
+// separated HTTP_HEADER_REDACT env with "name:mode" entries, mode is one
+// of "mask", "hash", "drop" and "show", entries are merged into defaults
+// and "show" removes default redaction of header.
+var headerRedactions = map[string]string{
+	"authorization":       redactMask,
+	"proxy-authorization": redactMask,
+	"cookie":              redactMask,
+	"set-cookie":          redactMask,
+}
+
+// headerMaxBytes max bytes of header names and values recorded per message,
+// default is 8192, it can be changed by HTTP_HEADER_MAX_BYTES env.
+var headerMaxBytes = 8192
+
+func parseHeaderNames(names string) map[string]bool {
+	nameSet := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			nameSet[name] = true
+		}
+	}
+
+	return nameSet
+}
+
+// mergeHeaderRedactions merge comma separated "name:mode" entries into
+// redactions, mode defaults to mask.
+func mergeHeaderRedactions(redactions map[string]string, redact string) {
+	for _, entry := range strings.Split(redact, ",") {
+		fields := strings.SplitN(entry, ":", 2)
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+
+		mode := redactMask
+		if len(fields) == 2 {
+			mode = strings.ToLower(strings.TrimSpace(fields[1]))
+		}
+
+		switch mode {
+		case redactMask, redactHash, redactDrop:
+			redactions[name] = mode
+
+		case redactShow:
+			delete(redactions, name)
+		}
+	}
+}
+
+func init() {
+	if allow := os.Getenv("HTTP_HEADER_ALLOW"); allow != "" {
+		headerAllowList = parseHeaderNames(allow)
+	}
+
+	if deny := os.Getenv("HTTP_HEADER_DENY"); deny != "" {
+		headerDenyList = parseHeaderNames(deny)
+	}
+
+	if redact := os.Getenv("HTTP_HEADER_REDACT"); redact != "" {
+		mergeHeaderRedactions(headerRedactions, redact)
+	}
+
+	if maxBytes, err := strconv.Atoi(os.Getenv("HTTP_HEADER_MAX_BYTES")); err == nil && maxBytes > 0 {
+		headerMaxBytes = maxBytes
+	}
+}
+
+// redactHeaderValue redact header value by mode, auth scheme of mask mode
+// value like "Bearer xxx" is kept.
+func redactHeaderValue(value string, mode string) string {
+	switch mode {
+	case redactMask:
+		if i := strings.IndexByte(value, ' '); i > 0 && isToken(value[:i]) {
+			return value[:i] + " ***"
+		}
+		return "***"
+
+	case redactHash:
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		return fmt.Sprintf("fnv32a:%08x", h.Sum32())
+
+	default:
+		return value
+	}
+}
+
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headers2Breakdown filter and redact headers, headers are keyed by canonical
+// name and repeated headers are kept in order, truncated is true if headers
+// exceed headerMaxBytes.
+func headers2Breakdown(headers []header) (result map[string][]string, truncated bool) {
+	result = make(map[string][]string)
+
+	recordBytes := 0
+	for _, h := range headers {
+		name := strings.ToLower(h.name)
+		if headerAllowList != nil && !headerAllowList[name] {
+			continue
+		}
+		if headerDenyList[name] {
+			continue
+		}
+
+		mode := headerRedactions[name]
+		if mode == redactDrop {
+			continue
+		}
+		value := redactHeaderValue(h.value, mode)
+
+		if recordBytes += len(h.name) + len(value); recordBytes > headerMaxBytes {
+			truncated = true
+			break
+		}
+		key := textproto.CanonicalMIMEHeaderKey(h.name)
+		result[key] = append(result[key], value)
+	}
+
+	return result, truncated
+}
@@ -0,0 +1,64 @@
+package http
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaders2Breakdown(t *testing.T) {
+	defer func(allow, deny map[string]bool, redactions map[string]string, maxBytes int) {
+		headerAllowList, headerDenyList, headerRedactions, headerMaxBytes = allow, deny, redactions, maxBytes
+	}(headerAllowList, headerDenyList, headerRedactions, headerMaxBytes)
+
+	headers := []header{
+		{"Host", "test"},
+		{"Authorization", "Bearer secret"},
+		{"Cookie", "sid=secret"},
+		{"X-Api-Key", "secret"},
+		{"X-Forwarded-For", "10.0.0.1"},
+		{"x-forwarded-for", "10.0.0.2"},
+		{"X-Internal", "1"},
+	}
+
+	headerAllowList = nil
+	headerDenyList = map[string]bool{"x-internal": true}
+	headerRedactions = map[string]string{
+		"authorization": redactMask,
+		"cookie":        redactMask,
+		"x-api-key":     redactHash,
+	}
+	result, truncated := headers2Breakdown(headers)
+	if truncated || len(result) != 5 ||
+		strings.Join(result["Authorization"], ",") != "Bearer ***" ||
+		strings.Join(result["Cookie"], ",") != "***" ||
+		!strings.HasPrefix(result["X-Api-Key"][0], "fnv32a:") ||
+		strings.Join(result["X-Forwarded-For"], ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("Headers: get wrong redacted headers %v.", result)
+	}
+
+	headerAllowList = map[string]bool{"host": true, "cookie": true}
+	headerRedactions = map[string]string{"cookie": redactDrop}
+	if result, _ = headers2Breakdown(headers); len(result) != 1 || result["Host"][0] != "test" {
+		t.Errorf("Headers: get wrong allowed headers %v.", result)
+	}
+
+	headerAllowList = nil
+	headerRedactions = nil
+	headerMaxBytes = 24
+	if result, truncated = headers2Breakdown(headers); !truncated || len(result) != 1 {
+		t.Errorf("Headers: get wrong truncated headers %v.", result)
+	}
+}
+
+func TestMergeHeaderRedactions(t *testing.T) {
+	redactions := map[string]string{
+		"authorization": redactMask,
+		"cookie":        redactMask,
+	}
+	mergeHeaderRedactions(redactions, "X-Api-Key:hash, Cookie:show,x-token, x-bad:unknown")
+
+	if len(redactions) != 3 || redactions["authorization"] != redactMask ||
+		redactions["x-api-key"] != redactHash || redactions["x-token"] != redactMask {
+		t.Errorf("Headers: get wrong merged redactions %v.", redactions)
+	}
+}
@@ -0,0 +1,803 @@
+package parser
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// MaxHeaderSize max bytes of HTTP message header (request/status line,
+// headers and trailers), same as HTTP_MAX_HEADER_SIZE of http_parser.
+const MaxHeaderSize = 80 * 1024
+
+// Type parser type.
+type Type uint8
+
+const (
+	// Request parser for HTTP requests.
+	Request Type = iota
+	// Response parser for HTTP responses.
+	Response
+)
+
+// Lenient parser lenient flags.
+type Lenient uint8
+
+const (
+	// LenientHeaders tolerate invalid header lines and tokens.
+	LenientHeaders Lenient = 1 << iota
+	// LenientChunkedLength allow Content-Length with chunked Transfer-Encoding,
+	// Transfer-Encoding wins.
+	LenientChunkedLength
+	// LenientKeepAlive keep parsing messages after Connection: close.
+	LenientKeepAlive
+)
+
+// Errno parser error number.
+type Errno uint8
+
+const (
+	// OK no error.
+	OK Errno = iota
+	// Paused parser is paused.
+	Paused
+	// CallbackMessageBegin OnMessageBegin callback failed.
+	CallbackMessageBegin
+	// CallbackURL OnURL callback failed.
+	CallbackURL
+	// CallbackStatus OnStatus callback failed.
+	CallbackStatus
+	// CallbackHeaderField OnHeaderField callback failed.
+	CallbackHeaderField
+	// CallbackHeaderValue OnHeaderValue callback failed.
+	CallbackHeaderValue
+	// CallbackHeadersComplete OnHeadersComplete callback failed.
+	CallbackHeadersComplete
+	// CallbackBody OnBody callback failed.
+	CallbackBody
+	// CallbackMessageComplete OnMessageComplete callback failed.
+	CallbackMessageComplete
+	// InvalidEOFState stream ended at an unexpected time.
+	InvalidEOFState
+	// HeaderOverflow too many header bytes seen.
+	HeaderOverflow
+	// ClosedConnection data received after completed connection: close message.
+	ClosedConnection
+	// InvalidVersion invalid HTTP version.
+	InvalidVersion
+	// InvalidStatus invalid HTTP status code.
+	InvalidStatus
+	// InvalidMethod invalid HTTP method.
+	InvalidMethod
+	// InvalidURL invalid URL.
+	InvalidURL
+	// InvalidHeaderToken invalid character in header.
+	InvalidHeaderToken
+	// InvalidContentLength invalid character in Content-Length header.
+	InvalidContentLength
+	// UnexpectedContentLength conflicting Content-Length or Transfer-Encoding headers.
+	UnexpectedContentLength
+	// InvalidChunkSize invalid character in chunk size header.
+	InvalidChunkSize
+	// Strict strict mode assertion failed.
+	Strict
+)
+
+func (e Errno) String() string {
+	switch e {
+	case OK:
+		return "OK"
+
+	case Paused:
+		return "Paused"
+
+	case CallbackMessageBegin:
+		return "CallbackMessageBegin"
+
+	case CallbackURL:
+		return "CallbackURL"
+
+	case CallbackStatus:
+		return "CallbackStatus"
+
+	case CallbackHeaderField:
+		return "CallbackHeaderField"
+
+	case CallbackHeaderValue:
+		return "CallbackHeaderValue"
+
+	case CallbackHeadersComplete:
+		return "CallbackHeadersComplete"
+
+	case CallbackBody:
+		return "CallbackBody"
+
+	case CallbackMessageComplete:
+		return "CallbackMessageComplete"
+
+	case InvalidEOFState:
+		return "InvalidEOFState"
+
+	case HeaderOverflow:
+		return "HeaderOverflow"
+
+	case ClosedConnection:
+		return "ClosedConnection"
+
+	case InvalidVersion:
+		return "InvalidVersion"
+
+	case InvalidStatus:
+		return "InvalidStatus"
+
+	case InvalidMethod:
+		return "InvalidMethod"
+
+	case InvalidURL:
+		return "InvalidURL"
+
+	case InvalidHeaderToken:
+		return "InvalidHeaderToken"
+
+	case InvalidContentLength:
+		return "InvalidContentLength"
+
+	case UnexpectedContentLength:
+		return "UnexpectedContentLength"
+
+	case InvalidChunkSize:
+		return "InvalidChunkSize"
+
+	case Strict:
+		return "Strict"
+
+	default:
+		return "InvalidErrno"
+	}
+}
+
+// Callback parser notification callback, returns non-zero to stop parser
+// with error.
+type Callback func(p *Parser) int
+
+// DataCallback parser data callback, data is only valid during the call,
+// returns non-zero to stop parser with error.
+type DataCallback func(p *Parser, data []byte) int
+
+// Settings parser callbacks, all callbacks are optional. OnHeadersComplete
+// could return 1 to tell parser the message has no body (response to HEAD
+// request) or 2 to skip body and treat the rest of connection as upgraded.
+// Trailers of chunked message are reported by OnHeaderField/OnHeaderValue
+// with Parser.Trailing set.
+type Settings struct {
+	OnMessageBegin    Callback
+	OnURL             DataCallback
+	OnStatus          DataCallback
+	OnHeaderField     DataCallback
+	OnHeaderValue     DataCallback
+	OnHeadersComplete Callback
+	OnBody            DataCallback
+	OnMessageComplete Callback
+}
+
+type state uint8
+
+const (
+	stateDead state = iota
+	stateStart
+	stateFirstLine
+	stateHeaderLine
+	stateBodyIdentity
+	stateBodyIdentityEOF
+	stateChunkSize
+	stateChunkData
+	stateChunkDataEnd
+	stateTrailerLine
+)
+
+type flags uint8
+
+const (
+	flagChunked flags = 1 << iota
+	flagConnectionKeepAlive
+	flagConnectionClose
+	flagConnectionUpgrade
+	flagUpgrade
+	flagSkipBody
+	flagContentLength
+)
+
+// Parser incremental HTTP/1.x parser.
+type Parser struct {
+	Type    Type
+	Lenient Lenient
+
+	// Read only, valid after OnHeadersComplete
+	HTTPMajor     uint16
+	HTTPMinor     uint16
+	StatusCode    uint16
+	Method        string
+	NRead         uint
+	ContentLength int64
+	Upgrade       bool
+	Trailing      bool
+
+	state        state
+	errno        Errno
+	flags        flags
+	remaining    uint64
+	line         []byte
+	hasPending   bool
+	pendingField []byte
+	pendingValue []byte
+}
+
+// New create a new parser.
+func New(t Type) *Parser {
+	p := new(Parser)
+	p.Init(t)
+
+	return p
+}
+
+// Init init or reinit parser.
+func (p *Parser) Init(t Type) {
+	lenient := p.Lenient
+	*p = Parser{
+		Type:    t,
+		Lenient: lenient,
+		state:   stateStart,
+	}
+	p.reset()
+}
+
+// Errno get parser error number.
+func (p *Parser) Errno() Errno {
+	return p.errno
+}
+
+// Pause pause or unpause parser, it can be called in callbacks to make
+// Execute return after the current parsing step.
+func (p *Parser) Pause(paused bool) {
+	if p.errno != OK && p.errno != Paused {
+		return
+	}
+
+	if paused {
+		p.errno = Paused
+	} else {
+		p.errno = OK
+	}
+}
+
+// ShouldKeepAlive return true if connection should be kept alive after
+// current message.
+func (p *Parser) ShouldKeepAlive() bool {
+	if p.HTTPMajor > 0 && p.HTTPMinor > 0 {
+		if p.flags&flagConnectionClose != 0 {
+			return false
+		}
+	} else if p.flags&flagConnectionKeepAlive == 0 {
+		return false
+	}
+
+	return !p.needsEOF()
+}
+
+// noBody return true if response never has body, see RFC 7230 section 3.3.3.
+func (p *Parser) noBody() bool {
+	return p.Type == Response && (p.StatusCode/100 == 1 || p.StatusCode == 204 || p.StatusCode == 304)
+}
+
+func (p *Parser) needsEOF() bool {
+	if p.Type == Request || p.noBody() || p.flags&flagSkipBody != 0 {
+		return false
+	}
+
+	if p.flags&flagChunked != 0 || p.flags&flagContentLength != 0 {
+		return false
+	}
+
+	return true
+}
+
+func (p *Parser) reset() {
+	p.HTTPMajor = 0
+	p.HTTPMinor = 0
+	p.StatusCode = 0
+	p.Method = ""
+	p.NRead = 0
+	p.ContentLength = -1
+	p.Upgrade = false
+	p.Trailing = false
+	p.flags = 0
+	p.remaining = 0
+	p.line = p.line[:0]
+	p.hasPending = false
+}
+
+// notify run callback, returns false if parser should stop with error.
+// Pause takes effect after the current parsing step is done.
+func (p *Parser) notify(cb Callback, errno Errno) bool {
+	if cb != nil && cb(p) != 0 {
+		p.errno = errno
+	}
+
+	return p.errno == OK || p.errno == Paused
+}
+
+func (p *Parser) notifyData(cb DataCallback, data []byte, errno Errno) bool {
+	if cb != nil && cb(p, data) != 0 {
+		p.errno = errno
+	}
+
+	return p.errno == OK || p.errno == Paused
+}
+
+// Execute parse data and return the number of parsed bytes, it returns
+// early if parser errored, the connection is upgraded or got paused, in
+// which case it returns after the current line or body data is handled.
+// Empty data tells parser that EOF has been received.
+func (p *Parser) Execute(settings *Settings, data []byte) int {
+	if p.errno != OK {
+		return 0
+	}
+
+	if len(data) == 0 {
+		p.finish(settings)
+		return 0
+	}
+
+	i := 0
+	for i < len(data) {
+		switch p.state {
+		case stateDead, stateStart:
+			// Skip CRLF between messages
+			if data[i] == '\r' || data[i] == '\n' {
+				i++
+				continue
+			}
+
+			if p.state == stateDead && p.Lenient&LenientKeepAlive == 0 {
+				p.errno = ClosedConnection
+				return i
+			}
+
+			p.reset()
+			p.state = stateFirstLine
+			if !p.notify(settings.OnMessageBegin, CallbackMessageBegin) {
+				return i
+			}
+
+		case stateBodyIdentity, stateChunkData:
+			n := uint64(len(data) - i)
+			if n > p.remaining {
+				n = p.remaining
+			}
+			body := data[i : i+int(n)]
+			i += int(n)
+			p.remaining -= n
+
+			if p.remaining == 0 {
+				if p.state == stateChunkData {
+					p.state = stateChunkDataEnd
+				} else {
+					p.state = stateStart
+				}
+			}
+
+			if !p.notifyData(settings.OnBody, body, CallbackBody) {
+				return i
+			}
+
+			if p.remaining == 0 && p.state == stateStart && !p.messageComplete(settings) {
+				return i
+			}
+
+		case stateBodyIdentityEOF:
+			body := data[i:]
+			i = len(data)
+
+			if !p.notifyData(settings.OnBody, body, CallbackBody) {
+				return i
+			}
+
+		default:
+			line, n, ok := p.readLine(data[i:])
+			i += n
+			if !ok {
+				if p.errno != OK {
+					return i
+				}
+				continue
+			}
+
+			if !p.handleLine(settings, line) {
+				return i
+			}
+		}
+
+		if p.errno == Paused {
+			return i
+		}
+	}
+
+	return i
+}
+
+// finish handle EOF.
+func (p *Parser) finish(settings *Settings) {
+	switch p.state {
+	case stateBodyIdentityEOF:
+		p.messageComplete(settings)
+
+	case stateDead, stateStart:
+		return
+
+	default:
+		p.errno = InvalidEOFState
+	}
+}
+
+// readLine read a line terminated by LF, incomplete line is buffered.
+func (p *Parser) readLine(data []byte) (line []byte, n int, ok bool) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		n = len(data)
+	} else {
+		n = idx + 1
+	}
+
+	if p.state == stateFirstLine || p.state == stateHeaderLine || p.state == stateTrailerLine {
+		p.NRead += uint(n)
+		if p.NRead > MaxHeaderSize {
+			p.errno = HeaderOverflow
+			return nil, n, false
+		}
+	} else if len(p.line)+n > MaxHeaderSize {
+		p.errno = HeaderOverflow
+		return nil, n, false
+	}
+
+	if idx < 0 {
+		p.line = append(p.line, data...)
+		return nil, n, false
+	}
+
+	if len(p.line) > 0 {
+		p.line = append(p.line, data[:idx]...)
+		line = p.line
+		p.line = p.line[:0]
+	} else {
+		line = data[:idx]
+	}
+
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line, n, true
+}
+
+// handleLine handle a complete line, returns false if parser should stop.
+func (p *Parser) handleLine(settings *Settings, line []byte) bool {
+	switch p.state {
+	case stateFirstLine:
+		if p.Type == Request {
+			return p.parseRequestLine(settings, line)
+		}
+		return p.parseStatusLine(settings, line)
+
+	case stateHeaderLine, stateTrailerLine:
+		if len(line) == 0 {
+			if !p.flushHeader(settings) {
+				return false
+			}
+
+			if p.state == stateTrailerLine {
+				p.state = stateStart
+				return p.messageComplete(settings)
+			}
+			return p.headersComplete(settings)
+		}
+
+		// Obsolete line folding
+		if line[0] == ' ' || line[0] == '\t' {
+			if !p.hasPending {
+				if p.Lenient&LenientHeaders != 0 {
+					return true
+				}
+				p.errno = InvalidHeaderToken
+				return false
+			}
+
+			p.pendingValue = append(p.pendingValue, ' ')
+			p.pendingValue = append(p.pendingValue, bytes.TrimSpace(line)...)
+			return true
+		}
+
+		if !p.flushHeader(settings) {
+			return false
+		}
+
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isToken(line[:colon]) {
+			if p.Lenient&LenientHeaders != 0 {
+				return true
+			}
+			p.errno = InvalidHeaderToken
+			return false
+		}
+
+		p.hasPending = true
+		p.pendingField = append(p.pendingField[:0], line[:colon]...)
+		p.pendingValue = append(p.pendingValue[:0], bytes.TrimSpace(line[colon+1:])...)
+		return true
+
+	case stateChunkSize:
+		if semicolon := bytes.IndexByte(line, ';'); semicolon >= 0 {
+			line = line[:semicolon]
+		}
+		size, err := strconv.ParseUint(string(bytes.TrimSpace(line)), 16, 63)
+		if err != nil {
+			p.errno = InvalidChunkSize
+			return false
+		}
+
+		if size == 0 {
+			p.Trailing = true
+			p.state = stateTrailerLine
+		} else {
+			p.remaining = size
+			p.state = stateChunkData
+		}
+		return true
+
+	case stateChunkDataEnd:
+		if len(line) != 0 && p.Lenient&LenientHeaders == 0 {
+			p.errno = Strict
+			return false
+		}
+
+		p.state = stateChunkSize
+		return true
+	}
+
+	return true
+}
+
+func (p *Parser) parseVersion(version []byte) bool {
+	if len(version) != 8 || string(version[:5]) != "HTTP/" || version[6] != '.' ||
+		!isDigit(version[5]) || !isDigit(version[7]) {
+		p.errno = InvalidVersion
+		return false
+	}
+
+	p.HTTPMajor = uint16(version[5] - '0')
+	p.HTTPMinor = uint16(version[7] - '0')
+	return true
+}
+
+func (p *Parser) parseRequestLine(settings *Settings, line []byte) bool {
+	first := bytes.IndexByte(line, ' ')
+	last := bytes.LastIndexByte(line, ' ')
+	if first <= 0 || !isMethod(line[:first]) {
+		p.errno = InvalidMethod
+		return false
+	}
+	if last <= first+1 {
+		p.errno = InvalidURL
+		return false
+	}
+
+	url := line[first+1 : last]
+	if bytes.IndexByte(url, ' ') >= 0 && p.Lenient&LenientHeaders == 0 {
+		p.errno = InvalidURL
+		return false
+	}
+
+	if !p.parseVersion(line[last+1:]) {
+		return false
+	}
+
+	p.Method = string(line[:first])
+	p.state = stateHeaderLine
+	return p.notifyData(settings.OnURL, url, CallbackURL)
+}
+
+func (p *Parser) parseStatusLine(settings *Settings, line []byte) bool {
+	if len(line) < 12 || line[8] != ' ' {
+		if len(line) >= 8 && !p.parseVersion(line[:8]) {
+			return false
+		}
+		p.errno = InvalidStatus
+		return false
+	}
+
+	if !p.parseVersion(line[:8]) {
+		return false
+	}
+
+	if !isDigit(line[9]) || !isDigit(line[10]) || !isDigit(line[11]) ||
+		(len(line) > 12 && line[12] != ' ') {
+		p.errno = InvalidStatus
+		return false
+	}
+
+	p.StatusCode = uint16(line[9]-'0')*100 + uint16(line[10]-'0')*10 + uint16(line[11]-'0')
+	p.state = stateHeaderLine
+
+	var reason []byte
+	if len(line) > 13 {
+		reason = line[13:]
+	}
+	return p.notifyData(settings.OnStatus, reason, CallbackStatus)
+}
+
+// flushHeader report pending header after folded lines are joined.
+func (p *Parser) flushHeader(settings *Settings) bool {
+	if !p.hasPending {
+		return true
+	}
+	p.hasPending = false
+
+	if !p.Trailing && !p.checkHeader(p.pendingField, p.pendingValue) {
+		return false
+	}
+
+	if !p.notifyData(settings.OnHeaderField, p.pendingField, CallbackHeaderField) {
+		return false
+	}
+
+	return p.notifyData(settings.OnHeaderValue, p.pendingValue, CallbackHeaderValue)
+}
+
+// checkHeader check headers which affect message framing.
+func (p *Parser) checkHeader(field []byte, value []byte) bool {
+	switch {
+	case bytes.EqualFold(field, []byte("Content-Length")):
+		length, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil || length < 0 {
+			p.errno = InvalidContentLength
+			return false
+		}
+		if p.flags&flagContentLength != 0 && length != p.ContentLength {
+			p.errno = UnexpectedContentLength
+			return false
+		}
+		p.flags |= flagContentLength
+		p.ContentLength = length
+
+	case bytes.EqualFold(field, []byte("Transfer-Encoding")):
+		codings := bytes.Split(value, []byte(","))
+		if bytes.EqualFold(bytes.TrimSpace(codings[len(codings)-1]), []byte("chunked")) {
+			p.flags |= flagChunked
+		} else {
+			p.flags &^= flagChunked
+		}
+
+	case bytes.EqualFold(field, []byte("Connection")),
+		bytes.EqualFold(field, []byte("Proxy-Connection")):
+		for _, token := range bytes.Split(value, []byte(",")) {
+			token = bytes.TrimSpace(token)
+			switch {
+			case bytes.EqualFold(token, []byte("close")):
+				p.flags |= flagConnectionClose
+
+			case bytes.EqualFold(token, []byte("keep-alive")):
+				p.flags |= flagConnectionKeepAlive
+
+			case bytes.EqualFold(token, []byte("upgrade")):
+				p.flags |= flagConnectionUpgrade
+			}
+		}
+
+	case bytes.EqualFold(field, []byte("Upgrade")):
+		p.flags |= flagUpgrade
+	}
+
+	return true
+}
+
+func (p *Parser) headersComplete(settings *Settings) bool {
+	if p.flags&flagChunked != 0 && p.flags&flagContentLength != 0 {
+		if p.Lenient&LenientChunkedLength == 0 {
+			p.errno = UnexpectedContentLength
+			return false
+		}
+		p.flags &^= flagContentLength
+		p.ContentLength = -1
+	}
+
+	if p.Type == Request {
+		p.Upgrade = (p.flags&flagUpgrade != 0 && p.flags&flagConnectionUpgrade != 0) || p.Method == "CONNECT"
+	} else {
+		p.Upgrade = p.StatusCode == 101
+	}
+
+	if settings.OnHeadersComplete != nil {
+		switch settings.OnHeadersComplete(p) {
+		case 0:
+
+		case 1:
+			p.flags |= flagSkipBody
+
+		case 2:
+			p.flags |= flagSkipBody
+			p.Upgrade = true
+
+		default:
+			p.errno = CallbackHeadersComplete
+			return false
+		}
+	}
+
+	// Upgrade request may carry body before protocol is switched, only
+	// CONNECT request has no body.
+	switch {
+	case p.Upgrade && p.Method == "CONNECT", p.flags&flagSkipBody != 0, p.noBody():
+		p.state = stateStart
+		return p.messageComplete(settings)
+
+	case p.flags&flagChunked != 0:
+		p.state = stateChunkSize
+
+	case p.flags&flagContentLength != 0 && p.ContentLength > 0:
+		p.remaining = uint64(p.ContentLength)
+		p.state = stateBodyIdentity
+
+	case p.flags&flagContentLength != 0 || p.Type == Request:
+		p.state = stateStart
+		return p.messageComplete(settings)
+
+	default:
+		p.state = stateBodyIdentityEOF
+	}
+
+	return true
+}
+
+// messageComplete notify message complete, returns false if parser should
+// stop, which includes the connection is upgraded.
+func (p *Parser) messageComplete(settings *Settings) bool {
+	if !p.Upgrade && !p.ShouldKeepAlive() && p.state != stateBodyIdentityEOF {
+		p.state = stateDead
+	} else {
+		p.state = stateStart
+	}
+
+	if !p.notify(settings.OnMessageComplete, CallbackMessageComplete) {
+		return false
+	}
+
+	return !p.Upgrade
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isMethod(method []byte) bool {
+	for _, c := range method {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isToken check RFC 7230 token characters.
+func isToken(token []byte) bool {
+	for _, c := range token {
+		if c <= ' ' || c >= 0x7F {
+			return false
+		}
+
+		switch c {
+		case '(', ')', ',', '/', ':', ';', '<', '=', '>', '?', '@', '[', '\\', ']', '{', '}', '"':
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,296 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+type message struct {
+	method     string
+	url        string
+	statusCode uint16
+	headers    []string
+	trailers   []string
+	body       string
+}
+
+type recorder struct {
+	messages []*message
+	field    string
+}
+
+func (r *recorder) settings() *Settings {
+	return &Settings{
+		OnMessageBegin: func(p *Parser) int {
+			r.messages = append(r.messages, new(message))
+			return 0
+		},
+		OnURL: func(p *Parser, data []byte) int {
+			r.messages[len(r.messages)-1].url += string(data)
+			return 0
+		},
+		OnHeaderField: func(p *Parser, data []byte) int {
+			r.field = string(data)
+			return 0
+		},
+		OnHeaderValue: func(p *Parser, data []byte) int {
+			m := r.messages[len(r.messages)-1]
+			if p.Trailing {
+				m.trailers = append(m.trailers, r.field+"="+string(data))
+			} else {
+				m.headers = append(m.headers, r.field+"="+string(data))
+			}
+			return 0
+		},
+		OnHeadersComplete: func(p *Parser) int {
+			m := r.messages[len(r.messages)-1]
+			m.method = p.Method
+			m.statusCode = p.StatusCode
+			return 0
+		},
+		OnBody: func(p *Parser, data []byte) int {
+			r.messages[len(r.messages)-1].body += string(data)
+			return 0
+		},
+	}
+}
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      Type
+		lenient  Lenient
+		data     string
+		eof      bool
+		errno    Errno
+		messages []message
+	}{
+		{
+			name: "request with body",
+			typ:  Request,
+			data: "POST /a?b=c HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello",
+			messages: []message{
+				{method: "POST", url: "/a?b=c", headers: []string{"Host=test", "Content-Length=5"}, body: "hello"},
+			},
+		},
+		{
+			name: "chunked request with trailers",
+			typ:  Request,
+			data: "PUT /f HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n",
+			messages: []message{
+				{method: "PUT", url: "/f", headers: []string{"Transfer-Encoding=chunked"}, trailers: []string{"Checksum=abc"}, body: "hello world"},
+			},
+		},
+		{
+			name: "folded header",
+			typ:  Request,
+			data: "GET / HTTP/1.1\r\nX-Long: a\r\n  b\r\n\r\n",
+			messages: []message{
+				{method: "GET", url: "/", headers: []string{"X-Long=a b"}},
+			},
+		},
+		{
+			name: "response read until EOF",
+			typ:  Response,
+			data: "HTTP/1.0 200 OK\r\n\r\nbody until close",
+			eof:  true,
+			messages: []message{
+				{statusCode: 200, body: "body until close"},
+			},
+		},
+		{
+			name: "response with bare LF",
+			typ:  Response,
+			data: "HTTP/1.1 404 Not Found\nContent-Length: 2\n\nno",
+			messages: []message{
+				{statusCode: 404, headers: []string{"Content-Length=2"}, body: "no"},
+			},
+		},
+		{
+			name:  "conflicting content length",
+			typ:   Response,
+			data:  "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok",
+			errno: UnexpectedContentLength,
+		},
+		{
+			name:  "chunked with content length",
+			typ:   Request,
+			data:  "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			errno: UnexpectedContentLength,
+		},
+		{
+			name:    "lenient chunked with content length",
+			typ:     Request,
+			lenient: LenientChunkedLength,
+			data:    "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			messages: []message{
+				{method: "POST", url: "/", headers: []string{"Content-Length=3", "Transfer-Encoding=chunked"}, body: "ok"},
+			},
+		},
+		{
+			name:  "invalid header",
+			typ:   Request,
+			data:  "GET / HTTP/1.1\r\nBad Header\r\n\r\n",
+			errno: InvalidHeaderToken,
+		},
+		{
+			name:    "lenient invalid header",
+			typ:     Request,
+			lenient: LenientHeaders,
+			data:    "GET / HTTP/1.1\r\nBad Header\r\nHost: test\r\n\r\n",
+			messages: []message{
+				{method: "GET", url: "/", headers: []string{"Host=test"}},
+			},
+		},
+		{
+			name:  "data after connection close",
+			typ:   Request,
+			data:  "GET /1 HTTP/1.1\r\nConnection: close\r\n\r\nGET /2 HTTP/1.1\r\n\r\n",
+			errno: ClosedConnection,
+			messages: []message{
+				{method: "GET", url: "/1", headers: []string{"Connection=close"}},
+			},
+		},
+		{
+			name:    "lenient keep alive",
+			typ:     Request,
+			lenient: LenientKeepAlive,
+			data:    "GET /1 HTTP/1.1\r\nConnection: close\r\n\r\nGET /2 HTTP/1.1\r\n\r\n",
+			messages: []message{
+				{method: "GET", url: "/1", headers: []string{"Connection=close"}},
+				{method: "GET", url: "/2"},
+			},
+		},
+		{
+			name:  "invalid version",
+			typ:   Response,
+			data:  "HTTP/x.1 200 OK\r\n\r\n",
+			errno: InvalidVersion,
+		},
+		{
+			name:  "invalid chunk size",
+			typ:   Response,
+			data:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			errno: InvalidChunkSize,
+		},
+		{
+			name:  "header overflow",
+			typ:   Request,
+			data:  "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", MaxHeaderSize) + "\r\n\r\n",
+			errno: HeaderOverflow,
+		},
+	}
+
+	for _, test := range tests {
+		// Feed data at once and byte by byte
+		for _, step := range []int{len(test.data), 1} {
+			r := new(recorder)
+			p := &Parser{Lenient: test.lenient}
+			p.Init(test.typ)
+			settings := r.settings()
+
+			data := []byte(test.data)
+			for len(data) > 0 && p.Errno() == OK {
+				n := step
+				if n > len(data) {
+					n = len(data)
+				}
+				p.Execute(settings, data[:n])
+				data = data[n:]
+			}
+			if test.eof {
+				p.Execute(settings, nil)
+			}
+
+			if p.Errno() != test.errno {
+				t.Errorf("%s(step=%d): get errno %s, expected %s.", test.name, step, p.Errno(), test.errno)
+				continue
+			}
+			if test.errno != OK && test.messages == nil {
+				continue
+			}
+
+			if len(r.messages) != len(test.messages) {
+				t.Errorf("%s(step=%d): get %d messages, expected %d.", test.name, step, len(r.messages), len(test.messages))
+				continue
+			}
+			for i, expected := range test.messages {
+				m := r.messages[i]
+				if m.method != expected.method || m.url != expected.url || m.statusCode != expected.statusCode ||
+					strings.Join(m.headers, ",") != strings.Join(expected.headers, ",") ||
+					strings.Join(m.trailers, ",") != strings.Join(expected.trailers, ",") ||
+					m.body != expected.body {
+					t.Errorf("%s(step=%d): message %d is %+v, expected %+v.", test.name, step, i, *m, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestParserPause(t *testing.T) {
+	completed := 0
+	settings := &Settings{
+		OnMessageComplete: func(p *Parser) int {
+			completed++
+			p.Pause(true)
+			return 0
+		},
+	}
+
+	p := New(Response)
+	data := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 204 No Content\r\n\r\n")
+	first := p.Execute(settings, data)
+	if p.Errno() != Paused || completed != 1 || first != len("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na") {
+		t.Fatalf("Parser: pause after first message get errno %s, parsed %d.", p.Errno(), first)
+	}
+
+	if p.Execute(settings, data[first:]) != 0 {
+		t.Error("Parser: paused parser should not parse data.")
+	}
+
+	p.Pause(false)
+	second := p.Execute(settings, data[first:])
+	if p.Errno() != Paused || completed != 2 || first+second != len(data) {
+		t.Errorf("Parser: pause after second message get errno %s, parsed %d.", p.Errno(), second)
+	}
+}
+
+func TestParserUpgrade(t *testing.T) {
+	p := New(Request)
+	data := []byte("GET /ws HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n\x81\x00")
+	parsed := p.Execute(new(Settings), data)
+	if !p.Upgrade || parsed != len(data)-2 || p.Errno() != OK {
+		t.Errorf("Parser: upgrade request get upgrade=%t, parsed %d, errno %s.", p.Upgrade, parsed, p.Errno())
+	}
+}
+
+func TestParserUpgradeWithBody(t *testing.T) {
+	tests := []string{
+		"POST /h2 HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nContent-Length: 4\r\n\r\nbody",
+		"POST /h2 HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+	}
+
+	for _, test := range tests {
+		var body []byte
+		var completed bool
+		settings := &Settings{
+			OnBody: func(p *Parser, data []byte) int {
+				body = append(body, data...)
+				return 0
+			},
+			OnMessageComplete: func(p *Parser) int {
+				completed = true
+				return 0
+			},
+		}
+
+		p := New(Request)
+		data := []byte(test + "PRI * HTTP/2.0\r\n")
+		parsed := p.Execute(settings, data)
+		if !p.Upgrade || !completed || string(body) != "body" || parsed != len(test) || p.Errno() != OK {
+			t.Errorf("Parser: upgrade request with body get upgrade=%t, body %q, parsed %d, errno %s.",
+				p.Upgrade, body, parsed, p.Errno())
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/http2"
+	"github.com/zhengyuli/ntrace/proto/analyzer/websocket"
+	"strings"
+	"time"
+)
+
+// upgradedAnalyzer analyzer of protocol switched from HTTP/1.1 by upgrade.
+type upgradedAnalyzer interface {
+	HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{})
+	HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{})
+	HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{})
+}
+
+// sessionBreakdownQueue optional interface of upgraded analyzer which may
+// generate more than one session breakdown by one call.
+type sessionBreakdownQueue interface {
+	PopSessionBreakdown() (sessionBreakdown interface{})
+}
+
+// headerValue get value of the first header by case-insensitive name.
+func headerValue(headers []header, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+
+	return ""
+}
+
+// newUpgradedAnalyzer create analyzer of protocol switched by session,
+// returns nil if protocol is not supported.
+func newUpgradedAnalyzer(s *session) upgradedAnalyzer {
+	switch strings.ToLower(strings.TrimSpace(headerValue(s.respHeaders, "Upgrade"))) {
+	case "h2c":
+		a := new(http2.Analyzer)
+		a.Init()
+		a.HandleUpgrade(s.reqMethod, s.reqURI, s.reqTime)
+
+		return a
+
+	case "websocket":
+		a := new(websocket.Analyzer)
+		a.Init()
+		a.HandleUpgrade(s.respBeginTime)
+
+		return a
+
+	default:
+		return nil
+	}
+}
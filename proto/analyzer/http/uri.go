@@ -0,0 +1,212 @@
+package http
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+)
+
+// Query normalize mode.
+const (
+	queryKeep  = "keep"
+	queryStrip = "strip"
+	queryHash  = "hash"
+)
+
+// uriQueryMode how to normalize query values, "strip" replaces values with
+// "*", "hash" replaces values with hash and "keep" keeps values unchanged,
+// default is "strip", it can be changed by HTTP_URI_QUERY_MODE env.
+var uriQueryMode = queryStrip
+
+// routeTemplates user supplied route templates like "/users/{id}", it can
+// be set by comma separated HTTP_ROUTE_TEMPLATES env.
+var routeTemplates [][]string
+
+func init() {
+	switch mode := strings.ToLower(os.Getenv("HTTP_URI_QUERY_MODE")); mode {
+	case queryKeep, queryStrip, queryHash:
+		uriQueryMode = mode
+	}
+
+	if templates := os.Getenv("HTTP_ROUTE_TEMPLATES"); templates != "" {
+		setRouteTemplates(strings.Split(templates, ","))
+	}
+}
+
+// setRouteTemplates set route templates, templates are matched in order.
+func setRouteTemplates(templates []string) {
+	routeTemplates = nil
+	for _, template := range templates {
+		if template = strings.TrimSpace(template); template != "" {
+			routeTemplates = append(routeTemplates, strings.Split(template, "/"))
+		}
+	}
+}
+
+// normalizeURI split request URI into templated route and normalized query.
+func normalizeURI(uri string) (route string, query string) {
+	// Authority form of CONNECT and asterisk form of OPTIONS
+	if uri == "*" || (uri != "" && !strings.HasPrefix(uri, "/") && !strings.Contains(uri, "://")) {
+		return uri, ""
+	}
+
+	// Absolute form, skip scheme and authority
+	if i := strings.Index(uri, "://"); i >= 0 {
+		uri = uri[i+3:]
+		if j := strings.IndexAny(uri, "/?"); j >= 0 {
+			uri = uri[j:]
+		} else {
+			uri = ""
+		}
+	}
+
+	if i := strings.IndexByte(uri, '#'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	path := uri
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		path = uri[:i]
+		query = normalizeQuery(uri[i+1:])
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	return templatePath(path), query
+}
+
+// normalizeQuery normalize query values by uriQueryMode.
+func normalizeQuery(query string) string {
+	if uriQueryMode == queryKeep || query == "" {
+		return query
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		// Parameter without value is kept as flag
+		j := strings.IndexByte(param, '=')
+		if j < 0 {
+			continue
+		}
+		key, value := param[:j], param[j+1:]
+
+		if uriQueryMode == queryHash {
+			h := fnv.New32a()
+			h.Write([]byte(value))
+			params[i] = fmt.Sprintf("%s=%08x", key, h.Sum32())
+		} else {
+			params[i] = key + "=*"
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// templatePath match path with route templates, if none is matched, path
+// segments of number, UUID and hex string are collapsed into placeholders.
+func templatePath(path string) string {
+	segments := strings.Split(path, "/")
+
+	for _, template := range routeTemplates {
+		if matchRouteTemplate(template, segments) {
+			return strings.Join(template, "/")
+		}
+	}
+
+	for i, segment := range segments {
+		switch {
+		case isNumber(segment):
+			segments[i] = "{num}"
+
+		case isUUID(segment):
+			segments[i] = "{uuid}"
+
+		case isHex(segment):
+			segments[i] = "{hex}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// matchRouteTemplate return true if path segments match template, template
+// segment like "{id}" matches any non empty segment.
+func matchRouteTemplate(template []string, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if t != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+
+		default:
+			if !isHexDigit(s[i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isHex return true if s is hex string with at least 8 chars and digits,
+// which is usually object id or hash.
+func isHex(s string) bool {
+	if len(s) < 8 {
+		return false
+	}
+
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		if !isHexDigit(s[i]) {
+			return false
+		}
+		if s[i] <= '9' {
+			digits++
+		}
+	}
+
+	return digits > 0
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"testing"
+)
+
+func TestNormalizeURI(t *testing.T) {
+	defer func(mode string, templates [][]string) {
+		uriQueryMode, routeTemplates = mode, templates
+	}(uriQueryMode, routeTemplates)
+	setRouteTemplates([]string{"/users/{id}/orders/{order}"})
+
+	tests := []struct {
+		mode  string
+		uri   string
+		route string
+		query string
+	}{
+		{queryStrip, "/users/123", "/users/{num}", ""},
+		{queryStrip, "/users/123/orders/abc", "/users/{id}/orders/{order}", ""},
+		{queryStrip, "/items/550e8400-e29b-41d4-a716-446655440000?page=2&sort", "/items/{uuid}", "page=*&sort"},
+		{queryStrip, "/blobs/5f2b9c0e1a/raw#top", "/blobs/{hex}/raw", ""},
+		{queryStrip, "/static/deadbeef.js", "/static/deadbeef.js", ""},
+		{queryStrip, "http://example.com/a/42?x=1", "/a/{num}", "x=*"},
+		{queryStrip, "http://example.com", "/", ""},
+		{queryStrip, "example.com:443", "example.com:443", ""},
+		{queryStrip, "*", "*", ""},
+		{queryKeep, "/search?q=ntrace", "/search", "q=ntrace"},
+		{queryHash, "/search?q=", "/search", "q=811c9dc5"},
+	}
+
+	for _, test := range tests {
+		uriQueryMode = test.mode
+		route, query := normalizeURI(test.uri)
+		if route != test.route || query != test.query {
+			t.Errorf("Normalize URI: %s get route %q and query %q, expected %q and %q.",
+				test.uri, route, query, test.route, test.query)
+		}
+	}
+}
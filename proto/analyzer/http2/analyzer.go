@@ -0,0 +1,660 @@
+package http2
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2/hpack"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	sessionInit sessionState = iota
+	requestHeaderComplete
+	requestBodyBegin
+	requestComplete
+	responseHeaderComplete
+	responseBodyBegin
+	responseComplete
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionInit:
+		return "HTTP2SessionInit"
+
+	case requestHeaderComplete:
+		return "HTTP2RequestHeaderComplete"
+
+	case requestBodyBegin:
+		return "HTTP2RequestBodyBegin"
+
+	case requestComplete:
+		return "HTTP2RequestComplete"
+
+	case responseHeaderComplete:
+		return "HTTP2ResponseHeaderComplete"
+
+	case responseBodyBegin:
+		return "HTTP2ResponseBodyBegin"
+
+	case responseComplete:
+		return "HTTP2ResponseComplete"
+
+	default:
+		return "InvalidHTTP2SessionState"
+	}
+}
+
+// defaultHeaderTableSize default HPACK dynamic table size.
+const defaultHeaderTableSize = 4096
+
+// session HTTP/2 stream, each stream is a request and response exchange.
+type session struct {
+	streamID         uint32
+	resetFlag        bool
+	state            sessionState
+	pushed           bool
+	reqHeaders       []hpack.HeaderField
+	reqHeaderBytes   uint
+	reqBodyBytes     uint
+	reqEnd           bool
+	respHeaders      []hpack.HeaderField
+	respTrailers     []hpack.HeaderField
+	statusCode       uint16
+	respHeaderBytes  uint
+	respBodyBytes    uint
+	respEnd          bool
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+	rstStreamErrCode *ErrCode
+	goAwayErrCode    *ErrCode
+	grpc             *grpcCall
+}
+
+func headerValue(headers []hpack.HeaderField, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+
+	return ""
+}
+
+func (s *session) session2Breakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.StreamID = s.streamID
+	sb.Pushed = s.pushed
+	sb.ReqMethod = headerValue(s.reqHeaders, ":method")
+	sb.ReqScheme = headerValue(s.reqHeaders, ":scheme")
+	sb.ReqAuthority = headerValue(s.reqHeaders, ":authority")
+	sb.ReqPath = headerValue(s.reqHeaders, ":path")
+	sb.ReqHeaderBytes = s.reqHeaderBytes
+	sb.ReqBodyBytes = s.reqBodyBytes
+
+	sb.StatusCode = s.statusCode
+	sb.RespHeaderBytes = s.respHeaderBytes
+	sb.RespBodyBytes = s.respBodyBytes
+
+	if s.rstStreamErrCode != nil {
+		sb.RSTStreamErrorCode = s.rstStreamErrCode.String()
+	}
+	if s.goAwayErrCode != nil {
+		sb.GoAwayErrorCode = s.goAwayErrCode.String()
+	}
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	if s.grpc != nil {
+		s.grpc.breakdown(sb)
+	}
+
+	return sb
+}
+
+// SessionBreakdown HTTP/2 analyzer session breakdown of one stream.
+type SessionBreakdown struct {
+	SessionState       string  `json:"http2_session_state"`
+	StreamID           uint32  `json:"http2_stream_id"`
+	Pushed             bool    `json:"http2_server_push,omitempty"`
+	ReqMethod          string  `json:"http2_request_method"`
+	ReqScheme          string  `json:"http2_request_scheme"`
+	ReqAuthority       string  `json:"http2_request_authority"`
+	ReqPath            string  `json:"http2_request_path"`
+	ReqHeaderBytes     uint    `json:"http2_request_header_bytes"`
+	ReqBodyBytes       uint    `json:"http2_request_body_bytes"`
+	StatusCode         uint16  `json:"http2_response_status_code"`
+	RespHeaderBytes    uint    `json:"http2_response_header_bytes"`
+	RespBodyBytes      uint    `json:"http2_response_body_bytes"`
+	ServerLatency      uint    `json:"http2_server_latency"`
+	DownloadLatency    uint    `json:"http2_download_latency"`
+	RSTStreamErrorCode string  `json:"http2_rst_stream_error_code,omitempty"`
+	GoAwayErrorCode    string  `json:"http2_goaway_error_code,omitempty"`
+	GRPCService        string  `json:"http2_grpc_service,omitempty"`
+	GRPCMethod         string  `json:"http2_grpc_method,omitempty"`
+	GRPCCallType       string  `json:"http2_grpc_call_type,omitempty"`
+	GRPCStatus         *uint32 `json:"http2_grpc_status,omitempty"`
+	GRPCStatusName     string  `json:"http2_grpc_status_name,omitempty"`
+	GRPCMessage        string  `json:"http2_grpc_message,omitempty"`
+	GRPCReqMessages    uint    `json:"http2_grpc_request_messages,omitempty"`
+	GRPCRespMessages   uint    `json:"http2_grpc_response_messages,omitempty"`
+}
+
+// ApplicationStatusCode get HTTP2 status code of session breakdown.
+func (sb *SessionBreakdown) ApplicationStatusCode() uint16 {
+	return sb.StatusCode
+}
+
+// ApplicationLatency get HTTP2 latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction, each direction has its own HPACK
+// dynamic table.
+type halfConn struct {
+	fromClient  bool
+	prefaceDone bool
+	decoder     *hpack.Decoder
+
+	// Header block split into HEADERS/PUSH_PROMISE and CONTINUATION frames
+	headerBlock         []byte
+	headerFrameStreamID uint32
+	headerStreamID      uint32
+	headerEndStream     bool
+	headerPushed        bool
+	headerBytes         uint
+
+	// DATA frame is consumed as it arrives since it could be large
+	dataStreamID   uint32
+	dataRemaining  uint32
+	padRemaining   uint32
+	dataEndStream  bool
+	dataInProgress bool
+}
+
+func (hc *halfConn) init(fromClient bool) {
+	hc.fromClient = fromClient
+	hc.prefaceDone = !fromClient
+	hc.decoder = hpack.NewDecoder(defaultHeaderTableSize, nil)
+	hc.headerBlock = nil
+	hc.dataInProgress = false
+}
+
+// Analyzer HTTP/2 analyzer.
+type Analyzer struct {
+	timestamp  time.Time
+	client     halfConn
+	server     halfConn
+	sessions   map[uint32]*session
+	completed  list.List
+	goAwayCode *ErrCode
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init HTTP/2 analyzer init function.
+func (a *Analyzer) Init() {
+	a.client.init(true)
+	a.server.init(false)
+	a.sessions = make(map[uint32]*session)
+	a.completed.Init()
+	a.goAwayCode = nil
+	a.broken = false
+}
+
+// HandleUpgrade init HTTP/2 analyzer for connection upgraded from HTTP/1.1
+// by "Upgrade: h2c", the upgrade request becomes stream 1 which is half
+// closed by client.
+func (a *Analyzer) HandleUpgrade(method string, uri string, reqTime time.Time) {
+	a.sessions[1] = &session{
+		streamID: 1,
+		state:    requestComplete,
+		reqHeaders: []hpack.HeaderField{
+			{Name: ":method", Value: method},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: uri},
+		},
+		reqEnd:  true,
+		reqTime: reqTime,
+	}
+}
+
+func (a *Analyzer) getSession(streamID uint32) *session {
+	s := a.sessions[streamID]
+	if s == nil {
+		s = &session{streamID: streamID, goAwayErrCode: a.goAwayCode}
+		a.sessions[streamID] = s
+	}
+
+	return s
+}
+
+// completeSession move session to completed list.
+func (a *Analyzer) completeSession(s *session) {
+	delete(a.sessions, s.streamID)
+	if s.goAwayErrCode == nil {
+		s.goAwayErrCode = a.goAwayCode
+	}
+	a.completed.PushBack(s)
+}
+
+func (a *Analyzer) onHeaders(hc *halfConn) {
+	fields, err := hc.decoder.DecodeFull(hc.headerBlock)
+	if err != nil {
+		log.Errorf("HTTP2 Analyzer: decode header block of stream %d error: %s.", hc.headerStreamID, err)
+		a.broken = true
+		return
+	}
+
+	s := a.getSession(hc.headerStreamID)
+	if hc.fromClient {
+		if s.reqHeaders == nil {
+			s.reqHeaders = fields
+			s.reqTime = a.timestamp
+			s.state = requestHeaderComplete
+			if isGRPC(headerValue(fields, "content-type")) {
+				s.grpc = newGRPCCall(headerValue(fields, ":path"))
+			}
+		}
+		s.reqHeaderBytes += hc.headerBytes
+		if hc.headerEndStream {
+			s.reqEnd = true
+			s.state = requestComplete
+		}
+		return
+	}
+
+	// Promised request is sent by server in PUSH_PROMISE
+	if hc.headerPushed {
+		s.pushed = true
+		s.reqHeaders = fields
+		s.reqHeaderBytes = hc.headerBytes
+		s.reqEnd = true
+		s.reqTime = a.timestamp
+		s.state = requestComplete
+		return
+	}
+
+	s.respHeaderBytes += hc.headerBytes
+	if s.statusCode == 0 || s.statusCode/100 == 1 {
+		status, _ := strconv.ParseUint(headerValue(fields, ":status"), 10, 16)
+		s.statusCode = uint16(status)
+
+		// Interim response, the final response will follow
+		if s.statusCode/100 != 1 {
+			s.respHeaders = fields
+			s.respBeginTime = a.timestamp
+			s.state = responseHeaderComplete
+		}
+	} else {
+		s.respTrailers = fields
+	}
+
+	// Trailers-only response carries status in headers
+	if s.grpc != nil && hc.headerEndStream {
+		s.grpc.onTrailers(fields)
+	}
+
+	if hc.headerEndStream {
+		a.onRespEnd(s)
+	}
+}
+
+func (a *Analyzer) onRespEnd(s *session) {
+	s.respEnd = true
+	s.state = responseComplete
+	s.respCompleteTime = a.timestamp
+	if s.respBeginTime.IsZero() {
+		s.respBeginTime = a.timestamp
+	}
+	a.completeSession(s)
+}
+
+func (a *Analyzer) onData(hc *halfConn, streamID uint32, data []byte) {
+	s := a.sessions[streamID]
+	if s == nil {
+		return
+	}
+
+	if s.grpc != nil {
+		s.grpc.onData(hc.fromClient, data)
+	}
+
+	if hc.fromClient {
+		s.reqBodyBytes += uint(len(data))
+		if s.state == requestHeaderComplete {
+			s.state = requestBodyBegin
+		}
+	} else {
+		s.respBodyBytes += uint(len(data))
+		if s.state == responseHeaderComplete {
+			s.state = responseBodyBegin
+		}
+	}
+}
+
+func (a *Analyzer) onDataEnd(hc *halfConn, streamID uint32) {
+	s := a.sessions[streamID]
+	if s == nil {
+		return
+	}
+
+	if hc.fromClient {
+		s.reqEnd = true
+		s.state = requestComplete
+	} else {
+		a.onRespEnd(s)
+	}
+}
+
+func (a *Analyzer) onRSTStream(streamID uint32, errCode ErrCode) {
+	if s := a.sessions[streamID]; s != nil {
+		s.resetFlag = true
+		s.rstStreamErrCode = &errCode
+		a.completeSession(s)
+	}
+}
+
+func (a *Analyzer) onGoAway(lastStreamID uint32, errCode ErrCode) {
+	a.goAwayCode = &errCode
+
+	// Streams after last stream are not processed by peer
+	for streamID, s := range a.sessions {
+		if streamID > lastStreamID {
+			s.resetFlag = true
+			a.completeSession(s)
+		}
+	}
+}
+
+// parseData consume payload of DATA frame in progress.
+func (a *Analyzer) parseData(hc *halfConn, payload []byte) (parseBytes int) {
+	if hc.dataRemaining > 0 {
+		n := uint32(len(payload))
+		if n > hc.dataRemaining {
+			n = hc.dataRemaining
+		}
+		a.onData(hc, hc.dataStreamID, payload[:n])
+		hc.dataRemaining -= n
+		parseBytes = int(n)
+		payload = payload[n:]
+	}
+
+	if hc.dataRemaining == 0 {
+		n := uint32(len(payload))
+		if n > hc.padRemaining {
+			n = hc.padRemaining
+		}
+		hc.padRemaining -= n
+		parseBytes += int(n)
+
+		if hc.padRemaining == 0 {
+			hc.dataInProgress = false
+			if hc.dataEndStream {
+				a.onDataEnd(hc, hc.dataStreamID)
+			}
+		}
+	}
+
+	return parseBytes
+}
+
+// parseFrame parse one frame, returns 0 if frame is not complete.
+func (a *Analyzer) parseFrame(hc *halfConn, payload []byte) (parseBytes int) {
+	if hc.dataInProgress {
+		return a.parseData(hc, payload)
+	}
+
+	if len(payload) < frameHeaderLen {
+		return 0
+	}
+	fh := parseFrameHeader(payload)
+
+	// Consume DATA frame without waiting for the whole frame
+	if fh.typ == frameData {
+		headerLen := frameHeaderLen
+		var padLen uint32
+		if fh.flags&flagPadded != 0 {
+			if len(payload) < frameHeaderLen+1 {
+				return 0
+			}
+			padLen = uint32(payload[frameHeaderLen])
+			headerLen++
+		}
+		if padLen+uint32(headerLen-frameHeaderLen) > fh.length {
+			log.Errorf("HTTP2 Analyzer: invalid padding of DATA frame on stream %d.", fh.streamID)
+			a.broken = true
+			return len(payload)
+		}
+
+		hc.dataInProgress = true
+		hc.dataStreamID = fh.streamID
+		hc.dataRemaining = fh.length - uint32(headerLen-frameHeaderLen) - padLen
+		hc.padRemaining = padLen
+		hc.dataEndStream = fh.flags&flagEndStream != 0
+
+		return headerLen + a.parseData(hc, payload[headerLen:])
+	}
+
+	if len(payload) < frameHeaderLen+int(fh.length) {
+		return 0
+	}
+	framePayload := payload[frameHeaderLen : frameHeaderLen+int(fh.length)]
+	parseBytes = frameHeaderLen + int(fh.length)
+
+	// Header block must be continued by CONTINUATION frames
+	if hc.headerBlock != nil && fh.typ != frameContinuation {
+		log.Errorf("HTTP2 Analyzer: get %s frame while header block of stream %d is not complete.", fh.typ, hc.headerStreamID)
+		a.broken = true
+		return parseBytes
+	}
+
+	switch fh.typ {
+	case frameHeaders, framePushPromise:
+		fragment, ok := trimPadding(framePayload, fh.flags)
+		if !ok {
+			log.Errorf("HTTP2 Analyzer: invalid padding of %s frame on stream %d.", fh.typ, fh.streamID)
+			a.broken = true
+			return parseBytes
+		}
+
+		hc.headerFrameStreamID = fh.streamID
+		hc.headerStreamID = fh.streamID
+		hc.headerEndStream = fh.flags&flagEndStream != 0
+		hc.headerPushed = false
+		hc.headerBytes = uint(len(fragment))
+
+		if fh.typ == frameHeaders && fh.flags&flagPriority != 0 {
+			if len(fragment) < 5 {
+				a.broken = true
+				return parseBytes
+			}
+			fragment = fragment[5:]
+		}
+		if fh.typ == framePushPromise {
+			if len(fragment) < 4 {
+				a.broken = true
+				return parseBytes
+			}
+			hc.headerStreamID = readUint32(fragment) & 0x7fffffff
+			hc.headerEndStream = false
+			hc.headerPushed = true
+			fragment = fragment[4:]
+		}
+
+		hc.headerBlock = append(make([]byte, 0, len(fragment)), fragment...)
+		if fh.flags&flagEndHeaders != 0 {
+			a.onHeaders(hc)
+			hc.headerBlock = nil
+		}
+
+	case frameContinuation:
+		if hc.headerBlock == nil || fh.streamID != hc.headerFrameStreamID {
+			log.Errorf("HTTP2 Analyzer: unexpected CONTINUATION frame on stream %d.", fh.streamID)
+			a.broken = true
+			return parseBytes
+		}
+
+		hc.headerBlock = append(hc.headerBlock, framePayload...)
+		hc.headerBytes += uint(len(framePayload))
+		if fh.flags&flagEndHeaders != 0 {
+			a.onHeaders(hc)
+			hc.headerBlock = nil
+		}
+
+	case frameRSTStream:
+		if len(framePayload) == 4 {
+			a.onRSTStream(fh.streamID, ErrCode(readUint32(framePayload)))
+		}
+
+	case frameSettings:
+		if fh.flags&flagAck != 0 {
+			break
+		}
+
+		// Header table size limits the encoder of peer
+		peer := &a.server
+		if !hc.fromClient {
+			peer = &a.client
+		}
+		for i := 0; i+6 <= len(framePayload); i += 6 {
+			id := uint16(framePayload[i])<<8 | uint16(framePayload[i+1])
+			if id == settingHeaderTableSize {
+				peer.decoder.SetAllowedMaxDynamicTableSize(readUint32(framePayload[i+2:]))
+			}
+		}
+
+	case frameGoAway:
+		if len(framePayload) >= 8 {
+			a.onGoAway(readUint32(framePayload)&0x7fffffff, ErrCode(readUint32(framePayload[4:])))
+		}
+	}
+
+	return parseBytes
+}
+
+// HandleEstb HTTP/2 analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("HTTP2 Analyzer: HandleEstb.")
+}
+
+// HandleData HTTP/2 analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	if !hc.prefaceDone {
+		if len(payload) < len(ClientPreface) {
+			if string(payload) != ClientPreface[:len(payload)] {
+				log.Error("HTTP2 Analyzer: invalid client connection preface.")
+				a.broken = true
+			}
+			if !a.broken {
+				return 0, nil
+			}
+		} else if string(payload[:len(ClientPreface)]) != ClientPreface {
+			log.Error("HTTP2 Analyzer: invalid client connection preface.")
+			a.broken = true
+		} else {
+			hc.prefaceDone = true
+			parsed = len(ClientPreface)
+		}
+	}
+
+	for !a.broken {
+		n := a.parseFrame(hc, payload[parsed:])
+		parsed += n
+
+		if a.completed.Len() > 0 {
+			return uint(parsed), a.PopSessionBreakdown()
+		}
+		if n == 0 {
+			return uint(parsed), nil
+		}
+	}
+
+	return uint(len(payload)), nil
+}
+
+// closeSessions complete all open sessions in stream ID order on connection
+// termination, sessions without response end are marked as reset if reset
+// is true.
+func (a *Analyzer) closeSessions(reset bool) {
+	streamIDs := make([]uint32, 0, len(a.sessions))
+	for streamID := range a.sessions {
+		streamIDs = append(streamIDs, streamID)
+	}
+	sort.Slice(streamIDs, func(i, j int) bool { return streamIDs[i] < streamIDs[j] })
+
+	for _, streamID := range streamIDs {
+		s := a.sessions[streamID]
+		if reset && !s.respEnd && s.rstStreamErrCode == nil {
+			s.resetFlag = true
+		}
+		a.completeSession(s)
+	}
+}
+
+// PopSessionBreakdown HTTP/2 analyzer pop session breakdown function, streams
+// completed by the same frame or on connection termination are returned one
+// by one.
+func (a *Analyzer) PopSessionBreakdown() (sessionBreakdown interface{}) {
+	if front := a.completed.Front(); front != nil {
+		a.completed.Remove(front)
+		return front.Value.(*session).session2Breakdown()
+	}
+
+	return nil
+}
+
+// HandleReset HTTP/2 analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("HTTP2 Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("HTTP2 Analyzer: HandleReset from server.")
+	}
+
+	a.closeSessions(true)
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin HTTP/2 analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("HTTP2 Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("HTTP2 Analyzer: HandleFin from server.")
+	}
+
+	// Server may still respond after client closes, open streams are
+	// complete only when server closes.
+	if !fromClient {
+		a.closeSessions(false)
+	}
+
+	return a.PopSessionBreakdown()
+}
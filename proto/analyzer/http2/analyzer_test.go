@@ -0,0 +1,187 @@
+package http2
+
+import (
+	"bytes"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"golang.org/x/net/http2/hpack"
+	"strings"
+	"testing"
+	"time"
+)
+
+// framer build frames of one direction with its own HPACK encoder.
+type framer struct {
+	buf     bytes.Buffer
+	encoder *hpack.Encoder
+}
+
+func newFramer() *framer {
+	f := new(framer)
+	f.encoder = hpack.NewEncoder(&f.buf)
+	return f
+}
+
+func frame(typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	header := []byte{
+		byte(length >> 16), byte(length >> 8), byte(length),
+		byte(typ), flags,
+		byte(streamID >> 24), byte(streamID >> 16), byte(streamID >> 8), byte(streamID),
+	}
+	return append(header, payload...)
+}
+
+func (f *framer) headerBlock(fields ...string) []byte {
+	f.buf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		f.encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), f.buf.Bytes()...)
+}
+
+func (f *framer) headers(streamID uint32, endStream bool, fields ...string) []byte {
+	flags := flagEndHeaders
+	if endStream {
+		flags |= flagEndStream
+	}
+	return frame(frameHeaders, flags, streamID, f.headerBlock(fields...))
+}
+
+func data(streamID uint32, endStream bool, payload string) []byte {
+	var flags uint8
+	if endStream {
+		flags = flagEndStream
+	}
+	return frame(frameData, flags, streamID, []byte(payload))
+}
+
+func errCodeFrame(typ frameType, streamID uint32, payload ...uint32) []byte {
+	var buf []byte
+	for _, v := range payload {
+		buf = append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return frame(typ, 0, streamID, buf)
+}
+
+// run replay steps and collect HTTP2 session breakdowns.
+func run(a *Analyzer, steps []analyzertest.Step, split bool) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Replay(a, steps, split, time.Now()) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	client, server := newFramer(), newFramer()
+
+	var steps []analyzertest.Step
+	add := func(fromClient bool, frames ...[]byte) {
+		steps = append(steps, analyzertest.Step{FromClient: fromClient, Data: string(bytes.Join(frames, nil))})
+	}
+
+	add(true, []byte(ClientPreface), frame(frameSettings, 0, 0, nil))
+	add(false, frame(frameSettings, 0, 0, []byte{0, settingHeaderTableSize, 0, 0, 0x10, 0}))
+
+	// Two concurrent requests, responses are interleaved
+	add(true,
+		client.headers(1, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/a"),
+		client.headers(3, false, ":method", "POST", ":scheme", "http", ":authority", "svc", ":path", "/b"),
+		data(3, false, "hello"),
+		frame(frameData, flagPadded|flagEndStream, 3, []byte("\x02ok\x00\x00")))
+	add(false,
+		server.headers(3, false, ":status", "100"),
+		server.headers(3, false, ":status", "201"),
+		server.headers(1, false, ":status", "200", "content-type", "text/plain"),
+		data(1, false, "body-1"),
+		data(3, false, "created"),
+		server.headers(3, true, "x-trailer", "done"),
+		data(1, true, ""))
+
+	// Header block split into CONTINUATION frame with dynamic table entries
+	block := client.headerBlock(":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/a")
+	add(true,
+		frame(frameHeaders, flagEndStream, 5, block[:2]),
+		frame(frameContinuation, flagEndHeaders, 5, block[2:]))
+	add(false, server.headers(5, true, ":status", "404"))
+
+	// Stream reset by client and connection closed by server
+	add(true,
+		client.headers(7, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/slow"),
+		errCodeFrame(frameRSTStream, 7, uint32(ErrCodeCancel)),
+		client.headers(9, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/late"))
+	add(false, errCodeFrame(frameGoAway, 0, 7, uint32(ErrCodeEnhanceYourCalm)))
+
+	expected := []SessionBreakdown{
+		{SessionState: "HTTP2ResponseComplete", StreamID: 3, ReqMethod: "POST", ReqPath: "/b", ReqBodyBytes: 7, StatusCode: 201, RespBodyBytes: 7},
+		{SessionState: "HTTP2ResponseComplete", StreamID: 1, ReqMethod: "GET", ReqPath: "/a", StatusCode: 200, RespBodyBytes: 6},
+		{SessionState: "HTTP2ResponseComplete", StreamID: 5, ReqMethod: "GET", ReqPath: "/a", StatusCode: 404},
+		{SessionState: "Reset:HTTP2RequestComplete", StreamID: 7, ReqMethod: "GET", ReqPath: "/slow", RSTStreamErrorCode: "CANCEL"},
+		{SessionState: "Reset:HTTP2RequestComplete", StreamID: 9, ReqMethod: "GET", ReqPath: "/late", GoAwayErrorCode: "ENHANCE_YOUR_CALM"},
+	}
+
+	for _, split := range []bool{false, true} {
+		a := new(Analyzer)
+		a.Init()
+
+		// Encoders are stateful, so each run uses the same frames
+		breakdowns := run(a, steps, split)
+		if len(breakdowns) != len(expected) {
+			t.Errorf("HTTP2 Analyzer(split=%t): get %d session breakdowns, expected %d.", split, len(breakdowns), len(expected))
+			continue
+		}
+
+		for i, e := range expected {
+			sb := breakdowns[i]
+			if sb.SessionState != e.SessionState || sb.StreamID != e.StreamID ||
+				sb.ReqMethod != e.ReqMethod || sb.ReqPath != e.ReqPath ||
+				sb.ReqBodyBytes != e.ReqBodyBytes || sb.StatusCode != e.StatusCode ||
+				sb.RespBodyBytes != e.RespBodyBytes ||
+				sb.RSTStreamErrorCode != e.RSTStreamErrorCode || sb.GoAwayErrorCode != e.GoAwayErrorCode {
+				t.Errorf("HTTP2 Analyzer(split=%t): session breakdown %d is %+v, expected %+v.", split, i, *sb, e)
+			}
+		}
+	}
+}
+
+func TestAnalyzerConnectionClose(t *testing.T) {
+	for _, reset := range []bool{true, false} {
+		client, server := newFramer(), newFramer()
+		a := new(Analyzer)
+		a.Init()
+
+		breakdowns := run(a, []analyzertest.Step{
+			analyzertest.FromClientBytes(bytes.Join([][]byte{
+				[]byte(ClientPreface),
+				client.headers(1, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/a"),
+				client.headers(3, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/b"),
+				client.headers(5, true, ":method", "GET", ":scheme", "http", ":authority", "svc", ":path", "/c"),
+			}, nil)),
+			analyzertest.FromServerBytes(server.headers(3, false, ":status", "200")),
+		}, false)
+		if len(breakdowns) != 0 {
+			t.Fatalf("HTTP2 Analyzer(reset=%t): get %d session breakdowns before close.", reset, len(breakdowns))
+		}
+
+		var sb interface{}
+		if reset {
+			sb = a.HandleReset(false, time.Now())
+		} else {
+			sb = a.HandleFin(false, time.Now())
+		}
+		for ; sb != nil; sb = a.PopSessionBreakdown() {
+			breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+		}
+
+		if len(breakdowns) != 3 {
+			t.Fatalf("HTTP2 Analyzer(reset=%t): get %d session breakdowns on close, expected 3.", reset, len(breakdowns))
+		}
+		for i, streamID := range []uint32{1, 3, 5} {
+			if sb := breakdowns[i]; sb.StreamID != streamID || strings.HasPrefix(sb.SessionState, "Reset:") != reset {
+				t.Errorf("HTTP2 Analyzer(reset=%t): session breakdown %d is stream %d in state %s.",
+					reset, i, sb.StreamID, sb.SessionState)
+			}
+		}
+	}
+}
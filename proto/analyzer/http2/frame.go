@@ -0,0 +1,181 @@
+package http2
+
+import (
+	"fmt"
+)
+
+// ClientPreface HTTP/2 client connection preface.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frameHeaderLen HTTP/2 frame header length.
+const frameHeaderLen = 9
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameData:
+		return "DATA"
+
+	case frameHeaders:
+		return "HEADERS"
+
+	case framePriority:
+		return "PRIORITY"
+
+	case frameRSTStream:
+		return "RST_STREAM"
+
+	case frameSettings:
+		return "SETTINGS"
+
+	case framePushPromise:
+		return "PUSH_PROMISE"
+
+	case framePing:
+		return "PING"
+
+	case frameGoAway:
+		return "GOAWAY"
+
+	case frameWindowUpdate:
+		return "WINDOW_UPDATE"
+
+	case frameContinuation:
+		return "CONTINUATION"
+
+	default:
+		return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+	}
+}
+
+const (
+	flagEndStream  uint8 = 0x1
+	flagAck        uint8 = 0x1
+	flagEndHeaders uint8 = 0x4
+	flagPadded     uint8 = 0x8
+	flagPriority   uint8 = 0x20
+)
+
+// settingHeaderTableSize SETTINGS_HEADER_TABLE_SIZE setting identifier.
+const settingHeaderTableSize = 0x1
+
+// ErrCode HTTP/2 error code of RST_STREAM and GOAWAY frame.
+type ErrCode uint32
+
+// HTTP/2 error codes.
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+func (e ErrCode) String() string {
+	switch e {
+	case ErrCodeNo:
+		return "NO_ERROR"
+
+	case ErrCodeProtocol:
+		return "PROTOCOL_ERROR"
+
+	case ErrCodeInternal:
+		return "INTERNAL_ERROR"
+
+	case ErrCodeFlowControl:
+		return "FLOW_CONTROL_ERROR"
+
+	case ErrCodeSettingsTimeout:
+		return "SETTINGS_TIMEOUT"
+
+	case ErrCodeStreamClosed:
+		return "STREAM_CLOSED"
+
+	case ErrCodeFrameSize:
+		return "FRAME_SIZE_ERROR"
+
+	case ErrCodeRefusedStream:
+		return "REFUSED_STREAM"
+
+	case ErrCodeCancel:
+		return "CANCEL"
+
+	case ErrCodeCompression:
+		return "COMPRESSION_ERROR"
+
+	case ErrCodeConnect:
+		return "CONNECT_ERROR"
+
+	case ErrCodeEnhanceYourCalm:
+		return "ENHANCE_YOUR_CALM"
+
+	case ErrCodeInadequateSecurity:
+		return "INADEQUATE_SECURITY"
+
+	case ErrCodeHTTP11Required:
+		return "HTTP_1_1_REQUIRED"
+
+	default:
+		return fmt.Sprintf("UNKNOWN_ERROR_CODE_%d", uint32(e))
+	}
+}
+
+type frameHeader struct {
+	length   uint32
+	typ      frameType
+	flags    uint8
+	streamID uint32
+}
+
+func parseFrameHeader(data []byte) frameHeader {
+	return frameHeader{
+		length:   uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]),
+		typ:      frameType(data[3]),
+		flags:    data[4],
+		streamID: readUint32(data[5:]) & 0x7fffffff,
+	}
+}
+
+func readUint32(data []byte) uint32 {
+	return uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+}
+
+// trimPadding strip pad length and padding of padded frame payload.
+func trimPadding(payload []byte, flags uint8) ([]byte, bool) {
+	if flags&flagPadded == 0 {
+		return payload, true
+	}
+	if len(payload) < 1 {
+		return nil, false
+	}
+
+	padLen := int(payload[0])
+	if padLen > len(payload)-1 {
+		return nil, false
+	}
+
+	return payload[1 : len(payload)-padLen], true
+}
@@ -0,0 +1,189 @@
+package http2
+
+import (
+	"fmt"
+	"golang.org/x/net/http2/hpack"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcMessageHeaderLen gRPC length-prefixed message header length.
+const grpcMessageHeaderLen = 5
+
+// gRPC call types.
+const (
+	grpcUnary           = "unary"
+	grpcClientStreaming = "client_streaming"
+	grpcServerStreaming = "server_streaming"
+	grpcBidiStreaming   = "bidi_streaming"
+)
+
+var grpcStatusNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+func grpcStatusName(code uint32) string {
+	if int(code) < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+
+	return fmt.Sprintf("UNKNOWN_STATUS_%d", code)
+}
+
+// isGRPC return true if content type is gRPC, like "application/grpc" and
+// "application/grpc+proto".
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcMessageReader count length-prefixed messages of one direction.
+type grpcMessageReader struct {
+	header    []byte
+	remaining uint32
+	messages  uint
+}
+
+func (r *grpcMessageReader) write(data []byte) (completed uint) {
+	for len(data) > 0 {
+		if r.remaining == 0 {
+			n := grpcMessageHeaderLen - len(r.header)
+			if n > len(data) {
+				n = len(data)
+			}
+			r.header = append(r.header, data[:n]...)
+			data = data[n:]
+
+			if len(r.header) < grpcMessageHeaderLen {
+				break
+			}
+			r.remaining = readUint32(r.header[1:])
+			r.header = r.header[:0]
+
+			// Empty message completes with its header
+			if r.remaining == 0 {
+				r.messages++
+				completed++
+			}
+			continue
+		}
+
+		n := uint32(len(data))
+		if n > r.remaining {
+			n = r.remaining
+		}
+		r.remaining -= n
+		data = data[n:]
+
+		if r.remaining == 0 {
+			r.messages++
+			completed++
+		}
+	}
+
+	return completed
+}
+
+// grpcCall gRPC call on HTTP/2 stream.
+type grpcCall struct {
+	service    string
+	method     string
+	status     *uint32
+	message    string
+	req        grpcMessageReader
+	resp       grpcMessageReader
+	interleave bool
+}
+
+func newGRPCCall(path string) *grpcCall {
+	call := new(grpcCall)
+
+	// Path is "/package.Service/Method"
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		call.service, call.method = path[:i], path[i+1:]
+	} else {
+		call.method = path
+	}
+
+	return call
+}
+
+func (c *grpcCall) onData(fromClient bool, data []byte) {
+	if fromClient {
+		// Request message after response message means bidi streaming
+		if c.req.write(data) > 0 && c.resp.messages > 0 {
+			c.interleave = true
+		}
+	} else {
+		c.resp.write(data)
+	}
+}
+
+// onTrailers get status from trailers or headers of trailers-only response.
+func (c *grpcCall) onTrailers(fields []hpack.HeaderField) {
+	value := headerValue(fields, "grpc-status")
+	if value == "" {
+		return
+	}
+
+	if code, err := strconv.ParseUint(value, 10, 32); err == nil {
+		status := uint32(code)
+		c.status = &status
+	}
+	if message := headerValue(fields, "grpc-message"); message != "" {
+		// Message is percent encoded
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		c.message = message
+	}
+}
+
+// callType classify call type by message counts of both directions.
+func (c *grpcCall) callType() string {
+	switch {
+	case c.interleave || (c.req.messages > 1 && c.resp.messages > 1):
+		return grpcBidiStreaming
+
+	case c.req.messages > 1:
+		return grpcClientStreaming
+
+	case c.resp.messages > 1:
+		return grpcServerStreaming
+
+	default:
+		return grpcUnary
+	}
+}
+
+func (c *grpcCall) breakdown(sb *SessionBreakdown) {
+	sb.GRPCService = c.service
+	sb.GRPCMethod = c.method
+	sb.GRPCCallType = c.callType()
+	sb.GRPCStatus = c.status
+	if c.status != nil {
+		sb.GRPCStatusName = grpcStatusName(*c.status)
+	}
+	sb.GRPCMessage = c.message
+	sb.GRPCReqMessages = c.req.messages
+	sb.GRPCRespMessages = c.resp.messages
+}
@@ -0,0 +1,92 @@
+package http2
+
+import (
+	"bytes"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"testing"
+)
+
+func grpcMessage(payload string) string {
+	length := len(payload)
+	return string([]byte{0, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}) + payload
+}
+
+func TestAnalyzerGRPC(t *testing.T) {
+	client, server := newFramer(), newFramer()
+
+	var steps []analyzertest.Step
+	add := func(fromClient bool, frames ...[]byte) {
+		steps = append(steps, analyzertest.Step{FromClient: fromClient, Data: string(bytes.Join(frames, nil))})
+	}
+	request := func(streamID uint32, path string) []byte {
+		return client.headers(streamID, false, ":method", "POST", ":scheme", "http", ":path", path,
+			"content-type", "application/grpc+proto", "te", "trailers")
+	}
+
+	add(true, []byte(ClientPreface))
+
+	// Unary call
+	add(true, request(1, "/helloworld.Greeter/SayHello"), data(1, true, grpcMessage("hi")))
+	add(false,
+		server.headers(1, false, ":status", "200", "content-type", "application/grpc"),
+		data(1, false, grpcMessage("hello")),
+		server.headers(1, true, "grpc-status", "0"))
+
+	// Server streaming call with message split across frames
+	reply := grpcMessage("first") + grpcMessage("second")
+	add(true, request(3, "/feed.Feed/Watch"), data(3, true, grpcMessage("")))
+	add(false,
+		server.headers(3, false, ":status", "200", "content-type", "application/grpc"),
+		data(3, false, reply[:3]),
+		data(3, false, reply[3:]),
+		server.headers(3, true, "grpc-status", "0"))
+
+	// Bidi streaming call
+	add(true, request(5, "/chat.Chat/Talk"), data(5, false, grpcMessage("a")))
+	add(false,
+		server.headers(5, false, ":status", "200", "content-type", "application/grpc"),
+		data(5, false, grpcMessage("b")))
+	add(true, data(5, true, grpcMessage("c")))
+	add(false, server.headers(5, true, "grpc-status", "0"))
+
+	// Trailers-only error response
+	add(true, request(7, "/helloworld.Greeter/SayHello"), data(7, true, grpcMessage("hi")))
+	add(false, server.headers(7, true, ":status", "200", "content-type", "application/grpc",
+		"grpc-status", "14", "grpc-message", "backend%20down"))
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(a, steps, false)
+	if len(breakdowns) != 4 {
+		t.Fatalf("gRPC: get %d session breakdowns, expected 4.", len(breakdowns))
+	}
+
+	expected := []struct {
+		service      string
+		method       string
+		callType     string
+		status       uint32
+		statusName   string
+		message      string
+		reqMessages  uint
+		respMessages uint
+	}{
+		{"helloworld.Greeter", "SayHello", grpcUnary, 0, "OK", "", 1, 1},
+		{"feed.Feed", "Watch", grpcServerStreaming, 0, "OK", "", 1, 2},
+		{"chat.Chat", "Talk", grpcBidiStreaming, 0, "OK", "", 2, 1},
+		{"helloworld.Greeter", "SayHello", grpcUnary, 14, "UNAVAILABLE", "backend down", 1, 0},
+	}
+
+	for i, e := range expected {
+		sb := breakdowns[i]
+		if sb.GRPCStatus == nil || *sb.GRPCStatus != e.status {
+			t.Errorf("gRPC: session breakdown %d get wrong status.", i)
+			continue
+		}
+		if sb.GRPCService != e.service || sb.GRPCMethod != e.method || sb.GRPCCallType != e.callType ||
+			sb.GRPCStatusName != e.statusName || sb.GRPCMessage != e.message ||
+			sb.GRPCReqMessages != e.reqMessages || sb.GRPCRespMessages != e.respMessages {
+			t.Errorf("gRPC: session breakdown %d is %+v, expected %+v.", i, *sb, e)
+		}
+	}
+}
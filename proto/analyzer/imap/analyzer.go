@@ -0,0 +1,451 @@
+package imap
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/textline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "IMAPRequestSent"
+
+	case responseBegin:
+		return "IMAPResponseBegin"
+
+	case responseComplete:
+		return "IMAPResponseComplete"
+
+	case responseError:
+		return "IMAPResponseError"
+
+	default:
+		return "InvalidIMAPSessionState"
+	}
+}
+
+// mailboxCommands commands whose first argument is mailbox.
+var mailboxCommands = map[string]bool{
+	"SELECT":      true,
+	"EXAMINE":     true,
+	"CREATE":      true,
+	"DELETE":      true,
+	"RENAME":      true,
+	"SUBSCRIBE":   true,
+	"UNSUBSCRIBE": true,
+	"STATUS":      true,
+	"APPEND":      true,
+}
+
+// dataCommands commands followed by client data lines after continuation
+// request.
+var dataCommands = map[string]bool{
+	"AUTHENTICATE": true,
+	"IDLE":         true,
+}
+
+// session state of one tagged command.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	tag       string
+	command   string
+	mailbox   string
+	status    string
+	// untagged count of untagged responses
+	untagged int
+	// responseSize bytes of untagged responses including literals
+	responseSize     int
+	startTLS         bool
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Tag = s.tag
+	sb.Command = s.command
+	sb.Mailbox = s.mailbox
+	sb.Status = s.status
+	sb.UntaggedResponses = s.untagged
+	sb.ResponseSize = s.responseSize
+	sb.StartTLS = s.startTLS
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// begin mark response begin.
+func (s *session) begin(timestamp time.Time) {
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = timestamp
+	}
+}
+
+// SessionBreakdown IMAP analyzer session breakdown of one tagged command.
+type SessionBreakdown struct {
+	SessionState      string `json:"imap_session_state"`
+	Tag               string `json:"imap_tag"`
+	Command           string `json:"imap_command"`
+	Mailbox           string `json:"imap_mailbox,omitempty"`
+	Status            string `json:"imap_status"`
+	UntaggedResponses int    `json:"imap_untagged_responses"`
+	ResponseSize      int    `json:"imap_response_size"`
+	// StartTLS session is upgraded to TLS by this command
+	StartTLS        bool `json:"imap_starttls"`
+	ServerLatency   uint `json:"imap_server_latency"`
+	DownloadLatency uint `json:"imap_download_latency"`
+}
+
+// ApplicationLatency get IMAP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of literal not received yet
+	skip int
+	// continued the next line continues line ending with literal
+	continued bool
+}
+
+// Analyzer IMAP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	client    halfConn
+	server    halfConn
+	// sessions tagged commands waiting for completion in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// clientData client lines are data of AUTHENTICATE or IDLE
+	clientData bool
+	// upgraded session is upgraded to TLS and not parsable any more
+	upgraded bool
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init IMAP analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// literalSize get size of literal ending line, -1 if there is no literal.
+func literalSize(line string) int {
+	if !strings.HasSuffix(line, "}") {
+		return -1
+	}
+
+	start := strings.LastIndexByte(line, '{')
+	if start < 0 {
+		return -1
+	}
+
+	// Non-synchronizing literal of LITERAL+
+	size, err := strconv.Atoi(strings.TrimSuffix(line[start+1:len(line)-1], "+"))
+	if err != nil || size < 0 {
+		return -1
+	}
+
+	return size
+}
+
+// readLine read line without line break, it returns bytes of line including
+// line break, 0 if line is incomplete. Connection is broken if line is too
+// long.
+func (a *Analyzer) readLine(data []byte) (string, int) {
+	line, n, err := textline.Read(data)
+	if err != nil {
+		log.Errorf("IMAP Analyzer: %s.", err)
+		a.broken = true
+	}
+
+	return line, n
+}
+
+// afterLine set literal following line.
+func (hc *halfConn) afterLine(line string) {
+	if size := literalSize(line); size >= 0 {
+		hc.skip = size
+		hc.continued = true
+	} else {
+		hc.continued = false
+	}
+}
+
+// skipLiteral skip literal bytes of half connection, it returns bytes
+// skipped.
+func (hc *halfConn) skipLiteral(data []byte) int {
+	n := len(data)
+	if n > hc.skip {
+		n = hc.skip
+	}
+	hc.skip -= n
+
+	return n
+}
+
+// mailbox get mailbox of the first argument, literal mailbox is ignored.
+func mailbox(args string) string {
+	if strings.HasPrefix(args, "\"") {
+		if end := strings.IndexByte(args[1:], '"'); end >= 0 {
+			return args[1 : end+1]
+		}
+		return ""
+	}
+
+	if strings.HasPrefix(args, "{") {
+		return ""
+	}
+
+	if space := strings.IndexByte(args, ' '); space >= 0 {
+		return args[:space]
+	}
+
+	return args
+}
+
+func (a *Analyzer) handleCommand(line string) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		log.Errorf("IMAP Analyzer: invalid command %q.", line)
+		return
+	}
+
+	s := &session{
+		state:   requestSent,
+		tag:     fields[0],
+		command: strings.ToUpper(fields[1]),
+		reqTime: a.timestamp,
+	}
+
+	var args string
+	if len(fields) == 3 {
+		args = fields[2]
+	}
+	if s.command == "UID" && args != "" {
+		sub := strings.SplitN(args, " ", 2)
+		s.command += " " + strings.ToUpper(sub[0])
+	}
+	if mailboxCommands[s.command] {
+		s.mailbox = mailbox(args)
+	}
+
+	a.sessions.PushBack(s)
+}
+
+func (a *Analyzer) handleClientData(data []byte) int {
+	if a.client.skip > 0 {
+		return a.client.skipLiteral(data)
+	}
+
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	if !a.client.continued && !a.clientData && line != "" {
+		a.handleCommand(line)
+	}
+	a.client.afterLine(line)
+
+	return n
+}
+
+// findSession find session by tag.
+func (a *Analyzer) findSession(tag string) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).tag == tag {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// handleResponse handle response line not continuing literal.
+func (a *Analyzer) handleResponse(line string) *SessionBreakdown {
+	var current *session
+	if front := a.sessions.Front(); front != nil {
+		current = front.Value.(*session)
+	}
+
+	switch {
+	// Untagged response of the oldest command, greeting is ignored
+	case strings.HasPrefix(line, "* "):
+		if current != nil {
+			current.begin(a.timestamp)
+			current.untagged++
+		}
+		return nil
+
+	// Continuation request
+	case strings.HasPrefix(line, "+"):
+		if back := a.sessions.Back(); back != nil {
+			s := back.Value.(*session)
+			s.begin(a.timestamp)
+			if dataCommands[s.command] {
+				a.clientData = true
+			}
+		}
+		return nil
+	}
+
+	fields := strings.SplitN(line, " ", 3)
+	e := a.findSession(fields[0])
+	if e == nil {
+		log.Debugf("IMAP Analyzer: completion of unknown tag %s.", fields[0])
+		return nil
+	}
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.begin(a.timestamp)
+	s.respCompleteTime = a.timestamp
+	if len(fields) > 1 {
+		s.status = strings.ToUpper(fields[1])
+	}
+	if dataCommands[s.command] {
+		a.clientData = false
+	}
+
+	if s.status == "OK" {
+		s.state = responseComplete
+		if s.command == "STARTTLS" {
+			s.startTLS = true
+			a.upgraded = true
+		}
+	} else {
+		s.state = responseError
+	}
+
+	return s.toBreakdown()
+}
+
+func (a *Analyzer) handleServerData(data []byte) (int, *SessionBreakdown) {
+	var current *session
+	if front := a.sessions.Front(); front != nil {
+		current = front.Value.(*session)
+	}
+
+	if a.server.skip > 0 {
+		n := a.server.skipLiteral(data)
+		if current != nil {
+			current.responseSize += n
+		}
+		return n, nil
+	}
+
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0, nil
+	}
+
+	var sb *SessionBreakdown
+	if !a.server.continued {
+		sb = a.handleResponse(line)
+	}
+	if sb == nil && current != nil && current.state != requestSent {
+		current.responseSize += n
+	}
+	a.server.afterLine(line)
+
+	return n, sb
+}
+
+// HandleEstb IMAP analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("IMAP Analyzer: HandleEstb.")
+}
+
+// HandleData IMAP analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && !a.upgraded && parsed < len(payload) {
+		var n int
+		var sb *SessionBreakdown
+		if fromClient {
+			n = a.handleClientData(payload[parsed:])
+		} else {
+			n, sb = a.handleServerData(payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+
+		if sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	// Data after TLS upgrade is ignored
+	if a.broken || a.upgraded {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset IMAP analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("IMAP Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("IMAP Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin IMAP analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("IMAP Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("IMAP Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
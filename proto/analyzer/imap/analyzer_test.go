@@ -0,0 +1,96 @@
+package imap
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	fetched := "* 1 FETCH (BODY[] {11}\r\nhello world)\r\n"
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n"),
+		analyzertest.FromClient("a1 LOGIN bob {6}\r\n"),
+		analyzertest.FromServer("+ Ready for literal\r\n"),
+		analyzertest.FromClient("secret\r\n"),
+		analyzertest.FromServer("a1 OK LOGIN completed\r\n"),
+		analyzertest.FromClient("a2 SELECT \"Sent Items\"\r\n"),
+		analyzertest.FromServer("* 3 EXISTS\r\n* 0 RECENT\r\na2 OK [READ-WRITE] SELECT completed\r\n"),
+		analyzertest.FromClient("a3 UID FETCH 1 BODY[]\r\n"),
+		analyzertest.FromServer(fetched + "a3 OK FETCH completed\r\n"),
+		analyzertest.FromClient("a4 IDLE\r\n"),
+		analyzertest.FromServer("+ idling\r\n"),
+		analyzertest.FromServer("* 4 EXISTS\r\n"),
+		analyzertest.FromClient("DONE\r\n"),
+		analyzertest.FromServer("a4 OK IDLE terminated\r\n"),
+		analyzertest.FromClient("a5 SELECT Missing\r\n"),
+		analyzertest.FromServer("a5 NO Mailbox doesn't exist\r\n"),
+		analyzertest.FromClient("a6 STARTTLS\r\n"),
+		analyzertest.FromServer("a6 OK Begin TLS negotiation now\r\n"),
+		analyzertest.FromClient("\x16\x03\x01\x00\x05hello"),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "IMAPResponseComplete", Tag: "a1", Command: "LOGIN", Status: "OK", ResponseSize: 21},
+		{SessionState: "IMAPResponseComplete", Tag: "a2", Command: "SELECT", Mailbox: "Sent Items", Status: "OK",
+			UntaggedResponses: 2, ResponseSize: 24},
+		{SessionState: "IMAPResponseComplete", Tag: "a3", Command: "UID FETCH", Status: "OK",
+			UntaggedResponses: 1, ResponseSize: len(fetched)},
+		{SessionState: "IMAPResponseComplete", Tag: "a4", Command: "IDLE", Status: "OK",
+			UntaggedResponses: 1, ResponseSize: 22},
+		{SessionState: "IMAPResponseError", Tag: "a5", Command: "SELECT", Mailbox: "Missing", Status: "NO"},
+		{SessionState: "IMAPResponseComplete", Tag: "a6", Command: "STARTTLS", Status: "OK", StartTLS: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("IMAP Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("IMAP Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("IMAP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("IMAP Analyzer: get session breakdown %v on reset after TLS upgrade.", sb)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("* OK ready\r\n"),
+		analyzertest.FromClient("a1 NOOP\r\na2 CAPABILITY\r\n"),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Tag != "a1" || breakdowns[1].Tag != "a2" {
+		t.Fatalf("IMAP Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("IMAP Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
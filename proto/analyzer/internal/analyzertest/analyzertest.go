@@ -0,0 +1,116 @@
+package analyzertest
+
+import (
+	"time"
+)
+
+// Analyzer data handler of analyzer under test.
+type Analyzer interface {
+	HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{})
+}
+
+// sessionBreakdownQueue optional interface of analyzer which may generate
+// more than one session breakdown by one call.
+type sessionBreakdownQueue interface {
+	PopSessionBreakdown() (sessionBreakdown interface{})
+}
+
+// Step data sent by one side of connection.
+type Step struct {
+	FromClient bool
+	Data       string
+}
+
+// FromClient create step of data sent by client.
+func FromClient(data string) Step {
+	return Step{FromClient: true, Data: data}
+}
+
+// FromServer create step of data sent by server.
+func FromServer(data string) Step {
+	return Step{FromClient: false, Data: data}
+}
+
+// FromClientBytes create step of binary data sent by client.
+func FromClientBytes(data []byte) Step {
+	return FromClient(string(data))
+}
+
+// FromServerBytes create step of binary data sent by server.
+func FromServerBytes(data []byte) Step {
+	return FromServer(string(data))
+}
+
+// feed feed data to analyzer like TCP assembler does, data not parsed is
+// kept in pending and fed again with the next data of same direction.
+func feed(a Analyzer, pending *[]byte, data []byte, fromClient bool, timestamp time.Time) []interface{} {
+	var breakdowns []interface{}
+
+	queue, _ := a.(sessionBreakdownQueue)
+	*pending = append(*pending, data...)
+	for len(*pending) > 0 {
+		parseBytes, sb := a.HandleData(*pending, fromClient, timestamp)
+		*pending = (*pending)[parseBytes:]
+		if sb == nil {
+			break
+		}
+
+		breakdowns = append(breakdowns, sb)
+		for queue != nil {
+			if sb = queue.PopSessionBreakdown(); sb == nil {
+				break
+			}
+			breakdowns = append(breakdowns, sb)
+		}
+
+		if parseBytes == 0 {
+			break
+		}
+	}
+
+	return breakdowns
+}
+
+// Feed feed data byte by byte and collect session breakdowns, including
+// the ones queued by analyzer.
+func Feed(a Analyzer, data string, fromClient bool, timestamp time.Time) []interface{} {
+	var breakdowns []interface{}
+	var pending []byte
+	for i := 0; i < len(data); i++ {
+		breakdowns = append(breakdowns, feed(a, &pending, []byte{data[i]}, fromClient, timestamp)...)
+	}
+
+	return breakdowns
+}
+
+// Replay feed steps one by one with 10 milliseconds interval from
+// timestamp and collect session breakdowns, data of step is fed byte by
+// byte if split, otherwise as one chunk.
+func Replay(a Analyzer, steps []Step, split bool, timestamp time.Time) []interface{} {
+	var breakdowns []interface{}
+	var clientData, serverData []byte
+	for _, s := range steps {
+		timestamp = timestamp.Add(10 * time.Millisecond)
+
+		pending := &serverData
+		if s.FromClient {
+			pending = &clientData
+		}
+
+		if !split {
+			breakdowns = append(breakdowns, feed(a, pending, []byte(s.Data), s.FromClient, timestamp)...)
+			continue
+		}
+		for i := 0; i < len(s.Data); i++ {
+			breakdowns = append(breakdowns, feed(a, pending, []byte{s.Data[i]}, s.FromClient, timestamp)...)
+		}
+	}
+
+	return breakdowns
+}
+
+// Run feed steps byte by byte with 10 milliseconds interval and collect
+// session breakdowns.
+func Run(a Analyzer, steps []Step) []interface{} {
+	return Replay(a, steps, true, time.Now())
+}
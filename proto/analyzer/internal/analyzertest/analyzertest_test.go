@@ -0,0 +1,37 @@
+package analyzertest
+
+import (
+	"testing"
+	"time"
+)
+
+// stubAnalyzer return session breakdown without consuming data once it
+// gets a full line.
+type stubAnalyzer struct {
+	calls int
+}
+
+func (a *stubAnalyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (uint, interface{}) {
+	a.calls++
+	if payload[len(payload)-1] != '\n' {
+		return 0, nil
+	}
+
+	return 0, string(payload)
+}
+
+func TestFeedNoProgress(t *testing.T) {
+	a := new(stubAnalyzer)
+	breakdowns := Feed(a, "ab\n", true, time.Now())
+	if len(breakdowns) != 1 || breakdowns[0] != "ab\n" || a.calls != 3 {
+		t.Errorf("Feed: get session breakdowns %v by %d calls.", breakdowns, a.calls)
+	}
+}
+
+func TestReplayPending(t *testing.T) {
+	a := new(stubAnalyzer)
+	breakdowns := Replay(a, []Step{FromClient("a"), FromServer("x\n"), FromClient("b\n")}, false, time.Now())
+	if len(breakdowns) != 2 || breakdowns[0] != "x\n" || breakdowns[1] != "ab\n" {
+		t.Errorf("Replay: get session breakdowns %v.", breakdowns)
+	}
+}
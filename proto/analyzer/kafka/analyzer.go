@@ -0,0 +1,270 @@
+package kafka
+
+import (
+	"container/list"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "KafkaRequestSent"
+
+	case responseBegin:
+		return "KafkaResponseBegin"
+
+	case responseComplete:
+		return "KafkaResponseComplete"
+
+	case responseError:
+		return "KafkaResponseError"
+
+	default:
+		return "InvalidKafkaSessionState"
+	}
+}
+
+// session state of one request.
+type session struct {
+	resetFlag    bool
+	state        sessionState
+	req          *request
+	throttleTime int32
+	errorCode    int16
+	// records records count of produce request or fetch response
+	records          int
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.APIKey = apiName(s.req.apiKey)
+	sb.APIVersion = s.req.apiVersion
+	sb.CorrelationID = s.req.correlationID
+	sb.ClientID = s.req.clientID
+	sb.Topic = s.req.topic
+	sb.Partition = s.req.partition
+	sb.Partitions = s.req.partitions
+	sb.Records = s.records
+	sb.ErrorCode = s.errorCode
+	sb.ThrottleTime = s.throttleTime
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown Kafka analyzer session breakdown of one request.
+type SessionBreakdown struct {
+	SessionState  string `json:"kafka_session_state"`
+	APIKey        string `json:"kafka_api_key"`
+	APIVersion    int16  `json:"kafka_api_version"`
+	CorrelationID int32  `json:"kafka_correlation_id"`
+	ClientID      string `json:"kafka_client_id,omitempty"`
+	Topic         string `json:"kafka_topic,omitempty"`
+	// Partition the first partition of request, -1 for request without
+	// partitions
+	Partition       int32 `json:"kafka_partition"`
+	Partitions      int   `json:"kafka_partitions"`
+	Records         int   `json:"kafka_records"`
+	ErrorCode       int16 `json:"kafka_error_code"`
+	ThrottleTime    int32 `json:"kafka_throttle_time"`
+	ServerLatency   uint  `json:"kafka_server_latency"`
+	DownloadLatency uint  `json:"kafka_download_latency"`
+}
+
+// ApplicationLatency get Kafka latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer Kafka analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// sessions requests waiting for responses
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init Kafka analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+func (a *Analyzer) handleRequest(data []byte) {
+	req, err := parseRequest(data)
+	if err != nil {
+		log.Errorf("Kafka Analyzer: parse request error: %s.", err)
+		return
+	}
+
+	// No response for produce request with acks 0
+	if req.noResponse {
+		return
+	}
+
+	a.sessions.PushBack(&session{
+		state:   requestSent,
+		req:     req,
+		records: req.records,
+		reqTime: a.timestamp,
+	})
+}
+
+// findSession find session by correlation id.
+func (a *Analyzer) findSession(correlationID int32) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).req.correlationID == correlationID {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (a *Analyzer) handleResponse(data []byte) *SessionBreakdown {
+	correlationID := parseCorrelationID(data)
+	e := a.findSession(correlationID)
+	if e == nil {
+		log.Debugf("Kafka Analyzer: response to unknown request %d.", correlationID)
+		return nil
+	}
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.begin(a.timestamp)
+	s.respCompleteTime = a.timestamp
+
+	resp, err := parseResponse(data, s.req)
+	if err != nil {
+		log.Errorf("Kafka Analyzer: parse %s response error: %s.", apiName(s.req.apiKey), err)
+		s.state = responseError
+		return s.toBreakdown()
+	}
+
+	s.throttleTime = resp.throttleTime
+	s.errorCode = resp.errorCode
+	if s.req.apiKey == apiFetch {
+		s.records = resp.records
+	}
+
+	if s.errorCode == 0 {
+		s.state = responseComplete
+	} else {
+		s.state = responseError
+	}
+
+	return s.toBreakdown()
+}
+
+// begin mark response begin.
+func (s *session) begin(timestamp time.Time) {
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = timestamp
+	}
+}
+
+// HandleEstb Kafka analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("Kafka Analyzer: HandleEstb.")
+}
+
+// HandleData Kafka analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && len(payload)-parsed >= 4 {
+		length := int(int32(binary.BigEndian.Uint32(payload[parsed:])))
+		if length < 4 || length > maxMessageLen {
+			log.Errorf("Kafka Analyzer: invalid message length %d.", length)
+			a.broken = true
+			break
+		}
+
+		if len(payload)-parsed-4 < length {
+			// Response begins before the whole message is received
+			if !fromClient && len(payload)-parsed >= 8 {
+				if e := a.findSession(parseCorrelationID(payload[parsed+4:])); e != nil {
+					e.Value.(*session).begin(timestamp)
+				}
+			}
+			break
+		}
+
+		data := payload[parsed+4 : parsed+4+length]
+		parsed += 4 + length
+
+		if fromClient {
+			a.handleRequest(data)
+		} else if sb := a.handleResponse(data); sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset Kafka analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Kafka Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("Kafka Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin Kafka analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Kafka Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("Kafka Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func i16(v int16) string {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	return string(b[:])
+}
+
+func i32(v int32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	return string(b[:])
+}
+
+func i64(v int64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	return string(b[:])
+}
+
+func str(s string) string {
+	return i16(int16(len(s))) + s
+}
+
+// compact build compact string or compact array length of n.
+func compact(n int) string {
+	return string([]byte{byte(n + 1)})
+}
+
+// frame build message with length.
+func frame(message string) string {
+	return i32(int32(len(message))) + message
+}
+
+// batch build record batch of count records.
+func batch(count int32) string {
+	records := "records"
+	return i64(0) + i32(int32(49+len(records))) + i32(0) + "\x02" + i32(0) + i16(0) + i32(count-1) +
+		i64(0) + i64(0) + i64(-1) + i16(-1) + i32(-1) + i32(count) + records
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	produceBatches := batch(3)
+	fetchedRecords := batch(4) + batch(5)[:30]
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		// Flexible request header with non flexible response header
+		analyzertest.FromClient(frame(i16(apiApiVersions) + i16(3) + i32(1) + str("app") + "\x00" +
+			compact(4) + "java" + compact(5) + "3.7.0" + "\x00")),
+		analyzertest.FromServer(frame(i32(1) + i16(0) + compact(0) + i32(0) + "\x00")),
+		analyzertest.FromClient(frame(i16(apiProduce) + i16(3) + i32(2) + str("app") + i16(-1) + i16(1) + i32(30000) +
+			i32(1) + str("orders") + i32(2) +
+			i32(0) + i32(int32(len(produceBatches))) + produceBatches +
+			i32(1) + i32(int32(len(produceBatches))) + produceBatches)),
+		analyzertest.FromServer(frame(i32(2) + i32(1) + str("orders") + i32(2) +
+			i32(0) + i16(0) + i64(100) + i64(-1) +
+			i32(1) + i16(0) + i64(200) + i64(-1) +
+			i32(5))),
+		// Produce without acks has no response
+		analyzertest.FromClient(frame(i16(apiProduce) + i16(3) + i32(3) + str("app") + i16(-1) + i16(0) + i32(30000) +
+			i32(1) + str("orders") + i32(1) + i32(0) + i32(int32(len(produceBatches))) + produceBatches)),
+		analyzertest.FromClient(frame(i16(apiFetch) + i16(4) + i32(4) + str("app") + i32(-1) + i32(500) + i32(1) + i32(1024) + "\x00" +
+			i32(1) + str("orders") + i32(1) + i32(0) + i64(100) + i32(1024))),
+		analyzertest.FromServer(frame(i32(4) + i32(0) + i32(1) + str("orders") + i32(1) +
+			i32(0) + i16(0) + i64(300) + i64(300) + i32(-1) + i32(int32(len(fetchedRecords))) + fetchedRecords)),
+		// Flexible produce
+		analyzertest.FromClient(frame(i16(apiProduce) + i16(9) + i32(5) + i16(-1) + "\x00" + compact(-1) + i16(-1) + i32(30000) +
+			compact(1) + compact(6) + "events" + compact(1) +
+			i32(7) + compact(len(produceBatches)) + produceBatches + "\x00" + "\x00" + "\x00")),
+		analyzertest.FromServer(frame(i32(5) + "\x00" + compact(1) + compact(6) + "events" + compact(1) +
+			i32(7) + i16(6) + i64(-1) + i64(-1) + i64(-1) + compact(0) + compact(-1) + "\x00" + "\x00" +
+			i32(0) + "\x00")),
+		analyzertest.FromClient(frame(i16(apiHeartbeat) + i16(1) + i32(6) + str("app") + str("group") + i32(1) + str("member"))),
+		analyzertest.FromServer(frame(i32(6) + i32(7) + i16(27))),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "KafkaResponseComplete", APIKey: "ApiVersions", APIVersion: 3, CorrelationID: 1,
+			ClientID: "app", Partition: -1},
+		{SessionState: "KafkaResponseComplete", APIKey: "Produce", APIVersion: 3, CorrelationID: 2,
+			ClientID: "app", Topic: "orders", Partition: 0, Partitions: 2, Records: 6, ThrottleTime: 5},
+		{SessionState: "KafkaResponseComplete", APIKey: "Fetch", APIVersion: 4, CorrelationID: 4,
+			ClientID: "app", Topic: "orders", Partition: 0, Partitions: 1, Records: 4},
+		{SessionState: "KafkaResponseError", APIKey: "Produce", APIVersion: 9, CorrelationID: 5,
+			Topic: "events", Partition: 7, Partitions: 1, Records: 3, ErrorCode: 6},
+		{SessionState: "KafkaResponseError", APIKey: "Heartbeat", APIVersion: 1, CorrelationID: 6,
+			ClientID: "app", Partition: -1, ErrorCode: 27, ThrottleTime: 7},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("Kafka Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("Kafka Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("Kafka Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("Kafka Analyzer: get session breakdown %v on reset without pending request.", sb)
+	}
+}
+
+func TestAnalyzerOutOfOrder(t *testing.T) {
+	metadata := func(correlationID int32) string {
+		return frame(i16(apiMetadata) + i16(1) + i32(correlationID) + str("app") + i32(-1))
+	}
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(metadata(1) + metadata(2)),
+		analyzertest.FromServer(frame(i32(2) + i32(0) + i32(0))),
+		analyzertest.FromServer(frame(i32(1) + i32(0) + i32(0))),
+	})
+
+	if len(breakdowns) != 2 || breakdowns[0].CorrelationID != 2 || breakdowns[1].CorrelationID != 1 {
+		t.Fatalf("Kafka Analyzer: get wrong session breakdowns %v of responses out of order.", breakdowns)
+	}
+	if breakdowns[1].ServerLatency != 20 {
+		t.Errorf("Kafka Analyzer: get wrong server latency %d of response out of order.", breakdowns[1].ServerLatency)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	metadata := func(correlationID int32) string {
+		return frame(i16(apiMetadata) + i16(1) + i32(correlationID) + str("app") + i32(-1))
+	}
+
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(metadata(1) + metadata(2)),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].CorrelationID != 1 || breakdowns[1].CorrelationID != 2 {
+		t.Fatalf("Kafka Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("Kafka Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// maxMessageLen max message length, the default socket.request.max.bytes of
+// Kafka broker.
+const maxMessageLen = 100 * 1024 * 1024
+
+var errInvalidMessage = errors.New("invalid message")
+
+// request parsed request of interest.
+type request struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+	clientID      string
+	// noResponse produce request with acks 0 has no response
+	noResponse bool
+	// topic and partition the first topic partition of request
+	topic      string
+	partition  int32
+	partitions int
+	records    int
+}
+
+func (req *request) addPartition(topic string, partition int32) {
+	if req.partitions == 0 {
+		req.topic = topic
+		req.partition = partition
+	}
+	req.partitions++
+}
+
+// response parsed response of interest.
+type response struct {
+	correlationID int32
+	throttleTime  int32
+	// errorCode top level error code or the first error code of partitions
+	errorCode int16
+	records   int
+}
+
+func (resp *response) setError(errorCode int16) {
+	if resp.errorCode == 0 {
+		resp.errorCode = errorCode
+	}
+}
+
+// parseRequest parse request message without length.
+func parseRequest(data []byte) (*request, error) {
+	r := &reader{data: data}
+	req := &request{
+		apiKey:        r.int16(),
+		apiVersion:    r.int16(),
+		correlationID: r.int32(),
+		clientID:      r.legacyString(),
+		partition:     -1,
+	}
+	if r.failed {
+		return nil, errInvalidMessage
+	}
+
+	r.flexible = isFlexible(req.apiKey, req.apiVersion)
+	r.taggedFields()
+
+	switch req.apiKey {
+	case apiProduce:
+		req.parseProduce(r)
+
+	case apiFetch:
+		req.parseFetch(r)
+
+	default:
+		return req, nil
+	}
+
+	if r.failed {
+		return nil, errInvalidMessage
+	}
+
+	return req, nil
+}
+
+// topicName read topic name or topic id of versions since topic ids.
+func topicName(r *reader, topicIDVersion int16, version int16) string {
+	if version >= topicIDVersion {
+		return r.uuid()
+	}
+
+	return r.string()
+}
+
+func (req *request) parseProduce(r *reader) {
+	v := req.apiVersion
+	if v >= 3 {
+		// Transactional id
+		r.string()
+	}
+	req.noResponse = r.int16() == 0
+	// Timeout
+	r.int32()
+
+	for i, topics := 0, r.array(); i < topics && !r.failed; i++ {
+		topic := topicName(r, 13, v)
+		for j, partitions := 0, r.array(); j < partitions && !r.failed; j++ {
+			req.addPartition(topic, r.int32())
+			req.records += countRecords(r.recordsBytes())
+			r.taggedFields()
+		}
+		r.taggedFields()
+	}
+}
+
+func (req *request) parseFetch(r *reader) {
+	v := req.apiVersion
+	if v < 15 {
+		// Replica id
+		r.int32()
+	}
+	// Max wait and min bytes
+	r.bytes(8)
+	if v >= 3 {
+		// Max bytes
+		r.int32()
+	}
+	if v >= 4 {
+		// Isolation level
+		r.int8()
+	}
+	if v >= 7 {
+		// Session id and epoch
+		r.bytes(8)
+	}
+
+	for i, topics := 0, r.array(); i < topics && !r.failed; i++ {
+		topic := topicName(r, 13, v)
+		for j, partitions := 0, r.array(); j < partitions && !r.failed; j++ {
+			req.addPartition(topic, r.int32())
+			if v >= 9 {
+				// Current leader epoch
+				r.int32()
+			}
+			// Fetch offset
+			r.int64()
+			if v >= 12 {
+				// Last fetched epoch
+				r.int32()
+			}
+			if v >= 5 {
+				// Log start offset
+				r.int64()
+			}
+			// Partition max bytes
+			r.int32()
+			r.taggedFields()
+		}
+		r.taggedFields()
+	}
+}
+
+// parseCorrelationID parse correlation id of response message without
+// length.
+func parseCorrelationID(data []byte) int32 {
+	return int32(binary.BigEndian.Uint32(data))
+}
+
+// parseResponse parse response message without length to request.
+func parseResponse(data []byte, req *request) (*response, error) {
+	r := &reader{data: data}
+	resp := &response{correlationID: r.int32()}
+
+	// Response header of ApiVersions is never flexible for clients not
+	// knowing versions of broker
+	r.flexible = isFlexible(req.apiKey, req.apiVersion)
+	if req.apiKey != apiApiVersions {
+		r.taggedFields()
+	}
+
+	switch req.apiKey {
+	case apiProduce:
+		resp.parseProduce(r, req.apiVersion)
+
+	case apiFetch:
+		resp.parseFetch(r, req.apiVersion)
+
+	default:
+		info, ok := apis[req.apiKey]
+		if !ok {
+			return resp, nil
+		}
+		if info.throttleVersion != noVersion && req.apiVersion >= info.throttleVersion {
+			resp.throttleTime = r.int32()
+		}
+		if info.errorVersion != noVersion && req.apiVersion >= info.errorVersion {
+			resp.setError(r.int16())
+		}
+	}
+
+	if r.failed {
+		return nil, errInvalidMessage
+	}
+
+	return resp, nil
+}
+
+func (resp *response) parseProduce(r *reader, v int16) {
+	for i, topics := 0, r.array(); i < topics && !r.failed; i++ {
+		topicName(r, 13, v)
+		for j, partitions := 0, r.array(); j < partitions && !r.failed; j++ {
+			// Partition index
+			r.int32()
+			resp.setError(r.int16())
+			// Base offset
+			r.int64()
+			if v >= 2 {
+				// Log append time
+				r.int64()
+			}
+			if v >= 5 {
+				// Log start offset
+				r.int64()
+			}
+			if v >= 8 {
+				// Record errors with batch index and message, and error
+				// message
+				for k, recordErrors := 0, r.array(); k < recordErrors && !r.failed; k++ {
+					r.int32()
+					r.string()
+					r.taggedFields()
+				}
+				r.string()
+			}
+			r.taggedFields()
+		}
+		r.taggedFields()
+	}
+
+	if v >= 1 {
+		resp.throttleTime = r.int32()
+	}
+}
+
+func (resp *response) parseFetch(r *reader, v int16) {
+	if v >= 1 {
+		resp.throttleTime = r.int32()
+	}
+	if v >= 7 {
+		resp.setError(r.int16())
+		// Session id
+		r.int32()
+	}
+
+	for i, topics := 0, r.array(); i < topics && !r.failed; i++ {
+		topicName(r, 13, v)
+		for j, partitions := 0, r.array(); j < partitions && !r.failed; j++ {
+			// Partition index
+			r.int32()
+			resp.setError(r.int16())
+			// High watermark
+			r.int64()
+			if v >= 4 {
+				// Last stable offset
+				r.int64()
+			}
+			if v >= 5 {
+				// Log start offset
+				r.int64()
+			}
+			if v >= 4 {
+				// Aborted transactions with producer id and first offset
+				for k, aborted := 0, r.array(); k < aborted && !r.failed; k++ {
+					r.bytes(16)
+					r.taggedFields()
+				}
+			}
+			if v >= 11 {
+				// Preferred read replica
+				r.int32()
+			}
+			resp.records += countRecords(r.recordsBytes())
+			r.taggedFields()
+		}
+		r.taggedFields()
+	}
+}
@@ -0,0 +1,276 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// API keys.
+const (
+	apiProduce            int16 = 0
+	apiFetch              int16 = 1
+	apiListOffsets        int16 = 2
+	apiMetadata           int16 = 3
+	apiOffsetCommit       int16 = 8
+	apiOffsetFetch        int16 = 9
+	apiFindCoordinator    int16 = 10
+	apiJoinGroup          int16 = 11
+	apiHeartbeat          int16 = 12
+	apiLeaveGroup         int16 = 13
+	apiSyncGroup          int16 = 14
+	apiDescribeGroups     int16 = 15
+	apiListGroups         int16 = 16
+	apiSaslHandshake      int16 = 17
+	apiApiVersions        int16 = 18
+	apiCreateTopics       int16 = 19
+	apiDeleteTopics       int16 = 20
+	apiInitProducerID     int16 = 22
+	apiAddPartitionsToTxn int16 = 24
+	apiAddOffsetsToTxn    int16 = 25
+	apiEndTxn             int16 = 26
+	apiTxnOffsetCommit    int16 = 28
+	apiDescribeConfigs    int16 = 32
+	apiAlterConfigs       int16 = 33
+	apiSaslAuthenticate   int16 = 36
+	apiCreatePartitions   int16 = 37
+	apiDeleteGroups       int16 = 42
+	apiDescribeCluster    int16 = 60
+)
+
+// noVersion version of field which doesn't exist in any version.
+const noVersion int16 = -1
+
+// apiInfo versions of API deciding layout of messages.
+type apiInfo struct {
+	name string
+	// flexibleVersion the first version using compact types and tagged
+	// fields
+	flexibleVersion int16
+	// throttleVersion the first version whose response begins with
+	// throttle_time_ms
+	throttleVersion int16
+	// errorVersion the first version whose response has top level
+	// error_code after throttle_time_ms
+	errorVersion int16
+}
+
+var apis = map[int16]apiInfo{
+	apiProduce:            {"Produce", 9, noVersion, noVersion},
+	apiFetch:              {"Fetch", 12, 1, 7},
+	apiListOffsets:        {"ListOffsets", 6, 2, noVersion},
+	apiMetadata:           {"Metadata", 9, 3, noVersion},
+	apiOffsetCommit:       {"OffsetCommit", 8, 3, noVersion},
+	apiOffsetFetch:        {"OffsetFetch", 6, 3, noVersion},
+	apiFindCoordinator:    {"FindCoordinator", 3, 1, 0},
+	apiJoinGroup:          {"JoinGroup", 6, 2, 0},
+	apiHeartbeat:          {"Heartbeat", 4, 1, 0},
+	apiLeaveGroup:         {"LeaveGroup", 4, 1, 0},
+	apiSyncGroup:          {"SyncGroup", 4, 1, 0},
+	apiDescribeGroups:     {"DescribeGroups", 5, 1, noVersion},
+	apiListGroups:         {"ListGroups", 3, 1, 0},
+	apiSaslHandshake:      {"SaslHandshake", noVersion, noVersion, 0},
+	apiApiVersions:        {"ApiVersions", 3, noVersion, 0},
+	apiCreateTopics:       {"CreateTopics", 5, 2, noVersion},
+	apiDeleteTopics:       {"DeleteTopics", 4, 1, noVersion},
+	apiInitProducerID:     {"InitProducerId", 2, 0, 0},
+	apiAddPartitionsToTxn: {"AddPartitionsToTxn", 3, 0, noVersion},
+	apiAddOffsetsToTxn:    {"AddOffsetsToTxn", 3, 0, 0},
+	apiEndTxn:             {"EndTxn", 3, 0, 0},
+	apiTxnOffsetCommit:    {"TxnOffsetCommit", 3, 0, noVersion},
+	apiDescribeConfigs:    {"DescribeConfigs", 4, 0, noVersion},
+	apiAlterConfigs:       {"AlterConfigs", 2, 0, noVersion},
+	apiSaslAuthenticate:   {"SaslAuthenticate", 2, noVersion, 0},
+	apiCreatePartitions:   {"CreatePartitions", 2, 0, noVersion},
+	apiDeleteGroups:       {"DeleteGroups", 2, 0, noVersion},
+	apiDescribeCluster:    {"DescribeCluster", 0, 0, 0},
+}
+
+func apiName(apiKey int16) string {
+	if info, ok := apis[apiKey]; ok {
+		return info.name
+	}
+
+	return fmt.Sprintf("ApiKey(%d)", apiKey)
+}
+
+// isFlexible return true if version of API uses compact types and tagged
+// fields.
+func isFlexible(apiKey int16, version int16) bool {
+	info, ok := apis[apiKey]
+	return ok && info.flexibleVersion != noVersion && version >= info.flexibleVersion
+}
+
+// reader bounds checked big endian reader of Kafka protocol types, any read
+// out of bounds marks reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+	// flexible compact types are used
+	flexible bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) int8() int8 {
+	if b := r.bytes(1); b != nil {
+		return int8(b[0])
+	}
+
+	return 0
+}
+
+func (r *reader) int16() int16 {
+	if b := r.bytes(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (r *reader) int32() int32 {
+	if b := r.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (r *reader) int64() int64 {
+	if b := r.bytes(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.failed {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.failed = true
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return v
+}
+
+// length read length of string, bytes or array, -1 means null.
+func (r *reader) length(int16Length bool) int {
+	if r.flexible {
+		return int(r.uvarint()) - 1
+	}
+
+	if int16Length {
+		return int(r.int16())
+	}
+
+	return int(r.int32())
+}
+
+// string read string or nullable string.
+func (r *reader) string() string {
+	n := r.length(true)
+	if n < 0 {
+		return ""
+	}
+
+	return string(r.bytes(n))
+}
+
+// legacyString read nullable string which is never compact like client id
+// of request header.
+func (r *reader) legacyString() string {
+	n := int(r.int16())
+	if n < 0 {
+		return ""
+	}
+
+	return string(r.bytes(n))
+}
+
+// recordsBytes read bytes or nullable bytes.
+func (r *reader) recordsBytes() []byte {
+	n := r.length(false)
+	if n < 0 {
+		return nil
+	}
+
+	return r.bytes(n)
+}
+
+// array read length of array, null array is empty.
+func (r *reader) array() int {
+	n := r.length(false)
+	if n < 0 || n > len(r.data) {
+		if n > len(r.data) {
+			r.failed = true
+		}
+		return 0
+	}
+
+	return n
+}
+
+// uuid read uuid as hex string.
+func (r *reader) uuid() string {
+	if b := r.bytes(16); b != nil {
+		return hex.EncodeToString(b)
+	}
+
+	return ""
+}
+
+// taggedFields skip tagged fields of flexible versions.
+func (r *reader) taggedFields() {
+	if !r.flexible {
+		return
+	}
+
+	for count := r.uvarint(); count > 0 && !r.failed; count-- {
+		r.uvarint()
+		r.bytes(int(r.uvarint()))
+	}
+}
+
+// countRecords count records of record batches or legacy message sets,
+// incomplete batch at the end of fetched records is ignored.
+func countRecords(records []byte) int {
+	count := 0
+
+	for len(records) >= 17 {
+		// Base offset, batch length and partition leader epoch or crc
+		batchLen := int(int32(binary.BigEndian.Uint32(records[8:])))
+		if batchLen < 0 || 12+batchLen > len(records) {
+			break
+		}
+
+		magic := records[16]
+		if magic >= 2 {
+			// Records count follows attributes, offsets, timestamps and
+			// producer fields
+			if batchLen < 49 {
+				break
+			}
+			count += int(int32(binary.BigEndian.Uint32(records[57:])))
+		} else {
+			count++
+		}
+		records = records[12+batchLen:]
+	}
+
+	return count
+}
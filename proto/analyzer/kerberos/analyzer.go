@@ -0,0 +1,278 @@
+package kerberos
+
+import (
+	"container/list"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ber"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "KerberosRequestSent"
+
+	case responseComplete:
+		return "KerberosResponseComplete"
+
+	case responseError:
+		return "KerberosResponseError"
+
+	default:
+		return "InvalidKerberosSessionState"
+	}
+}
+
+// recordHeaderLen length of record mark of Kerberos over TCP.
+const recordHeaderLen = 4
+
+// maxMessageLen max length of Kerberos message.
+const maxMessageLen = 1024 * 1024
+
+// session state of one AS or TGS exchange.
+type session struct {
+	resetFlag   bool
+	state       sessionState
+	messageType string
+	realm       string
+	clientName  string
+	serverName  string
+	eTypes      string
+	replyEType  string
+	errorCode   int64
+	errorText   string
+	reqTime     time.Time
+	respTime    time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.MessageType = s.messageType
+	sb.Realm = s.realm
+	sb.ClientName = s.clientName
+	sb.ServerName = s.serverName
+	sb.ETypes = s.eTypes
+	sb.ReplyEType = s.replyEType
+	if s.state == responseError {
+		sb.ErrorCode = s.errorCode
+		sb.Error = errorName(s.errorCode)
+		sb.ErrorText = s.errorText
+	}
+
+	if s.respTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown Kerberos analyzer session breakdown of one AS or TGS
+// exchange.
+type SessionBreakdown struct {
+	SessionState string `json:"kerberos_session_state"`
+	// MessageType AS or TGS
+	MessageType string `json:"kerberos_message_type"`
+	Realm       string `json:"kerberos_realm,omitempty"`
+	ClientName  string `json:"kerberos_client_name,omitempty"`
+	ServerName  string `json:"kerberos_server_name,omitempty"`
+	// ETypes encryption types requested by client
+	ETypes string `json:"kerberos_etypes,omitempty"`
+	// ReplyEType encryption type of reply
+	ReplyEType    string `json:"kerberos_reply_etype,omitempty"`
+	ErrorCode     int64  `json:"kerberos_error_code"`
+	Error         string `json:"kerberos_error,omitempty"`
+	ErrorText     string `json:"kerberos_error_text,omitempty"`
+	ServerLatency uint   `json:"kerberos_server_latency"`
+}
+
+// ApplicationLatency get Kerberos latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency) * time.Millisecond
+}
+
+// Analyzer Kerberos over TCP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// sessions requests waiting for replies in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init Kerberos analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+func (a *Analyzer) handleRequest(msg ber.Element) {
+	s := &session{
+		state:   requestSent,
+		reqTime: a.timestamp,
+	}
+	if msg.Tag == msgASReq {
+		s.messageType = "AS"
+	} else {
+		s.messageType = "TGS"
+	}
+
+	// KDC-REQ-BODY is [4] of KDC-REQ
+	if f, ok := unwrap(msg); ok {
+		if body, ok := fields(f[4]); ok {
+			s.clientName = principalName(body[1])
+			s.realm = body[2].String()
+			s.serverName = principalName(body[3])
+			s.eTypes = eTypes(body[8])
+		}
+	} else {
+		log.Errorf("Kerberos Analyzer: parse %s-REQ error.", s.messageType)
+	}
+
+	a.sessions.PushBack(s)
+}
+
+func (a *Analyzer) handleReply(msg ber.Element) *SessionBreakdown {
+	front := a.sessions.Front()
+	if front == nil {
+		log.Debug("Kerberos Analyzer: reply without request.")
+		return nil
+	}
+	a.sessions.Remove(front)
+
+	s := front.Value.(*session)
+	s.respTime = a.timestamp
+
+	f, ok := unwrap(msg)
+	if !ok {
+		log.Error("Kerberos Analyzer: parse reply error.")
+		s.state = responseError
+		return s.toBreakdown()
+	}
+
+	if msg.Tag == msgKRBError {
+		s.state = responseError
+		if code, err := f[6].Int(); err == nil {
+			s.errorCode = code
+		}
+		s.errorText = f[11].String()
+		return s.toBreakdown()
+	}
+
+	// Encryption type of enc-part [6]
+	s.state = responseComplete
+	if encPart, ok := fields(f[6]); ok {
+		if eType, err := encPart[0].Int(); err == nil {
+			s.replyEType = eTypeName(eType)
+		}
+	}
+
+	return s.toBreakdown()
+}
+
+// handleMessage handle one Kerberos message.
+func (a *Analyzer) handleMessage(data []byte) *SessionBreakdown {
+	msg, _, err := ber.Parse(data)
+	if err != nil || msg.Class != ber.ClassApplication || !msg.Constructed {
+		log.Error("Kerberos Analyzer: invalid message.")
+		a.broken = true
+		return nil
+	}
+
+	switch msg.Tag {
+	case msgASReq, msgTGSReq:
+		a.handleRequest(msg)
+		return nil
+
+	case msgASRep, msgTGSRep, msgKRBError:
+		return a.handleReply(msg)
+
+	default:
+		log.Errorf("Kerberos Analyzer: unsupported message type %d.", msg.Tag)
+		return nil
+	}
+}
+
+// HandleEstb Kerberos analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("Kerberos Analyzer: HandleEstb.")
+}
+
+// HandleData Kerberos analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && len(payload)-parsed >= recordHeaderLen {
+		// The highest bit of record mark is reserved for extensions
+		length := binary.BigEndian.Uint32(payload[parsed:])
+		if length > maxMessageLen {
+			log.Errorf("Kerberos Analyzer: invalid record length %d.", length)
+			a.broken = true
+			break
+		}
+		if uint32(len(payload)-parsed-recordHeaderLen) < length {
+			break
+		}
+
+		record := payload[parsed+recordHeaderLen : parsed+recordHeaderLen+int(length)]
+		parsed += recordHeaderLen + int(length)
+
+		if sb := a.handleMessage(record); sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset Kerberos analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Kerberos Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("Kerberos Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin Kerberos analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Kerberos Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("Kerberos Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
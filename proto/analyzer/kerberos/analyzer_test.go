@@ -0,0 +1,146 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"testing"
+)
+
+// tlv encode BER element of identifier and content.
+func tlv(identifier byte, content ...[]byte) []byte {
+	var data []byte
+	for _, c := range content {
+		data = append(data, c...)
+	}
+
+	header := []byte{identifier}
+	if len(data) < 0x80 {
+		header = append(header, byte(len(data)))
+	} else {
+		header = append(header, 0x82, byte(len(data)>>8), byte(len(data)))
+	}
+
+	return append(header, data...)
+}
+
+func integer(v byte) []byte {
+	return tlv(0x02, []byte{v})
+}
+
+func generalString(s string) []byte {
+	return tlv(0x1b, []byte(s))
+}
+
+// field encode explicitly context tagged field.
+func field(tag byte, content []byte) []byte {
+	return tlv(0xa0|tag, content)
+}
+
+func principal(nameType byte, components ...string) []byte {
+	var names [][]byte
+	for _, c := range components {
+		names = append(names, generalString(c))
+	}
+
+	return tlv(0x30, field(0, integer(nameType)), field(1, tlv(0x30, names...)))
+}
+
+// record encode record mark and message.
+func record(msg []byte) []byte {
+	data := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(data, uint32(len(msg)))
+
+	return append(data, msg...)
+}
+
+func kdcReq(tag byte, cname []byte, sname []byte, eTypes ...byte) []byte {
+	var eTypeList [][]byte
+	for _, e := range eTypes {
+		eTypeList = append(eTypeList, integer(e))
+	}
+
+	bodyFields := [][]byte{field(0, tlv(0x03, []byte{0, 0, 0, 0, 0}))}
+	if cname != nil {
+		bodyFields = append(bodyFields, field(1, cname))
+	}
+	bodyFields = append(bodyFields,
+		field(2, generalString("EXAMPLE.COM")),
+		field(3, sname),
+		field(7, integer(42)),
+		field(8, tlv(0x30, eTypeList...)))
+
+	return record(tlv(tag, tlv(0x30,
+		field(1, integer(5)),
+		field(2, integer(tag&0x1f)),
+		field(4, tlv(0x30, bodyFields...)))))
+}
+
+func krbError(code byte, text string) []byte {
+	return record(tlv(0x7e, tlv(0x30,
+		field(0, integer(5)),
+		field(1, integer(30)),
+		field(5, integer(0)),
+		field(6, integer(code)),
+		field(9, generalString("EXAMPLE.COM")),
+		field(10, principal(2, "krbtgt", "EXAMPLE.COM")),
+		field(11, generalString(text)))))
+}
+
+func asRep(eType byte) []byte {
+	return record(tlv(0x6b, tlv(0x30,
+		field(0, integer(5)),
+		field(1, integer(11)),
+		field(3, generalString("EXAMPLE.COM")),
+		field(4, principal(1, "alice")),
+		field(5, tlv(0x61, tlv(0x30))),
+		field(6, tlv(0x30, field(0, integer(eType)), field(2, tlv(0x04, []byte("cipher"))))))))
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	krbtgt := principal(2, "krbtgt", "EXAMPLE.COM")
+	http := principal(2, "HTTP", "web.example.com")
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(kdcReq(0x6a, principal(1, "alice"), krbtgt, 18, 17, 23)),
+		analyzertest.FromServerBytes(krbError(25, "Additional pre-authentication required")),
+		analyzertest.FromClientBytes(kdcReq(0x6a, principal(1, "alice"), krbtgt, 18, 17, 23)),
+		analyzertest.FromServerBytes(asRep(18)),
+		analyzertest.FromClientBytes(kdcReq(0x6c, nil, http, 18, 23)),
+		analyzertest.FromServerBytes(krbError(7, "")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "KerberosResponseError", MessageType: "AS", Realm: "EXAMPLE.COM", ClientName: "alice",
+			ServerName: "krbtgt/EXAMPLE.COM", ETypes: "aes256-cts-hmac-sha1-96,aes128-cts-hmac-sha1-96,rc4-hmac",
+			ErrorCode: 25, Error: "KDC_ERR_PREAUTH_REQUIRED", ErrorText: "Additional pre-authentication required"},
+		{SessionState: "KerberosResponseComplete", MessageType: "AS", Realm: "EXAMPLE.COM", ClientName: "alice",
+			ServerName: "krbtgt/EXAMPLE.COM", ETypes: "aes256-cts-hmac-sha1-96,aes128-cts-hmac-sha1-96,rc4-hmac",
+			ReplyEType: "aes256-cts-hmac-sha1-96"},
+		{SessionState: "KerberosResponseError", MessageType: "TGS", Realm: "EXAMPLE.COM",
+			ServerName: "HTTP/web.example.com", ETypes: "aes256-cts-hmac-sha1-96,rc4-hmac",
+			ErrorCode: 7, Error: "KDC_ERR_S_PRINCIPAL_UNKNOWN"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("Kerberos Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("Kerberos Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("Kerberos Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package kerberos
+
+import (
+	"fmt"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ber"
+	"strings"
+)
+
+// Message types by application tag.
+const (
+	msgASReq    = 10
+	msgASRep    = 11
+	msgTGSReq   = 12
+	msgTGSRep   = 13
+	msgKRBError = 30
+)
+
+var eTypeNames = map[int64]string{
+	1:  "des-cbc-crc",
+	3:  "des-cbc-md5",
+	16: "des3-cbc-sha1",
+	17: "aes128-cts-hmac-sha1-96",
+	18: "aes256-cts-hmac-sha1-96",
+	19: "aes128-cts-hmac-sha256-128",
+	20: "aes256-cts-hmac-sha384-192",
+	23: "rc4-hmac",
+	24: "rc4-hmac-exp",
+	25: "camellia128-cts-cmac",
+	26: "camellia256-cts-cmac",
+}
+
+func eTypeName(eType int64) string {
+	if name, ok := eTypeNames[eType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", eType)
+}
+
+var errorNames = map[int64]string{
+	0:  "KDC_ERR_NONE",
+	1:  "KDC_ERR_NAME_EXP",
+	2:  "KDC_ERR_SERVICE_EXP",
+	3:  "KDC_ERR_BAD_PVNO",
+	4:  "KDC_ERR_C_OLD_MAST_KVNO",
+	5:  "KDC_ERR_S_OLD_MAST_KVNO",
+	6:  "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	7:  "KDC_ERR_S_PRINCIPAL_UNKNOWN",
+	8:  "KDC_ERR_PRINCIPAL_NOT_UNIQUE",
+	9:  "KDC_ERR_NULL_KEY",
+	10: "KDC_ERR_CANNOT_POSTDATE",
+	11: "KDC_ERR_NEVER_VALID",
+	12: "KDC_ERR_POLICY",
+	13: "KDC_ERR_BADOPTION",
+	14: "KDC_ERR_ETYPE_NOSUPP",
+	15: "KDC_ERR_SUMTYPE_NOSUPP",
+	16: "KDC_ERR_PADATA_TYPE_NOSUPP",
+	17: "KDC_ERR_TRTYPE_NOSUPP",
+	18: "KDC_ERR_CLIENT_REVOKED",
+	19: "KDC_ERR_SERVICE_REVOKED",
+	20: "KDC_ERR_TGT_REVOKED",
+	21: "KDC_ERR_CLIENT_NOTYET",
+	22: "KDC_ERR_SERVICE_NOTYET",
+	23: "KDC_ERR_KEY_EXPIRED",
+	24: "KDC_ERR_PREAUTH_FAILED",
+	25: "KDC_ERR_PREAUTH_REQUIRED",
+	26: "KDC_ERR_SERVER_NOMATCH",
+	27: "KDC_ERR_MUST_USE_USER2USER",
+	28: "KDC_ERR_PATH_NOT_ACCEPTED",
+	29: "KDC_ERR_SVC_UNAVAILABLE",
+	31: "KRB_AP_ERR_BAD_INTEGRITY",
+	32: "KRB_AP_ERR_TKT_EXPIRED",
+	33: "KRB_AP_ERR_TKT_NYV",
+	34: "KRB_AP_ERR_REPEAT",
+	35: "KRB_AP_ERR_NOT_US",
+	36: "KRB_AP_ERR_BADMATCH",
+	37: "KRB_AP_ERR_SKEW",
+	38: "KRB_AP_ERR_BADADDR",
+	39: "KRB_AP_ERR_BADVERSION",
+	40: "KRB_AP_ERR_MSG_TYPE",
+	41: "KRB_AP_ERR_MODIFIED",
+	42: "KRB_AP_ERR_BADORDER",
+	44: "KRB_AP_ERR_BADKEYVER",
+	45: "KRB_AP_ERR_NOKEY",
+	46: "KRB_AP_ERR_MUT_FAIL",
+	47: "KRB_AP_ERR_BADDIRECTION",
+	48: "KRB_AP_ERR_METHOD",
+	49: "KRB_AP_ERR_BADSEQ",
+	50: "KRB_AP_ERR_INAPP_CKSUM",
+	52: "KRB_ERR_RESPONSE_TOO_BIG",
+	60: "KRB_ERR_GENERIC",
+	61: "KRB_ERR_FIELD_TOOLONG",
+	68: "KDC_ERR_WRONG_REALM",
+}
+
+func errorName(code int64) string {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", code)
+}
+
+// fields parse sequence of explicitly context tagged fields, it returns inner
+// elements by tag.
+func fields(e ber.Element) (map[int]ber.Element, bool) {
+	if !e.Is(ber.ClassUniversal, ber.TagSequence) {
+		return nil, false
+	}
+
+	children, err := e.Children()
+	if err != nil {
+		return nil, false
+	}
+
+	result := make(map[int]ber.Element, len(children))
+	for _, child := range children {
+		if child.Class != ber.ClassContext {
+			return nil, false
+		}
+		inner, _, err := ber.Parse(child.Content)
+		if err != nil {
+			return nil, false
+		}
+		result[child.Tag] = inner
+	}
+
+	return result, true
+}
+
+// unwrap parse sequence of fields inside application tagged message.
+func unwrap(msg ber.Element) (map[int]ber.Element, bool) {
+	inner, _, err := ber.Parse(msg.Content)
+	if err != nil {
+		return nil, false
+	}
+
+	return fields(inner)
+}
+
+// principalName format PrincipalName as components separated by "/".
+func principalName(e ber.Element) string {
+	f, ok := fields(e)
+	if !ok {
+		return ""
+	}
+
+	names, err := f[1].Children()
+	if err != nil {
+		return ""
+	}
+
+	components := make([]string, 0, len(names))
+	for _, name := range names {
+		components = append(components, name.String())
+	}
+
+	return strings.Join(components, "/")
+}
+
+// eTypes format sequence of encryption types.
+func eTypes(e ber.Element) string {
+	children, err := e.Children()
+	if err != nil {
+		return ""
+	}
+
+	names := make([]string, 0, len(children))
+	for _, child := range children {
+		if eType, err := child.Int(); err == nil {
+			names = append(names, eTypeName(eType))
+		}
+	}
+
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,397 @@
+package ldap
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ber"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "LDAPRequestSent"
+
+	case responseBegin:
+		return "LDAPResponseBegin"
+
+	case responseComplete:
+		return "LDAPResponseComplete"
+
+	case responseError:
+		return "LDAPResponseError"
+
+	default:
+		return "InvalidLDAPSessionState"
+	}
+}
+
+// maxMessageLen max length of LDAP message.
+const maxMessageLen = 16 * 1024 * 1024
+
+// session state of one request.
+type session struct {
+	resetFlag         bool
+	state             sessionState
+	messageID         int64
+	operation         string
+	dn                string
+	auth              string
+	scope             string
+	filter            string
+	extendedName      string
+	resultCode        int64
+	diagnosticMessage string
+	entries           int
+	references        int
+	startTLS          bool
+	reqTime           time.Time
+	respBeginTime     time.Time
+	respCompleteTime  time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.MessageID = s.messageID
+	sb.Operation = s.operation
+	sb.DN = s.dn
+	sb.Auth = s.auth
+	sb.Scope = s.scope
+	sb.Filter = s.filter
+	sb.ExtendedName = s.extendedName
+	if s.state == responseComplete || s.state == responseError {
+		sb.ResultCode = s.resultCode
+		sb.Result = resultName(s.resultCode)
+	}
+	sb.DiagnosticMessage = s.diagnosticMessage
+	sb.Entries = s.entries
+	sb.References = s.references
+	sb.StartTLS = s.startTLS
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// begin mark response begin.
+func (s *session) begin(timestamp time.Time) {
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = timestamp
+	}
+}
+
+// SessionBreakdown LDAP analyzer session breakdown of one request.
+type SessionBreakdown struct {
+	SessionState string `json:"ldap_session_state"`
+	MessageID    int64  `json:"ldap_message_id"`
+	Operation    string `json:"ldap_operation"`
+	// DN bind name, search base or entry of operation
+	DN    string `json:"ldap_dn,omitempty"`
+	Auth  string `json:"ldap_auth,omitempty"`
+	Scope string `json:"ldap_scope,omitempty"`
+	// Filter search filter with assertion values replaced by "?"
+	Filter            string `json:"ldap_filter,omitempty"`
+	ExtendedName      string `json:"ldap_extended_name,omitempty"`
+	ResultCode        int64  `json:"ldap_result_code"`
+	Result            string `json:"ldap_result,omitempty"`
+	DiagnosticMessage string `json:"ldap_diagnostic_message,omitempty"`
+	// Entries and References search result entries and references
+	Entries    int `json:"ldap_entries"`
+	References int `json:"ldap_references"`
+	// StartTLS session is upgraded to TLS by this request
+	StartTLS        bool `json:"ldap_starttls"`
+	ServerLatency   uint `json:"ldap_server_latency"`
+	DownloadLatency uint `json:"ldap_download_latency"`
+}
+
+// ApplicationLatency get LDAP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer LDAP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// sessions requests waiting for responses in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// upgraded session is upgraded to TLS and not parsable any more
+	upgraded bool
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init LDAP analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// findSession find session by message ID.
+func (a *Analyzer) findSession(messageID int64) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).messageID == messageID {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// parseRequest parse fields of request operation.
+func (s *session) parseRequest(op ber.Element) bool {
+	// Delete request is primitive DN
+	if op.Tag == opDelRequest {
+		s.dn = op.String()
+		return true
+	}
+
+	children, err := op.Children()
+	if err != nil {
+		return false
+	}
+
+	switch op.Tag {
+	case opBindRequest:
+		if len(children) < 3 {
+			return false
+		}
+		s.dn = children[1].String()
+		switch auth := children[2]; auth.Tag {
+		case 0:
+			s.auth = "simple"
+		case 3:
+			s.auth = "SASL"
+			if mechanism, err := auth.Children(); err == nil && len(mechanism) > 0 {
+				s.auth += " " + mechanism[0].String()
+			}
+		}
+
+	case opSearchRequest:
+		if len(children) < 7 {
+			return false
+		}
+		s.dn = children[0].String()
+		if scope, err := children[1].Int(); err == nil && scope >= 0 && int(scope) < len(scopeNames) {
+			s.scope = scopeNames[scope]
+		}
+		s.filter = summarizeFilter(children[6])
+
+	case opModifyRequest, opAddRequest, opModifyDNRequest, opCompareRequest:
+		if len(children) < 1 {
+			return false
+		}
+		s.dn = children[0].String()
+
+	case opExtendedRequest:
+		if len(children) < 1 || !children[0].Is(ber.ClassContext, 0) {
+			return false
+		}
+		s.extendedName = children[0].String()
+	}
+
+	return true
+}
+
+func (a *Analyzer) handleRequest(messageID int64, op ber.Element) {
+	name, ok := requestNames[op.Tag]
+	if !ok {
+		log.Errorf("LDAP Analyzer: invalid request operation %d.", op.Tag)
+		return
+	}
+
+	// Unbind and abandon requests have no response
+	if op.Tag == opUnbindRequest || op.Tag == opAbandonRequest {
+		return
+	}
+
+	s := &session{
+		state:     requestSent,
+		messageID: messageID,
+		operation: name,
+		reqTime:   a.timestamp,
+	}
+	if !s.parseRequest(op) {
+		log.Errorf("LDAP Analyzer: parse %s request error.", name)
+	}
+
+	a.sessions.PushBack(s)
+}
+
+func (a *Analyzer) handleResponse(messageID int64, op ber.Element) *SessionBreakdown {
+	e := a.findSession(messageID)
+	if e == nil {
+		// Unsolicited notification uses message ID 0
+		log.Debugf("LDAP Analyzer: response of unknown message ID %d.", messageID)
+		return nil
+	}
+
+	s := e.Value.(*session)
+	s.begin(a.timestamp)
+
+	switch op.Tag {
+	case opSearchResultEntry:
+		s.entries++
+		return nil
+
+	case opSearchResultReference:
+		s.references++
+		return nil
+
+	case opIntermediateResponse:
+		return nil
+	}
+
+	a.sessions.Remove(e)
+	s.respCompleteTime = a.timestamp
+	s.state = responseError
+
+	children, err := op.Children()
+	if err != nil || len(children) < 3 {
+		log.Errorf("LDAP Analyzer: invalid result of message ID %d.", messageID)
+		return s.toBreakdown()
+	}
+
+	code, err := children[0].Int()
+	if err != nil {
+		log.Errorf("LDAP Analyzer: invalid result code of message ID %d.", messageID)
+		return s.toBreakdown()
+	}
+	s.resultCode = code
+	s.diagnosticMessage = children[2].String()
+	if isSuccess(code) {
+		s.state = responseComplete
+	}
+
+	if op.Tag == opExtendedResponse && s.extendedName == startTLSOID && code == resultSuccess {
+		s.startTLS = true
+		a.upgraded = true
+	}
+
+	return s.toBreakdown()
+}
+
+// handleMessage handle one LDAP message.
+func (a *Analyzer) handleMessage(data []byte) *SessionBreakdown {
+	msg, _, err := ber.Parse(data)
+	if err != nil || !msg.Is(ber.ClassUniversal, ber.TagSequence) {
+		log.Error("LDAP Analyzer: invalid message.")
+		a.broken = true
+		return nil
+	}
+
+	children, err := msg.Children()
+	if err != nil || len(children) < 2 || children[1].Class != ber.ClassApplication {
+		log.Error("LDAP Analyzer: invalid message.")
+		a.broken = true
+		return nil
+	}
+
+	messageID, err := children[0].Int()
+	if err != nil {
+		log.Error("LDAP Analyzer: invalid message ID.")
+		a.broken = true
+		return nil
+	}
+
+	op := children[1]
+	if _, ok := requestNames[op.Tag]; ok {
+		a.handleRequest(messageID, op)
+		return nil
+	}
+
+	return a.handleResponse(messageID, op)
+}
+
+// HandleEstb LDAP analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("LDAP Analyzer: HandleEstb.")
+}
+
+// HandleData LDAP analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && !a.upgraded && parsed < len(payload) {
+		n, err := ber.Len(payload[parsed:])
+		if err == ber.ErrIncomplete {
+			break
+		}
+		if err != nil || n > maxMessageLen {
+			log.Errorf("LDAP Analyzer: invalid message length %d.", n)
+			a.broken = true
+			break
+		}
+		if len(payload)-parsed < n {
+			break
+		}
+
+		sb := a.handleMessage(payload[parsed : parsed+n])
+		parsed += n
+
+		if sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	// Data after TLS upgrade is ignored
+	if a.broken || a.upgraded {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset LDAP analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("LDAP Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("LDAP Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin LDAP analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("LDAP Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("LDAP Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
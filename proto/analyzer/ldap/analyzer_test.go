@@ -0,0 +1,152 @@
+package ldap
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"testing"
+	"time"
+)
+
+// tlv encode BER element of identifier and content.
+func tlv(identifier byte, content ...[]byte) []byte {
+	var data []byte
+	for _, c := range content {
+		data = append(data, c...)
+	}
+
+	header := []byte{identifier}
+	if len(data) < 0x80 {
+		header = append(header, byte(len(data)))
+	} else {
+		header = append(header, 0x82, byte(len(data)>>8), byte(len(data)))
+	}
+
+	return append(header, data...)
+}
+
+func str(identifier byte, s string) []byte {
+	return tlv(identifier, []byte(s))
+}
+
+func integer(identifier byte, v byte) []byte {
+	return tlv(identifier, []byte{v})
+}
+
+// message encode LDAP message of message ID and protocol operation.
+func message(id byte, op []byte) []byte {
+	return tlv(0x30, integer(0x02, id), op)
+}
+
+// result encode LDAPResult of response operation.
+func result(identifier byte, code byte, diagnosticMessage string) []byte {
+	return tlv(identifier, integer(0x0a, code), str(0x04, ""), str(0x04, diagnosticMessage))
+}
+
+func searchRequest(base string, scope byte, filter []byte) []byte {
+	return tlv(0x63,
+		str(0x04, base),
+		integer(0x0a, scope),
+		integer(0x0a, 0),
+		integer(0x02, 0),
+		integer(0x02, 0),
+		integer(0x01, 0),
+		filter,
+		tlv(0x30, str(0x04, "cn")))
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	// (&(objectClass=person)(cn=jo*)(mail=*))
+	filter := tlv(0xa0,
+		tlv(0xa3, str(0x04, "objectClass"), str(0x04, "person")),
+		tlv(0xa4, str(0x04, "cn"), tlv(0x30, str(0x80, "jo"))),
+		str(0x87, "mail"))
+
+	var pipelined []byte
+	pipelined = append(pipelined, message(3, searchRequest("ou=missing,dc=example,dc=com", 1,
+		tlv(0xa3, str(0x04, "uid"), str(0x04, "bob"))))...)
+	pipelined = append(pipelined, message(4, tlv(0x66, str(0x04, "cn=x,dc=example,dc=com"), tlv(0x30)))...)
+
+	var searchResults []byte
+	searchResults = append(searchResults, message(2, tlv(0x64, str(0x04, "cn=john,dc=example,dc=com"), tlv(0x30)))...)
+	searchResults = append(searchResults, message(2, tlv(0x64, str(0x04, "cn=joe,dc=example,dc=com"), tlv(0x30)))...)
+	searchResults = append(searchResults, message(2, tlv(0x73, str(0x04, "ldap://other/dc=example,dc=com")))...)
+	searchResults = append(searchResults, message(2, result(0x65, 0, ""))...)
+
+	var pipelinedResults []byte
+	pipelinedResults = append(pipelinedResults, message(4, result(0x67, 50, "no access"))...)
+	pipelinedResults = append(pipelinedResults, message(3, result(0x65, 32, ""))...)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(message(1, tlv(0x60, integer(0x02, 3), str(0x04, "cn=admin,dc=example,dc=com"), str(0x80, "secret")))),
+		analyzertest.FromServerBytes(message(1, result(0x61, 0, ""))),
+		analyzertest.FromClientBytes(message(2, searchRequest("dc=example,dc=com", 2, filter))),
+		analyzertest.FromServerBytes(searchResults),
+		analyzertest.FromClientBytes(pipelined),
+		analyzertest.FromServerBytes(pipelinedResults),
+		analyzertest.FromClientBytes(message(5, tlv(0x77, str(0x80, startTLSOID)))),
+		analyzertest.FromServerBytes(message(5, result(0x78, 0, ""))),
+		analyzertest.FromClientBytes([]byte("\x16\x03\x01\x00\x05hello")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "LDAPResponseComplete", MessageID: 1, Operation: "Bind", DN: "cn=admin,dc=example,dc=com",
+			Auth: "simple", Result: "success"},
+		{SessionState: "LDAPResponseComplete", MessageID: 2, Operation: "Search", DN: "dc=example,dc=com",
+			Scope: "sub", Filter: "(&(objectClass=?)(cn=*?*)(mail=*))", Result: "success", Entries: 2, References: 1},
+		{SessionState: "LDAPResponseError", MessageID: 4, Operation: "Modify", DN: "cn=x,dc=example,dc=com",
+			ResultCode: 50, Result: "insufficientAccessRights", DiagnosticMessage: "no access"},
+		{SessionState: "LDAPResponseError", MessageID: 3, Operation: "Search", DN: "ou=missing,dc=example,dc=com",
+			Scope: "one", Filter: "(uid=?)", ResultCode: 32, Result: "noSuchObject"},
+		{SessionState: "LDAPResponseComplete", MessageID: 5, Operation: "Extended", ExtendedName: startTLSOID,
+			Result: "success", StartTLS: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("LDAP Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("LDAP Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("LDAP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("LDAP Analyzer: get session breakdown %v on reset after TLS upgrade.", sb)
+	}
+}
+
+func TestAnalyzerReset(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(message(7, tlv(0x60, integer(0x02, 3), str(0x04, ""),
+			tlv(0xa3, str(0x04, "GSSAPI"), str(0x04, "token"))))),
+		analyzertest.FromClientBytes(message(8, searchRequest("dc=example,dc=com", 2, str(0x87, "objectClass")))),
+	})
+
+	sb := a.HandleReset(false, time.Now())
+	expected := SessionBreakdown{SessionState: "Reset:LDAPRequestSent", MessageID: 7, Operation: "Bind", Auth: "SASL GSSAPI"}
+	if sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("LDAP Analyzer: session breakdown is %+v, expected %+v.", sb, expected)
+	}
+
+	// Outstanding request after the first one is queued
+	sb = a.PopSessionBreakdown()
+	if sb == nil || sb.(*SessionBreakdown).MessageID != 8 || sb.(*SessionBreakdown).SessionState != "Reset:LDAPRequestSent" {
+		t.Errorf("LDAP Analyzer: get wrong queued session breakdown %+v on reset.", sb)
+	}
+}
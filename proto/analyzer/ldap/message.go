@@ -0,0 +1,219 @@
+package ldap
+
+import (
+	"fmt"
+	"github.com/zhengyuli/ntrace/proto/analyzer/ber"
+	"strings"
+)
+
+// Protocol operations by application tag.
+const (
+	opBindRequest           = 0
+	opBindResponse          = 1
+	opUnbindRequest         = 2
+	opSearchRequest         = 3
+	opSearchResultEntry     = 4
+	opSearchResultDone      = 5
+	opModifyRequest         = 6
+	opModifyResponse        = 7
+	opAddRequest            = 8
+	opAddResponse           = 9
+	opDelRequest            = 10
+	opDelResponse           = 11
+	opModifyDNRequest       = 12
+	opModifyDNResponse      = 13
+	opCompareRequest        = 14
+	opCompareResponse       = 15
+	opAbandonRequest        = 16
+	opSearchResultReference = 19
+	opExtendedRequest       = 23
+	opExtendedResponse      = 24
+	opIntermediateResponse  = 25
+)
+
+// requestNames names of request operations.
+var requestNames = map[int]string{
+	opBindRequest:     "Bind",
+	opUnbindRequest:   "Unbind",
+	opSearchRequest:   "Search",
+	opModifyRequest:   "Modify",
+	opAddRequest:      "Add",
+	opDelRequest:      "Delete",
+	opModifyDNRequest: "ModifyDN",
+	opCompareRequest:  "Compare",
+	opAbandonRequest:  "Abandon",
+	opExtendedRequest: "Extended",
+}
+
+// Result codes.
+const (
+	resultSuccess            = 0
+	resultCompareFalse       = 5
+	resultCompareTrue        = 6
+	resultReferral           = 10
+	resultSaslBindInProgress = 14
+)
+
+var resultNames = map[int64]string{
+	0:  "success",
+	1:  "operationsError",
+	2:  "protocolError",
+	3:  "timeLimitExceeded",
+	4:  "sizeLimitExceeded",
+	5:  "compareFalse",
+	6:  "compareTrue",
+	7:  "authMethodNotSupported",
+	8:  "strongerAuthRequired",
+	10: "referral",
+	11: "adminLimitExceeded",
+	12: "unavailableCriticalExtension",
+	13: "confidentialityRequired",
+	14: "saslBindInProgress",
+	16: "noSuchAttribute",
+	17: "undefinedAttributeType",
+	18: "inappropriateMatching",
+	19: "constraintViolation",
+	20: "attributeOrValueExists",
+	21: "invalidAttributeSyntax",
+	32: "noSuchObject",
+	33: "aliasProblem",
+	34: "invalidDNSyntax",
+	36: "aliasDereferencingProblem",
+	48: "inappropriateAuthentication",
+	49: "invalidCredentials",
+	50: "insufficientAccessRights",
+	51: "busy",
+	52: "unavailable",
+	53: "unwillingToPerform",
+	54: "loopDetect",
+	64: "namingViolation",
+	65: "objectClassViolation",
+	66: "notAllowedOnNonLeaf",
+	67: "notAllowedOnRDN",
+	68: "entryAlreadyExists",
+	69: "objectClassModsProhibited",
+	71: "affectsMultipleDSAs",
+	80: "other",
+}
+
+func resultName(code int64) string {
+	if name, ok := resultNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", code)
+}
+
+// isSuccess return true if result code is not error.
+func isSuccess(code int64) bool {
+	switch code {
+	case resultSuccess, resultCompareFalse, resultCompareTrue, resultReferral, resultSaslBindInProgress:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// startTLSOID OID of StartTLS extended request.
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+var scopeNames = []string{"base", "one", "sub"}
+
+// Filter choices by context tag.
+const (
+	filterAnd             = 0
+	filterOr              = 1
+	filterNot             = 2
+	filterEqualityMatch   = 3
+	filterSubstrings      = 4
+	filterGreaterOrEqual  = 5
+	filterLessOrEqual     = 6
+	filterPresent         = 7
+	filterApproxMatch     = 8
+	filterExtensibleMatch = 9
+)
+
+// maxFilterDepth max depth of nested filters summarized.
+const maxFilterDepth = 16
+
+// maxFilterLen max length of filter summary.
+const maxFilterLen = 1024
+
+// filterOperators operators of attribute value assertion filters.
+var filterOperators = map[int]string{
+	filterEqualityMatch:  "=",
+	filterGreaterOrEqual: ">=",
+	filterLessOrEqual:    "<=",
+	filterApproxMatch:    "~=",
+}
+
+// filterSummary summarize search filter in string representation with
+// assertion values replaced by "?".
+func filterSummary(e ber.Element, depth int) string {
+	if e.Class != ber.ClassContext || depth > maxFilterDepth {
+		return "(?)"
+	}
+
+	switch e.Tag {
+	case filterAnd, filterOr, filterNot:
+		children, err := e.Children()
+		if err != nil {
+			return "(?)"
+		}
+
+		op := map[int]string{filterAnd: "&", filterOr: "|", filterNot: "!"}[e.Tag]
+		parts := make([]string, 0, len(children))
+		for _, child := range children {
+			parts = append(parts, filterSummary(child, depth+1))
+		}
+		return "(" + op + strings.Join(parts, "") + ")"
+
+	case filterEqualityMatch, filterGreaterOrEqual, filterLessOrEqual, filterApproxMatch:
+		children, err := e.Children()
+		if err != nil || len(children) != 2 {
+			return "(?)"
+		}
+		return "(" + children[0].String() + filterOperators[e.Tag] + "?)"
+
+	case filterSubstrings:
+		children, err := e.Children()
+		if err != nil || len(children) != 2 {
+			return "(?)"
+		}
+		return "(" + children[0].String() + "=*?*)"
+
+	case filterPresent:
+		return "(" + e.String() + "=*)"
+
+	case filterExtensibleMatch:
+		// Matching rule [1], type [2] and dnAttributes [4] are optional
+		children, err := e.Children()
+		if err != nil {
+			return "(?)"
+		}
+		var attr, rule string
+		for _, child := range children {
+			switch child.Tag {
+			case 1:
+				rule = ":" + child.String()
+			case 2:
+				attr = child.String()
+			}
+		}
+		return "(" + attr + rule + ":=?)"
+
+	default:
+		return "(?)"
+	}
+}
+
+// summarizeFilter summarize search filter, long summary is truncated.
+func summarizeFilter(e ber.Element) string {
+	summary := filterSummary(e, 0)
+	if len(summary) > maxFilterLen {
+		return summary[:maxFilterLen] + "..."
+	}
+
+	return summary
+}
@@ -0,0 +1,263 @@
+package memcached
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "MemcachedRequestSent"
+
+	case responseBegin:
+		return "MemcachedResponseBegin"
+
+	case responseComplete:
+		return "MemcachedResponseComplete"
+
+	case responseError:
+		return "MemcachedResponseError"
+
+	default:
+		return "InvalidMemcachedSessionState"
+	}
+}
+
+// Protocol names.
+const (
+	protocolText   = "Text"
+	protocolBinary = "Binary"
+)
+
+// session state of one operation.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	command   string
+	key       string
+	// keys count of keys requested by text retrieval command
+	keys int
+	// kind expected response of text command
+	kind responseKind
+	// opcode, opaque and quiet of binary request
+	opcode           uint8
+	opaque           uint32
+	quiet            bool
+	hits             uint
+	misses           uint
+	valueSize        uint64
+	status           string
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+// begin mark response begin.
+func (s *session) begin(timestamp time.Time) {
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = timestamp
+	}
+}
+
+// SessionBreakdown memcached analyzer session breakdown of one operation.
+type SessionBreakdown struct {
+	SessionState    string `json:"memcached_session_state"`
+	Protocol        string `json:"memcached_protocol"`
+	Command         string `json:"memcached_command"`
+	Key             string `json:"memcached_key,omitempty"`
+	Hits            uint   `json:"memcached_hits"`
+	Misses          uint   `json:"memcached_misses"`
+	ValueSize       uint64 `json:"memcached_value_size"`
+	Status          string `json:"memcached_status,omitempty"`
+	ServerLatency   uint   `json:"memcached_server_latency"`
+	DownloadLatency uint   `json:"memcached_download_latency"`
+}
+
+// ApplicationLatency get memcached latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of value not received yet
+	skip int
+	// completing session completed once value is skipped
+	completing *session
+}
+
+// Analyzer memcached analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// protocol text or binary protocol decided by the first request
+	protocol string
+	client   halfConn
+	server   halfConn
+	// sessions operations waiting for responses in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init memcached analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// complete complete session and queue its session breakdown.
+func (a *Analyzer) complete(s *session) {
+	s.respCompleteTime = a.timestamp
+	if s.state != responseError {
+		s.state = responseComplete
+	}
+	a.Push(a.session2Breakdown(s))
+}
+
+func (a *Analyzer) session2Breakdown(s *session) *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Protocol = a.protocol
+	sb.Command = s.command
+	sb.Key = s.key
+	sb.Hits = s.hits
+	sb.Misses = s.misses
+	sb.ValueSize = s.valueSize
+	sb.Status = s.status
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// skip skip value bytes of half connection, it returns bytes skipped.
+func (a *Analyzer) skip(hc *halfConn, data []byte) int {
+	n := len(data)
+	if n > hc.skip {
+		n = hc.skip
+	}
+
+	if hc.skip -= n; hc.skip == 0 && hc.completing != nil {
+		a.complete(hc.completing)
+		hc.completing = nil
+	}
+
+	return n
+}
+
+// HandleEstb memcached analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("Memcached Analyzer: HandleEstb.")
+}
+
+// HandleData memcached analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	if a.broken || len(payload) == 0 {
+		return uint(len(payload)), nil
+	}
+
+	if a.protocol == "" {
+		if payload[0] == magicRequest || payload[0] == magicResponse {
+			a.protocol = protocolBinary
+		} else {
+			a.protocol = protocolText
+		}
+	}
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.Len() == 0 && parsed < len(payload) {
+		if hc.skip > 0 {
+			parsed += a.skip(hc, payload[parsed:])
+			continue
+		}
+
+		var n int
+		switch {
+		case a.protocol == protocolBinary && fromClient:
+			n = a.handleBinaryRequest(payload[parsed:])
+
+		case a.protocol == protocolBinary:
+			n = a.handleBinaryResponse(payload[parsed:])
+
+		case fromClient:
+			n = a.handleTextRequest(payload[parsed:])
+
+		default:
+			n = a.handleTextResponse(payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset memcached analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Memcached Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("Memcached Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		if !s.quiet || s.state != requestSent {
+			s.resetFlag = true
+			a.Push(a.session2Breakdown(s))
+		}
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin memcached analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Memcached Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("Memcached Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func check(t *testing.T, breakdowns []*SessionBreakdown, expected []SessionBreakdown) {
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("Memcached Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("Memcached Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("Memcached Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzerText(t *testing.T) {
+	large := strings.Repeat("x", 4096)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("set user:1 0 60 4096\r\n" + large + "\r\n"),
+		analyzertest.FromServer("STORED\r\n"),
+		analyzertest.FromClient("set hits 0 0 1 noreply\r\n0\r\nincr hits 1\r\nget user:1 user:2 hits\r\n"),
+		analyzertest.FromServer("2\r\nVALUE user:1 0 4096\r\n" + large + "\r\nVALUE hits 0 1\r\n2\r\nEND\r\n"),
+		analyzertest.FromClient("delete user:2\r\nstats\r\n"),
+		analyzertest.FromServer("NOT_FOUND\r\nSTAT pid 1\r\nSTAT uptime 10\r\nEND\r\n"),
+		analyzertest.FromClient("set bad 0 0 1\r\nx\r\n"),
+		analyzertest.FromServer("CLIENT_ERROR bad data chunk\r\n"),
+		analyzertest.FromClient("mg user:1 v\r\nmg user:3 v\r\n"),
+		analyzertest.FromServer("VA 2\r\nab\r\nEN\r\n"),
+	})
+
+	check(t, breakdowns, []SessionBreakdown{
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "set", Key: "user:1", ValueSize: 4096, Status: "STORED"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "incr", Key: "hits", Status: "VALUE"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "get", Key: "user:1", Hits: 2, Misses: 1,
+			ValueSize: 4097, Status: "END"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "delete", Key: "user:2", Status: "NOT_FOUND"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "stats", Status: "END"},
+		{SessionState: "MemcachedResponseError", Protocol: "Text", Command: "set", Key: "bad", ValueSize: 1,
+			Status: "CLIENT_ERROR bad data chunk"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "mg", Key: "user:1", Hits: 1, ValueSize: 2, Status: "VA"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Text", Command: "mg", Key: "user:3", Misses: 1, Status: "EN"},
+	})
+}
+
+// packet build binary protocol packet.
+func packet(magic byte, opcode uint8, status uint16, opaque uint32, extras string, key string, value string) string {
+	header := make([]byte, binaryHeaderLen)
+	header[0] = magic
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:], status)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:], opaque)
+
+	return string(header) + extras + key + value
+}
+
+func TestAnalyzerBinary(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(packet(magicRequest, opSet, 0, 1, strings.Repeat("\x00", 8), "user:1", "alice")),
+		analyzertest.FromServer(packet(magicResponse, opSet, statusNoError, 1, "", "", "")),
+		// Quiet retrieval terminated by Noop
+		analyzertest.FromClient(packet(magicRequest, opGetKQ, 0, 2, "", "user:1", "") +
+			packet(magicRequest, opGetKQ, 0, 3, "", "user:2", "") +
+			packet(magicRequest, opNoop, 0, 4, "", "", "")),
+		analyzertest.FromServer(packet(magicResponse, opGetKQ, statusNoError, 2, "\x00\x00\x00\x00", "user:1", "alice") +
+			packet(magicResponse, opNoop, statusNoError, 4, "", "", "")),
+		analyzertest.FromClient(packet(magicRequest, opIncrement, 0, 5, strings.Repeat("\x00", 20), "user:1", "")),
+		analyzertest.FromServer(packet(magicResponse, opIncrement, statusNonNumeric, 5, "", "", "Non-numeric server-side value for incr or decr")),
+	})
+
+	check(t, breakdowns, []SessionBreakdown{
+		{SessionState: "MemcachedResponseComplete", Protocol: "Binary", Command: "Set", Key: "user:1", ValueSize: 5, Status: "NoError"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Binary", Command: "GetKQ", Key: "user:1", Hits: 1, ValueSize: 5, Status: "NoError"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Binary", Command: "GetKQ", Key: "user:2", Misses: 1, Status: "KeyNotFound"},
+		{SessionState: "MemcachedResponseComplete", Protocol: "Binary", Command: "Noop", Status: "NoError"},
+		{SessionState: "MemcachedResponseError", Protocol: "Binary", Command: "Increment", Key: "user:1", Status: "NonNumericValue"},
+	})
+
+	if sb := a.HandleReset(true, time.Now()); sb != nil {
+		t.Errorf("Memcached Analyzer: get session breakdown %v on reset without pending request.", sb)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("get user:1\r\ndelete user:2\r\n"),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Command != "get" || breakdowns[1].Command != "delete" {
+		t.Fatalf("Memcached Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("Memcached Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Magic bytes of binary protocol packets.
+const (
+	magicRequest  byte = 0x80
+	magicResponse byte = 0x81
+)
+
+// binaryHeaderLen binary protocol packet header length.
+const binaryHeaderLen = 24
+
+// maxKeyLen max length of key.
+const maxKeyLen = 250
+
+// Opcodes of binary protocol.
+const (
+	opGet        uint8 = 0x00
+	opSet        uint8 = 0x01
+	opAdd        uint8 = 0x02
+	opReplace    uint8 = 0x03
+	opDelete     uint8 = 0x04
+	opIncrement  uint8 = 0x05
+	opDecrement  uint8 = 0x06
+	opQuit       uint8 = 0x07
+	opFlush      uint8 = 0x08
+	opGetQ       uint8 = 0x09
+	opNoop       uint8 = 0x0a
+	opVersion    uint8 = 0x0b
+	opGetK       uint8 = 0x0c
+	opGetKQ      uint8 = 0x0d
+	opAppend     uint8 = 0x0e
+	opPrepend    uint8 = 0x0f
+	opStat       uint8 = 0x10
+	opSetQ       uint8 = 0x11
+	opAddQ       uint8 = 0x12
+	opReplaceQ   uint8 = 0x13
+	opDeleteQ    uint8 = 0x14
+	opIncrementQ uint8 = 0x15
+	opDecrementQ uint8 = 0x16
+	opQuitQ      uint8 = 0x17
+	opFlushQ     uint8 = 0x18
+	opAppendQ    uint8 = 0x19
+	opPrependQ   uint8 = 0x1a
+	opTouch      uint8 = 0x1c
+	opGAT        uint8 = 0x1d
+	opGATQ       uint8 = 0x1e
+	opSASLList   uint8 = 0x20
+	opSASLAuth   uint8 = 0x21
+	opSASLStep   uint8 = 0x22
+	opGATK       uint8 = 0x23
+	opGATKQ      uint8 = 0x24
+)
+
+var opcodeNames = map[uint8]string{
+	opGet:        "Get",
+	opSet:        "Set",
+	opAdd:        "Add",
+	opReplace:    "Replace",
+	opDelete:     "Delete",
+	opIncrement:  "Increment",
+	opDecrement:  "Decrement",
+	opQuit:       "Quit",
+	opFlush:      "Flush",
+	opGetQ:       "GetQ",
+	opNoop:       "Noop",
+	opVersion:    "Version",
+	opGetK:       "GetK",
+	opGetKQ:      "GetKQ",
+	opAppend:     "Append",
+	opPrepend:    "Prepend",
+	opStat:       "Stat",
+	opSetQ:       "SetQ",
+	opAddQ:       "AddQ",
+	opReplaceQ:   "ReplaceQ",
+	opDeleteQ:    "DeleteQ",
+	opIncrementQ: "IncrementQ",
+	opDecrementQ: "DecrementQ",
+	opQuitQ:      "QuitQ",
+	opFlushQ:     "FlushQ",
+	opAppendQ:    "AppendQ",
+	opPrependQ:   "PrependQ",
+	opTouch:      "Touch",
+	opGAT:        "GAT",
+	opGATQ:       "GATQ",
+	opSASLList:   "SASLListMechs",
+	opSASLAuth:   "SASLAuth",
+	opSASLStep:   "SASLStep",
+	opGATK:       "GATK",
+	opGATKQ:      "GATKQ",
+}
+
+func opcodeName(opcode uint8) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%02x", opcode)
+}
+
+// isQuietOpcode return true if request has no response unless it fails, or
+// misses for quiet retrieval.
+func isQuietOpcode(opcode uint8) bool {
+	switch opcode {
+	case opGetQ, opGetKQ, opSetQ, opAddQ, opReplaceQ, opDeleteQ, opIncrementQ, opDecrementQ,
+		opQuitQ, opFlushQ, opAppendQ, opPrependQ, opGATQ, opGATKQ:
+		return true
+
+	default:
+		return false
+	}
+}
+
+func isRetrievalOpcode(opcode uint8) bool {
+	switch opcode {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ:
+		return true
+
+	default:
+		return false
+	}
+}
+
+func isStorageOpcode(opcode uint8) bool {
+	switch opcode {
+	case opSet, opAdd, opReplace, opAppend, opPrepend, opSetQ, opAddQ, opReplaceQ, opAppendQ, opPrependQ:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Response status of binary protocol.
+const (
+	statusNoError       uint16 = 0x0000
+	statusKeyNotFound   uint16 = 0x0001
+	statusKeyExists     uint16 = 0x0002
+	statusValueTooLarge uint16 = 0x0003
+	statusInvalidArgs   uint16 = 0x0004
+	statusNotStored     uint16 = 0x0005
+	statusNonNumeric    uint16 = 0x0006
+	statusAuthError     uint16 = 0x0020
+	statusAuthContinue  uint16 = 0x0021
+)
+
+var statusNames = map[uint16]string{
+	statusNoError:       "NoError",
+	statusKeyNotFound:   "KeyNotFound",
+	statusKeyExists:     "KeyExists",
+	statusValueTooLarge: "ValueTooLarge",
+	statusInvalidArgs:   "InvalidArguments",
+	statusNotStored:     "ItemNotStored",
+	statusNonNumeric:    "NonNumericValue",
+	statusAuthError:     "AuthError",
+	statusAuthContinue:  "AuthContinue",
+	0x0081:              "UnknownCommand",
+	0x0082:              "OutOfMemory",
+	0x0083:              "NotSupported",
+	0x0084:              "InternalError",
+	0x0085:              "Busy",
+	0x0086:              "TemporaryFailure",
+}
+
+func statusName(status uint16) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", status)
+}
+
+// isErrorStatus return true if status is error instead of normal result
+// like missing or existing key.
+func isErrorStatus(status uint16) bool {
+	switch status {
+	case statusNoError, statusKeyNotFound, statusKeyExists, statusNotStored, statusAuthContinue:
+		return false
+
+	default:
+		return true
+	}
+}
+
+// binaryHeader binary protocol packet header.
+type binaryHeader struct {
+	magic     byte
+	opcode    uint8
+	keyLen    int
+	extrasLen int
+	// status of response, vbucket id of request
+	status  uint16
+	bodyLen int
+	opaque  uint32
+}
+
+// parseBinaryHeader parse binary packet header, it returns nil if header is
+// invalid.
+func parseBinaryHeader(data []byte) *binaryHeader {
+	h := &binaryHeader{
+		magic:     data[0],
+		opcode:    data[1],
+		keyLen:    int(binary.BigEndian.Uint16(data[2:4])),
+		extrasLen: int(data[4]),
+		status:    binary.BigEndian.Uint16(data[6:8]),
+		bodyLen:   int(binary.BigEndian.Uint32(data[8:12])),
+		opaque:    binary.BigEndian.Uint32(data[12:16]),
+	}
+
+	if h.keyLen > maxKeyLen || h.bodyLen < 0 || h.keyLen+h.extrasLen > h.bodyLen {
+		return nil
+	}
+
+	return h
+}
+
+func (a *Analyzer) handleBinaryRequest(data []byte) int {
+	if len(data) < binaryHeaderLen {
+		return 0
+	}
+
+	h := parseBinaryHeader(data)
+	if h == nil || h.magic != magicRequest {
+		log.Errorf("Memcached Analyzer: invalid request header %x.", data[:binaryHeaderLen])
+		a.broken = true
+		return 0
+	}
+	if len(data) < binaryHeaderLen+h.extrasLen+h.keyLen {
+		return 0
+	}
+
+	keyOffset := binaryHeaderLen + h.extrasLen
+	s := &session{
+		state:   requestSent,
+		command: opcodeName(h.opcode),
+		key:     string(data[keyOffset : keyOffset+h.keyLen]),
+		opcode:  h.opcode,
+		opaque:  h.opaque,
+		quiet:   isQuietOpcode(h.opcode),
+		reqTime: a.timestamp,
+	}
+	valueLen := h.bodyLen - h.extrasLen - h.keyLen
+	if isStorageOpcode(h.opcode) {
+		s.valueSize = uint64(valueLen)
+	}
+	if h.opcode != opQuitQ {
+		a.sessions.PushBack(s)
+	}
+
+	a.client.skip = valueLen
+	return keyOffset + h.keyLen
+}
+
+// completeQuiet complete quiet requests before the response which means
+// they succeeded, or missed for quiet retrieval.
+func (a *Analyzer) completeQuiet(s *session) {
+	s.respBeginTime = a.timestamp
+	if isRetrievalOpcode(s.opcode) {
+		s.misses = 1
+		s.status = statusName(statusKeyNotFound)
+	} else {
+		s.status = statusName(statusNoError)
+	}
+	a.complete(s)
+}
+
+func (a *Analyzer) handleBinaryResponse(data []byte) int {
+	if len(data) < binaryHeaderLen {
+		return 0
+	}
+
+	h := parseBinaryHeader(data)
+	if h == nil || h.magic != magicResponse {
+		log.Errorf("Memcached Analyzer: invalid response header %x.", data[:binaryHeaderLen])
+		a.broken = true
+		return 0
+	}
+	a.server.skip = h.bodyLen
+
+	// Match request by opaque, requests before it are quiet ones or lost
+	var s *session
+	for e := a.sessions.Front(); e != nil; e = a.sessions.Front() {
+		candidate := e.Value.(*session)
+		if candidate.opaque == h.opaque && candidate.opcode == h.opcode {
+			s = candidate
+			break
+		}
+
+		a.sessions.Remove(e)
+		if candidate.quiet {
+			a.completeQuiet(candidate)
+		} else {
+			log.Debugf("Memcached Analyzer: request %s without response.", candidate.command)
+		}
+	}
+	if s == nil {
+		log.Debug("Memcached Analyzer: response without request.")
+		return binaryHeaderLen
+	}
+
+	s.begin(a.timestamp)
+
+	// Stat responses are terminated by response with empty key
+	if h.opcode == opStat && h.keyLen > 0 && h.status == statusNoError {
+		return binaryHeaderLen
+	}
+
+	a.sessions.Remove(a.sessions.Front())
+	s.status = statusName(h.status)
+	if isErrorStatus(h.status) {
+		s.state = responseError
+	}
+	if isRetrievalOpcode(h.opcode) {
+		switch h.status {
+		case statusNoError:
+			s.hits = 1
+			s.valueSize = uint64(h.bodyLen - h.extrasLen - h.keyLen)
+
+		case statusKeyNotFound:
+			s.misses = 1
+		}
+	}
+
+	// Session completes once the whole response body is received
+	if h.bodyLen > 0 {
+		a.server.completing = s
+	} else {
+		a.complete(s)
+	}
+
+	return binaryHeaderLen
+}
@@ -0,0 +1,252 @@
+package memcached
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// maxLineLen max length of command and response line.
+const maxLineLen = 64 * 1024
+
+// responseKind expected response of text command.
+type responseKind uint16
+
+const (
+	// respLine one response line
+	respLine responseKind = iota
+	// respRetrieval VALUE lines with data blocks terminated by END
+	respRetrieval
+	// respStats STAT lines terminated by END or other line
+	respStats
+)
+
+// readLine return line without CRLF and the length of line with CRLF, zero
+// length is returned if line is incomplete.
+func (a *Analyzer) readLine(data []byte) (string, int) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) > maxLineLen {
+			log.Errorf("Memcached Analyzer: line is longer than %d bytes.", maxLineLen)
+			a.broken = true
+		}
+		return "", 0
+	}
+
+	return string(data[:end]), end + 2
+}
+
+// isNoreply return true if field of storage command at index is noreply.
+func isNoreply(fields []string, index int) bool {
+	return len(fields) > index && fields[index] == "noreply"
+}
+
+// isQuiet return true if meta command has quiet mode flag.
+func isQuiet(flags []string) bool {
+	for _, flag := range flags {
+		if flag == "q" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dataLength parse length of data block, it returns -1 if length is
+// invalid.
+func (a *Analyzer) dataLength(field string) int {
+	length, err := strconv.Atoi(field)
+	if err != nil || length < 0 {
+		log.Errorf("Memcached Analyzer: invalid data length %q.", field)
+		a.broken = true
+		return -1
+	}
+
+	return length
+}
+
+// skipData skip data block and CRLF following it.
+func (hc *halfConn) skipData(length int) {
+	if length >= 0 {
+		hc.skip = length + 2
+	}
+}
+
+func (a *Analyzer) handleTextRequest(data []byte) int {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return n
+	}
+
+	s := &session{
+		state:   requestSent,
+		command: strings.ToLower(fields[0]),
+		reqTime: a.timestamp,
+	}
+	if len(fields) > 1 {
+		s.key = fields[1]
+	}
+
+	noreply := false
+	switch s.command {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(fields) < 5 {
+			break
+		}
+		length := a.dataLength(fields[4])
+		a.client.skipData(length)
+		s.valueSize = uint64(length)
+		if s.command == "cas" {
+			noreply = isNoreply(fields, 6)
+		} else {
+			noreply = isNoreply(fields, 5)
+		}
+
+	case "get", "gets":
+		s.kind = respRetrieval
+		s.keys = len(fields) - 1
+
+	case "gat", "gats":
+		s.kind = respRetrieval
+		s.keys = len(fields) - 2
+		s.key = ""
+		if len(fields) > 2 {
+			s.key = fields[2]
+		}
+
+	case "stats":
+		s.kind = respStats
+
+	case "delete", "incr", "decr", "touch", "flush_all", "verbosity":
+		noreply = fields[len(fields)-1] == "noreply"
+		if s.command == "flush_all" || s.command == "verbosity" {
+			s.key = ""
+		}
+
+	case "ms":
+		if len(fields) < 3 {
+			break
+		}
+		length := a.dataLength(fields[2])
+		a.client.skipData(length)
+		s.valueSize = uint64(length)
+		fallthrough
+
+	case "mg", "md", "ma":
+		// Responses of quiet mode are suppressed and not matchable in order
+		if len(fields) > 2 && isQuiet(fields[2:]) {
+			log.Debug("Memcached Analyzer: meta command of quiet mode is not supported.")
+			a.broken = true
+			return n
+		}
+
+	case "quit":
+		return n
+
+	case "mn", "version":
+		s.key = ""
+	}
+
+	if !noreply && !a.broken {
+		a.sessions.PushBack(s)
+	}
+
+	return n
+}
+
+// completeFront complete the front session.
+func (a *Analyzer) completeFront() {
+	front := a.sessions.Front()
+	a.sessions.Remove(front)
+	a.complete(front.Value.(*session))
+}
+
+func (a *Analyzer) handleTextResponse(data []byte) int {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return n
+	}
+
+	front := a.sessions.Front()
+	if front == nil {
+		log.Debug("Memcached Analyzer: response without request.")
+		switch {
+		case fields[0] == "VALUE" && len(fields) > 3:
+			a.server.skipData(a.dataLength(fields[3]))
+
+		case fields[0] == "VA" && len(fields) > 1:
+			a.server.skipData(a.dataLength(fields[1]))
+		}
+		return n
+	}
+
+	s := front.Value.(*session)
+	s.begin(a.timestamp)
+
+	switch fields[0] {
+	case "VALUE":
+		if len(fields) > 3 {
+			length := a.dataLength(fields[3])
+			a.server.skipData(length)
+			s.hits++
+			s.valueSize += uint64(length)
+		}
+		return n
+
+	case "VA":
+		if len(fields) > 1 {
+			a.sessions.Remove(front)
+			length := a.dataLength(fields[1])
+			a.server.skipData(length)
+			a.server.completing = s
+			s.hits = 1
+			s.valueSize = uint64(length)
+			s.status = fields[0]
+			return n
+		}
+
+	case "STAT":
+		if s.kind == respStats {
+			return n
+		}
+
+	case "END":
+		if s.kind == respRetrieval && s.keys > int(s.hits) {
+			s.misses = uint(s.keys) - s.hits
+		}
+
+	case "ERROR", "CLIENT_ERROR", "SERVER_ERROR":
+		s.state = responseError
+		s.status = line
+		a.completeFront()
+		return n
+
+	case "EN":
+		s.misses = 1
+
+	case "HD":
+		if s.command == "mg" {
+			s.hits = 1
+		}
+	}
+
+	if _, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+		s.status = "VALUE"
+	} else {
+		s.status = fields[0]
+	}
+	a.completeFront()
+
+	return n
+}
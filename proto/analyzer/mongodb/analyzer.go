@@ -0,0 +1,429 @@
+package mongodb
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "MongoDBRequestSent"
+
+	case responseBegin:
+		return "MongoDBResponseBegin"
+
+	case responseComplete:
+		return "MongoDBResponseComplete"
+
+	case responseError:
+		return "MongoDBResponseError"
+
+	default:
+		return "InvalidMongoDBSessionState"
+	}
+}
+
+// session state of one request.
+type session struct {
+	resetFlag  bool
+	state      sessionState
+	requestID  int32
+	database   string
+	collection string
+	command    string
+	// legacyCommand request is command of OP_QUERY on $cmd collection
+	legacyCommand    bool
+	ok               bool
+	errCode          int32
+	errMessage       string
+	requestDocs      int
+	returnedDocs     int
+	affectedDocs     int
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Database = s.database
+	sb.Collection = s.collection
+	sb.Command = s.command
+	sb.OK = s.ok
+	sb.ErrorCode = s.errCode
+	sb.ErrorMessage = s.errMessage
+	sb.RequestDocuments = s.requestDocs
+	sb.ReturnedDocuments = s.returnedDocs
+	sb.AffectedDocuments = s.affectedDocs
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown MongoDB analyzer session breakdown of one request.
+type SessionBreakdown struct {
+	SessionState      string `json:"mongodb_session_state"`
+	Database          string `json:"mongodb_database,omitempty"`
+	Collection        string `json:"mongodb_collection,omitempty"`
+	Command           string `json:"mongodb_command"`
+	OK                bool   `json:"mongodb_ok"`
+	ErrorCode         int32  `json:"mongodb_error_code,omitempty"`
+	ErrorMessage      string `json:"mongodb_error_message,omitempty"`
+	RequestDocuments  int    `json:"mongodb_request_documents"`
+	ReturnedDocuments int    `json:"mongodb_returned_documents"`
+	AffectedDocuments int    `json:"mongodb_affected_documents"`
+	ServerLatency     uint   `json:"mongodb_server_latency"`
+	DownloadLatency   uint   `json:"mongodb_download_latency"`
+}
+
+// ApplicationLatency get MongoDB latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer MongoDB analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// sessions requests waiting for replies
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init MongoDB analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// splitNamespace split full collection name into database and collection.
+func splitNamespace(namespace string) (string, string) {
+	if dot := strings.IndexByte(namespace, '.'); dot >= 0 {
+		return namespace[:dot], namespace[dot+1:]
+	}
+
+	return namespace, ""
+}
+
+// docsFields fields of documents of write commands.
+var docsFields = []string{"documents", "updates", "deletes"}
+
+// writeCommands commands whose reply has count of affected documents.
+var writeCommands = map[string]bool{
+	"insert": true,
+	"update": true,
+	"delete": true,
+}
+
+// parseCommand fill session with command document.
+func (s *session) parseCommand(body document, sequences map[string]int) {
+	elements, err := body.elements()
+	if err != nil || len(elements) == 0 {
+		return
+	}
+
+	// Legacy command could be wrapped by $query
+	if elements[0].name == "$query" {
+		if query, ok := elements[0].doc(); ok {
+			s.parseCommand(query, sequences)
+		}
+		return
+	}
+
+	s.command = elements[0].name
+	s.collection, _ = elements[0].str()
+	for _, e := range elements[1:] {
+		switch e.name {
+		case "$db":
+			s.database, _ = e.str()
+
+		case "collection":
+			if s.command == "getMore" {
+				s.collection, _ = e.str()
+			}
+		}
+	}
+
+	for _, field := range docsFields {
+		if e, ok := body.lookup(field); ok {
+			s.requestDocs += e.count()
+		}
+		s.requestDocs += sequences[field]
+	}
+}
+
+func (a *Analyzer) handleRequest(m *message) {
+	s := &session{
+		state:     requestSent,
+		requestID: m.requestID,
+		reqTime:   a.timestamp,
+	}
+
+	switch m.opcode {
+	case opMsg:
+		// No reply for request with moreToCome
+		if m.flags&flagMoreToCome != 0 || m.body == nil {
+			return
+		}
+		s.parseCommand(m.body, m.sequences)
+
+	case opQuery:
+		var collection string
+		s.database, collection = splitNamespace(m.collection)
+		if collection == "$cmd" {
+			s.legacyCommand = true
+			s.parseCommand(m.body, nil)
+		} else {
+			s.command = "query"
+			s.collection = collection
+		}
+
+	case opGetMore:
+		s.command = "getMore"
+		s.database, s.collection = splitNamespace(m.collection)
+
+	// Legacy write operations have no reply
+	default:
+		return
+	}
+
+	a.sessions.PushBack(s)
+}
+
+// findSession find session by request id.
+func (a *Analyzer) findSession(requestID int32) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).requestID == requestID {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// parseReply fill session with command reply document.
+func (s *session) parseReply(body document) {
+	elements, err := body.elements()
+	if err != nil {
+		return
+	}
+
+	for _, e := range elements {
+		switch e.name {
+		case "ok":
+			ok, _ := e.number()
+			s.ok = ok == 1
+
+		case "errmsg", "$err":
+			s.errMessage, _ = e.str()
+
+		case "code":
+			code, _ := e.number()
+			s.errCode = int32(code)
+
+		case "n":
+			if writeCommands[s.command] {
+				n, _ := e.number()
+				s.affectedDocs = int(n)
+			}
+
+		case "cursor":
+			if cursor, ok := e.doc(); ok {
+				if batch, ok := cursor.lookup("firstBatch"); ok {
+					s.returnedDocs = batch.count()
+				} else if batch, ok := cursor.lookup("nextBatch"); ok {
+					s.returnedDocs = batch.count()
+				}
+			}
+
+		case "writeErrors":
+			if writeErrors, ok := e.doc(); ok {
+				if first, ok := writeErrors.lookup("0"); ok {
+					if writeError, ok := first.doc(); ok {
+						s.parseReply(writeError)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (a *Analyzer) handleReply(m *message) *SessionBreakdown {
+	e := a.findSession(m.responseTo)
+	if e == nil {
+		log.Debugf("MongoDB Analyzer: reply to unknown request %d.", m.responseTo)
+		return nil
+	}
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.begin(a.timestamp)
+	s.respCompleteTime = a.timestamp
+
+	switch m.opcode {
+	case opMsg:
+		if m.body != nil {
+			s.parseReply(m.body)
+		}
+
+		// Exhaust cursor replies to this reply without request
+		if m.flags&flagMoreToCome != 0 {
+			a.sessions.PushBack(&session{
+				state:      requestSent,
+				requestID:  m.requestID,
+				database:   s.database,
+				collection: s.collection,
+				command:    "getMore",
+				reqTime:    a.timestamp,
+			})
+		}
+
+	case opReply:
+		switch {
+		case m.flags&replyQueryFailure != 0:
+			s.ok = false
+			if m.body != nil {
+				s.parseReply(m.body)
+			}
+
+		case s.legacyCommand:
+			if m.body != nil {
+				s.parseReply(m.body)
+			}
+
+		default:
+			s.ok = true
+			s.returnedDocs = m.documents
+		}
+
+	default:
+		log.Debugf("MongoDB Analyzer: unexpected reply opcode %d.", m.opcode)
+	}
+
+	if s.ok && s.errCode == 0 && s.errMessage == "" {
+		s.state = responseComplete
+	} else {
+		s.state = responseError
+	}
+
+	return s.toBreakdown()
+}
+
+// begin mark response begin.
+func (s *session) begin(timestamp time.Time) {
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = timestamp
+	}
+}
+
+// HandleEstb MongoDB analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("MongoDB Analyzer: HandleEstb.")
+}
+
+// HandleData MongoDB analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && len(payload)-parsed >= headerLen {
+		h := parseHeader(payload[parsed:])
+		if h.length < headerLen || h.length > maxMessageLen {
+			log.Errorf("MongoDB Analyzer: invalid message length %d.", h.length)
+			a.broken = true
+			break
+		}
+
+		if len(payload)-parsed < h.length {
+			// Reply begins before the whole message is received
+			if !fromClient {
+				if e := a.findSession(h.responseTo); e != nil {
+					e.Value.(*session).begin(timestamp)
+				}
+			}
+			break
+		}
+
+		raw := payload[parsed : parsed+h.length]
+		parsed += h.length
+
+		m, err := parseMessage(raw)
+		if err != nil {
+			log.Errorf("MongoDB Analyzer: parse message with opcode %d error: %s.", h.opcode, err)
+			continue
+		}
+		if m.checksumMismatch {
+			log.Warnf("MongoDB Analyzer: checksum of message %d is mismatched.", m.requestID)
+		}
+
+		if fromClient {
+			a.handleRequest(m)
+		} else if sb := a.handleReply(m); sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset MongoDB analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MongoDB Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("MongoDB Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin MongoDB analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MongoDB Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("MongoDB Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
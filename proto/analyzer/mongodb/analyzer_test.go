@@ -0,0 +1,219 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"hash/crc32"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func int32String(v int32) string {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	return string(b[:])
+}
+
+// doc build BSON document of elements.
+func doc(elements ...string) string {
+	var body string
+	for _, e := range elements {
+		body += e
+	}
+
+	return int32String(int32(len(body)+5)) + body + "\x00"
+}
+
+// array build BSON array of documents.
+func array(docs ...string) string {
+	var elements []string
+	for i, d := range docs {
+		elements = append(elements, sub(string(rune('0'+i)), d))
+	}
+
+	return doc(elements...)
+}
+
+func str(name string, value string) string {
+	return "\x02" + name + "\x00" + int32String(int32(len(value)+1)) + value + "\x00"
+}
+
+func i32(name string, value int32) string {
+	return "\x10" + name + "\x00" + int32String(value)
+}
+
+func dbl(name string, value float64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+	return "\x01" + name + "\x00" + string(b[:])
+}
+
+func sub(name string, d string) string {
+	return "\x03" + name + "\x00" + d
+}
+
+func arr(name string, d string) string {
+	return "\x04" + name + "\x00" + d
+}
+
+// buildMessage build message of opcode.
+func buildMessage(requestID int32, responseTo int32, opcode int32, body string) string {
+	return int32String(int32(headerLen+len(body))) + int32String(requestID) + int32String(responseTo) +
+		int32String(opcode) + body
+}
+
+// opMsgWithChecksum build OP_MSG message with checksum.
+func opMsgWithChecksum(requestID int32, responseTo int32, sections string) string {
+	m := buildMessage(requestID, responseTo, opMsg, int32String(int32(flagChecksumPresent))+sections+"0000")
+	m = m[:len(m)-4]
+	return m + int32String(int32(crc32.Checksum([]byte(m), crc32c)))
+}
+
+// compressed build OP_COMPRESSED message of message.
+func compressed(t *testing.T, m string, compressor uint8) string {
+	h := parseHeader([]byte(m))
+	body := []byte(m[headerLen:])
+
+	var data []byte
+	switch compressor {
+	case compressorSnappy:
+		data = snappy.Encode(nil, body)
+
+	case compressorZlib:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		data = buf.Bytes()
+
+	case compressorZstd:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = encoder.EncodeAll(body, nil)
+	}
+
+	return buildMessage(h.requestID, h.responseTo, opCompressed,
+		int32String(h.opcode)+int32String(int32(len(body)))+string([]byte{compressor})+string(data))
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	user := doc(str("name", "bob"))
+	insert := "\x00" + doc(str("insert", "users"), str("$db", "shop")) +
+		"\x01" + int32String(int32(4+len("documents\x00")+2*len(user))) + "documents\x00" + user + user
+	find := buildMessage(2, 0, opMsg, int32String(0)+"\x00"+doc(str("find", "users"), str("$db", "shop")))
+	findReply := buildMessage(102, 2, opMsg, int32String(0)+"\x00"+
+		doc(sub("cursor", doc(arr("firstBatch", array(user, user, user)))), dbl("ok", 1)))
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(opMsgWithChecksum(1, 0, insert)),
+		analyzertest.FromServer(opMsgWithChecksum(101, 1, "\x00"+doc(i32("n", 2), dbl("ok", 1)))),
+		analyzertest.FromClient(compressed(t, find, compressorSnappy)),
+		analyzertest.FromServer(compressed(t, findReply, compressorZstd)),
+		analyzertest.FromClient(compressed(t, buildMessage(3, 0, opMsg, int32String(0)+"\x00"+
+			doc(str("update", "users"), str("$db", "shop"), arr("updates", array(doc(), doc())))), compressorZlib)),
+		analyzertest.FromServer(buildMessage(103, 3, opMsg, int32String(0)+"\x00"+doc(i32("n", 0), arr("writeErrors",
+			array(doc(i32("index", 0), i32("code", 11000), str("errmsg", "E11000 duplicate key error")))), dbl("ok", 1)))),
+		// Legacy command and query
+		analyzertest.FromClient(buildMessage(4, 0, opQuery, int32String(0)+"admin.$cmd\x00"+int32String(0)+int32String(-1)+
+			doc(i32("isMaster", 1)))),
+		analyzertest.FromServer(buildMessage(104, 4, opReply, int32String(0)+"\x00\x00\x00\x00\x00\x00\x00\x00"+int32String(0)+
+			int32String(1)+doc(dbl("ok", 1)))),
+		analyzertest.FromClient(buildMessage(5, 0, opQuery, int32String(0)+"shop.users\x00"+int32String(0)+int32String(0)+doc())),
+		analyzertest.FromServer(buildMessage(105, 5, opReply, int32String(int32(replyQueryFailure))+"\x00\x00\x00\x00\x00\x00\x00\x00"+
+			int32String(0)+int32String(1)+doc(str("$err", "not authorized"), i32("code", 13)))),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "MongoDBResponseComplete", Database: "shop", Collection: "users", Command: "insert", OK: true,
+			RequestDocuments: 2, AffectedDocuments: 2},
+		{SessionState: "MongoDBResponseComplete", Database: "shop", Collection: "users", Command: "find", OK: true,
+			ReturnedDocuments: 3},
+		{SessionState: "MongoDBResponseError", Database: "shop", Collection: "users", Command: "update", OK: true,
+			ErrorCode: 11000, ErrorMessage: "E11000 duplicate key error", RequestDocuments: 2},
+		{SessionState: "MongoDBResponseComplete", Database: "admin", Command: "isMaster", OK: true},
+		{SessionState: "MongoDBResponseError", Database: "shop", Collection: "users", Command: "query",
+			ErrorCode: 13, ErrorMessage: "not authorized"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("MongoDB Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("MongoDB Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("MongoDB Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("MongoDB Analyzer: get session breakdown %v on reset without pending request.", sb)
+	}
+}
+
+func TestAnalyzerExhaust(t *testing.T) {
+	batch := func(requestID int32, responseTo int32, flags uint32, id int32) string {
+		return buildMessage(requestID, responseTo, opMsg, int32String(int32(flags))+"\x00"+
+			doc(sub("cursor", doc(arr("nextBatch", array(doc(i32("_id", id)))))), dbl("ok", 1)))
+	}
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(buildMessage(1, 0, opMsg, int32String(0)+"\x00"+doc(i32("getMore", 7), str("collection", "events"), str("$db", "log")))),
+		analyzertest.FromServer(batch(101, 1, flagMoreToCome, 1)),
+		analyzertest.FromServer(batch(102, 101, flagMoreToCome, 2)),
+		analyzertest.FromServer(batch(103, 102, 0, 3)),
+	})
+
+	if len(breakdowns) != 3 {
+		t.Fatalf("MongoDB Analyzer: get %d session breakdowns of exhaust cursor, expected 3.", len(breakdowns))
+	}
+	for _, sb := range breakdowns {
+		if sb.Command != "getMore" || sb.Collection != "events" || sb.Database != "log" || sb.ReturnedDocuments != 1 {
+			t.Errorf("MongoDB Analyzer: get wrong session breakdown %+v of exhaust cursor.", *sb)
+		}
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(buildMessage(1, 0, opMsg, int32String(0)+"\x00"+doc(str("find", "users"), str("$db", "shop"))) +
+			buildMessage(2, 0, opMsg, int32String(0)+"\x00"+doc(str("count", "users"), str("$db", "shop")))),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Command != "find" || breakdowns[1].Command != "count" {
+		t.Fatalf("MongoDB Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("MongoDB Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
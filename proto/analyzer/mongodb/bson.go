@@ -0,0 +1,216 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// BSON element types.
+const (
+	bsonDouble     byte = 0x01
+	bsonString     byte = 0x02
+	bsonDocument   byte = 0x03
+	bsonArray      byte = 0x04
+	bsonBinary     byte = 0x05
+	bsonUndefined  byte = 0x06
+	bsonObjectID   byte = 0x07
+	bsonBoolean    byte = 0x08
+	bsonDateTime   byte = 0x09
+	bsonNull       byte = 0x0a
+	bsonRegex      byte = 0x0b
+	bsonDBPointer  byte = 0x0c
+	bsonJavaScript byte = 0x0d
+	bsonSymbol     byte = 0x0e
+	bsonCodeScope  byte = 0x0f
+	bsonInt32      byte = 0x10
+	bsonTimestamp  byte = 0x11
+	bsonInt64      byte = 0x12
+	bsonDecimal128 byte = 0x13
+	bsonMinKey     byte = 0xff
+	bsonMaxKey     byte = 0x7f
+)
+
+var errInvalidBSON = errors.New("invalid BSON document")
+
+// document raw BSON document.
+type document []byte
+
+// readDocument read BSON document from the beginning of data.
+func readDocument(data []byte) (document, error) {
+	if len(data) < 5 {
+		return nil, errInvalidBSON
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 5 || length > len(data) || data[length-1] != 0 {
+		return nil, errInvalidBSON
+	}
+
+	return document(data[:length]), nil
+}
+
+// valueLen return length of element value of typ at the beginning of data.
+func valueLen(typ byte, data []byte) (int, error) {
+	switch typ {
+	case bsonUndefined, bsonNull, bsonMinKey, bsonMaxKey:
+		return 0, nil
+
+	case bsonBoolean:
+		return 1, nil
+
+	case bsonInt32:
+		return 4, nil
+
+	case bsonDouble, bsonDateTime, bsonTimestamp, bsonInt64:
+		return 8, nil
+
+	case bsonObjectID:
+		return 12, nil
+
+	case bsonDecimal128:
+		return 16, nil
+
+	case bsonString, bsonJavaScript, bsonSymbol, bsonDBPointer:
+		if len(data) < 4 {
+			return 0, errInvalidBSON
+		}
+		length := 4 + int(int32(binary.LittleEndian.Uint32(data)))
+		if typ == bsonDBPointer {
+			length += 12
+		}
+		return length, nil
+
+	case bsonDocument, bsonArray, bsonCodeScope:
+		if len(data) < 4 {
+			return 0, errInvalidBSON
+		}
+		return int(int32(binary.LittleEndian.Uint32(data))), nil
+
+	case bsonBinary:
+		if len(data) < 4 {
+			return 0, errInvalidBSON
+		}
+		return 5 + int(int32(binary.LittleEndian.Uint32(data))), nil
+
+	case bsonRegex:
+		pattern := bytes.IndexByte(data, 0)
+		if pattern < 0 {
+			return 0, errInvalidBSON
+		}
+		options := bytes.IndexByte(data[pattern+1:], 0)
+		if options < 0 {
+			return 0, errInvalidBSON
+		}
+		return pattern + options + 2, nil
+
+	default:
+		return 0, errInvalidBSON
+	}
+}
+
+// element element of BSON document.
+type element struct {
+	name  string
+	typ   byte
+	value []byte
+}
+
+// elements return elements of document in order.
+func (d document) elements() ([]element, error) {
+	var elements []element
+
+	data := d[4 : len(d)-1]
+	for len(data) > 0 {
+		typ := data[0]
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			return nil, errInvalidBSON
+		}
+		name := string(data[1 : 1+end])
+		data = data[end+2:]
+
+		length, err := valueLen(typ, data)
+		if err != nil || length < 0 || length > len(data) {
+			return nil, errInvalidBSON
+		}
+		elements = append(elements, element{name, typ, data[:length]})
+		data = data[length:]
+	}
+
+	return elements, nil
+}
+
+// lookup return element of document by name.
+func (d document) lookup(name string) (element, bool) {
+	elements, err := d.elements()
+	if err != nil {
+		return element{}, false
+	}
+
+	for _, e := range elements {
+		if e.name == name {
+			return e, true
+		}
+	}
+
+	return element{}, false
+}
+
+// str return value of string element.
+func (e element) str() (string, bool) {
+	if e.typ != bsonString || len(e.value) < 5 {
+		return "", false
+	}
+
+	return string(e.value[4 : len(e.value)-1]), true
+}
+
+// number return value of numeric or boolean element.
+func (e element) number() (float64, bool) {
+	switch e.typ {
+	case bsonDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(e.value)), true
+
+	case bsonInt32:
+		return float64(int32(binary.LittleEndian.Uint32(e.value))), true
+
+	case bsonInt64:
+		return float64(int64(binary.LittleEndian.Uint64(e.value))), true
+
+	case bsonBoolean:
+		if e.value[0] != 0 {
+			return 1, true
+		}
+		return 0, true
+
+	default:
+		return 0, false
+	}
+}
+
+// doc return value of document or array element.
+func (e element) doc() (document, bool) {
+	if e.typ != bsonDocument && e.typ != bsonArray {
+		return nil, false
+	}
+
+	d, err := readDocument(e.value)
+	return d, err == nil
+}
+
+// count return count of elements of document or array element.
+func (e element) count() int {
+	d, ok := e.doc()
+	if !ok {
+		return 0
+	}
+
+	elements, err := d.elements()
+	if err != nil {
+		return 0
+	}
+
+	return len(elements)
+}
@@ -0,0 +1,283 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// headerLen message header length.
+const headerLen = 16
+
+// maxMessageLen max message length of MongoDB.
+const maxMessageLen = 48 * 1000 * 1000
+
+// Opcodes.
+const (
+	opReply       int32 = 1
+	opUpdate      int32 = 2001
+	opInsert      int32 = 2002
+	opQuery       int32 = 2004
+	opGetMore     int32 = 2005
+	opDelete      int32 = 2006
+	opKillCursors int32 = 2007
+	opCompressed  int32 = 2012
+	opMsg         int32 = 2013
+)
+
+// OP_MSG flag bits.
+const (
+	flagChecksumPresent uint32 = 1 << 0
+	flagMoreToCome      uint32 = 1 << 1
+)
+
+// OP_REPLY response flag bits.
+const replyQueryFailure uint32 = 1 << 1
+
+// Compressor ids of OP_COMPRESSED.
+const (
+	compressorNoop   uint8 = 0
+	compressorSnappy uint8 = 1
+	compressorZlib   uint8 = 2
+	compressorZstd   uint8 = 3
+)
+
+var errInvalidMessage = errors.New("invalid message")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// header message header.
+type header struct {
+	length     int
+	requestID  int32
+	responseTo int32
+	opcode     int32
+}
+
+func parseHeader(data []byte) header {
+	return header{
+		length:     int(int32(binary.LittleEndian.Uint32(data))),
+		requestID:  int32(binary.LittleEndian.Uint32(data[4:])),
+		responseTo: int32(binary.LittleEndian.Uint32(data[8:])),
+		opcode:     int32(binary.LittleEndian.Uint32(data[12:])),
+	}
+}
+
+// message parsed message of interest.
+type message struct {
+	header
+	// flags flag bits of OP_MSG or OP_QUERY, response flags of OP_REPLY
+	flags uint32
+	// body body section of OP_MSG, query of OP_QUERY and the first document
+	// of OP_REPLY
+	body document
+	// sequences documents count of OP_MSG document sequences by identifier
+	sequences map[string]int
+	// collection full collection name of OP_QUERY and OP_GET_MORE
+	collection string
+	// documents documents count of OP_REPLY
+	documents int
+	// checksumMismatch checksum of OP_MSG is mismatched
+	checksumMismatch bool
+}
+
+// reader bounds checked little endian reader, any read out of bounds marks
+// reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (r *reader) cstring() string {
+	if r.failed {
+		return ""
+	}
+
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.failed = true
+		return ""
+	}
+
+	s := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return s
+}
+
+func (r *reader) document() document {
+	if r.failed {
+		return nil
+	}
+
+	d, err := readDocument(r.data)
+	if err != nil {
+		r.failed = true
+		return nil
+	}
+
+	r.data = r.data[len(d):]
+	return d
+}
+
+// decompress decompress OP_COMPRESSED message into message of original
+// opcode.
+func decompress(raw []byte) ([]byte, error) {
+	r := &reader{data: raw[headerLen:]}
+	originalOpcode := r.uint32()
+	uncompressedSize := int(int32(r.uint32()))
+	compressor := r.uint8()
+	if r.failed || uncompressedSize < 0 || uncompressedSize > maxMessageLen {
+		return nil, errInvalidMessage
+	}
+
+	var body []byte
+	var err error
+	switch compressor {
+	case compressorNoop:
+		body = r.data
+
+	case compressorSnappy:
+		body, err = snappy.Decode(nil, r.data)
+
+	case compressorZlib:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(r.data)); err == nil {
+			body, err = ioutil.ReadAll(io.LimitReader(zr, int64(uncompressedSize)+1))
+			zr.Close()
+		}
+
+	case compressorZstd:
+		body, err = zstdDecoder.DecodeAll(r.data, make([]byte, 0, uncompressedSize))
+
+	default:
+		return nil, fmt.Errorf("unknown compressor %d", compressor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != uncompressedSize {
+		return nil, errInvalidMessage
+	}
+
+	// Rebuild message with original opcode
+	decompressed := make([]byte, headerLen, headerLen+len(body))
+	copy(decompressed, raw[:headerLen])
+	binary.LittleEndian.PutUint32(decompressed, uint32(headerLen+len(body)))
+	binary.LittleEndian.PutUint32(decompressed[12:], originalOpcode)
+
+	return append(decompressed, body...), nil
+}
+
+// parseMessage parse the whole message including header.
+func parseMessage(raw []byte) (*message, error) {
+	m := &message{header: parseHeader(raw)}
+
+	if m.opcode == opCompressed {
+		decompressed, err := decompress(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = decompressed
+		m.header = parseHeader(raw)
+		if m.opcode == opCompressed {
+			return nil, errInvalidMessage
+		}
+	}
+
+	r := &reader{data: raw[headerLen:]}
+	switch m.opcode {
+	case opMsg:
+		m.flags = r.uint32()
+		if m.flags&flagChecksumPresent != 0 && len(raw) >= headerLen+8 {
+			checksum := binary.LittleEndian.Uint32(raw[len(raw)-4:])
+			m.checksumMismatch = crc32.Checksum(raw[:len(raw)-4], crc32c) != checksum
+			r.data = r.data[:len(r.data)-4]
+		}
+
+		m.sequences = make(map[string]int)
+		for !r.failed && len(r.data) > 0 {
+			switch kind := r.uint8(); kind {
+			case 0:
+				m.body = r.document()
+
+			case 1:
+				size := int(int32(r.uint32()))
+				seq := &reader{data: r.bytes(size - 4)}
+				identifier := seq.cstring()
+				for !seq.failed && len(seq.data) > 0 {
+					seq.document()
+					m.sequences[identifier]++
+				}
+				r.failed = r.failed || seq.failed
+
+			default:
+				return nil, fmt.Errorf("unknown section kind %d", kind)
+			}
+		}
+
+	case opQuery:
+		m.flags = r.uint32()
+		m.collection = r.cstring()
+		// Number to skip and number to return
+		r.bytes(8)
+		m.body = r.document()
+
+	case opGetMore:
+		r.bytes(4)
+		m.collection = r.cstring()
+
+	case opReply:
+		m.flags = r.uint32()
+		// Cursor id and starting from
+		r.bytes(12)
+		m.documents = int(int32(r.uint32()))
+		if m.documents > 0 {
+			m.body = r.document()
+		}
+
+	default:
+		return m, nil
+	}
+
+	if r.failed {
+		return nil, errInvalidMessage
+	}
+
+	return m, nil
+}
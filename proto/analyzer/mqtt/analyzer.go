@@ -0,0 +1,479 @@
+package mqtt
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+	messageSent
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "MQTTRequestSent"
+
+	case responseBegin:
+		return "MQTTResponseBegin"
+
+	case responseComplete:
+		return "MQTTResponseComplete"
+
+	case responseError:
+		return "MQTTResponseError"
+
+	case messageSent:
+		return "MQTTMessageSent"
+
+	default:
+		return "InvalidMQTTSessionState"
+	}
+}
+
+// maxPacketLen max length of packet buffered, payload of larger PUBLISH
+// packet is skipped.
+const maxPacketLen = 64 * 1024
+
+// session state of one CONNECT, PUBLISH, SUBSCRIBE or UNSUBSCRIBE.
+type session struct {
+	resetFlag  bool
+	state      sessionState
+	packetType uint8
+	// fromClient packet is sent by client
+	fromClient  bool
+	packetID    uint16
+	topic       string
+	topics      int
+	qos         uint8
+	retain      bool
+	payloadSize int
+	reasonCode  uint8
+	reqTime     time.Time
+	// ackTime time of CONNACK, PUBACK, PUBREC, SUBACK or UNSUBACK
+	ackTime time.Time
+	// completeTime time of PUBCOMP of QoS 2 PUBLISH
+	completeTime time.Time
+}
+
+// SessionBreakdown MQTT analyzer session breakdown of one CONNECT, PUBLISH,
+// SUBSCRIBE or UNSUBSCRIBE.
+type SessionBreakdown struct {
+	SessionState    string `json:"mqtt_session_state"`
+	ProtocolVersion uint8  `json:"mqtt_protocol_version"`
+	ClientID        string `json:"mqtt_client_id,omitempty"`
+	PacketType      string `json:"mqtt_packet_type"`
+	FromClient      bool   `json:"mqtt_from_client"`
+	PacketID        uint16 `json:"mqtt_packet_id,omitempty"`
+	Topic           string `json:"mqtt_topic,omitempty"`
+	Topics          int    `json:"mqtt_topics,omitempty"`
+	QoS             uint8  `json:"mqtt_qos"`
+	Retain          bool   `json:"mqtt_retain"`
+	PayloadSize     int    `json:"mqtt_payload_size"`
+	ReasonCode      uint8  `json:"mqtt_reason_code"`
+	// AckLatency latency of CONNACK, PUBACK, PUBREC, SUBACK or UNSUBACK
+	AckLatency uint `json:"mqtt_ack_latency"`
+	// CompleteLatency latency of PUBCOMP after PUBREC
+	CompleteLatency uint `json:"mqtt_complete_latency"`
+}
+
+// ApplicationLatency get MQTT latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.AckLatency+sb.CompleteLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of payload not received yet
+	skip int
+	// topicAliases topics of aliases of PUBLISH sent by this direction
+	topicAliases map[uint16]string
+}
+
+// Analyzer MQTT analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// version protocol level of CONNECT
+	version  uint8
+	clientID string
+	client   halfConn
+	server   halfConn
+	// sessions packets waiting for acknowledgements in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init MQTT analyzer init function.
+func (a *Analyzer) Init() {
+	a.version = version311
+	a.client.topicAliases = make(map[uint16]string)
+	a.server.topicAliases = make(map[uint16]string)
+	a.sessions.Init()
+}
+
+func (a *Analyzer) session2Breakdown(s *session) *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.ProtocolVersion = a.version
+	sb.ClientID = a.clientID
+	sb.PacketType = packetName(s.packetType)
+	sb.FromClient = s.fromClient
+	sb.PacketID = s.packetID
+	sb.Topic = s.topic
+	sb.Topics = s.topics
+	sb.QoS = s.qos
+	sb.Retain = s.retain
+	sb.PayloadSize = s.payloadSize
+	sb.ReasonCode = s.reasonCode
+
+	if s.ackTime.After(s.reqTime) {
+		sb.AckLatency = uint(s.ackTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.completeTime.After(s.ackTime) {
+		sb.CompleteLatency = uint(s.completeTime.Sub(s.ackTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// findSession find session of packet type sent by direction with packet id.
+func (a *Analyzer) findSession(packetType uint8, fromClient bool, packetID uint16) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		s := e.Value.(*session)
+		if s.packetType == packetType && s.fromClient == fromClient && s.packetID == packetID {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// complete complete session of element with reason code and queue its
+// session breakdown.
+func (a *Analyzer) complete(e *list.Element, reasonCode uint8) {
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.reasonCode = reasonCode
+	if s.ackTime.IsZero() {
+		s.ackTime = a.timestamp
+	}
+	// Return codes of CONNACK of MQTT 3 are failures except 0
+	if reasonCode >= failureCode || (s.packetType == packetConnect && reasonCode != 0) {
+		s.state = responseError
+	} else {
+		s.state = responseComplete
+	}
+	a.Push(a.session2Breakdown(s))
+}
+
+func (a *Analyzer) handleConnect(r *reader) {
+	// Protocol name
+	r.string()
+	a.version = r.uint8()
+	// Connect flags and keep alive
+	r.bytes(3)
+	if a.version >= version5 {
+		r.properties()
+	}
+	a.clientID = r.string()
+	if r.failed {
+		log.Error("MQTT Analyzer: invalid CONNECT packet.")
+		return
+	}
+
+	a.sessions.PushBack(&session{
+		state:      requestSent,
+		packetType: packetConnect,
+		fromClient: true,
+		reqTime:    a.timestamp,
+	})
+}
+
+func (a *Analyzer) handleConnack(r *reader) {
+	// Connect acknowledge flags
+	r.uint8()
+	reasonCode := r.uint8()
+	if a.version >= version5 {
+		if p := r.properties(); p.assignedClientID != "" {
+			a.clientID = p.assignedClientID
+		}
+	}
+
+	if e := a.findSession(packetConnect, true, 0); e != nil {
+		a.complete(e, reasonCode)
+	}
+}
+
+// handlePublish handle PUBLISH packet of remaining length, data may not
+// include the whole payload.
+func (a *Analyzer) handlePublish(hc *halfConn, flags uint8, r *reader, length int, fromClient bool) {
+	s := &session{
+		state:      requestSent,
+		packetType: packetPublish,
+		fromClient: fromClient,
+		qos:        (flags >> 1) & 0x03,
+		retain:     flags&0x01 != 0,
+		reqTime:    a.timestamp,
+	}
+
+	received := len(r.data)
+	s.topic = r.string()
+	if s.qos > 0 {
+		s.packetID = r.uint16()
+	}
+	if a.version >= version5 {
+		if p := r.properties(); p.topicAlias != 0 {
+			if s.topic == "" {
+				s.topic = hc.topicAliases[p.topicAlias]
+			} else {
+				hc.topicAliases[p.topicAlias] = s.topic
+			}
+		}
+	}
+	if r.failed {
+		log.Error("MQTT Analyzer: invalid PUBLISH packet.")
+		return
+	}
+	s.payloadSize = length - (received - len(r.data))
+
+	switch {
+	case s.qos == 0:
+		s.state = messageSent
+		a.Push(a.session2Breakdown(s))
+
+	// Duplicate delivery keeps the first one
+	case a.findSession(packetPublish, fromClient, s.packetID) == nil:
+		a.sessions.PushBack(s)
+	}
+}
+
+// handlePublishAck handle PUBACK, PUBREC or PUBCOMP of PUBLISH sent by peer.
+func (a *Analyzer) handlePublishAck(packetType uint8, r *reader, fromClient bool) {
+	packetID := r.uint16()
+	var reasonCode uint8
+	// Reason code of MQTT 5 is omitted for success
+	if len(r.data) > 0 {
+		reasonCode = r.uint8()
+	}
+
+	e := a.findSession(packetPublish, !fromClient, packetID)
+	if e == nil {
+		log.Debugf("MQTT Analyzer: %s of unknown packet id %d.", packetName(packetType), packetID)
+		return
+	}
+
+	s := e.Value.(*session)
+	switch {
+	case packetType == packetPuback && s.qos == 1:
+		a.complete(e, reasonCode)
+
+	case packetType == packetPubrec && s.qos == 2:
+		s.ackTime = a.timestamp
+		s.state = responseBegin
+		if reasonCode >= failureCode {
+			a.complete(e, reasonCode)
+		}
+
+	case packetType == packetPubcomp && s.qos == 2:
+		s.completeTime = a.timestamp
+		a.complete(e, reasonCode)
+	}
+}
+
+func (a *Analyzer) handleSubscribe(packetType uint8, r *reader) {
+	s := &session{
+		state:      requestSent,
+		packetType: packetType,
+		fromClient: true,
+		packetID:   r.uint16(),
+		reqTime:    a.timestamp,
+	}
+	if a.version >= version5 {
+		r.properties()
+	}
+
+	for !r.failed && len(r.data) > 0 {
+		topic := r.string()
+		if packetType == packetSubscribe {
+			// Subscription options
+			r.uint8()
+		}
+		if s.topics == 0 {
+			s.topic = topic
+		}
+		s.topics++
+	}
+	if r.failed {
+		log.Errorf("MQTT Analyzer: invalid %s packet.", packetName(packetType))
+		return
+	}
+
+	a.sessions.PushBack(s)
+}
+
+// handleSubscribeAck handle SUBACK or UNSUBACK, reason code is the first
+// failure of topic filters.
+func (a *Analyzer) handleSubscribeAck(packetType uint8, r *reader) {
+	packetID := r.uint16()
+	if a.version >= version5 {
+		r.properties()
+	}
+
+	var reasonCode uint8
+	for !r.failed && len(r.data) > 0 {
+		if code := r.uint8(); code >= failureCode && reasonCode == 0 {
+			reasonCode = code
+		}
+	}
+
+	request := packetSubscribe
+	if packetType == packetUnsuback {
+		request = packetUnsubscribe
+	}
+	if e := a.findSession(request, true, packetID); e != nil {
+		a.complete(e, reasonCode)
+	}
+}
+
+// handlePacket handle packet of remaining length, data may not include the
+// whole payload of PUBLISH.
+func (a *Analyzer) handlePacket(hc *halfConn, header uint8, data []byte, length int, fromClient bool) {
+	r := &reader{data: data}
+
+	switch packetType := header >> 4; packetType {
+	case packetConnect:
+		a.handleConnect(r)
+
+	case packetConnack:
+		a.handleConnack(r)
+
+	case packetPublish:
+		a.handlePublish(hc, header&0x0f, r, length, fromClient)
+
+	case packetPuback, packetPubrec, packetPubcomp:
+		a.handlePublishAck(packetType, r, fromClient)
+
+	case packetSubscribe, packetUnsubscribe:
+		a.handleSubscribe(packetType, r)
+
+	case packetSuback, packetUnsuback:
+		a.handleSubscribeAck(packetType, r)
+	}
+}
+
+// HandleEstb MQTT analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("MQTT Analyzer: HandleEstb.")
+}
+
+// HandleData MQTT analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.Len() == 0 && parsed < len(payload) {
+		data := payload[parsed:]
+
+		if hc.skip > 0 {
+			n := len(data)
+			if n > hc.skip {
+				n = hc.skip
+			}
+			hc.skip -= n
+			parsed += n
+			continue
+		}
+
+		length, n, err := remainingLength(data[1:])
+		if err != nil {
+			log.Error("MQTT Analyzer: invalid remaining length.")
+			a.broken = true
+			break
+		}
+		if n == 0 {
+			break
+		}
+
+		fixedHeaderLen := 1 + n
+		if fixedHeaderLen+length > len(data) {
+			// Only header of large PUBLISH is buffered
+			if data[0]>>4 != packetPublish || length <= maxPacketLen {
+				if length > maxPacketLen {
+					log.Errorf("MQTT Analyzer: invalid packet length %d.", length)
+					a.broken = true
+				}
+				break
+			}
+			if len(data) < fixedHeaderLen+maxPacketLen {
+				break
+			}
+
+			a.handlePacket(hc, data[0], data[fixedHeaderLen:], length, fromClient)
+			hc.skip = fixedHeaderLen + length - len(data)
+			parsed += len(data)
+			continue
+		}
+
+		a.handlePacket(hc, data[0], data[fixedHeaderLen:fixedHeaderLen+length], length, fromClient)
+		parsed += fixedHeaderLen + length
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset MQTT analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MQTT Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("MQTT Analyzer: HandleReset from server.")
+	}
+
+	for e := a.sessions.Front(); e != nil; e = a.sessions.Front() {
+		a.sessions.Remove(e)
+
+		s := e.Value.(*session)
+		s.resetFlag = true
+		a.Push(a.session2Breakdown(s))
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin MQTT analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MQTT Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("MQTT Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
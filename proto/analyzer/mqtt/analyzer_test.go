@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func str(s string) string {
+	return string([]byte{byte(len(s) >> 8), byte(len(s))}) + s
+}
+
+func id(v uint16) string {
+	return string([]byte{byte(v >> 8), byte(v)})
+}
+
+// packet build packet with fixed header.
+func packet(header uint8, body string) string {
+	var length []byte
+	for n := len(body); ; {
+		b := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			length = append(length, b|0x80)
+		} else {
+			length = append(length, b)
+			break
+		}
+	}
+
+	return string([]byte{header}) + string(length) + body
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(packet(0x10, str("MQTT")+"\x04\x02\x00\x3c"+str("sensor-1"))),
+		analyzertest.FromServer(packet(0x20, "\x00\x00")),
+		analyzertest.FromClient(packet(0x30, str("t/temp")+"21.5")),
+		analyzertest.FromClient(packet(0x32, str("t/hum")+id(1)+"40")),
+		analyzertest.FromServer(packet(0x40, id(1))),
+		analyzertest.FromClient(packet(0x82, id(2)+str("cmd/#")+"\x01")),
+		analyzertest.FromServer(packet(0x90, id(2)+"\x01")),
+		analyzertest.FromServer(packet(0x34, str("cmd/reboot")+id(7)+"now")),
+		analyzertest.FromClient(packet(0x50, id(7))),
+		analyzertest.FromServer(packet(0x62, id(7))),
+		analyzertest.FromClient(packet(0x70, id(7))),
+		analyzertest.FromClient(packet(0x82, id(3)+str("$SYS/#")+"\x00")),
+		analyzertest.FromServer(packet(0x90, id(3)+"\x80")),
+		// Payload of large message is skipped
+		analyzertest.FromClient(packet(0x33, str("fw/image")+id(4)+strings.Repeat("x", 70000))),
+		analyzertest.FromServer(packet(0x40, id(4))),
+		analyzertest.FromServer(packet(0xc0, "") + packet(0xd0, "")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "CONNECT",
+			FromClient: true},
+		{SessionState: "MQTTMessageSent", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "PUBLISH",
+			FromClient: true, Topic: "t/temp", PayloadSize: 4},
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "PUBLISH",
+			FromClient: true, PacketID: 1, Topic: "t/hum", QoS: 1, PayloadSize: 2},
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "SUBSCRIBE",
+			FromClient: true, PacketID: 2, Topic: "cmd/#", Topics: 1},
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "PUBLISH",
+			PacketID: 7, Topic: "cmd/reboot", QoS: 2, PayloadSize: 3},
+		{SessionState: "MQTTResponseError", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "SUBSCRIBE",
+			FromClient: true, PacketID: 3, Topic: "$SYS/#", Topics: 1, ReasonCode: 0x80},
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 4, ClientID: "sensor-1", PacketType: "PUBLISH",
+			FromClient: true, PacketID: 4, Topic: "fw/image", QoS: 1, Retain: true, PayloadSize: 70000},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("MQTT Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.PacketType != "PUBLISH" || sb.QoS != 0 {
+			if sb.AckLatency != 10 {
+				t.Errorf("MQTT Analyzer: session breakdown %d get wrong ack latency %d.", i, sb.AckLatency)
+			}
+			sb.AckLatency = 0
+		}
+		if sb.QoS == 2 {
+			if sb.CompleteLatency != 20 {
+				t.Errorf("MQTT Analyzer: session breakdown %d get wrong complete latency %d.", i, sb.CompleteLatency)
+			}
+			sb.CompleteLatency = 0
+		}
+		if *sb != expected[i] {
+			t.Errorf("MQTT Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("MQTT Analyzer: get session breakdown %v on reset without pending packet.", sb)
+	}
+}
+
+func TestAnalyzerVersion5(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(packet(0x10, str("MQTT")+"\x05\x02\x00\x3c"+"\x00"+str(""))),
+		analyzertest.FromServer(packet(0x20, "\x00\x00"+"\x0c\x12"+str("auto-1a2b"))),
+		// Topic alias is set by the first message and used by the next
+		analyzertest.FromClient(packet(0x32, str("a/b")+id(1)+"\x03\x23"+id(1)+"1")),
+		analyzertest.FromServer(packet(0x40, id(1)+"\x10\x00")),
+		analyzertest.FromClient(packet(0x32, str("")+id(2)+"\x03\x23"+id(1)+"2")),
+		analyzertest.FromServer(packet(0x40, id(2)+"\x87\x00")),
+		analyzertest.FromClient(packet(0x32, str("a/c")+id(3)+"\x00"+"3")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 5, ClientID: "auto-1a2b", PacketType: "CONNECT",
+			FromClient: true},
+		{SessionState: "MQTTResponseComplete", ProtocolVersion: 5, ClientID: "auto-1a2b", PacketType: "PUBLISH",
+			FromClient: true, PacketID: 1, Topic: "a/b", QoS: 1, PayloadSize: 1, ReasonCode: 0x10},
+		{SessionState: "MQTTResponseError", ProtocolVersion: 5, ClientID: "auto-1a2b", PacketType: "PUBLISH",
+			FromClient: true, PacketID: 2, Topic: "a/b", QoS: 1, PayloadSize: 1, ReasonCode: 0x87},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("MQTT Analyzer: get %d session breakdowns of MQTT 5, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		sb.AckLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("MQTT Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	sb, ok := a.HandleReset(true, time.Now()).(*SessionBreakdown)
+	if !ok || sb.SessionState != "Reset:MQTTRequestSent" || sb.Topic != "a/c" {
+		t.Errorf("MQTT Analyzer: get wrong session breakdown %v on reset.", sb)
+	}
+}
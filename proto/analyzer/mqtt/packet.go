@@ -0,0 +1,197 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Control packet types.
+const (
+	packetConnect     uint8 = 1
+	packetConnack     uint8 = 2
+	packetPublish     uint8 = 3
+	packetPuback      uint8 = 4
+	packetPubrec      uint8 = 5
+	packetPubrel      uint8 = 6
+	packetPubcomp     uint8 = 7
+	packetSubscribe   uint8 = 8
+	packetSuback      uint8 = 9
+	packetUnsubscribe uint8 = 10
+	packetUnsuback    uint8 = 11
+	packetPingreq     uint8 = 12
+	packetPingresp    uint8 = 13
+	packetDisconnect  uint8 = 14
+	packetAuth        uint8 = 15
+)
+
+var packetNames = map[uint8]string{
+	packetConnect:     "CONNECT",
+	packetConnack:     "CONNACK",
+	packetPublish:     "PUBLISH",
+	packetPuback:      "PUBACK",
+	packetPubrec:      "PUBREC",
+	packetPubrel:      "PUBREL",
+	packetPubcomp:     "PUBCOMP",
+	packetSubscribe:   "SUBSCRIBE",
+	packetSuback:      "SUBACK",
+	packetUnsubscribe: "UNSUBSCRIBE",
+	packetUnsuback:    "UNSUBACK",
+	packetPingreq:     "PINGREQ",
+	packetPingresp:    "PINGRESP",
+	packetDisconnect:  "DISCONNECT",
+	packetAuth:        "AUTH",
+}
+
+func packetName(packetType uint8) string {
+	if name, ok := packetNames[packetType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Reserved(%d)", packetType)
+}
+
+// Protocol levels.
+const (
+	version311 uint8 = 4
+	version5   uint8 = 5
+)
+
+// failureCode the first reason code of failure.
+const failureCode uint8 = 0x80
+
+// Properties of interest.
+const (
+	propertyAssignedClientID uint8 = 0x12
+	propertyTopicAlias       uint8 = 0x23
+)
+
+var errInvalidPacket = errors.New("invalid packet")
+
+// remainingLength decode remaining length of fixed header, it returns 0 bytes
+// used if remaining length is incomplete.
+func remainingLength(data []byte) (length int, n int, err error) {
+	for n < len(data) {
+		b := data[n]
+		length |= int(b&0x7f) << (7 * uint(n))
+		n++
+		if b&0x80 == 0 {
+			return length, n, nil
+		}
+		if n == 4 {
+			return 0, 0, errInvalidPacket
+		}
+	}
+
+	return 0, 0, nil
+}
+
+// reader bounds checked big endian reader of packet fields, any read out of
+// bounds marks reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *reader) varint() int {
+	if r.failed {
+		return 0
+	}
+
+	v, n, err := remainingLength(r.data)
+	if err != nil || n == 0 {
+		r.failed = true
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+// properties properties of interest of MQTT 5.
+type properties struct {
+	topicAlias       uint16
+	assignedClientID string
+}
+
+// properties read properties of MQTT 5.
+func (r *reader) properties() properties {
+	var p properties
+
+	props := &reader{data: r.bytes(r.varint())}
+	for !props.failed && len(props.data) > 0 {
+		switch id := props.uint8(); id {
+		// Byte
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			props.uint8()
+
+		// Two byte integer
+		case 0x13, 0x21, 0x22:
+			props.uint16()
+
+		case propertyTopicAlias:
+			p.topicAlias = props.uint16()
+
+		// Four byte integer
+		case 0x02, 0x11, 0x18, 0x27:
+			props.bytes(4)
+
+		// Variable byte integer
+		case 0x0b:
+			props.varint()
+
+		// UTF-8 string
+		case 0x03, 0x08, 0x15, 0x1a, 0x1c, 0x1f:
+			props.string()
+
+		case propertyAssignedClientID:
+			p.assignedClientID = props.string()
+
+		// Binary data
+		case 0x09, 0x16:
+			props.string()
+
+		// UTF-8 string pair
+		case 0x26:
+			props.string()
+			props.string()
+
+		default:
+			props.failed = true
+		}
+	}
+	r.failed = r.failed || props.failed
+
+	return p
+}
@@ -0,0 +1,649 @@
+package mysql
+
+import (
+	"container/list"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/sql"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	commandSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case commandSent:
+		return "MySQLCommandSent"
+
+	case responseBegin:
+		return "MySQLResponseBegin"
+
+	case responseComplete:
+		return "MySQLResponseComplete"
+
+	case responseError:
+		return "MySQLResponseError"
+
+	default:
+		return "InvalidMySQLSessionState"
+	}
+}
+
+// connPhase phase of MySQL connection.
+type connPhase uint16
+
+const (
+	// phaseHandshake waits for initial handshake of server
+	phaseHandshake connPhase = iota
+	// phaseAuth waits for authentication result
+	phaseAuth
+	phaseCommand
+)
+
+// respState parse state of command response.
+type respState uint16
+
+const (
+	// respFirst waits for the first packet of response or next result set
+	respFirst respState = iota
+	respColumns
+	respColumnsEOF
+	respRows
+	// respDefinitions parameter and column definitions of prepared statement
+	respDefinitions
+	respFieldList
+	respLocalInfile
+	// respAuth authentication exchange of COM_CHANGE_USER
+	respAuth
+)
+
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	command          uint8
+	query            string
+	schema           string
+	user             string
+	respState        respState
+	remaining        uint64
+	rows             uint64
+	affectedRows     uint64
+	warnings         uint16
+	errCode          uint16
+	sqlState         string
+	errMessage       string
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (a *Analyzer) session2Breakdown(s *session) *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.ServerVersion = a.serverVersion
+	sb.User = a.user
+	sb.Schema = a.schema
+	sb.Command = commandName(s.command)
+	if s.query != "" {
+		sb.SQL = sql.Normalize(s.query, sql.MySQL)
+	}
+	sb.Rows = s.rows
+	sb.AffectedRows = s.affectedRows
+	sb.Warnings = s.warnings
+	sb.ErrorCode = s.errCode
+	sb.SQLState = s.sqlState
+	sb.ErrorMessage = s.errMessage
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown MySQL analyzer session breakdown of one command.
+type SessionBreakdown struct {
+	SessionState    string `json:"mysql_session_state"`
+	ServerVersion   string `json:"mysql_server_version,omitempty"`
+	User            string `json:"mysql_user,omitempty"`
+	Schema          string `json:"mysql_schema,omitempty"`
+	Command         string `json:"mysql_command"`
+	SQL             string `json:"mysql_sql,omitempty"`
+	Rows            uint64 `json:"mysql_rows"`
+	AffectedRows    uint64 `json:"mysql_affected_rows"`
+	Warnings        uint16 `json:"mysql_warnings,omitempty"`
+	ErrorCode       uint16 `json:"mysql_error_code,omitempty"`
+	SQLState        string `json:"mysql_sql_state,omitempty"`
+	ErrorMessage    string `json:"mysql_error_message,omitempty"`
+	ServerLatency   uint   `json:"mysql_server_latency"`
+	DownloadLatency uint   `json:"mysql_download_latency"`
+}
+
+// ApplicationLatency get MySQL latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// continued packet of max payload length is continued by next packet
+	continued bool
+	// skip bytes of large row packet not received yet
+	skip int
+}
+
+// Analyzer MySQL analyzer.
+type Analyzer struct {
+	timestamp     time.Time
+	client        halfConn
+	server        halfConn
+	phase         connPhase
+	serverVersion string
+	capabilities  uint32
+	user          string
+	schema        string
+	// authTime time of handshake response for failed authentication
+	authTime time.Time
+	// statements queries of prepared statements by statement id
+	statements map[uint32]string
+	sessions   list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is encrypted or not parsable any more
+	broken bool
+}
+
+// Init MySQL analyzer init function.
+func (a *Analyzer) Init() {
+	a.phase = phaseHandshake
+	a.capabilities = clientProtocol41
+	a.statements = make(map[uint32]string)
+	a.sessions.Init()
+}
+
+func (a *Analyzer) handleClientPacket(seq uint8, payload []byte) {
+	switch a.phase {
+	case phaseHandshake:
+		// Connection is captured after handshake
+		if seq == 0 {
+			a.phase = phaseCommand
+			a.handleCommand(payload)
+		}
+
+	case phaseAuth:
+		// Only the first packet from client is handshake response
+		if seq != 1 {
+			return
+		}
+
+		resp, ok := parseHandshakeResponse(payload)
+		if !ok {
+			log.Error("MySQL Analyzer: parse handshake response error.")
+			a.broken = true
+			return
+		}
+		if resp.sslRequest {
+			log.Debug("MySQL Analyzer: connection switches to TLS.")
+			a.broken = true
+			return
+		}
+		if resp.capabilities&a.capabilities&clientCompress != 0 {
+			log.Debug("MySQL Analyzer: compressed protocol is not supported.")
+			a.broken = true
+			return
+		}
+
+		a.capabilities &= resp.capabilities
+		a.user = resp.user
+		a.schema = resp.schema
+		a.authTime = a.timestamp
+
+	case phaseCommand:
+		// Packets of command other than the first one are data of LOCAL
+		// INFILE or authentication exchange
+		if seq == 0 {
+			a.handleCommand(payload)
+		}
+	}
+}
+
+func (a *Analyzer) handleCommand(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	s := &session{
+		state:   commandSent,
+		command: payload[0],
+		reqTime: a.timestamp,
+	}
+	data := payload[1:]
+
+	switch s.command {
+	// Commands without response
+	case comQuit, comStmtSendLongData:
+		return
+
+	case comStmtClose:
+		if len(data) >= 4 {
+			delete(a.statements, binary.LittleEndian.Uint32(data))
+		}
+		return
+
+	case comQuery:
+		s.query = parseQuery(data, a.capabilities)
+
+	case comStmtPrepare:
+		s.query = string(data)
+
+	case comStmtExecute, comStmtFetch, comStmtReset:
+		if len(data) >= 4 {
+			s.query = a.statements[binary.LittleEndian.Uint32(data)]
+		}
+		if s.command == comStmtFetch {
+			s.respState = respRows
+		}
+
+	case comInitDB:
+		s.schema = string(data)
+
+	case comChangeUser:
+		r := &reader{data: data}
+		s.user = r.nulString()
+	}
+
+	a.sessions.PushBack(s)
+}
+
+// completeSession complete the front session and return its breakdown.
+func (a *Analyzer) completeSession(s *session) *SessionBreakdown {
+	s.respCompleteTime = a.timestamp
+	if s.state != responseError {
+		s.state = responseComplete
+
+		switch s.command {
+		case comInitDB:
+			a.schema = s.schema
+
+		case comChangeUser:
+			a.user = s.user
+			a.statements = make(map[uint32]string)
+		}
+	}
+
+	a.sessions.Remove(a.sessions.Front())
+	return a.session2Breakdown(s)
+}
+
+func (a *Analyzer) onOK(s *session, payload []byte) *okPacket {
+	ok := parseOK(payload, a.capabilities)
+	s.affectedRows += ok.affectedRows
+	s.warnings += ok.warnings
+
+	return ok
+}
+
+func (a *Analyzer) onERR(s *session, payload []byte) {
+	e := parseERR(payload)
+	s.state = responseError
+	s.errCode = e.code
+	s.sqlState = e.sqlState
+	s.errMessage = e.message
+}
+
+// onResultSetEnd handle terminator of result set, returns true if there is
+// no more result set.
+func (a *Analyzer) onResultSetEnd(s *session, payload []byte) bool {
+	var status *okPacket
+	if a.capabilities&clientDeprecateEOF != 0 {
+		status = parseOK(payload, a.capabilities)
+	} else {
+		status = parseEOF(payload)
+	}
+	s.warnings += status.warnings
+
+	if status.statusFlags&serverMoreResultsExists != 0 {
+		s.respState = respFirst
+		return false
+	}
+
+	return true
+}
+
+func (a *Analyzer) handleAuthPacket(payload []byte) *SessionBreakdown {
+	switch payload[0] {
+	case packetOK:
+		a.phase = phaseCommand
+
+	case packetERR:
+		// Failed authentication is reported as Connect command
+		s := &session{
+			state:         responseError,
+			command:       comConnect,
+			reqTime:       a.authTime,
+			respBeginTime: a.timestamp,
+		}
+		if s.reqTime.IsZero() {
+			s.reqTime = a.timestamp
+		}
+		a.onERR(s, payload)
+		s.respCompleteTime = a.timestamp
+		a.broken = true
+
+		return a.session2Breakdown(s)
+	}
+
+	return nil
+}
+
+func (a *Analyzer) handleServerPacket(seq uint8, payload []byte) *SessionBreakdown {
+	switch a.phase {
+	case phaseHandshake:
+		if len(payload) > 0 && payload[0] == packetERR {
+			return a.handleAuthPacket(payload)
+		}
+
+		hs, ok := parseHandshake(payload)
+		if !ok {
+			log.Error("MySQL Analyzer: parse initial handshake error.")
+			a.broken = true
+			return nil
+		}
+		a.serverVersion = hs.serverVersion
+		a.capabilities = hs.capabilities
+		a.phase = phaseAuth
+		return nil
+
+	case phaseAuth:
+		if len(payload) == 0 {
+			return nil
+		}
+		return a.handleAuthPacket(payload)
+	}
+
+	front := a.sessions.Front()
+	if front == nil || len(payload) == 0 {
+		return nil
+	}
+
+	s := front.Value.(*session)
+	if s.state == commandSent {
+		s.state = responseBegin
+		s.respBeginTime = a.timestamp
+	}
+
+	header := payload[0]
+	switch s.respState {
+	case respFirst:
+		switch {
+		case header == packetERR:
+			a.onERR(s, payload)
+			return a.completeSession(s)
+
+		case s.command == comStatistics:
+			return a.completeSession(s)
+
+		case s.command == comStmtPrepare && header == packetOK:
+			r := &reader{data: payload[1:]}
+			stmtID := r.uint32()
+			columns := uint64(r.uint16())
+			params := uint64(r.uint16())
+			if !r.failed {
+				a.statements[stmtID] = s.query
+			}
+
+			// Definitions are terminated by EOF unless it's deprecated
+			for _, n := range []uint64{params, columns} {
+				if n > 0 {
+					s.remaining += n
+					if a.capabilities&clientDeprecateEOF == 0 {
+						s.remaining++
+					}
+				}
+			}
+			if s.remaining == 0 {
+				return a.completeSession(s)
+			}
+			s.respState = respDefinitions
+
+		case header == packetOK:
+			if a.onOK(s, payload).statusFlags&serverMoreResultsExists != 0 {
+				return nil
+			}
+			return a.completeSession(s)
+
+		case s.command == comChangeUser:
+			// Authentication switch or more data
+			s.respState = respAuth
+
+		case header == packetLocalInfile:
+			s.respState = respLocalInfile
+
+		// COM_SET_OPTION and COM_DEBUG are answered by EOF
+		case header == packetEOF && len(payload) < maxEOFPacketLen:
+			return a.completeSession(s)
+
+		case s.command == comFieldList:
+			s.respState = respFieldList
+			return a.handleServerPacket(seq, payload)
+
+		default:
+			r := &reader{data: payload}
+			s.remaining = r.lenencInt()
+			s.respState = respColumns
+			if r.failed || s.remaining == 0 {
+				log.Errorf("MySQL Analyzer: invalid column count of %s response.", commandName(s.command))
+				a.broken = true
+			}
+		}
+
+	case respColumns:
+		if s.remaining--; s.remaining == 0 {
+			if a.capabilities&clientDeprecateEOF != 0 {
+				s.respState = respRows
+			} else {
+				s.respState = respColumnsEOF
+			}
+		}
+
+	case respColumnsEOF:
+		// Rows follow definitions directly if CLIENT_DEPRECATE_EOF is not
+		// known for connection captured after handshake
+		if header != packetEOF || len(payload) >= maxEOFPacketLen {
+			s.rows++
+			s.respState = respRows
+			return nil
+		}
+
+		// Rows of cursor are fetched by COM_STMT_FETCH
+		if parseEOF(payload).statusFlags&serverStatusCursorExists != 0 {
+			return a.completeSession(s)
+		}
+		s.respState = respRows
+
+	case respRows:
+		switch {
+		case header == packetERR:
+			a.onERR(s, payload)
+			return a.completeSession(s)
+
+		case isEOF(payload, a.capabilities):
+			if a.onResultSetEnd(s, payload) {
+				return a.completeSession(s)
+			}
+
+		default:
+			s.rows++
+		}
+
+	case respDefinitions:
+		if s.remaining--; s.remaining == 0 {
+			return a.completeSession(s)
+		}
+
+	case respFieldList:
+		if header == packetERR {
+			a.onERR(s, payload)
+			return a.completeSession(s)
+		}
+		if isEOF(payload, a.capabilities) {
+			return a.completeSession(s)
+		}
+
+	case respLocalInfile, respAuth:
+		switch header {
+		case packetOK:
+			a.onOK(s, payload)
+			return a.completeSession(s)
+
+		case packetERR:
+			a.onERR(s, payload)
+			return a.completeSession(s)
+		}
+	}
+
+	return nil
+}
+
+// skipIncomplete return true if incomplete packet is row or continuation
+// packet which is skipped without waiting for the whole packet.
+func (a *Analyzer) skipIncomplete(hc *halfConn, body []byte) bool {
+	if hc.continued {
+		return true
+	}
+
+	front := a.sessions.Front()
+	if front == nil || len(body) == 0 {
+		return false
+	}
+
+	s := front.Value.(*session)
+	if s.respState != respRows || body[0] == packetEOF || body[0] == packetERR {
+		return false
+	}
+	s.rows++
+
+	return true
+}
+
+// HandleEstb MySQL analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("MySQL Analyzer: HandleEstb.")
+}
+
+// HandleData MySQL analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken {
+		if hc.skip > 0 {
+			n := len(payload) - parsed
+			if n > hc.skip {
+				n = hc.skip
+			}
+			parsed += n
+			if hc.skip -= n; hc.skip > 0 {
+				break
+			}
+		}
+
+		if len(payload)-parsed < packetHeaderLen {
+			break
+		}
+		header := payload[parsed : parsed+packetHeaderLen]
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		seq := header[3]
+
+		if len(payload)-parsed < packetHeaderLen+length {
+			if !fromClient && a.skipIncomplete(hc, payload[parsed+packetHeaderLen:]) {
+				hc.continued = length == maxPacketPayloadLen
+				hc.skip = packetHeaderLen + length
+				continue
+			}
+			break
+		}
+
+		packet := payload[parsed+packetHeaderLen : parsed+packetHeaderLen+length]
+		parsed += packetHeaderLen + length
+
+		// Continuation packets are ignored, the first one is parsed
+		continued := hc.continued
+		hc.continued = length == maxPacketPayloadLen
+		if continued {
+			continue
+		}
+
+		if fromClient {
+			a.handleClientPacket(seq, packet)
+		} else if sb := a.handleServerPacket(seq, packet); sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset MySQL analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MySQL Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("MySQL Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.sessions.Remove(front)
+
+		a.Push(a.session2Breakdown(s))
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin MySQL analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("MySQL Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("MySQL Analyzer: HandleFin from server.")
+	}
+
+	// Server closes connection without response of pending commands
+	for front := a.sessions.Front(); front != nil && !fromClient; front = a.sessions.Front() {
+		s := front.Value.(*session)
+		a.sessions.Remove(front)
+
+		a.Push(a.session2Breakdown(s))
+	}
+
+	return a.PopSessionBreakdown()
+}
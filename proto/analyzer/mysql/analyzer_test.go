@@ -0,0 +1,167 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packet build MySQL packet.
+func packet(seq uint8, payload string) string {
+	return string([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}) + payload
+}
+
+func uint32String(v uint32) string {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return string(b[:])
+}
+
+func greeting(capabilities uint32) string {
+	return "\x0a8.0.36\x00" + uint32String(7) + "12345678\x00" +
+		string([]byte{byte(capabilities), byte(capabilities >> 8), 0x21, 0x02, 0x00,
+			byte(capabilities >> 16), byte(capabilities >> 24), 21}) +
+		strings.Repeat("\x00", 10) + "123456789012\x00mysql_native_password\x00"
+}
+
+func handshakeResponsePacket(capabilities uint32, user string, schema string) string {
+	return uint32String(capabilities) + uint32String(1<<24) + "\x21" + strings.Repeat("\x00", 23) +
+		user + "\x00" + "\x14" + strings.Repeat("a", 20) + schema + "\x00"
+}
+
+const (
+	eof         = "\xfe\x00\x00\x02\x00"
+	columnDef   = "\x03def\x04shop\x05users\x05users\x02id\x02id\x0c\x3f\x00\x0b\x00\x00\x00\x03\x03\x42\x00\x00\x00"
+	okAffected5 = "\x00\x05\x00\x02\x00\x00\x00"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	capabilities := clientProtocol41 | clientSecureConnection | clientConnectWithDB
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer(packet(0, greeting(capabilities))),
+		analyzertest.FromClient(packet(1, handshakeResponsePacket(capabilities, "app", "shop"))),
+		analyzertest.FromServer(packet(2, "\x00\x00\x00\x02\x00\x00\x00")),
+		analyzertest.FromClient(packet(0, "\x03SELECT id FROM users WHERE id IN (1, 2, 3)")),
+		analyzertest.FromServer(packet(1, "\x01") + packet(2, columnDef) + packet(3, eof) +
+			packet(4, "\x011") + packet(5, "\x012") + packet(6, "\xfb") + packet(7, eof)),
+		analyzertest.FromClient(packet(0, "\x03UPDATE users SET name = 'bob' WHERE id > 10")),
+		analyzertest.FromServer(packet(1, okAffected5)),
+		analyzertest.FromClient(packet(0, "\x03SELEC 1")),
+		analyzertest.FromServer(packet(1, "\xff\x28\x04#42000You have an error in your SQL syntax")),
+		analyzertest.FromClient(packet(0, "\x16SELECT id FROM users WHERE id = ?")),
+		analyzertest.FromServer(packet(1, "\x00"+uint32String(1)+"\x01\x00\x01\x00\x00\x00\x00") +
+			packet(2, columnDef) + packet(3, eof) + packet(4, columnDef) + packet(5, eof)),
+		analyzertest.FromClient(packet(0, "\x17"+uint32String(1)+"\x00\x01\x00\x00\x00\x00\x01\x08\x00"+strings.Repeat("\x00", 8))),
+		analyzertest.FromServer(packet(1, "\x01") + packet(2, columnDef) + packet(3, eof) +
+			packet(4, "\x00\x00"+strings.Repeat("\x01", 8)) + packet(5, eof)),
+		analyzertest.FromClient(packet(0, "\x02other")),
+		analyzertest.FromServer(packet(1, "\x00\x00\x00\x02\x00\x00\x00")),
+		analyzertest.FromClient(packet(0, "\x01")),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "MySQLResponseComplete", Command: "Query", SQL: "SELECT id FROM users WHERE id IN (?)", Rows: 3, Schema: "shop"},
+		{SessionState: "MySQLResponseComplete", Command: "Query", SQL: "UPDATE users SET name = ? WHERE id > ?", AffectedRows: 5, Schema: "shop"},
+		{SessionState: "MySQLResponseError", Command: "Query", SQL: "SELEC ?", ErrorCode: 1064, SQLState: "42000",
+			ErrorMessage: "You have an error in your SQL syntax", Schema: "shop"},
+		{SessionState: "MySQLResponseComplete", Command: "StmtPrepare", SQL: "SELECT id FROM users WHERE id = ?", Schema: "shop"},
+		{SessionState: "MySQLResponseComplete", Command: "StmtExecute", SQL: "SELECT id FROM users WHERE id = ?", Rows: 1, Schema: "shop"},
+		{SessionState: "MySQLResponseComplete", Command: "InitDB", Schema: "other"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("MySQL Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerVersion != "8.0.36" || sb.User != "app" || sb.ServerLatency != 10 {
+			t.Errorf("MySQL Analyzer: get wrong connection info %+v.", *sb)
+		}
+		sb.ServerVersion, sb.User, sb.ServerLatency = "", "", 0
+		if *sb != expected[i] {
+			t.Errorf("MySQL Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzerDeprecateEOF(t *testing.T) {
+	capabilities := clientProtocol41 | clientSecureConnection | clientDeprecateEOF
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer(packet(0, greeting(capabilities))),
+		analyzertest.FromClient(packet(1, handshakeResponsePacket(capabilities, "app", ""))),
+		analyzertest.FromServer(packet(2, "\x00\x00\x00\x02\x00\x00\x00")),
+		// Multiple result sets of stored procedure
+		analyzertest.FromClient(packet(0, "\x03CALL report(2024)")),
+		analyzertest.FromServer(packet(1, "\x01") + packet(2, columnDef) + packet(3, "\x011") +
+			packet(4, "\xfe\x00\x00\x0a\x00\x00\x00") +
+			packet(5, "\x01") + packet(6, columnDef) + packet(7, "\x011") + packet(8, "\x012") +
+			packet(9, "\xfe\x00\x00\x02\x00\x00\x00")),
+	})
+
+	if len(breakdowns) != 1 || breakdowns[0].Rows != 3 || breakdowns[0].SQL != "CALL report(?)" {
+		t.Fatalf("MySQL Analyzer: get wrong session breakdowns %v.", breakdowns)
+	}
+
+	sb := a.HandleReset(false, time.Now())
+	if sb != nil {
+		t.Errorf("MySQL Analyzer: get session breakdown %v on reset without pending command.", sb)
+	}
+}
+
+func TestAnalyzerAuthError(t *testing.T) {
+	capabilities := clientProtocol41 | clientSecureConnection
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer(packet(0, greeting(capabilities))),
+		analyzertest.FromClient(packet(1, handshakeResponsePacket(capabilities, "app", ""))),
+		analyzertest.FromServer(packet(2, "\xff\x15\x04#28000Access denied for user 'app'")),
+	})
+
+	if len(breakdowns) != 1 || breakdowns[0].Command != "Connect" || breakdowns[0].ErrorCode != 1045 ||
+		breakdowns[0].User != "app" || breakdowns[0].ServerLatency != 10 {
+		t.Fatalf("MySQL Analyzer: get wrong authentication error session breakdowns %v.", breakdowns)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	capabilities := clientProtocol41 | clientSecureConnection
+
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromServer(packet(0, greeting(capabilities))),
+		analyzertest.FromClient(packet(1, handshakeResponsePacket(capabilities, "app", ""))),
+		analyzertest.FromServer(packet(2, "\x00\x00\x00\x02\x00\x00\x00")),
+		analyzertest.FromClient(packet(0, "\x03SELECT 1") + packet(0, "\x03SELECT 2")),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 {
+		t.Fatalf("MySQL Analyzer: get %d session breakdowns on reset, expected 2.", len(breakdowns))
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") || sb.SQL != "SELECT ?" {
+			t.Errorf("MySQL Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
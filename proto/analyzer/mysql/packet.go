@@ -0,0 +1,416 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// packetHeaderLen MySQL packet header length, 3 bytes payload length and 1
+// byte sequence id.
+const packetHeaderLen = 4
+
+// maxPacketPayloadLen payload of max length is continued by next packet.
+const maxPacketPayloadLen = 0xffffff
+
+// Capability flags.
+const (
+	clientConnectWithDB        uint32 = 0x00000008
+	clientCompress             uint32 = 0x00000020
+	clientProtocol41           uint32 = 0x00000200
+	clientSSL                  uint32 = 0x00000800
+	clientSecureConnection     uint32 = 0x00008000
+	clientPluginAuthLenencData uint32 = 0x00200000
+	clientDeprecateEOF         uint32 = 0x01000000
+	clientQueryAttributes      uint32 = 0x08000000
+)
+
+// Server status flags.
+const (
+	serverMoreResultsExists  uint16 = 0x0008
+	serverStatusCursorExists uint16 = 0x0040
+)
+
+// Packet headers of server responses.
+const (
+	packetOK          byte = 0x00
+	packetLocalInfile byte = 0xfb
+	packetEOF         byte = 0xfe
+	packetERR         byte = 0xff
+)
+
+// maxEOFPacketLen EOF packet is shorter than 9 bytes which distinguishes it
+// from row beginning with 8 bytes length encoded integer.
+const maxEOFPacketLen = 9
+
+// Command codes.
+const (
+	comSleep            uint8 = 0x00
+	comQuit             uint8 = 0x01
+	comInitDB           uint8 = 0x02
+	comQuery            uint8 = 0x03
+	comFieldList        uint8 = 0x04
+	comCreateDB         uint8 = 0x05
+	comDropDB           uint8 = 0x06
+	comRefresh          uint8 = 0x07
+	comShutdown         uint8 = 0x08
+	comStatistics       uint8 = 0x09
+	comProcessInfo      uint8 = 0x0a
+	comConnect          uint8 = 0x0b
+	comProcessKill      uint8 = 0x0c
+	comDebug            uint8 = 0x0d
+	comPing             uint8 = 0x0e
+	comChangeUser       uint8 = 0x11
+	comBinlogDump       uint8 = 0x12
+	comStmtPrepare      uint8 = 0x16
+	comStmtExecute      uint8 = 0x17
+	comStmtSendLongData uint8 = 0x18
+	comStmtClose        uint8 = 0x19
+	comStmtReset        uint8 = 0x1a
+	comSetOption        uint8 = 0x1b
+	comStmtFetch        uint8 = 0x1c
+	comResetConnection  uint8 = 0x1f
+)
+
+var commandNames = map[uint8]string{
+	comSleep:            "Sleep",
+	comQuit:             "Quit",
+	comInitDB:           "InitDB",
+	comQuery:            "Query",
+	comFieldList:        "FieldList",
+	comCreateDB:         "CreateDB",
+	comDropDB:           "DropDB",
+	comRefresh:          "Refresh",
+	comShutdown:         "Shutdown",
+	comStatistics:       "Statistics",
+	comProcessInfo:      "ProcessInfo",
+	comConnect:          "Connect",
+	comProcessKill:      "ProcessKill",
+	comDebug:            "Debug",
+	comPing:             "Ping",
+	comChangeUser:       "ChangeUser",
+	comBinlogDump:       "BinlogDump",
+	comStmtPrepare:      "StmtPrepare",
+	comStmtExecute:      "StmtExecute",
+	comStmtSendLongData: "StmtSendLongData",
+	comStmtClose:        "StmtClose",
+	comStmtReset:        "StmtReset",
+	comSetOption:        "SetOption",
+	comStmtFetch:        "StmtFetch",
+	comResetConnection:  "ResetConnection",
+}
+
+func commandName(command uint8) string {
+	if name, ok := commandNames[command]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%02x", command)
+}
+
+// reader bounds checked little endian reader, any read out of bounds marks
+// reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n < 0 || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+// lenencInt length encoded integer.
+func (r *reader) lenencInt() uint64 {
+	switch first := r.uint8(); first {
+	case 0xfc:
+		return uint64(r.uint16())
+
+	case 0xfd:
+		if b := r.bytes(3); b != nil {
+			return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+		}
+		return 0
+
+	case 0xfe:
+		if b := r.bytes(8); b != nil {
+			return binary.LittleEndian.Uint64(b)
+		}
+		return 0
+
+	default:
+		return uint64(first)
+	}
+}
+
+// lenencString length encoded string.
+func (r *reader) lenencString() []byte {
+	n := r.lenencInt()
+	if n > uint64(len(r.data)) {
+		r.failed = true
+		return nil
+	}
+
+	return r.bytes(int(n))
+}
+
+// nulString NUL terminated string, the rest of data if NUL is missing.
+func (r *reader) nulString() string {
+	if r.failed {
+		return ""
+	}
+
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		s := string(r.data)
+		r.data = nil
+		return s
+	}
+
+	s := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return s
+}
+
+func (r *reader) empty() bool {
+	return len(r.data) == 0
+}
+
+// handshake initial handshake packet of server.
+type handshake struct {
+	serverVersion string
+	connectionID  uint32
+	capabilities  uint32
+}
+
+func parseHandshake(payload []byte) (*handshake, bool) {
+	r := &reader{data: payload}
+	if r.uint8() != 10 {
+		return nil, false
+	}
+
+	hs := new(handshake)
+	hs.serverVersion = r.nulString()
+	hs.connectionID = r.uint32()
+	// Auth plugin data part 1 and filler
+	r.bytes(9)
+	hs.capabilities = uint32(r.uint16())
+	if !r.failed && !r.empty() {
+		r.uint8()
+		r.uint16()
+		hs.capabilities |= uint32(r.uint16()) << 16
+	}
+
+	return hs, !r.failed
+}
+
+// handshakeResponse handshake response packet of client.
+type handshakeResponse struct {
+	capabilities uint32
+	sslRequest   bool
+	user         string
+	schema       string
+}
+
+func parseHandshakeResponse(payload []byte) (*handshakeResponse, bool) {
+	r := &reader{data: payload}
+	resp := new(handshakeResponse)
+
+	resp.capabilities = r.uint32()
+	if resp.capabilities&clientProtocol41 == 0 {
+		// Protocol 320 handshake response has 2 bytes capabilities
+		r = &reader{data: payload}
+		resp.capabilities = uint32(r.uint16())
+		r.bytes(3)
+		resp.user = r.nulString()
+		return resp, !r.failed
+	}
+
+	// Max packet size, character set and filler
+	r.bytes(4 + 1 + 23)
+	if r.failed {
+		return nil, false
+	}
+	if resp.capabilities&clientSSL != 0 && r.empty() {
+		resp.sslRequest = true
+		return resp, true
+	}
+
+	resp.user = r.nulString()
+	switch {
+	case resp.capabilities&clientPluginAuthLenencData != 0:
+		r.lenencString()
+
+	case resp.capabilities&clientSecureConnection != 0:
+		r.bytes(int(r.uint8()))
+
+	default:
+		r.nulString()
+	}
+	if resp.capabilities&clientConnectWithDB != 0 {
+		resp.schema = r.nulString()
+	}
+
+	return resp, !r.failed
+}
+
+// okPacket OK packet, or EOF packet of result set terminator.
+type okPacket struct {
+	affectedRows uint64
+	lastInsertID uint64
+	statusFlags  uint16
+	warnings     uint16
+}
+
+func parseOK(payload []byte, capabilities uint32) *okPacket {
+	r := &reader{data: payload[1:]}
+	ok := new(okPacket)
+
+	ok.affectedRows = r.lenencInt()
+	ok.lastInsertID = r.lenencInt()
+	if capabilities&clientProtocol41 != 0 {
+		ok.statusFlags = r.uint16()
+		ok.warnings = r.uint16()
+	}
+
+	return ok
+}
+
+// parseEOF parse EOF packet of protocol 4.1.
+func parseEOF(payload []byte) *okPacket {
+	r := &reader{data: payload[1:]}
+	eof := new(okPacket)
+
+	eof.warnings = r.uint16()
+	eof.statusFlags = r.uint16()
+
+	return eof
+}
+
+// errPacket ERR packet.
+type errPacket struct {
+	code     uint16
+	sqlState string
+	message  string
+}
+
+func parseERR(payload []byte) *errPacket {
+	r := &reader{data: payload[1:]}
+	e := new(errPacket)
+
+	e.code = r.uint16()
+	if len(r.data) > 0 && r.data[0] == '#' {
+		r.uint8()
+		e.sqlState = string(r.bytes(5))
+	}
+	e.message = string(r.data)
+
+	return e
+}
+
+// isEOF return true if payload is EOF packet, or OK packet with EOF header
+// which terminates result set since CLIENT_DEPRECATE_EOF.
+func isEOF(payload []byte, capabilities uint32) bool {
+	if len(payload) == 0 || payload[0] != packetEOF {
+		return false
+	}
+
+	if capabilities&clientDeprecateEOF != 0 {
+		return len(payload) < maxPacketPayloadLen
+	}
+
+	return len(payload) < maxEOFPacketLen
+}
+
+// skipBinaryValue skip parameter value of binary protocol by its type.
+func skipBinaryValue(r *reader, typ uint8) {
+	switch typ {
+	// NULL
+	case 0x06:
+
+	// TINY
+	case 0x01:
+		r.bytes(1)
+
+	// SHORT and YEAR
+	case 0x02, 0x0d:
+		r.bytes(2)
+
+	// LONG, INT24 and FLOAT
+	case 0x03, 0x09, 0x04:
+		r.bytes(4)
+
+	// LONGLONG and DOUBLE
+	case 0x08, 0x05:
+		r.bytes(8)
+
+	// TIMESTAMP, DATE, TIME and DATETIME
+	case 0x07, 0x0a, 0x0b, 0x0c:
+		r.bytes(int(r.uint8()))
+
+	default:
+		r.lenencString()
+	}
+}
+
+// parseQuery parse query text of COM_QUERY, query attributes are skipped.
+func parseQuery(data []byte, capabilities uint32) string {
+	if capabilities&clientQueryAttributes == 0 {
+		return string(data)
+	}
+
+	r := &reader{data: data}
+	paramCount := r.lenencInt()
+	// Parameter set count is always 1
+	r.lenencInt()
+	if paramCount > 0 && paramCount <= uint64(len(data)) {
+		nullBitmap := r.bytes(int(paramCount+7) / 8)
+		types := make([]uint8, paramCount)
+		if r.uint8() == 1 {
+			for i := range types {
+				types[i] = uint8(r.uint16())
+				r.lenencString()
+			}
+		}
+		for i := range types {
+			if !r.failed && nullBitmap[i/8]&(1<<(uint(i)%8)) == 0 {
+				skipBinaryValue(r, types[i])
+			}
+		}
+	}
+	if r.failed {
+		return ""
+	}
+
+	return string(r.data)
+}
@@ -0,0 +1,279 @@
+package nfs
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/oncrpc"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "NFSRequestSent"
+
+	case responseComplete:
+		return "NFSResponseComplete"
+
+	case responseError:
+		return "NFSResponseError"
+
+	default:
+		return "InvalidNFSSessionState"
+	}
+}
+
+// maxHeadLen max leading bytes of RPC record decoded, bulk data of READ and
+// WRITE beyond it is skipped.
+const maxHeadLen = 8 * 1024
+
+// session state of one RPC call.
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	xid              uint32
+	version          uint32
+	procedure        string
+	operations       string
+	fileHandle       string
+	rpcStatus        string
+	status           string
+	bytesRead        uint32
+	bytesWritten     uint32
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.XID = s.xid
+	sb.Version = s.version
+	sb.Procedure = s.procedure
+	sb.Operations = s.operations
+	sb.FileHandle = s.fileHandle
+	sb.RPCStatus = s.rpcStatus
+	sb.Status = s.status
+	sb.BytesRead = uint(s.bytesRead)
+	sb.BytesWritten = uint(s.bytesWritten)
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// newSession create session of RPC call.
+func newSession(exchange *oncrpc.Exchange) *session {
+	call := exchange.Call
+	s := &session{
+		state:   requestSent,
+		xid:     call.XID,
+		version: call.Version,
+		reqTime: exchange.CallTime,
+	}
+
+	if call.Program != nfsProgram {
+		s.procedure = fmt.Sprintf("program %d procedure %d", call.Program, call.Procedure)
+		return s
+	}
+
+	switch {
+	case call.Version == 4 && call.Procedure == proc4Null:
+		s.procedure = "NULL"
+
+	case call.Version == 4 && call.Procedure == proc4Compound:
+		s.procedure = "COMPOUND"
+		c := parseCompound(call.Body)
+		s.operations = c.operations()
+		if c.fileHandle != nil {
+			s.fileHandle = fileHandleHash(c.fileHandle)
+		}
+
+	case call.Version == 3 && call.Procedure < uint32(len(proc3Names)):
+		s.procedure = proc3Names[call.Procedure]
+		c := parseCall3(call.Procedure, call.Body)
+		if c.fileHandle != nil {
+			s.fileHandle = fileHandleHash(c.fileHandle)
+		}
+
+	default:
+		s.procedure = fmt.Sprintf("PROC_%d", call.Procedure)
+	}
+
+	return s
+}
+
+// handleReply handle reply of session.
+func (s *session) handleReply(exchange *oncrpc.Exchange) {
+	call := exchange.Call
+	reply := exchange.Reply
+	s.respBeginTime = exchange.ReplyBeginTime
+	s.respCompleteTime = exchange.ReplyTime
+	s.rpcStatus = reply.Status
+
+	s.state = responseError
+	if reply.Status != oncrpc.StatusSuccess {
+		return
+	}
+
+	// NULL procedure has no results
+	if call.Program != nfsProgram || call.Procedure == 0 {
+		s.state = responseComplete
+		return
+	}
+
+	var status, count uint32
+	var ok bool
+	switch {
+	case call.Version == 4 && call.Procedure == proc4Compound:
+		status, s.bytesRead, s.bytesWritten, ok = parseCompoundReply(reply.Body)
+
+	case call.Version == 3:
+		status, count, ok = parseReply3(call.Procedure, reply.Body)
+		if call.Procedure == proc3Write {
+			s.bytesWritten = count
+		} else {
+			s.bytesRead = count
+		}
+
+	default:
+		s.state = responseComplete
+		return
+	}
+
+	if !ok {
+		log.Errorf("NFS Analyzer: parse %s reply error.", s.procedure)
+		return
+	}
+
+	s.status = statusName(call.Version, status)
+	if status == 0 {
+		s.state = responseComplete
+	}
+}
+
+// SessionBreakdown NFS analyzer session breakdown of one RPC call.
+type SessionBreakdown struct {
+	SessionState string `json:"nfs_session_state"`
+	XID          uint32 `json:"nfs_xid"`
+	Version      uint32 `json:"nfs_version"`
+	Procedure    string `json:"nfs_procedure"`
+	// Operations operations of NFSv4 COMPOUND
+	Operations string `json:"nfs_operations,omitempty"`
+	// FileHandle CRC32 hash of file handle operated
+	FileHandle string `json:"nfs_file_handle,omitempty"`
+	// RPCStatus accept or reject status of RPC reply
+	RPCStatus       string `json:"nfs_rpc_status,omitempty"`
+	Status          string `json:"nfs_status,omitempty"`
+	BytesRead       uint   `json:"nfs_bytes_read"`
+	BytesWritten    uint   `json:"nfs_bytes_written"`
+	ServerLatency   uint   `json:"nfs_server_latency"`
+	DownloadLatency uint   `json:"nfs_download_latency"`
+}
+
+// ApplicationLatency get NFS latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer NFS over TCP analyzer.
+type Analyzer struct {
+	// conn ONC RPC decoder matching replies to calls
+	conn oncrpc.Conn
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init NFS analyzer init function.
+func (a *Analyzer) Init() {
+	a.conn.Init(maxHeadLen)
+}
+
+// HandleEstb NFS analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("NFS Analyzer: HandleEstb.")
+}
+
+// HandleData NFS analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	var parsed int
+	for !a.broken && parsed < len(payload) {
+		n, exchange, err := a.conn.Read(payload[parsed:], fromClient, timestamp)
+		parsed += n
+		if err == oncrpc.ErrInvalidFragment {
+			log.Error("NFS Analyzer: invalid record marking.")
+			a.broken = true
+			break
+		}
+		if err != nil {
+			log.Errorf("NFS Analyzer: invalid RPC message, %v.", err)
+			continue
+		}
+
+		if exchange != nil {
+			s := newSession(exchange)
+			s.handleReply(exchange)
+			return uint(parsed), s.toBreakdown()
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset NFS analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("NFS Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("NFS Analyzer: HandleReset from server.")
+	}
+
+	for exchange := a.conn.PopPending(); exchange != nil; exchange = a.conn.PopPending() {
+		s := newSession(exchange)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin NFS analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("NFS Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("NFS Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
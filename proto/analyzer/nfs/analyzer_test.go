@@ -0,0 +1,155 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"testing"
+	"time"
+)
+
+// xdr encode XDR unsigned integers.
+func xdr(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4*i:], v)
+	}
+
+	return data
+}
+
+func hyper(v uint64) []byte {
+	return xdr(uint32(v>>32), uint32(v))
+}
+
+// opaque encode variable-length opaque data with padding.
+func opaque(data []byte) []byte {
+	encoded := append(xdr(uint32(len(data))), data...)
+	for len(encoded)%4 != 0 {
+		encoded = append(encoded, 0)
+	}
+
+	return encoded
+}
+
+func join(parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+
+	return data
+}
+
+// record encode single fragment record.
+func record(data []byte) []byte {
+	return append(xdr(0x80000000|uint32(len(data))), data...)
+}
+
+func call(xid uint32, version uint32, proc uint32, args ...[]byte) []byte {
+	return record(join(xdr(xid, 0, 2, nfsProgram, version, proc, 0, 0, 0, 0), join(args...)))
+}
+
+func reply(xid uint32, results ...[]byte) []byte {
+	return record(join(xdr(xid, 1, 0, 0, 0, 0), join(results...)))
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	dir := []byte("root-dir-handle")
+	file := []byte("file-handle-0001")
+	stateID := make([]byte, stateIDLen)
+	sessionID := make([]byte, sessionIDLen)
+
+	// COMPOUND of SEQUENCE, PUTFH and READ
+	readCompound := call(4, 4, proc4Compound, opaque(nil), xdr(1, 3),
+		xdr(op4Sequence), sessionID, xdr(1, 0, 0, 0),
+		xdr(op4PutFH), opaque(file),
+		xdr(op4Read), stateID, hyper(0), xdr(512))
+	// COMPOUND of PUTROOTFH, GETFH and CREATE_SESSION not parsed
+	createSession := call(5, 4, proc4Compound, opaque(nil), xdr(1, 3),
+		xdr(op4PutRootFH), xdr(op4GetFH), xdr(43, 0, 0))
+
+	var pipelined []byte
+	pipelined = append(pipelined, readCompound...)
+	pipelined = append(pipelined, createSession...)
+
+	var pipelinedReplies []byte
+	pipelinedReplies = append(pipelinedReplies, reply(5, xdr(10013), opaque(nil), xdr(1, op4PutRootFH, 10013))...)
+	pipelinedReplies = append(pipelinedReplies, reply(4, xdr(0), opaque(nil), xdr(3),
+		xdr(op4Sequence, 0), sessionID, xdr(1, 0, 63, 63, 0),
+		xdr(op4PutFH, 0),
+		xdr(op4Read, 0, 0), opaque(make([]byte, 512)))...)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(call(1, 3, 3, opaque(dir), opaque([]byte("missing")))),
+		analyzertest.FromServerBytes(reply(1, xdr(2, 0))),
+		analyzertest.FromClientBytes(call(2, 3, proc3Read, opaque(file), hyper(0), xdr(10000))),
+		analyzertest.FromServerBytes(reply(2, xdr(0, 1), make([]byte, fattr3Len), xdr(10000, 1), opaque(make([]byte, 10000)))),
+		analyzertest.FromClientBytes(call(3, 3, proc3Write, opaque(file), hyper(0), xdr(20000, 2), opaque(make([]byte, 20000)))),
+		analyzertest.FromServerBytes(reply(3, xdr(0, 1), make([]byte, wccAttrLen), xdr(1), make([]byte, fattr3Len),
+			xdr(20000, 2), make([]byte, verifierLen))),
+		analyzertest.FromClientBytes(pipelined),
+		analyzertest.FromServerBytes(pipelinedReplies),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "NFSResponseError", XID: 1, Version: 3, Procedure: "LOOKUP", FileHandle: fileHandleHash(dir),
+			RPCStatus: "SUCCESS", Status: "NFS3ERR_NOENT"},
+		{SessionState: "NFSResponseComplete", XID: 2, Version: 3, Procedure: "READ", FileHandle: fileHandleHash(file),
+			RPCStatus: "SUCCESS", Status: "NFS3_OK", BytesRead: 10000},
+		{SessionState: "NFSResponseComplete", XID: 3, Version: 3, Procedure: "WRITE", FileHandle: fileHandleHash(file),
+			RPCStatus: "SUCCESS", Status: "NFS3_OK", BytesWritten: 20000},
+		{SessionState: "NFSResponseError", XID: 5, Version: 4, Procedure: "COMPOUND",
+			Operations: "PUTROOTFH,GETFH,CREATE_SESSION,...", RPCStatus: "SUCCESS", Status: "NFS4ERR_GRACE"},
+		{SessionState: "NFSResponseComplete", XID: 4, Version: 4, Procedure: "COMPOUND",
+			Operations: "SEQUENCE,PUTFH,READ", FileHandle: fileHandleHash(file), RPCStatus: "SUCCESS",
+			Status: "NFS4_OK", BytesRead: 512},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("NFS Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("NFS Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("NFS Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzerReset(t *testing.T) {
+	file := []byte("file-handle-0002")
+
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(call(9, 3, 1, opaque(file))),
+		analyzertest.FromClientBytes(call(10, 3, 1, opaque(file))),
+	})
+
+	sb := a.HandleReset(false, time.Now())
+	expected := SessionBreakdown{SessionState: "Reset:NFSRequestSent", XID: 9, Version: 3, Procedure: "GETATTR",
+		FileHandle: fileHandleHash(file)}
+	if sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("NFS Analyzer: session breakdown is %+v, expected %+v.", sb, expected)
+	}
+
+	// Outstanding call after the first one is queued
+	expected.XID = 10
+	if sb = a.PopSessionBreakdown(); sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("NFS Analyzer: queued session breakdown is %+v, expected %+v.", sb, expected)
+	}
+}
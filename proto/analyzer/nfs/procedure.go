@@ -0,0 +1,625 @@
+package nfs
+
+import (
+	"fmt"
+	"github.com/zhengyuli/ntrace/proto/analyzer/oncrpc"
+	"hash/crc32"
+	"strings"
+)
+
+// nfsProgram RPC program number of NFS.
+const nfsProgram = 100003
+
+// NFSv3 procedures.
+const (
+	proc3Read  = 6
+	proc3Write = 7
+)
+
+var proc3Names = []string{
+	"NULL",
+	"GETATTR",
+	"SETATTR",
+	"LOOKUP",
+	"ACCESS",
+	"READLINK",
+	"READ",
+	"WRITE",
+	"CREATE",
+	"MKDIR",
+	"SYMLINK",
+	"MKNOD",
+	"REMOVE",
+	"RMDIR",
+	"RENAME",
+	"LINK",
+	"READDIR",
+	"READDIRPLUS",
+	"FSSTAT",
+	"FSINFO",
+	"PATHCONF",
+	"COMMIT",
+}
+
+// NFSv4 procedures.
+const (
+	proc4Null     = 0
+	proc4Compound = 1
+)
+
+// NFSv4 operations.
+const (
+	op4Access           = 3
+	op4Close            = 4
+	op4Commit           = 5
+	op4Create           = 6
+	op4DelegPurge       = 7
+	op4DelegReturn      = 8
+	op4GetAttr          = 9
+	op4GetFH            = 10
+	op4Link             = 11
+	op4Lock             = 12
+	op4LockT            = 13
+	op4LockU            = 14
+	op4Lookup           = 15
+	op4LookupP          = 16
+	op4NVerify          = 17
+	op4Open             = 18
+	op4OpenAttr         = 19
+	op4OpenConfirm      = 20
+	op4OpenDowngrade    = 21
+	op4PutFH            = 22
+	op4PutPubFH         = 23
+	op4PutRootFH        = 24
+	op4Read             = 25
+	op4ReadDir          = 26
+	op4ReadLink         = 27
+	op4Remove           = 28
+	op4Rename           = 29
+	op4Renew            = 30
+	op4RestoreFH        = 31
+	op4SaveFH           = 32
+	op4SecInfo          = 33
+	op4SetAttr          = 34
+	op4SetClientIDConf  = 36
+	op4Verify           = 37
+	op4Write            = 38
+	op4ReleaseLockOwner = 39
+	op4DestroySession   = 44
+	op4FreeStateID      = 45
+	op4SecInfoNoName    = 52
+	op4Sequence         = 53
+	op4DestroyClientID  = 57
+	op4ReclaimComplete  = 58
+)
+
+var op4Names = map[uint32]string{
+	3:  "ACCESS",
+	4:  "CLOSE",
+	5:  "COMMIT",
+	6:  "CREATE",
+	7:  "DELEGPURGE",
+	8:  "DELEGRETURN",
+	9:  "GETATTR",
+	10: "GETFH",
+	11: "LINK",
+	12: "LOCK",
+	13: "LOCKT",
+	14: "LOCKU",
+	15: "LOOKUP",
+	16: "LOOKUPP",
+	17: "NVERIFY",
+	18: "OPEN",
+	19: "OPENATTR",
+	20: "OPEN_CONFIRM",
+	21: "OPEN_DOWNGRADE",
+	22: "PUTFH",
+	23: "PUTPUBFH",
+	24: "PUTROOTFH",
+	25: "READ",
+	26: "READDIR",
+	27: "READLINK",
+	28: "REMOVE",
+	29: "RENAME",
+	30: "RENEW",
+	31: "RESTOREFH",
+	32: "SAVEFH",
+	33: "SECINFO",
+	34: "SETATTR",
+	35: "SETCLIENTID",
+	36: "SETCLIENTID_CONFIRM",
+	37: "VERIFY",
+	38: "WRITE",
+	39: "RELEASE_LOCKOWNER",
+	40: "BACKCHANNEL_CTL",
+	41: "BIND_CONN_TO_SESSION",
+	42: "EXCHANGE_ID",
+	43: "CREATE_SESSION",
+	44: "DESTROY_SESSION",
+	45: "FREE_STATEID",
+	46: "GET_DIR_DELEGATION",
+	47: "GETDEVICEINFO",
+	48: "GETDEVICELIST",
+	49: "LAYOUTCOMMIT",
+	50: "LAYOUTGET",
+	51: "LAYOUTRETURN",
+	52: "SECINFO_NO_NAME",
+	53: "SEQUENCE",
+	54: "SET_SSV",
+	55: "TEST_STATEID",
+	56: "WANT_DELEGATION",
+	57: "DESTROY_CLIENTID",
+	58: "RECLAIM_COMPLETE",
+}
+
+func op4Name(op uint32) string {
+	if name, ok := op4Names[op]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("OP_%d", op)
+}
+
+// Status names shared by NFSv3 and NFSv4, NFSv4 only names are listed in
+// status4Names.
+var statusNames = map[uint32]string{
+	1:     "PERM",
+	2:     "NOENT",
+	5:     "IO",
+	6:     "NXIO",
+	13:    "ACCES",
+	17:    "EXIST",
+	18:    "XDEV",
+	19:    "NODEV",
+	20:    "NOTDIR",
+	21:    "ISDIR",
+	22:    "INVAL",
+	27:    "FBIG",
+	28:    "NOSPC",
+	30:    "ROFS",
+	31:    "MLINK",
+	63:    "NAMETOOLONG",
+	66:    "NOTEMPTY",
+	69:    "DQUOT",
+	70:    "STALE",
+	71:    "REMOTE",
+	10001: "BADHANDLE",
+	10002: "NOT_SYNC",
+	10003: "BAD_COOKIE",
+	10004: "NOTSUPP",
+	10005: "TOOSMALL",
+	10006: "SERVERFAULT",
+	10007: "BADTYPE",
+	10008: "JUKEBOX",
+}
+
+var status4Names = map[uint32]string{
+	13:    "ACCESS",
+	10008: "DELAY",
+	10009: "SAME",
+	10010: "DENIED",
+	10011: "EXPIRED",
+	10012: "LOCKED",
+	10013: "GRACE",
+	10014: "FHEXPIRED",
+	10015: "SHARE_DENIED",
+	10016: "WRONGSEC",
+	10017: "CLID_INUSE",
+	10018: "RESOURCE",
+	10019: "MOVED",
+	10020: "NOFILEHANDLE",
+	10021: "MINOR_VERS_MISMATCH",
+	10022: "STALE_CLIENTID",
+	10023: "STALE_STATEID",
+	10024: "OLD_STATEID",
+	10025: "BAD_STATEID",
+	10026: "BAD_SEQID",
+	10027: "NOT_SAME",
+	10028: "LOCK_RANGE",
+	10029: "SYMLINK",
+	10030: "RESTOREFH",
+	10031: "LEASE_MOVED",
+	10032: "ATTRNOTSUPP",
+	10033: "NO_GRACE",
+	10034: "RECLAIM_BAD",
+	10035: "RECLAIM_CONFLICT",
+	10036: "BADXDR",
+	10037: "LOCKS_HELD",
+	10038: "OPENMODE",
+	10039: "BADOWNER",
+	10040: "BADCHAR",
+	10041: "BADNAME",
+	10042: "BAD_RANGE",
+	10043: "LOCK_NOTSUPP",
+	10044: "OP_ILLEGAL",
+	10045: "DEADLOCK",
+	10046: "FILE_OPEN",
+	10047: "ADMIN_REVOKED",
+	10048: "CB_PATH_DOWN",
+	10052: "BADSESSION",
+	10053: "BADSLOT",
+}
+
+// statusName name status of NFS version like NFS3ERR_NOENT.
+func statusName(version uint32, status uint32) string {
+	if status == 0 {
+		return fmt.Sprintf("NFS%d_OK", version)
+	}
+
+	name, ok := status4Names[status]
+	if !ok || version != 4 {
+		name, ok = statusNames[status]
+	}
+	if !ok {
+		return fmt.Sprintf("%d", status)
+	}
+
+	return fmt.Sprintf("NFS%dERR_%s", version, name)
+}
+
+// fileHandleHash hash file handle with CRC32 like packet analyzers.
+func fileHandleHash(fh []byte) string {
+	return fmt.Sprintf("0x%08x", crc32.ChecksumIEEE(fh))
+}
+
+// Sizes of fixed XDR structures.
+const (
+	stateIDLen    = 16
+	verifierLen   = 8
+	sessionIDLen  = 16
+	fattr3Len     = 84
+	wccAttrLen    = 24
+	changeInfoLen = 20
+)
+
+// call3 arguments of NFSv3 call concerned.
+type call3 struct {
+	fileHandle []byte
+	count      uint32
+}
+
+// parseCall3 parse NFSv3 call arguments, all procedures except NULL begin
+// with file handle.
+func parseCall3(proc uint32, args []byte) call3 {
+	var c call3
+	if proc == 0 {
+		return c
+	}
+
+	d := oncrpc.NewDecoder(args)
+	c.fileHandle = d.Opaque()
+	if proc == proc3Write {
+		// Offset, count, stable and data
+		d.Uint64()
+		c.count = d.Uint32()
+	}
+
+	return c
+}
+
+// skipPostOpAttr skip post_op_attr of NFSv3.
+func skipPostOpAttr(d *oncrpc.Decoder) {
+	if d.Bool() {
+		d.Skip(fattr3Len)
+	}
+}
+
+// parseReply3 parse NFSv3 reply results, it returns status and bytes read or
+// written.
+func parseReply3(proc uint32, results []byte) (status uint32, count uint32, ok bool) {
+	d := oncrpc.NewDecoder(results)
+	status = d.Uint32()
+	if status == 0 {
+		switch proc {
+		case proc3Read:
+			skipPostOpAttr(d)
+			count = d.Uint32()
+
+		case proc3Write:
+			// wcc_data of pre_op_attr and post_op_attr
+			if d.Bool() {
+				d.Skip(wccAttrLen)
+			}
+			skipPostOpAttr(d)
+			count = d.Uint32()
+		}
+	}
+
+	return status, count, !d.Failed()
+}
+
+// compound arguments of NFSv4 COMPOUND concerned.
+type compound struct {
+	ops []uint32
+	// fileHandle the last file handle put by PUTFH
+	fileHandle []byte
+	// complete all operations are parsed
+	complete bool
+}
+
+// skipBitmap skip bitmap4.
+func skipBitmap(d *oncrpc.Decoder) {
+	n := d.Uint32()
+	d.Skip(4 * int(n))
+}
+
+// skipFattr4 skip fattr4 of bitmap and attribute values.
+func skipFattr4(d *oncrpc.Decoder) {
+	skipBitmap(d)
+	d.Opaque()
+}
+
+// skipLockOwner skip lock_owner4 or open_owner4.
+func skipLockOwner(d *oncrpc.Decoder) {
+	d.Uint64()
+	d.Opaque()
+}
+
+// skipOpenArgs skip OPEN4args after seqid, share_access and share_deny.
+func skipOpenArgs(d *oncrpc.Decoder) {
+	skipLockOwner(d)
+
+	// openflag4
+	if d.Uint32() == 1 {
+		switch d.Uint32() {
+		case 0, 1:
+			skipFattr4(d)
+		case 2:
+			d.Skip(verifierLen)
+		case 3:
+			d.Skip(verifierLen)
+			skipFattr4(d)
+		}
+	}
+
+	// open_claim4
+	switch d.Uint32() {
+	case 0, 3:
+		d.Opaque()
+	case 1:
+		d.Uint32()
+	case 2:
+		d.Skip(stateIDLen)
+		d.Opaque()
+	case 5:
+		d.Skip(stateIDLen)
+	}
+}
+
+// skipOpArgs skip arguments of NFSv4 operation, it returns false for
+// operations not supported.
+func skipOpArgs(op uint32, d *oncrpc.Decoder, c *compound) bool {
+	switch op {
+	case op4GetFH, op4LookupP, op4ReadLink, op4RestoreFH, op4SaveFH:
+
+	case op4PutPubFH, op4PutRootFH:
+		c.fileHandle = nil
+
+	case op4Access, op4OpenAttr, op4ReclaimComplete, op4SecInfoNoName:
+		d.Uint32()
+
+	case op4Close, op4OpenConfirm:
+		d.Skip(4 + stateIDLen)
+
+	case op4Commit:
+		d.Skip(12)
+
+	case op4Create:
+		switch d.Uint32() {
+		case 5:
+			d.Opaque()
+		case 3, 4:
+			d.Skip(8)
+		}
+		d.Opaque()
+		skipFattr4(d)
+
+	case op4DelegPurge, op4Renew, op4DestroyClientID:
+		d.Uint64()
+
+	case op4DelegReturn, op4FreeStateID:
+		d.Skip(stateIDLen)
+
+	case op4GetAttr:
+		skipBitmap(d)
+
+	case op4Link, op4Lookup, op4Remove, op4SecInfo:
+		d.Opaque()
+
+	case op4Lock:
+		// locktype, reclaim, offset and length
+		d.Skip(24)
+		if d.Bool() {
+			d.Skip(4 + stateIDLen + 4)
+			skipLockOwner(d)
+		} else {
+			d.Skip(stateIDLen + 4)
+		}
+
+	case op4LockT:
+		d.Skip(20)
+		skipLockOwner(d)
+
+	case op4LockU:
+		d.Skip(8 + stateIDLen + 16)
+
+	case op4NVerify, op4Verify:
+		skipFattr4(d)
+
+	case op4Open:
+		d.Skip(12)
+		skipOpenArgs(d)
+
+	case op4OpenDowngrade:
+		d.Skip(stateIDLen + 12)
+
+	case op4PutFH:
+		c.fileHandle = d.Opaque()
+
+	case op4Read:
+		d.Skip(stateIDLen + 12)
+
+	case op4ReadDir:
+		d.Skip(8 + verifierLen + 8)
+		skipBitmap(d)
+
+	case op4Rename:
+		d.Opaque()
+		d.Opaque()
+
+	case op4SetAttr:
+		d.Skip(stateIDLen)
+		skipFattr4(d)
+
+	case op4SetClientIDConf:
+		d.Skip(8 + verifierLen)
+
+	case op4Write:
+		d.Skip(stateIDLen + 12)
+		d.Opaque()
+
+	case op4ReleaseLockOwner:
+		skipLockOwner(d)
+
+	case op4DestroySession:
+		d.Skip(sessionIDLen)
+
+	case op4Sequence:
+		d.Skip(sessionIDLen + 16)
+
+	default:
+		return false
+	}
+
+	return !d.Failed()
+}
+
+// parseCompound parse NFSv4 COMPOUND arguments, operations following one not
+// supported or bulk data beyond parsed head are not listed.
+func parseCompound(args []byte) compound {
+	var c compound
+
+	d := oncrpc.NewDecoder(args)
+	// Tag and minor version
+	d.Opaque()
+	d.Uint32()
+	n := d.Uint32()
+	if d.Failed() {
+		return c
+	}
+
+	for i := uint32(0); i < n; i++ {
+		op := d.Uint32()
+		if d.Failed() {
+			return c
+		}
+		c.ops = append(c.ops, op)
+		if !skipOpArgs(op, d, &c) {
+			return c
+		}
+	}
+	c.complete = true
+
+	return c
+}
+
+// operations format operations of COMPOUND, "..." marks operations not
+// parsed.
+func (c *compound) operations() string {
+	names := make([]string, 0, len(c.ops)+1)
+	for _, op := range c.ops {
+		names = append(names, op4Name(op))
+	}
+	if !c.complete {
+		names = append(names, "...")
+	}
+
+	return strings.Join(names, ",")
+}
+
+// skipOpResult skip result of NFSv4 operation after status, it returns bytes
+// read or written and false for operations not supported.
+func skipOpResult(op uint32, d *oncrpc.Decoder) (uint32, bool) {
+	var count uint32
+
+	switch op {
+	case op4PutFH, op4PutPubFH, op4PutRootFH, op4SaveFH, op4RestoreFH, op4Lookup, op4LookupP,
+		op4Renew, op4DelegReturn, op4DelegPurge, op4NVerify, op4Verify, op4ReleaseLockOwner,
+		op4ReclaimComplete, op4FreeStateID, op4DestroySession, op4DestroyClientID,
+		op4OpenAttr, op4SetClientIDConf:
+
+	case op4Access:
+		d.Skip(8)
+
+	case op4Close, op4OpenConfirm, op4OpenDowngrade, op4LockU:
+		d.Skip(stateIDLen)
+
+	case op4Commit:
+		d.Skip(verifierLen)
+
+	case op4GetAttr:
+		skipFattr4(d)
+
+	case op4GetFH, op4ReadLink:
+		d.Opaque()
+
+	case op4Read:
+		// Data may be beyond parsed head
+		d.Bool()
+		count = d.Uint32()
+
+	case op4Write:
+		count = d.Uint32()
+		d.Skip(4 + verifierLen)
+
+	case op4Remove:
+		d.Skip(changeInfoLen)
+
+	case op4Sequence:
+		d.Skip(sessionIDLen + 20)
+
+	default:
+		return 0, false
+	}
+
+	return count, !d.Failed()
+}
+
+// parseCompoundReply parse NFSv4 COMPOUND results, it returns status and
+// bytes read and written.
+func parseCompoundReply(results []byte) (status uint32, read uint32, written uint32, ok bool) {
+	d := oncrpc.NewDecoder(results)
+	status = d.Uint32()
+	d.Opaque()
+	n := d.Uint32()
+	if d.Failed() {
+		return status, 0, 0, false
+	}
+
+	for i := uint32(0); i < n; i++ {
+		op := d.Uint32()
+		// SETATTR returns attributes set whatever status is
+		if opStatus := d.Uint32(); opStatus != 0 && op != op4SetAttr {
+			break
+		}
+		if op == op4SetAttr {
+			skipBitmap(d)
+			continue
+		}
+
+		count, ok := skipOpResult(op, d)
+		if !ok {
+			break
+		}
+		if op == op4Write {
+			written += count
+		}
+		if op == op4Read {
+			// READ result ends parsing since data may be beyond head
+			read += count
+			break
+		}
+	}
+
+	return status, read, written, true
+}
@@ -0,0 +1,125 @@
+package oncrpc
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxPendingCalls max calls waiting for replies of one connection.
+const maxPendingCalls = 1024
+
+// Exchange RPC call and its reply matched by XID.
+type Exchange struct {
+	Call  *Message
+	Reply *Message
+	// CallLen and ReplyLen record length of call and reply
+	CallLen  int
+	ReplyLen int
+	// CallTime time of call record complete
+	CallTime       time.Time
+	ReplyBeginTime time.Time
+	ReplyTime      time.Time
+}
+
+// Conn ONC RPC over TCP decoder of one connection, it reassembles records of
+// both directions and matches replies to calls by XID.
+type Conn struct {
+	client RecordReader
+	server RecordReader
+	// pending calls waiting for replies in order
+	pending list.List
+}
+
+// Init init decoder, only the leading maxHeadLen bytes of each record are
+// decoded.
+func (c *Conn) Init(maxHeadLen int) {
+	c.client.MaxHeadLen = maxHeadLen
+	c.server.MaxHeadLen = maxHeadLen
+	c.pending.Init()
+}
+
+// findPending find pending call by XID.
+func (c *Conn) findPending(xid uint32) *list.Element {
+	for e := c.pending.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Exchange).Call.XID == xid {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// handleRecord handle one record, it returns exchange completed by reply.
+func (c *Conn) handleRecord(record *Record, timestamp time.Time) (*Exchange, error) {
+	msg, err := ParseMessage(record.Head)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Call {
+		// Retransmitted call replaces the former one
+		if e := c.findPending(msg.XID); e != nil {
+			c.pending.Remove(e)
+		}
+		if c.pending.Len() >= maxPendingCalls {
+			c.pending.Remove(c.pending.Front())
+		}
+		c.pending.PushBack(&Exchange{
+			Call:     msg,
+			CallLen:  record.Len,
+			CallTime: timestamp,
+		})
+		return nil, nil
+	}
+
+	e := c.findPending(msg.XID)
+	if e == nil {
+		return nil, nil
+	}
+	c.pending.Remove(e)
+
+	exchange := e.Value.(*Exchange)
+	exchange.Reply = msg
+	exchange.ReplyLen = record.Len
+	exchange.ReplyBeginTime = record.BeginTime
+	exchange.ReplyTime = timestamp
+
+	return exchange, nil
+}
+
+// Read read data of one direction, it returns bytes consumed and exchange
+// once a reply matches pending call. Invalid message is skipped and reported
+// by error while invalid record marking breaks the stream.
+func (c *Conn) Read(data []byte, fromClient bool, timestamp time.Time) (int, *Exchange, error) {
+	r := &c.server
+	if fromClient {
+		r = &c.client
+	}
+
+	var parsed int
+	for parsed < len(data) {
+		n, record, err := r.Read(data[parsed:], timestamp)
+		parsed += n
+		if err != nil || record == nil {
+			return parsed, nil, err
+		}
+
+		exchange, err := c.handleRecord(record, timestamp)
+		if err != nil || exchange != nil {
+			return parsed, exchange, err
+		}
+	}
+
+	return parsed, nil, nil
+}
+
+// PopPending pop the oldest call waiting for reply.
+func (c *Conn) PopPending() *Exchange {
+	front := c.pending.Front()
+	if front == nil {
+		return nil
+	}
+	c.pending.Remove(front)
+
+	return front.Value.(*Exchange)
+}
@@ -0,0 +1,128 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func uint32s(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4*i:], v)
+	}
+
+	return data
+}
+
+// fragment encode record marking fragment.
+func fragment(last bool, data []byte) []byte {
+	header := uint32(len(data))
+	if last {
+		header |= lastFragment
+	}
+
+	return append(uint32s(header), data...)
+}
+
+func call(xid uint32, proc uint32, args []byte) []byte {
+	// AUTH_SYS credential with empty body and AUTH_NONE verifier
+	header := uint32s(xid, msgCall, rpcVersion, 100003, 3, proc, 1, 0, 0, 0)
+	return append(header, args...)
+}
+
+func reply(xid uint32, results []byte) []byte {
+	header := uint32s(xid, msgReply, msgAccepted, 0, 0, 0)
+	return append(header, results...)
+}
+
+// feed feed data byte by byte and collect exchanges.
+func feed(t *testing.T, c *Conn, data []byte, fromClient bool, timestamp time.Time) []*Exchange {
+	var exchanges []*Exchange
+
+	var pending []byte
+	for i := 0; i < len(data); i++ {
+		pending = append(pending, data[i])
+		for len(pending) > 0 {
+			n, exchange, err := c.Read(pending, fromClient, timestamp)
+			if err != nil {
+				t.Fatalf("ONC RPC: read error %v.", err)
+			}
+			pending = pending[n:]
+			if exchange == nil {
+				break
+			}
+			exchanges = append(exchanges, exchange)
+		}
+	}
+
+	return exchanges
+}
+
+func TestConn(t *testing.T) {
+	c := new(Conn)
+	c.Init(48)
+
+	// Call of two fragments with bulk data beyond head
+	bulk := make([]byte, 100)
+	write := call(1, 7, bulk)
+	var calls []byte
+	calls = append(calls, fragment(false, write[:30])...)
+	calls = append(calls, fragment(true, write[30:])...)
+	calls = append(calls, fragment(true, call(2, 1, uint32s(8, 1, 2)))...)
+	calls = append(calls, fragment(true, call(3, 0, nil))...)
+	// Retransmission of call 3
+	calls = append(calls, fragment(true, call(3, 0, nil))...)
+
+	timestamp := time.Now()
+	if exchanges := feed(t, c, calls, true, timestamp); len(exchanges) != 0 {
+		t.Fatalf("ONC RPC: get %d exchanges of calls, expected 0.", len(exchanges))
+	}
+
+	var replies []byte
+	replies = append(replies, fragment(true, reply(2, uint32s(0)))...)
+	replies = append(replies, fragment(true, uint32s(9, msgReply, msgDenied, 1, 5))...)
+	replies = append(replies, fragment(true, reply(1, uint32s(0)))...)
+	replies = append(replies, fragment(true, reply(3, nil))...)
+
+	exchanges := feed(t, c, replies, false, timestamp.Add(10*time.Millisecond))
+	if len(exchanges) != 3 {
+		t.Fatalf("ONC RPC: get %d exchanges, expected 3.", len(exchanges))
+	}
+
+	expected := []struct {
+		xid     uint32
+		proc    uint32
+		callLen int
+	}{
+		{2, 1, 52},
+		{1, 7, len(write)},
+		{3, 0, 40},
+	}
+	for i, e := range exchanges {
+		if e.Call.XID != expected[i].xid || e.Reply.XID != expected[i].xid {
+			t.Errorf("ONC RPC: exchange %d get XID %d/%d, expected %d.", i, e.Call.XID, e.Reply.XID, expected[i].xid)
+		}
+		if e.Call.Procedure != expected[i].proc || e.Call.Program != 100003 || e.Call.Version != 3 {
+			t.Errorf("ONC RPC: exchange %d get call %+v.", i, *e.Call)
+		}
+		if e.CallLen != expected[i].callLen {
+			t.Errorf("ONC RPC: exchange %d get call length %d, expected %d.", i, e.CallLen, expected[i].callLen)
+		}
+		if e.Reply.Status != StatusSuccess {
+			t.Errorf("ONC RPC: exchange %d get reply status %s.", i, e.Reply.Status)
+		}
+		if e.ReplyTime.Sub(e.CallTime) != 10*time.Millisecond {
+			t.Errorf("ONC RPC: exchange %d get wrong latency %v.", i, e.ReplyTime.Sub(e.CallTime))
+		}
+	}
+
+	// Head is truncated to 48 bytes
+	if len(exchanges[1].Call.Body) != 8 {
+		t.Errorf("ONC RPC: get call body of %d bytes, expected 8.", len(exchanges[1].Call.Body))
+	}
+
+	if e := c.PopPending(); e != nil {
+		t.Errorf("ONC RPC: get pending call %+v, expected none.", *e.Call)
+	}
+}
@@ -0,0 +1,115 @@
+package oncrpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Message types.
+const (
+	msgCall  = 0
+	msgReply = 1
+)
+
+// rpcVersion version of RPC protocol.
+const rpcVersion = 2
+
+// Reply status.
+const (
+	msgAccepted = 0
+	msgDenied   = 1
+)
+
+// StatusSuccess status of successfully executed call.
+const StatusSuccess = "SUCCESS"
+
+var acceptStatusNames = map[uint32]string{
+	0: StatusSuccess,
+	1: "PROG_UNAVAIL",
+	2: "PROG_MISMATCH",
+	3: "PROC_UNAVAIL",
+	4: "GARBAGE_ARGS",
+	5: "SYSTEM_ERR",
+}
+
+var rejectStatusNames = map[uint32]string{
+	0: "RPC_MISMATCH",
+	1: "AUTH_ERROR",
+}
+
+// ErrInvalidMessage message is not valid RPC call or reply.
+var ErrInvalidMessage = errors.New("oncrpc: invalid message")
+
+// Message RPC call or reply header.
+type Message struct {
+	XID  uint32
+	Call bool
+	// Program, Version and Procedure of call
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+	// Status accept or reject status of reply
+	Status string
+	// Body arguments of call or results of successful reply, it may be
+	// truncated
+	Body []byte
+}
+
+// skipAuth skip opaque_auth of flavor and body.
+func skipAuth(d *Decoder) {
+	d.Uint32()
+	d.Opaque()
+}
+
+// ParseMessage parse header of RPC message.
+func ParseMessage(data []byte) (*Message, error) {
+	d := NewDecoder(data)
+	msg := &Message{XID: d.Uint32()}
+
+	switch d.Uint32() {
+	case msgCall:
+		msg.Call = true
+		if d.Uint32() != rpcVersion {
+			return nil, ErrInvalidMessage
+		}
+		msg.Program = d.Uint32()
+		msg.Version = d.Uint32()
+		msg.Procedure = d.Uint32()
+		// Credential and verifier
+		skipAuth(d)
+		skipAuth(d)
+
+	case msgReply:
+		switch d.Uint32() {
+		case msgAccepted:
+			skipAuth(d)
+			stat := d.Uint32()
+			msg.Status = statusName(acceptStatusNames, stat)
+
+		case msgDenied:
+			stat := d.Uint32()
+			msg.Status = statusName(rejectStatusNames, stat)
+
+		default:
+			return nil, ErrInvalidMessage
+		}
+
+	default:
+		return nil, ErrInvalidMessage
+	}
+
+	if d.Failed() {
+		return nil, ErrInvalidMessage
+	}
+	msg.Body = d.Rest()
+
+	return msg, nil
+}
+
+func statusName(names map[uint32]string, stat uint32) string {
+	if name, ok := names[stat]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", stat)
+}
@@ -0,0 +1,94 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// fragmentHeaderLen length of record marking fragment header
+	fragmentHeaderLen = 4
+	// lastFragment flag of the last fragment of record
+	lastFragment = 0x80000000
+	// maxFragmentLen max length of fragment
+	maxFragmentLen = 16 * 1024 * 1024
+)
+
+// ErrInvalidFragment fragment header is not valid.
+var ErrInvalidFragment = errors.New("oncrpc: invalid fragment header")
+
+// Record record of record marking standard, only head of record is kept.
+type Record struct {
+	// Head the leading bytes of record
+	Head []byte
+	// Len length of record without fragment headers
+	Len       int
+	BeginTime time.Time
+}
+
+// RecordReader reassemble records of record marking standard from TCP stream
+// of one direction. Only the leading MaxHeadLen bytes of each record are kept,
+// the rest like bulk data of READ and WRITE is counted and skipped.
+type RecordReader struct {
+	MaxHeadLen int
+	record     *Record
+	// fragmentLeft bytes of current fragment not read yet
+	fragmentLeft int
+	// last current fragment is the last fragment of record
+	last bool
+	// inFragment fragment header is read
+	inFragment bool
+}
+
+// Read read data, it returns bytes consumed and record once it completes.
+func (r *RecordReader) Read(data []byte, timestamp time.Time) (int, *Record, error) {
+	var n int
+	for n < len(data) || (r.inFragment && r.fragmentLeft == 0) {
+		if !r.inFragment {
+			if len(data)-n < fragmentHeaderLen {
+				break
+			}
+
+			header := binary.BigEndian.Uint32(data[n:])
+			length := int(header &^ lastFragment)
+			if length > maxFragmentLen {
+				return n, nil, ErrInvalidFragment
+			}
+			n += fragmentHeaderLen
+
+			if r.record == nil {
+				r.record = &Record{BeginTime: timestamp}
+			}
+			r.fragmentLeft = length
+			r.last = header&lastFragment != 0
+			r.inFragment = true
+		}
+
+		size := len(data) - n
+		if size > r.fragmentLeft {
+			size = r.fragmentLeft
+		}
+		if keep := r.MaxHeadLen - len(r.record.Head); keep > 0 {
+			if keep > size {
+				keep = size
+			}
+			r.record.Head = append(r.record.Head, data[n:n+keep]...)
+		}
+		r.record.Len += size
+		r.fragmentLeft -= size
+		n += size
+
+		if r.fragmentLeft > 0 {
+			break
+		}
+		r.inFragment = false
+		if r.last {
+			record := r.record
+			r.record = nil
+			return n, record, nil
+		}
+	}
+
+	return n, nil, nil
+}
@@ -0,0 +1,94 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+)
+
+// Decoder XDR decoder, decoding beyond data fails decoder and returns zero
+// values.
+type Decoder struct {
+	data   []byte
+	failed bool
+}
+
+// NewDecoder create XDR decoder of data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// Failed return true if decoding is beyond data.
+func (d *Decoder) Failed() bool {
+	return d.failed
+}
+
+// Rest get data not decoded yet.
+func (d *Decoder) Rest() []byte {
+	return d.data
+}
+
+// pad round n up to multiple of 4.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// Skip skip n bytes.
+func (d *Decoder) Skip(n int) {
+	if d.failed || n < 0 || n > len(d.data) {
+		d.failed = true
+		return
+	}
+
+	d.data = d.data[n:]
+}
+
+// Uint32 decode unsigned integer.
+func (d *Decoder) Uint32() uint32 {
+	if d.failed || len(d.data) < 4 {
+		d.failed = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+// Uint64 decode unsigned hyper integer.
+func (d *Decoder) Uint64() uint64 {
+	if d.failed || len(d.data) < 8 {
+		d.failed = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+// Bool decode boolean.
+func (d *Decoder) Bool() bool {
+	return d.Uint32() != 0
+}
+
+// Fixed decode fixed-length opaque data of n bytes.
+func (d *Decoder) Fixed(n int) []byte {
+	if d.failed || n < 0 || pad(n) > len(d.data) {
+		d.failed = true
+		return nil
+	}
+
+	v := d.data[:n]
+	d.data = d.data[pad(n):]
+	return v
+}
+
+// Opaque decode variable-length opaque data or string.
+func (d *Decoder) Opaque() []byte {
+	n := d.Uint32()
+	if n > uint32(len(d.data)) {
+		d.failed = true
+		return nil
+	}
+
+	return d.Fixed(int(n))
+}
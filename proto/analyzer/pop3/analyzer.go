@@ -0,0 +1,349 @@
+package pop3
+
+import (
+	"bytes"
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/textline"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "POP3RequestSent"
+
+	case responseBegin:
+		return "POP3ResponseBegin"
+
+	case responseComplete:
+		return "POP3ResponseComplete"
+
+	case responseError:
+		return "POP3ResponseError"
+
+	default:
+		return "InvalidPOP3SessionState"
+	}
+}
+
+// Status indicators.
+const (
+	statusOK  = "+OK"
+	statusErr = "-ERR"
+)
+
+// session state of one command.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	command   string
+	status    string
+	// multiline positive response is multiline
+	multiline bool
+	// responseSize bytes of multiline response
+	responseSize     int
+	startTLS         bool
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Command = s.command
+	sb.Status = s.status
+	sb.ResponseSize = s.responseSize
+	sb.StartTLS = s.startTLS
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown POP3 analyzer session breakdown of one command.
+type SessionBreakdown struct {
+	SessionState string `json:"pop3_session_state"`
+	Command      string `json:"pop3_command"`
+	Status       string `json:"pop3_status"`
+	// ResponseSize bytes of multiline response like message of RETR
+	ResponseSize int `json:"pop3_response_size"`
+	// StartTLS session is upgraded to TLS by this command
+	StartTLS        bool `json:"pop3_starttls"`
+	ServerLatency   uint `json:"pop3_server_latency"`
+	DownloadLatency uint `json:"pop3_download_latency"`
+}
+
+// ApplicationLatency get POP3 latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer POP3 analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// sessions commands waiting for responses in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// inMultiline server is sending multiline response
+	inMultiline bool
+	// lineStart multiline response parsed so far ends with line break
+	lineStart bool
+	// authData the next client line is response to AUTH challenge
+	authData bool
+	// upgraded session is upgraded to TLS and not parsable any more
+	upgraded bool
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init POP3 analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+}
+
+// isMultiline return true if positive response to command is multiline.
+func isMultiline(command string, args string) bool {
+	switch command {
+	case "RETR", "TOP", "CAPA":
+		return true
+
+	// Listing of all messages or mechanisms
+	case "LIST", "UIDL", "AUTH":
+		return args == ""
+
+	default:
+		return false
+	}
+}
+
+// readLine read line without line break, it returns bytes of line including
+// line break, 0 if line is incomplete. Connection is broken if line is too
+// long.
+func (a *Analyzer) readLine(data []byte) (string, int) {
+	line, n, err := textline.Read(data)
+	if err != nil {
+		log.Errorf("POP3 Analyzer: %s.", err)
+		a.broken = true
+	}
+
+	return line, n
+}
+
+func (a *Analyzer) handleClientData(data []byte) int {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	if a.authData {
+		a.authData = false
+		return n
+	}
+	if line == "" {
+		return n
+	}
+
+	command, args := line, ""
+	if space := strings.IndexByte(line, ' '); space >= 0 {
+		command, args = line[:space], strings.TrimSpace(line[space+1:])
+	}
+	command = strings.ToUpper(command)
+
+	a.sessions.PushBack(&session{
+		state:     requestSent,
+		command:   command,
+		multiline: isMultiline(command, args),
+		reqTime:   a.timestamp,
+	})
+
+	return n
+}
+
+// complete complete the oldest session.
+func (a *Analyzer) complete() *SessionBreakdown {
+	front := a.sessions.Front()
+	a.sessions.Remove(front)
+
+	s := front.Value.(*session)
+	s.respCompleteTime = a.timestamp
+	if s.status == statusOK {
+		s.state = responseComplete
+	} else {
+		s.state = responseError
+	}
+
+	return s.toBreakdown()
+}
+
+// parseMultiline parse multiline response until the line with single dot,
+// it returns bytes parsed.
+func (a *Analyzer) parseMultiline(s *session, data []byte) (int, *SessionBreakdown) {
+	var parsed int
+	for parsed < len(data) {
+		rest := data[parsed:]
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			// The line with single dot may be incomplete
+			if a.lineStart && len(rest) < 3 && bytes.HasPrefix([]byte(".\r\n"), rest) {
+				break
+			}
+			s.responseSize += len(rest)
+			a.lineStart = false
+			parsed = len(data)
+			break
+		}
+
+		line := rest[:end+1]
+		parsed += len(line)
+		if a.lineStart && (string(line) == ".\r\n" || string(line) == ".\n") {
+			a.inMultiline = false
+			return parsed, a.complete()
+		}
+		s.responseSize += len(line)
+		a.lineStart = true
+	}
+
+	return parsed, nil
+}
+
+func (a *Analyzer) handleServerData(data []byte) (int, *SessionBreakdown) {
+	front := a.sessions.Front()
+	if a.inMultiline && front != nil {
+		return a.parseMultiline(front.Value.(*session), data)
+	}
+
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0, nil
+	}
+
+	// Greeting and unsolicited response
+	if front == nil {
+		return n, nil
+	}
+
+	s := front.Value.(*session)
+	if s.state == requestSent {
+		s.state = responseBegin
+		s.respBeginTime = a.timestamp
+	}
+
+	switch {
+	case strings.HasPrefix(line, statusOK):
+		s.status = statusOK
+		if s.multiline {
+			a.inMultiline = true
+			a.lineStart = true
+			return n, nil
+		}
+		if s.command == "STLS" {
+			s.startTLS = true
+			a.upgraded = true
+		}
+
+	case strings.HasPrefix(line, statusErr):
+		s.status = statusErr
+
+	// Challenge of AUTH
+	case strings.HasPrefix(line, "+ ") || line == "+":
+		a.authData = true
+		return n, nil
+
+	default:
+		log.Errorf("POP3 Analyzer: invalid status line %q.", line)
+		s.status = line
+	}
+
+	return n, a.complete()
+}
+
+// HandleEstb POP3 analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("POP3 Analyzer: HandleEstb.")
+}
+
+// HandleData POP3 analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && !a.upgraded && parsed < len(payload) {
+		var n int
+		var sb *SessionBreakdown
+		if fromClient {
+			n = a.handleClientData(payload[parsed:])
+		} else {
+			n, sb = a.handleServerData(payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+
+		if sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	// Data after TLS upgrade is ignored
+	if a.broken || a.upgraded {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset POP3 analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("POP3 Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("POP3 Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin POP3 analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("POP3 Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("POP3 Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
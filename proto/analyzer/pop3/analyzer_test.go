@@ -0,0 +1,89 @@
+package pop3
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	message := "Subject: hi\r\n\r\n..leading dot\r\n"
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("+OK POP3 server ready\r\n"),
+		analyzertest.FromClient("USER bob\r\n"),
+		analyzertest.FromServer("+OK\r\n"),
+		analyzertest.FromClient("PASS wrong\r\n"),
+		analyzertest.FromServer("-ERR invalid password\r\n"),
+		analyzertest.FromClient("AUTH PLAIN\r\n"),
+		analyzertest.FromServer("+ \r\n"),
+		analyzertest.FromClient("AGJvYgBzZWNyZXQ=\r\n"),
+		analyzertest.FromServer("+OK logged in\r\n"),
+		analyzertest.FromClient("LIST\r\nRETR 1\r\nDELE 1\r\n"),
+		analyzertest.FromServer("+OK 1 messages\r\n1 29\r\n.\r\n+OK 29 octets\r\n" + message + ".\r\n+OK deleted\r\n"),
+		analyzertest.FromClient("STLS\r\n"),
+		analyzertest.FromServer("+OK Begin TLS negotiation\r\n"),
+		analyzertest.FromClient("\x16\x03\x01\x00\x05hello"),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "POP3ResponseComplete", Command: "USER", Status: "+OK"},
+		{SessionState: "POP3ResponseError", Command: "PASS", Status: "-ERR"},
+		{SessionState: "POP3ResponseComplete", Command: "AUTH", Status: "+OK"},
+		{SessionState: "POP3ResponseComplete", Command: "LIST", Status: "+OK", ResponseSize: 6},
+		{SessionState: "POP3ResponseComplete", Command: "RETR", Status: "+OK", ResponseSize: len(message)},
+		{SessionState: "POP3ResponseComplete", Command: "DELE", Status: "+OK"},
+		{SessionState: "POP3ResponseComplete", Command: "STLS", Status: "+OK", StartTLS: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("POP3 Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	if breakdowns[0].ServerLatency != 10 {
+		t.Errorf("POP3 Analyzer: get wrong server latency %d.", breakdowns[0].ServerLatency)
+	}
+	for i, sb := range breakdowns {
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("POP3 Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("POP3 Analyzer: get session breakdown %v on reset after TLS upgrade.", sb)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("+OK POP3 server ready\r\n"),
+		analyzertest.FromClient("STAT\r\nLIST\r\n"),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Command != "STAT" || breakdowns[1].Command != "LIST" {
+		t.Fatalf("POP3 Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("POP3 Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package postgresql
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/sql"
+	"github.com/zhengyuli/ntrace/proto/analyzer/tls"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	querySent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case querySent:
+		return "PostgreSQLQuerySent"
+
+	case responseBegin:
+		return "PostgreSQLResponseBegin"
+
+	case responseComplete:
+		return "PostgreSQLResponseComplete"
+
+	case responseError:
+		return "PostgreSQLResponseError"
+
+	default:
+		return "InvalidPostgreSQLSessionState"
+	}
+}
+
+// connPhase phase of PostgreSQL connection.
+type connPhase uint16
+
+const (
+	// phaseStartup waits for startup message or SSL negotiation
+	phaseStartup connPhase = iota
+	// phaseSSLResponse waits for response of SSLRequest or GSSENCRequest
+	phaseSSLResponse
+	// phaseAuth waits for authentication and ReadyForQuery
+	phaseAuth
+	phaseQuery
+)
+
+// session state of one frontend message which expects response, only
+// Query, Execute and FunctionCall generate session breakdowns unless they
+// fail.
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	msgType          byte
+	query            string
+	commandTag       string
+	rows             uint64
+	affectedRows     uint64
+	errSeverity      string
+	errCode          string
+	errMessage       string
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (a *Analyzer) session2Breakdown(s *session) *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.ServerVersion = a.serverVersion
+	sb.User = a.user
+	sb.Database = a.database
+	sb.ApplicationName = a.applicationName
+	sb.Command = commandNames[s.msgType]
+	if s.msgType == 0 {
+		sb.Command = "Startup"
+	}
+	if s.query != "" {
+		sb.SQL = sql.Normalize(s.query, sql.PostgreSQL)
+	}
+	sb.CommandTag = s.commandTag
+	sb.Rows = s.rows
+	sb.AffectedRows = s.affectedRows
+	sb.ErrorSeverity = s.errSeverity
+	sb.ErrorCode = s.errCode
+	sb.ErrorMessage = s.errMessage
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown PostgreSQL analyzer session breakdown of one query.
+type SessionBreakdown struct {
+	SessionState    string `json:"postgresql_session_state"`
+	ServerVersion   string `json:"postgresql_server_version,omitempty"`
+	User            string `json:"postgresql_user,omitempty"`
+	Database        string `json:"postgresql_database,omitempty"`
+	ApplicationName string `json:"postgresql_application_name,omitempty"`
+	Command         string `json:"postgresql_command"`
+	SQL             string `json:"postgresql_sql,omitempty"`
+	CommandTag      string `json:"postgresql_command_tag,omitempty"`
+	Rows            uint64 `json:"postgresql_rows"`
+	AffectedRows    uint64 `json:"postgresql_affected_rows"`
+	ErrorSeverity   string `json:"postgresql_error_severity,omitempty"`
+	ErrorCode       string `json:"postgresql_error_code,omitempty"`
+	ErrorMessage    string `json:"postgresql_error_message,omitempty"`
+	ServerLatency   uint   `json:"postgresql_server_latency"`
+	DownloadLatency uint   `json:"postgresql_download_latency"`
+}
+
+// ApplicationLatency get PostgreSQL latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of large message not received yet
+	skip int
+}
+
+// Analyzer PostgreSQL analyzer.
+type Analyzer struct {
+	timestamp       time.Time
+	client          halfConn
+	server          halfConn
+	phase           connPhase
+	serverVersion   string
+	user            string
+	database        string
+	applicationName string
+	// startupTime time of startup message for failed authentication
+	startupTime time.Time
+	// statements queries of prepared statements by name
+	statements map[string]string
+	// portals queries of portals by name
+	portals  map[string]string
+	sessions list.List
+	// pending session breakdowns not returned yet
+	pending breakdown.Queue
+	// tls analyzer of connection switched to TLS by SSLRequest
+	tls *tls.Analyzer
+	// broken connection is encrypted or not parsable any more
+	broken bool
+}
+
+// Init PostgreSQL analyzer init function.
+func (a *Analyzer) Init() {
+	a.phase = phaseStartup
+	a.statements = make(map[string]string)
+	a.portals = make(map[string]string)
+	a.sessions.Init()
+}
+
+func (a *Analyzer) handleStartup(data []byte) {
+	switch code := readUint32(data); code {
+	case sslRequest, gssEncRequest:
+		a.phase = phaseSSLResponse
+
+	case cancelRequest:
+		a.broken = true
+
+	default:
+		if code>>16 != protocolVersion3>>16 {
+			log.Errorf("PostgreSQL Analyzer: unsupported protocol version 0x%08x.", code)
+			a.broken = true
+			return
+		}
+
+		params := parseStartupParams(data[4:])
+		a.user = params["user"]
+		a.database = params["database"]
+		if a.database == "" {
+			a.database = a.user
+		}
+		a.applicationName = params["application_name"]
+		a.startupTime = a.timestamp
+		a.phase = phaseAuth
+	}
+}
+
+// handleSSLResponse handle single byte response of SSLRequest or
+// GSSENCRequest, connection continues with startup message if declined.
+func (a *Analyzer) handleSSLResponse(response byte) {
+	switch response {
+	case 'S':
+		log.Debug("PostgreSQL Analyzer: connection switches to TLS.")
+		a.tls = new(tls.Analyzer)
+		a.tls.Init()
+
+		// Decrypted data begins with startup message
+		inner := new(Analyzer)
+		inner.Init()
+		a.tls.SetInnerAnalyzer(inner)
+
+	case 'G':
+		log.Debug("PostgreSQL Analyzer: connection switches to GSSAPI encryption.")
+		a.broken = true
+
+	default:
+		a.phase = phaseStartup
+	}
+}
+
+func (a *Analyzer) handleClientMessage(typ byte, data []byte) {
+	if a.phase != phaseQuery {
+		return
+	}
+
+	s := &session{
+		state:   querySent,
+		msgType: typ,
+		reqTime: a.timestamp,
+	}
+
+	switch typ {
+	case msgQuery:
+		s.query, _ = cstring(data)
+
+	case msgParse:
+		var name string
+		name, data = cstring(data)
+		s.query, _ = cstring(data)
+		a.statements[name] = s.query
+
+	case msgBind:
+		portal, data := cstring(data)
+		statement, _ := cstring(data)
+		s.query = a.statements[statement]
+		a.portals[portal] = s.query
+
+	case msgExecute:
+		portal, _ := cstring(data)
+		s.query = a.portals[portal]
+
+	case msgDescribe, msgClose:
+		if len(data) > 0 {
+			name, _ := cstring(data[1:])
+			if data[0] == 'S' {
+				s.query = a.statements[name]
+			} else {
+				s.query = a.portals[name]
+			}
+
+			if typ == msgClose {
+				if data[0] == 'S' {
+					delete(a.statements, name)
+				} else {
+					delete(a.portals, name)
+				}
+			}
+		}
+
+	case msgSync, msgFunctionCall:
+
+	// Flush, Terminate, copy data and authentication messages have no
+	// response of their own
+	default:
+		return
+	}
+
+	a.sessions.PushBack(s)
+}
+
+// completeSession complete the front session and return its breakdown if
+// it's reported.
+func (a *Analyzer) completeSession(s *session) *SessionBreakdown {
+	s.respCompleteTime = a.timestamp
+	if s.state != responseError {
+		s.state = responseComplete
+	}
+	a.sessions.Remove(a.sessions.Front())
+
+	switch {
+	case s.msgType == msgQuery || s.msgType == msgExecute || s.msgType == msgFunctionCall:
+		return a.session2Breakdown(s)
+
+	case s.state == responseError && s.msgType != msgSync:
+		return a.session2Breakdown(s)
+
+	default:
+		return nil
+	}
+}
+
+func (a *Analyzer) onError(s *session, data []byte) {
+	e := parseErrorResponse(data)
+	s.state = responseError
+	s.errSeverity = e.severity
+	s.errCode = e.code
+	s.errMessage = e.message
+}
+
+func (a *Analyzer) handleAuthMessage(typ byte, data []byte) *SessionBreakdown {
+	switch typ {
+	case msgParameterStatus:
+		if name, data := cstring(data); name == "server_version" {
+			a.serverVersion, _ = cstring(data)
+		}
+
+	case msgReadyForQuery:
+		a.phase = phaseQuery
+
+	case msgErrorResponse:
+		// Failed startup is reported as Startup command
+		s := &session{
+			reqTime:          a.startupTime,
+			respBeginTime:    a.timestamp,
+			respCompleteTime: a.timestamp,
+		}
+		a.onError(s, data)
+		a.broken = true
+
+		return a.session2Breakdown(s)
+	}
+
+	return nil
+}
+
+func (a *Analyzer) handleServerMessage(typ byte, data []byte) *SessionBreakdown {
+	if a.phase == phaseAuth {
+		return a.handleAuthMessage(typ, data)
+	}
+
+	if typ == msgParameterStatus {
+		if name, data := cstring(data); name == "server_version" {
+			a.serverVersion, _ = cstring(data)
+		}
+		return nil
+	}
+
+	front := a.sessions.Front()
+	if front == nil {
+		return nil
+	}
+
+	s := front.Value.(*session)
+	if s.state == querySent {
+		s.state = responseBegin
+		s.respBeginTime = a.timestamp
+	}
+
+	switch typ {
+	case msgParseComplete, msgBindComplete, msgCloseComplete, msgNoData:
+		return a.completeSession(s)
+
+	case msgRowDescription:
+		if s.msgType == msgDescribe {
+			return a.completeSession(s)
+		}
+
+	case msgDataRow:
+		s.rows++
+
+	case msgCommandComplete:
+		tag, _ := cstring(data)
+		command, rows := parseCommandTag(tag)
+		s.commandTag = command
+		if command != "SELECT" && command != "FETCH" && command != "MOVE" {
+			s.affectedRows += rows
+		}
+		if s.msgType == msgExecute {
+			return a.completeSession(s)
+		}
+
+	case msgEmptyQueryResponse, msgPortalSuspended:
+		if s.msgType == msgExecute {
+			return a.completeSession(s)
+		}
+
+	case msgErrorResponse:
+		a.onError(s, data)
+		if s.msgType == msgQuery || s.msgType == msgFunctionCall || s.msgType == msgSync {
+			return nil
+		}
+
+		// Server discards extended query messages until Sync
+		for next := front.Next(); next != nil && next.Value.(*session).msgType != msgSync; {
+			discarded := next
+			next = next.Next()
+			a.sessions.Remove(discarded)
+		}
+		return a.completeSession(s)
+
+	case msgReadyForQuery:
+		return a.completeSession(s)
+	}
+
+	return nil
+}
+
+// skipIncomplete return true if incomplete message is row or copy data
+// which is skipped without waiting for the whole message.
+func skipIncomplete(typ byte, fromClient bool) bool {
+	if fromClient {
+		return typ == msgCopyData
+	}
+
+	return typ == msgDataRow || typ == msgCopyData
+}
+
+// HandleEstb PostgreSQL analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("PostgreSQL Analyzer: HandleEstb.")
+}
+
+// HandleData PostgreSQL analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	if a.tls != nil {
+		return a.tls.HandleData(payload, fromClient, timestamp)
+	}
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.tls == nil {
+		if hc.skip > 0 {
+			n := len(payload) - parsed
+			if n > hc.skip {
+				n = hc.skip
+			}
+			parsed += n
+			if hc.skip -= n; hc.skip > 0 {
+				break
+			}
+		}
+
+		rest := payload[parsed:]
+
+		// Startup messages have no type
+		if fromClient && a.phase == phaseStartup {
+			if len(rest) < 8 {
+				break
+			}
+			length := int(readUint32(rest))
+			if length < 8 || length > 10000 {
+				log.Errorf("PostgreSQL Analyzer: invalid startup message length %d.", length)
+				a.broken = true
+				break
+			}
+			if len(rest) < length {
+				break
+			}
+			parsed += length
+			a.handleStartup(rest[4:length])
+			continue
+		}
+
+		// SSL response is single byte, client waits for it
+		if a.phase == phaseSSLResponse {
+			if fromClient {
+				break
+			}
+			if len(rest) < 1 {
+				break
+			}
+			parsed++
+			a.handleSSLResponse(rest[0])
+			continue
+		}
+
+		if len(rest) < 5 {
+			break
+		}
+		typ := rest[0]
+		length := int(readUint32(rest[1:]))
+		if length < 4 {
+			log.Errorf("PostgreSQL Analyzer: invalid message length %d.", length)
+			a.broken = true
+			break
+		}
+		if len(rest) < 1+length {
+			if skipIncomplete(typ, fromClient) && a.phase == phaseQuery {
+				if !fromClient && typ == msgDataRow {
+					if front := a.sessions.Front(); front != nil {
+						front.Value.(*session).rows++
+					}
+				}
+				hc.skip = 1 + length
+				continue
+			}
+			break
+		}
+
+		data := rest[5 : 1+length]
+		parsed += 1 + length
+		if fromClient {
+			a.handleClientMessage(typ, data)
+		} else if sb := a.handleServerMessage(typ, data); sb != nil {
+			return uint(parsed), sb
+		}
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	// The rest of data is TLS
+	if a.tls != nil && parsed < len(payload) {
+		parseBytes, sessionBreakdown = a.tls.HandleData(payload[parsed:], fromClient, timestamp)
+		return uint(parsed) + parseBytes, sessionBreakdown
+	}
+
+	return uint(parsed), nil
+}
+
+// PopSessionBreakdown PostgreSQL analyzer pop session breakdown function,
+// session breakdowns flushed by reset and the ones of connection switched
+// to TLS are queued.
+func (a *Analyzer) PopSessionBreakdown() (sessionBreakdown interface{}) {
+	if a.tls != nil {
+		return a.tls.PopSessionBreakdown()
+	}
+
+	return a.pending.PopSessionBreakdown()
+}
+
+// HandleReset PostgreSQL analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("PostgreSQL Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("PostgreSQL Analyzer: HandleReset from server.")
+	}
+
+	if a.tls != nil {
+		return a.tls.HandleReset(fromClient, timestamp)
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		s := front.Value.(*session)
+		a.sessions.Remove(front)
+
+		if s.msgType == msgQuery || s.msgType == msgExecute || s.msgType == msgFunctionCall {
+			s.resetFlag = true
+			a.pending.Push(a.session2Breakdown(s))
+		}
+	}
+
+	return a.pending.PopSessionBreakdown()
+}
+
+// HandleFin PostgreSQL analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("PostgreSQL Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("PostgreSQL Analyzer: HandleFin from server.")
+	}
+
+	if a.tls != nil {
+		return a.tls.HandleFin(fromClient, timestamp)
+	}
+
+	return nil
+}
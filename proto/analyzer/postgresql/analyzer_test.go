@@ -0,0 +1,167 @@
+package postgresql
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uint32String(v uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return string(b[:])
+}
+
+// message build typed PostgreSQL message.
+func message(typ byte, body string) string {
+	return string(typ) + uint32String(uint32(len(body)+4)) + body
+}
+
+func startup(params ...string) string {
+	body := uint32String(protocolVersion3)
+	for _, p := range params {
+		body += p + "\x00"
+	}
+	body += "\x00"
+
+	return uint32String(uint32(len(body)+4)) + body
+}
+
+const (
+	authOK        = "R\x00\x00\x00\x08\x00\x00\x00\x00"
+	readyForQuery = "Z\x00\x00\x00\x05I"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(startup("user", "app", "database", "shop", "application_name", "psql")),
+		analyzertest.FromServer(authOK + message('S', "server_version\x0016.2\x00") + readyForQuery),
+		analyzertest.FromClient(message('Q', "SELECT id FROM users WHERE id IN (1, 2, 3)\x00")),
+		analyzertest.FromServer(message('T', "\x00\x01id\x00") + message('D', "\x00\x01\x00\x00\x00\x011") +
+			message('D', "\x00\x01\x00\x00\x00\x012") + message('C', "SELECT 2\x00") + readyForQuery),
+		analyzertest.FromClient(message('Q', "UPDATE users SET name = 'bob' WHERE id > 10\x00")),
+		analyzertest.FromServer(message('C', "UPDATE 5\x00") + readyForQuery),
+		analyzertest.FromClient(message('Q', "SELEC 1\x00")),
+		analyzertest.FromServer(message('E', "SERROR\x00VERROR\x00C42601\x00Msyntax error at or near \"SELEC\"\x00\x00") + readyForQuery),
+		// Extended query protocol
+		analyzertest.FromClient(message('P', "s1\x00INSERT INTO users (name) VALUES ($1)\x00\x00\x00") +
+			message('B', "\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x03bob\x00\x00") +
+			message('D', "P\x00") + message('E', "\x00\x00\x00\x00\x00") + message('S', "")),
+		analyzertest.FromServer(message('1', "") + message('2', "") + message('n', "") +
+			message('C', "INSERT 0 1\x00") + readyForQuery),
+		// Failed Bind discards Execute until Sync
+		analyzertest.FromClient(message('B', "\x00s2\x00\x00\x00\x00\x00\x00\x00") + message('E', "\x00\x00\x00\x00\x00") + message('S', "")),
+		analyzertest.FromServer(message('E', "SERROR\x00C26000\x00Mprepared statement \"s2\" does not exist\x00\x00") + readyForQuery),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "PostgreSQLResponseComplete", Command: "Query", SQL: "SELECT id FROM users WHERE id IN (?)",
+			CommandTag: "SELECT", Rows: 2},
+		{SessionState: "PostgreSQLResponseComplete", Command: "Query", SQL: "UPDATE users SET name = ? WHERE id > ?",
+			CommandTag: "UPDATE", AffectedRows: 5},
+		{SessionState: "PostgreSQLResponseError", Command: "Query", SQL: "SELEC ?", ErrorSeverity: "ERROR",
+			ErrorCode: "42601", ErrorMessage: "syntax error at or near \"SELEC\""},
+		{SessionState: "PostgreSQLResponseComplete", Command: "Execute", SQL: "INSERT INTO users (name) VALUES ($1)",
+			CommandTag: "INSERT", AffectedRows: 1},
+		{SessionState: "PostgreSQLResponseError", Command: "Bind", ErrorSeverity: "ERROR",
+			ErrorCode: "26000", ErrorMessage: "prepared statement \"s2\" does not exist"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("PostgreSQL Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerVersion != "16.2" || sb.User != "app" || sb.Database != "shop" ||
+			sb.ApplicationName != "psql" || sb.ServerLatency != 10 {
+			t.Errorf("PostgreSQL Analyzer: get wrong connection info %+v.", *sb)
+		}
+		sb.ServerVersion, sb.User, sb.Database, sb.ApplicationName, sb.ServerLatency = "", "", "", "", 0
+		if *sb != expected[i] {
+			t.Errorf("PostgreSQL Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("PostgreSQL Analyzer: get session breakdown %v on reset without pending query.", sb)
+	}
+}
+
+func TestAnalyzerStartupError(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(startup("user", "app")),
+		analyzertest.FromServer(message('E', "SFATAL\x00C28P01\x00Mpassword authentication failed for user \"app\"\x00\x00")),
+	})
+
+	if len(breakdowns) != 1 || breakdowns[0].Command != "Startup" || breakdowns[0].ErrorCode != "28P01" ||
+		breakdowns[0].Database != "app" || breakdowns[0].ServerLatency != 10 {
+		t.Fatalf("PostgreSQL Analyzer: get wrong startup error session breakdowns %v.", breakdowns)
+	}
+}
+
+func TestAnalyzerSSLRequest(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(uint32String(8) + uint32String(sslRequest)),
+		analyzertest.FromServer("S"),
+		// TLS ClientHello record header
+		analyzertest.FromClient("\x16\x03\x01\x00\x05\x01\x00\x00\x01\x00"),
+	})
+
+	if len(breakdowns) != 0 || a.tls == nil || a.phase != phaseSSLResponse {
+		t.Fatalf("PostgreSQL Analyzer: connection is not handed over to TLS analyzer, breakdowns %v.", breakdowns)
+	}
+
+	// Declined SSLRequest is followed by plaintext startup message
+	a = new(Analyzer)
+	a.Init()
+	breakdowns = run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(uint32String(8) + uint32String(sslRequest)),
+		analyzertest.FromServer("N"),
+		analyzertest.FromClient(startup("user", "app")),
+		analyzertest.FromServer(authOK + readyForQuery),
+		analyzertest.FromClient(message('Q', "SELECT 1\x00")),
+		analyzertest.FromServer(message('C', "SELECT 1\x00") + readyForQuery),
+	})
+
+	if len(breakdowns) != 1 || breakdowns[0].SQL != "SELECT ?" || a.tls != nil {
+		t.Fatalf("PostgreSQL Analyzer: get wrong session breakdowns %v after declined SSLRequest.", breakdowns)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClient(startup("user", "app")),
+		analyzertest.FromServer(authOK + readyForQuery),
+		analyzertest.FromClient(message('Q', "SELECT 1\x00") + message('Q', "SELECT 2\x00")),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 {
+		t.Fatalf("PostgreSQL Analyzer: get %d session breakdowns on reset, expected 2.", len(breakdowns))
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") || sb.SQL != "SELECT ?" {
+			t.Errorf("PostgreSQL Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// Codes of untyped messages from client.
+const (
+	protocolVersion3 uint32 = 196608
+	cancelRequest    uint32 = 80877102
+	sslRequest       uint32 = 80877103
+	gssEncRequest    uint32 = 80877104
+)
+
+// Frontend message types.
+const (
+	msgBind         byte = 'B'
+	msgClose        byte = 'C'
+	msgDescribe     byte = 'D'
+	msgExecute      byte = 'E'
+	msgFunctionCall byte = 'F'
+	msgFlush        byte = 'H'
+	msgParse        byte = 'P'
+	msgQuery        byte = 'Q'
+	msgSync         byte = 'S'
+	msgTerminate    byte = 'X'
+)
+
+// Backend message types.
+const (
+	msgParseComplete        byte = '1'
+	msgBindComplete         byte = '2'
+	msgCloseComplete        byte = '3'
+	msgCommandComplete      byte = 'C'
+	msgDataRow              byte = 'D'
+	msgErrorResponse        byte = 'E'
+	msgEmptyQueryResponse   byte = 'I'
+	msgParameterStatus      byte = 'S'
+	msgAuthentication       byte = 'R'
+	msgFunctionCallResponse byte = 'V'
+	msgReadyForQuery        byte = 'Z'
+	msgRowDescription       byte = 'T'
+	msgNoData               byte = 'n'
+	msgPortalSuspended      byte = 's'
+	msgCopyData             byte = 'd'
+)
+
+// commandNames names of frontend messages which are reported.
+var commandNames = map[byte]string{
+	msgBind:         "Bind",
+	msgClose:        "Close",
+	msgDescribe:     "Describe",
+	msgExecute:      "Execute",
+	msgFunctionCall: "FunctionCall",
+	msgParse:        "Parse",
+	msgQuery:        "Query",
+	msgSync:         "Sync",
+}
+
+// cstring split NUL terminated string from data.
+func cstring(data []byte) (string, []byte) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return string(data), nil
+	}
+
+	return string(data[:end]), data[end+1:]
+}
+
+// parseStartupParams parse parameter pairs of startup message.
+func parseStartupParams(data []byte) map[string]string {
+	params := make(map[string]string)
+
+	for len(data) > 0 && data[0] != 0 {
+		var name, value string
+		name, data = cstring(data)
+		value, data = cstring(data)
+		params[name] = value
+	}
+
+	return params
+}
+
+// errorResponse fields of ErrorResponse.
+type errorResponse struct {
+	severity string
+	code     string
+	message  string
+}
+
+func parseErrorResponse(data []byte) *errorResponse {
+	e := new(errorResponse)
+
+	for len(data) > 0 && data[0] != 0 {
+		typ := data[0]
+		var value string
+		value, data = cstring(data[1:])
+
+		switch typ {
+		// Non-localized severity is preferred
+		case 'V':
+			e.severity = value
+
+		case 'S':
+			if e.severity == "" {
+				e.severity = value
+			}
+
+		case 'C':
+			e.code = value
+
+		case 'M':
+			e.message = value
+		}
+	}
+
+	return e
+}
+
+// parseCommandTag split CommandComplete tag like "INSERT 0 5" into command
+// and rows count.
+func parseCommandTag(tag string) (command string, rows uint64) {
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return "", 0
+	}
+
+	last := fields[len(fields)-1]
+	count, err := strconv.ParseUint(last, 10, 64)
+	if err != nil || len(fields) == 1 {
+		return tag, 0
+	}
+
+	// INSERT tag has oid before rows count
+	if fields[0] == "INSERT" && len(fields) == 3 {
+		return fields[0], count
+	}
+
+	return strings.Join(fields[:len(fields)-1], " "), count
+}
+
+func readUint32(data []byte) uint32 {
+	if len(data) < 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(data)
+}
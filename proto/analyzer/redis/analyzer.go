@@ -0,0 +1,315 @@
+package redis
+
+import (
+	"container/list"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keyKeep  = "keep"
+	keyHash  = "hash"
+	keyStrip = "strip"
+)
+
+// keyMode how to report command key, "hash" replaces key with hash, "strip"
+// drops key and "keep" keeps key unchanged, default is "keep", it can be
+// changed by REDIS_KEY_MODE env.
+var keyMode = keyKeep
+
+func init() {
+	switch mode := strings.ToLower(os.Getenv("REDIS_KEY_MODE")); mode {
+	case keyKeep, keyHash, keyStrip:
+		keyMode = mode
+	}
+}
+
+// keylessCommands commands whose second argument is not key, arguments of
+// AUTH and HELLO are credentials which must not be reported.
+var keylessCommands = map[string]bool{
+	"AUTH":       true,
+	"HELLO":      true,
+	"PING":       true,
+	"ECHO":       true,
+	"SELECT":     true,
+	"INFO":       true,
+	"CONFIG":     true,
+	"CLIENT":     true,
+	"CLUSTER":    true,
+	"COMMAND":    true,
+	"SCRIPT":     true,
+	"FUNCTION":   true,
+	"EVAL":       true,
+	"EVALSHA":    true,
+	"FCALL":      true,
+	"MULTI":      true,
+	"EXEC":       true,
+	"DISCARD":    true,
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"PUBLISH":    true,
+	"SCAN":       true,
+	"DBSIZE":     true,
+	"FLUSHDB":    true,
+	"FLUSHALL":   true,
+	"SLOWLOG":    true,
+	"MEMORY":     true,
+	"LATENCY":    true,
+	"ACL":        true,
+	"MONITOR":    true,
+	"QUIT":       true,
+}
+
+// formatKey format key by key mode.
+func formatKey(key string) string {
+	switch keyMode {
+	case keyHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return fmt.Sprintf("%08x", h.Sum32())
+
+	case keyStrip:
+		return ""
+
+	default:
+		return key
+	}
+}
+
+type sessionState uint16
+
+const (
+	commandSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case commandSent:
+		return "RedisCommandSent"
+
+	case responseBegin:
+		return "RedisResponseBegin"
+
+	case responseComplete:
+		return "RedisResponseComplete"
+
+	case responseError:
+		return "RedisResponseError"
+
+	default:
+		return "InvalidRedisSessionState"
+	}
+}
+
+// session state of one command.
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	command          string
+	key              string
+	replyType        string
+	err              string
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Command = s.command
+	sb.Key = s.key
+	sb.ReplyType = s.replyType
+	sb.Error = s.err
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown Redis analyzer session breakdown of one command.
+type SessionBreakdown struct {
+	SessionState    string `json:"redis_session_state"`
+	Command         string `json:"redis_command"`
+	Key             string `json:"redis_key,omitempty"`
+	ReplyType       string `json:"redis_reply_type,omitempty"`
+	Error           string `json:"redis_error,omitempty"`
+	ServerLatency   uint   `json:"redis_server_latency"`
+	DownloadLatency uint   `json:"redis_download_latency"`
+}
+
+// ApplicationLatency get Redis latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// Analyzer Redis analyzer.
+type Analyzer struct {
+	client respReader
+	server respReader
+	// sessions commands waiting for replies in order
+	sessions list.List
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init Redis analyzer init function.
+func (a *Analyzer) Init() {
+	a.client.fromClient = true
+	a.sessions.Init()
+}
+
+func (a *Analyzer) handleCommand(v *value, timestamp time.Time) {
+	if len(v.args) == 0 {
+		return
+	}
+
+	s := &session{
+		state:   commandSent,
+		command: strings.ToUpper(v.args[0]),
+		reqTime: timestamp,
+	}
+	if len(v.args) > 1 && !keylessCommands[s.command] {
+		s.key = formatKey(v.args[1])
+	}
+
+	a.sessions.PushBack(s)
+}
+
+func (a *Analyzer) handleReply(v *value, timestamp time.Time) *SessionBreakdown {
+	// Attributes precede reply and push messages are out of band
+	if v.typ == typeAttribute || v.typ == typePush {
+		return nil
+	}
+
+	front := a.sessions.Front()
+	if front == nil {
+		log.Debug("Redis Analyzer: reply without command.")
+		return nil
+	}
+	a.sessions.Remove(front)
+
+	s := front.Value.(*session)
+	s.respCompleteTime = timestamp
+	if v.null {
+		s.replyType = typeNames[typeNull]
+	} else {
+		s.replyType = typeNames[v.typ]
+	}
+	if v.typ == typeError || v.typ == typeBulkError {
+		s.state = responseError
+		s.err = v.err
+	} else {
+		s.state = responseComplete
+	}
+
+	return s.toBreakdown()
+}
+
+// HandleEstb Redis analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("Redis Analyzer: HandleEstb.")
+}
+
+// HandleData Redis analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	r := &a.server
+	if fromClient {
+		r = &a.client
+	}
+
+	var parsed int
+	for parsed < len(payload) {
+		n, v, err := r.read(payload[parsed:])
+		parsed += n
+		if err != nil {
+			log.Errorf("Redis Analyzer: %s.", err)
+			a.broken = true
+			return uint(len(payload)), nil
+		}
+
+		if !fromClient && (r.started || v != nil) {
+			a.markResponseBegin(timestamp)
+		}
+
+		if v == nil {
+			break
+		}
+
+		if fromClient {
+			a.handleCommand(v, timestamp)
+		} else {
+			if sb := a.handleReply(v, timestamp); sb != nil {
+				return uint(parsed), sb
+			}
+		}
+	}
+
+	return uint(parsed), nil
+}
+
+// markResponseBegin mark response begin of front command once its reply
+// arrives.
+func (a *Analyzer) markResponseBegin(timestamp time.Time) {
+	if front := a.sessions.Front(); front != nil {
+		if s := front.Value.(*session); s.state == commandSent {
+			s.state = responseBegin
+			s.respBeginTime = timestamp
+		}
+	}
+}
+
+// HandleReset Redis analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Redis Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("Redis Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin Redis analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("Redis Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("Redis Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	large := strings.Repeat("x", 3*maxCaptureLen)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n"),
+		analyzertest.FromServer("+OK\r\n"),
+		// Pipelined commands
+		analyzertest.FromClient("*3\r\n$3\r\nset\r\n$4\r\nuser\r\n$" + "12288\r\n" + large + "\r\n" +
+			"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n" +
+			"*2\r\n$7\r\nHGETALL\r\n$4\r\nuser\r\n" +
+			"*2\r\n$4\r\nINCR\r\n$4\r\nuser\r\n"),
+		analyzertest.FromServer("+OK\r\n$-1\r\n*2\r\n$4\r\nname\r\n$" + "12288\r\n" + large + "\r\n" +
+			"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"),
+		// RESP3 reply with attribute and push message
+		analyzertest.FromClient("HELLO 3\r\n"),
+		analyzertest.FromServer("%1\r\n+server\r\n+redis\r\n"),
+		analyzertest.FromClient("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"),
+		analyzertest.FromServer(">3\r\n+message\r\n+news\r\n+hi\r\n|1\r\n+ttl\r\n:10\r\n=7\r\ntxt:abc\r\n"),
+		analyzertest.FromClient("*1\r\n$4\r\nPING\r\n"),
+		analyzertest.FromServer("!21\r\nSYNTAX invalid syntax\r\n"),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "RedisResponseComplete", Command: "AUTH", ReplyType: "SimpleString"},
+		{SessionState: "RedisResponseComplete", Command: "SET", Key: "user", ReplyType: "SimpleString"},
+		{SessionState: "RedisResponseComplete", Command: "GET", Key: "missing", ReplyType: "Null"},
+		{SessionState: "RedisResponseComplete", Command: "HGETALL", Key: "user", ReplyType: "Array"},
+		{SessionState: "RedisResponseError", Command: "INCR", Key: "user", ReplyType: "Error",
+			Error: "WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{SessionState: "RedisResponseComplete", Command: "HELLO", ReplyType: "Map"},
+		{SessionState: "RedisResponseComplete", Command: "GET", Key: "key", ReplyType: "VerbatimString"},
+		{SessionState: "RedisResponseError", Command: "PING", ReplyType: "BulkError", Error: "SYNTAX invalid syntax"},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("Redis Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if sb.ServerLatency != 10 {
+			t.Errorf("Redis Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		sb.ServerLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("Redis Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzerReset(t *testing.T) {
+	keyMode = keyHash
+	defer func() { keyMode = keyKeep }()
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("*2\r\n$4\r\nLLEN\r\n$5\r\nqueue\r\n*1\r\n$4\r\nPING\r\n"),
+		analyzertest.FromServer(":3"),
+	})
+	if len(breakdowns) != 0 {
+		t.Fatalf("Redis Analyzer: get session breakdowns %v of incomplete reply.", breakdowns)
+	}
+
+	sb, ok := a.HandleReset(false, time.Now()).(*SessionBreakdown)
+	if !ok || sb.SessionState != "Reset:RedisResponseBegin" || sb.Command != "LLEN" || sb.Key != formatKey("queue") ||
+		sb.Key == "queue" {
+		t.Fatalf("Redis Analyzer: get wrong session breakdown %v on reset.", sb)
+	}
+
+	// Pipelined command not replied yet is queued
+	sb, ok = a.PopSessionBreakdown().(*SessionBreakdown)
+	if !ok || !strings.HasPrefix(sb.SessionState, "Reset:") || sb.Command != "PING" {
+		t.Fatalf("Redis Analyzer: get wrong pipelined session breakdown %v on reset.", sb)
+	}
+	if sb := a.PopSessionBreakdown(); sb != nil {
+		t.Errorf("Redis Analyzer: get unexpected session breakdown %v on reset.", sb)
+	}
+}
@@ -0,0 +1,267 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// RESP value types.
+const (
+	typeSimpleString   byte = '+'
+	typeError          byte = '-'
+	typeInteger        byte = ':'
+	typeBulkString     byte = '$'
+	typeArray          byte = '*'
+	typeNull           byte = '_'
+	typeBoolean        byte = '#'
+	typeDouble         byte = ','
+	typeBigNumber      byte = '('
+	typeBulkError      byte = '!'
+	typeVerbatimString byte = '='
+	typeMap            byte = '%'
+	typeSet            byte = '~'
+	typeAttribute      byte = '|'
+	typePush           byte = '>'
+)
+
+var typeNames = map[byte]string{
+	typeSimpleString:   "SimpleString",
+	typeError:          "Error",
+	typeInteger:        "Integer",
+	typeBulkString:     "BulkString",
+	typeArray:          "Array",
+	typeNull:           "Null",
+	typeBoolean:        "Boolean",
+	typeDouble:         "Double",
+	typeBigNumber:      "BigNumber",
+	typeBulkError:      "BulkError",
+	typeVerbatimString: "VerbatimString",
+	typeMap:            "Map",
+	typeSet:            "Set",
+	typeAttribute:      "Attribute",
+	typePush:           "Push",
+}
+
+// maxLineLen max length of RESP line and inline command.
+const maxLineLen = 64 * 1024
+
+// maxCaptureLen max length of bulk string which is captured, longer one is
+// skipped without waiting for the whole of it.
+const maxCaptureLen = 4096
+
+// maxCaptureArgs command name and key are captured from command arguments.
+const maxCaptureArgs = 2
+
+var errInvalidRESP = errors.New("invalid RESP data")
+
+// value top level RESP value.
+type value struct {
+	typ byte
+	// null bulk string or array of RESP2
+	null bool
+	// args captured command arguments
+	args []string
+	// err error message of error reply
+	err string
+}
+
+// respReader incremental RESP reader of one direction, aggregate values are
+// tracked by remaining elements of each level instead of being buffered so
+// large values are skipped as they arrive.
+type respReader struct {
+	fromClient bool
+	// started top level value is being parsed
+	started bool
+	current value
+	// levels remaining elements of open aggregate values
+	levels []int
+	// skip bytes of bulk string not received yet
+	skip int
+	// argIndex index of next element of top level array
+	argIndex int
+}
+
+func (r *respReader) reset() {
+	r.started = false
+	r.current = value{}
+	r.levels = r.levels[:0]
+	r.argIndex = 0
+}
+
+// onElementEnd close aggregate values whose elements are all parsed, it
+// returns true if top level value is completed.
+func (r *respReader) onElementEnd() bool {
+	if len(r.levels) == 1 {
+		r.argIndex++
+	}
+
+	for len(r.levels) > 0 {
+		r.levels[len(r.levels)-1]--
+		if r.levels[len(r.levels)-1] > 0 {
+			return false
+		}
+		r.levels = r.levels[:len(r.levels)-1]
+	}
+
+	return true
+}
+
+// capture return true if bulk string at current position should be captured.
+func (r *respReader) capture(typ byte) bool {
+	if len(r.levels) == 0 {
+		return typ == typeBulkError
+	}
+
+	return r.fromClient && len(r.levels) == 1 && r.argIndex < maxCaptureArgs
+}
+
+// readLine return line without CRLF and the length of line with CRLF, it
+// returns -1 as length if line is incomplete.
+func readLine(data []byte) (string, int, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) > maxLineLen {
+			return "", 0, errInvalidRESP
+		}
+		return "", -1, nil
+	}
+
+	return string(data[:end]), end + 2, nil
+}
+
+// read parse data until top level value is completed, it returns bytes
+// consumed and completed value or nil if more data is needed.
+func (r *respReader) read(data []byte) (int, *value, error) {
+	parsed := 0
+
+	for {
+		if r.skip > 0 {
+			n := len(data) - parsed
+			if n > r.skip {
+				n = r.skip
+			}
+			parsed += n
+			if r.skip -= n; r.skip > 0 {
+				return parsed, nil, nil
+			}
+			if r.onElementEnd() {
+				v := r.current
+				r.reset()
+				return parsed, &v, nil
+			}
+		}
+
+		if parsed == len(data) {
+			return parsed, nil, nil
+		}
+
+		rest := data[parsed:]
+		typ := rest[0]
+		if !r.started {
+			r.started = true
+			r.current.typ = typ
+		}
+
+		// Inline command is line of space separated arguments
+		if r.fromClient && len(r.levels) == 0 && typ != typeArray {
+			line, n, err := readLine(rest)
+			if n <= 0 {
+				return parsed, nil, err
+			}
+			parsed += n
+
+			r.current.args = strings.Fields(line)
+			if len(r.current.args) > maxCaptureArgs {
+				r.current.args = r.current.args[:maxCaptureArgs]
+			}
+			// Empty line is ignored
+			if len(r.current.args) == 0 {
+				r.reset()
+				continue
+			}
+			v := r.current
+			r.reset()
+			return parsed, &v, nil
+		}
+
+		line, n, err := readLine(rest)
+		if n <= 0 {
+			return parsed, nil, err
+		}
+		if line == "" {
+			return parsed, nil, errInvalidRESP
+		}
+		line = line[1:]
+
+		switch typ {
+		case typeBulkString, typeBulkError, typeVerbatimString:
+			length, err := strconv.Atoi(line)
+			if err != nil || length < -1 {
+				return parsed, nil, errInvalidRESP
+			}
+			if length == -1 {
+				if len(r.levels) == 0 {
+					r.current.null = true
+				}
+				parsed += n
+				break
+			}
+
+			if r.capture(typ) && length <= maxCaptureLen {
+				// Wait for the whole bulk string
+				if len(rest) < n+length+2 {
+					return parsed, nil, nil
+				}
+				str := string(rest[n : n+length])
+				if typ == typeBulkError {
+					r.current.err = str
+				} else {
+					r.current.args = append(r.current.args, str)
+				}
+				parsed += n + length + 2
+				break
+			}
+
+			parsed += n
+			r.skip = length + 2
+			continue
+
+		case typeArray, typeSet, typePush, typeMap, typeAttribute:
+			count, err := strconv.Atoi(line)
+			if err != nil || count < -1 {
+				return parsed, nil, errInvalidRESP
+			}
+			parsed += n
+			if typ == typeMap || typ == typeAttribute {
+				count *= 2
+			}
+			if count > 0 {
+				r.levels = append(r.levels, count)
+				continue
+			}
+			if count == -1 && len(r.levels) == 0 {
+				r.current.null = true
+			}
+
+		case typeError:
+			if len(r.levels) == 0 {
+				r.current.err = line
+			}
+			parsed += n
+
+		case typeSimpleString, typeInteger, typeNull, typeBoolean, typeDouble, typeBigNumber:
+			parsed += n
+
+		default:
+			return parsed, nil, errInvalidRESP
+		}
+
+		if r.onElementEnd() {
+			v := r.current
+			r.reset()
+			return parsed, &v, nil
+		}
+	}
+}
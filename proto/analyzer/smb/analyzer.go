@@ -0,0 +1,516 @@
+package smb
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseComplete
+	responseError
+	encrypted
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "SMBRequestSent"
+
+	case responseComplete:
+		return "SMBResponseComplete"
+
+	case responseError:
+		return "SMBResponseError"
+
+	case encrypted:
+		return "SMBEncrypted"
+
+	default:
+		return "InvalidSMBSessionState"
+	}
+}
+
+// maxHeadLen max leading bytes of message parsed, data of READ and WRITE
+// beyond it is skipped.
+const maxHeadLen = 4096
+
+// maxOpenFiles max open files tracked of one connection.
+const maxOpenFiles = 4096
+
+// session state of one command.
+type session struct {
+	resetFlag        bool
+	state            sessionState
+	messageID        uint64
+	command          uint16
+	dialect          string
+	sessionID        uint64
+	treeID           uint32
+	share            string
+	fileID           string
+	fileName         string
+	ioctl            string
+	status           uint32
+	bytesRead        uint32
+	bytesWritten     uint32
+	reqTime          time.Time
+	respBeginTime    time.Time
+	respCompleteTime time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Dialect = s.dialect
+	sb.SessionID = s.sessionID
+	if s.state == encrypted {
+		sb.Encrypted = true
+		return sb
+	}
+
+	sb.MessageID = s.messageID
+	sb.Command = commandName(s.command)
+	sb.Share = s.share
+	sb.FileName = s.fileName
+	sb.Ioctl = s.ioctl
+	if s.state == responseComplete || s.state == responseError {
+		sb.StatusCode = s.status
+		sb.Status = statusName(s.status)
+	}
+	sb.BytesRead = uint(s.bytesRead)
+	sb.BytesWritten = uint(s.bytesWritten)
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown SMB analyzer session breakdown of one command, or of SMB
+// session turning to encrypted messages.
+type SessionBreakdown struct {
+	SessionState string `json:"smb_session_state"`
+	MessageID    uint64 `json:"smb_message_id"`
+	Command      string `json:"smb_command,omitempty"`
+	Dialect      string `json:"smb_dialect,omitempty"`
+	SessionID    uint64 `json:"smb_session_id"`
+	// Share path of tree connected like \\server\share
+	Share    string `json:"smb_share,omitempty"`
+	FileName string `json:"smb_file_name,omitempty"`
+	// Ioctl control code of IOCTL
+	Ioctl        string `json:"smb_ioctl,omitempty"`
+	StatusCode   uint32 `json:"smb_status_code"`
+	Status       string `json:"smb_status,omitempty"`
+	BytesRead    uint   `json:"smb_bytes_read"`
+	BytesWritten uint   `json:"smb_bytes_written"`
+	// Encrypted messages of SMB session are encrypted and not parsed
+	Encrypted       bool `json:"smb_encrypted"`
+	ServerLatency   uint `json:"smb_server_latency"`
+	DownloadLatency uint `json:"smb_download_latency"`
+}
+
+// ApplicationLatency get SMB latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// skip bytes of message beyond parsed head not received yet
+	skip int
+	// completing sessions completed once message is skipped
+	completing []*session
+}
+
+// Analyzer SMB2/SMB3 over direct TCP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	client    halfConn
+	server    halfConn
+	dialect   string
+	// sessions commands waiting for responses
+	sessions list.List
+	// trees share paths by TreeId
+	trees map[uint32]string
+	// files file names by FileId
+	files map[string]string
+	// encryptedSessions SMB sessions seen encrypted
+	encryptedSessions map[uint64]bool
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init SMB analyzer init function.
+func (a *Analyzer) Init() {
+	a.sessions.Init()
+	a.trees = make(map[uint32]string)
+	a.files = make(map[string]string)
+	a.encryptedSessions = make(map[uint64]bool)
+}
+
+// complete complete session and queue its session breakdown.
+func (a *Analyzer) complete(s *session) {
+	s.respCompleteTime = a.timestamp
+	a.Push(s.toBreakdown())
+}
+
+// findSession find session by MessageId.
+func (a *Analyzer) findSession(messageID uint64) *list.Element {
+	for e := a.sessions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*session).messageID == messageID {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// handleRequest handle one request of compound chain, related is session of
+// the previous request of chain.
+func (a *Analyzer) handleRequest(h *header, data []byte, related *session) *session {
+	// Cancel request has no response
+	if h.command == cmdCancel {
+		return nil
+	}
+
+	s := &session{
+		state:     requestSent,
+		messageID: h.messageID,
+		command:   h.command,
+		dialect:   a.dialect,
+		sessionID: h.sessionID,
+		treeID:    h.treeID,
+		share:     a.trees[h.treeID],
+		reqTime:   a.timestamp,
+	}
+	if h.flags&flagRelated != 0 && related != nil {
+		s.sessionID = related.sessionID
+		s.share = related.share
+	}
+
+	// Offsets of request are relative to beginning of header
+	body := data[headerLen:]
+	switch h.command {
+	case cmdTreeConnect:
+		offset := int(uint16At(body, 4))
+		length := int(uint16At(body, 6))
+		s.share = utf16String(bytesAt(data, offset, length))
+
+	case cmdCreate:
+		offset := int(uint16At(body, 44))
+		length := int(uint16At(body, 46))
+		s.fileName = utf16String(bytesAt(data, offset, length))
+
+	case cmdIoctl:
+		s.ioctl = ioctlName(uint32At(body, 4))
+	}
+
+	if offset, ok := fileIDOffsets[h.command]; ok {
+		fileID := bytesAt(body, offset, fileIDLen)
+		if h.flags&flagRelated != 0 && isRelatedFileID(fileID) {
+			if related != nil {
+				s.fileID = related.fileID
+				s.fileName = related.fileName
+			}
+		} else if fileID != nil {
+			s.fileID = string(fileID)
+			s.fileName = a.files[s.fileID]
+		}
+	}
+
+	a.sessions.PushBack(s)
+	return s
+}
+
+// handleResponse handle one response of compound chain, it returns session
+// completed.
+func (a *Analyzer) handleResponse(h *header, data []byte) *session {
+	// Interim response of asynchronous command
+	if h.status == statusPending && h.flags&flagAsync != 0 {
+		return nil
+	}
+
+	e := a.findSession(h.messageID)
+	if e == nil {
+		// Oplock break notification uses MessageId 0xFFFFFFFFFFFFFFFF
+		log.Debugf("SMB Analyzer: response of unknown message ID %d.", h.messageID)
+		return nil
+	}
+	a.sessions.Remove(e)
+
+	s := e.Value.(*session)
+	s.respBeginTime = a.timestamp
+	s.status = h.status
+	if isError(h.status) {
+		s.state = responseError
+		return s
+	}
+	s.state = responseComplete
+
+	body := data[headerLen:]
+	switch h.command {
+	case cmdNegotiate:
+		a.dialect = dialectName(uint16At(body, 4))
+		s.dialect = a.dialect
+
+	case cmdSessionSetup:
+		s.sessionID = h.sessionID
+
+	case cmdTreeConnect:
+		a.trees[h.treeID] = s.share
+
+	case cmdTreeDisconnect:
+		delete(a.trees, s.treeID)
+
+	case cmdCreate:
+		if fileID := bytesAt(body, 64, fileIDLen); fileID != nil {
+			s.fileID = string(fileID)
+			if len(a.files) < maxOpenFiles {
+				a.files[s.fileID] = s.fileName
+			}
+		}
+
+	case cmdClose:
+		delete(a.files, s.fileID)
+
+	case cmdRead:
+		s.bytesRead = uint32At(body, 4)
+
+	case cmdWrite:
+		s.bytesWritten = uint32At(body, 4)
+	}
+
+	return s
+}
+
+// handleSMB2 handle SMB2 message of compound chain, it returns sessions
+// completed by responses.
+func (a *Analyzer) handleSMB2(msg []byte) []*session {
+	var completed []*session
+	var related *session
+
+	for offset := 0; offset < len(msg); {
+		h, ok := parseHeader(msg[offset:])
+		if !ok {
+			log.Error("SMB Analyzer: invalid SMB2 header.")
+			break
+		}
+		if h.nextCommand != 0 && h.nextCommand < headerLen {
+			log.Errorf("SMB Analyzer: invalid next command offset %d.", h.nextCommand)
+			break
+		}
+
+		end := len(msg)
+		if h.nextCommand != 0 && offset+int(h.nextCommand) < end {
+			end = offset + int(h.nextCommand)
+		}
+
+		data := msg[offset:end]
+		if h.flags&flagResponse != 0 {
+			if s := a.handleResponse(h, data); s != nil {
+				completed = append(completed, s)
+			}
+		} else {
+			related = a.handleRequest(h, data, related)
+		}
+
+		// The rest of chain beyond parsed head is ignored
+		if h.nextCommand == 0 {
+			break
+		}
+		offset += int(h.nextCommand)
+	}
+
+	return completed
+}
+
+// handleEncrypted handle encrypted message, SMB session turning to encrypted
+// is reported once.
+func (a *Analyzer) handleEncrypted(msg []byte) {
+	if len(msg) < transformHeaderLen {
+		return
+	}
+
+	sessionID := binary.LittleEndian.Uint64(msg[44:])
+	if a.encryptedSessions[sessionID] {
+		return
+	}
+	a.encryptedSessions[sessionID] = true
+
+	s := &session{
+		state:     encrypted,
+		dialect:   a.dialect,
+		sessionID: sessionID,
+	}
+	a.Push(s.toBreakdown())
+}
+
+// handleMessage handle one message of direct TCP transport, it returns bytes
+// consumed, 0 if more data is needed.
+func (a *Analyzer) handleMessage(hc *halfConn, data []byte) int {
+	if len(data) < transportHeaderLen {
+		return 0
+	}
+
+	length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	switch data[0] {
+	case sessionMessage:
+
+	case sessionKeepAlive:
+		hc.skip = length
+		return transportHeaderLen
+
+	default:
+		log.Errorf("SMB Analyzer: invalid transport message type %d.", data[0])
+		a.broken = true
+		return 0
+	}
+
+	headLen := length
+	if headLen > maxHeadLen {
+		headLen = maxHeadLen
+	}
+	if len(data) < transportHeaderLen+headLen {
+		return 0
+	}
+	msg := data[transportHeaderLen : transportHeaderLen+headLen]
+	hc.skip = length - headLen
+
+	switch {
+	case bytes.HasPrefix(msg, protocolSMB2):
+		completed := a.handleSMB2(msg)
+		if hc.skip > 0 {
+			hc.completing = append(hc.completing, completed...)
+		} else {
+			for _, s := range completed {
+				a.complete(s)
+			}
+		}
+
+	case bytes.HasPrefix(msg, protocolTransform):
+		a.handleEncrypted(msg)
+
+	case bytes.HasPrefix(msg, protocolSMB1):
+		// Multi-protocol negotiate answered by SMB2 negotiate response of
+		// MessageId 0
+		if len(msg) > 4 && msg[4] == smb1Negotiate {
+			a.sessions.PushBack(&session{
+				state:   requestSent,
+				command: cmdNegotiate,
+				reqTime: a.timestamp,
+			})
+		}
+
+	case bytes.HasPrefix(msg, protocolCompression):
+		log.Debug("SMB Analyzer: skip compressed message.")
+
+	default:
+		log.Error("SMB Analyzer: invalid protocol ID.")
+		a.broken = true
+		return 0
+	}
+
+	return transportHeaderLen + headLen
+}
+
+// skip skip message bytes beyond parsed head of half connection, it returns
+// bytes skipped.
+func (a *Analyzer) skip(hc *halfConn, data []byte) int {
+	n := len(data)
+	if n > hc.skip {
+		n = hc.skip
+	}
+
+	if hc.skip -= n; hc.skip == 0 && hc.completing != nil {
+		for _, s := range hc.completing {
+			a.complete(s)
+		}
+		hc.completing = nil
+	}
+
+	return n
+}
+
+// HandleEstb SMB analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("SMB Analyzer: HandleEstb.")
+}
+
+// HandleData SMB analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.broken && a.Len() == 0 && parsed < len(payload) {
+		if hc.skip > 0 {
+			parsed += a.skip(hc, payload[parsed:])
+			continue
+		}
+
+		n := a.handleMessage(hc, payload[parsed:])
+		if n == 0 {
+			break
+		}
+		parsed += n
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset SMB analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SMB Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("SMB Analyzer: HandleReset from server.")
+	}
+
+	for front := a.sessions.Front(); front != nil; front = a.sessions.Front() {
+		a.sessions.Remove(front)
+
+		s := front.Value.(*session)
+		s.resetFlag = true
+		a.Push(s.toBreakdown())
+	}
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin SMB analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SMB Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("SMB Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package smb
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	data := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(data[2*i:], c)
+	}
+
+	return data
+}
+
+// body create body of size beginning with structure size.
+func body(size int, structureSize uint16) []byte {
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint16(data, structureSize)
+
+	return data
+}
+
+func put16(data []byte, offset int, v uint16) []byte {
+	binary.LittleEndian.PutUint16(data[offset:], v)
+	return data
+}
+
+func put32(data []byte, offset int, v uint32) []byte {
+	binary.LittleEndian.PutUint32(data[offset:], v)
+	return data
+}
+
+// command encode SMB2 header and body.
+func command(cmd uint16, flags uint32, status uint32, messageID uint64, treeID uint32, sessionID uint64, b []byte) []byte {
+	h := make([]byte, headerLen)
+	copy(h, protocolSMB2)
+	binary.LittleEndian.PutUint16(h[4:], headerLen)
+	binary.LittleEndian.PutUint32(h[8:], status)
+	binary.LittleEndian.PutUint16(h[12:], cmd)
+	binary.LittleEndian.PutUint32(h[16:], flags)
+	binary.LittleEndian.PutUint64(h[24:], messageID)
+	binary.LittleEndian.PutUint32(h[36:], treeID)
+	binary.LittleEndian.PutUint64(h[40:], sessionID)
+
+	return append(h, b...)
+}
+
+// compound chain commands with 8 bytes aligned NextCommand.
+func compound(commands ...[]byte) []byte {
+	var data []byte
+	for i, c := range commands {
+		if i < len(commands)-1 {
+			for len(c)%8 != 0 {
+				c = append(c, 0)
+			}
+			binary.LittleEndian.PutUint32(c[20:], uint32(len(c)))
+		}
+		data = append(data, c...)
+	}
+
+	return data
+}
+
+// message encode direct TCP transport message.
+func message(msg []byte) []byte {
+	return append([]byte{0, byte(len(msg) >> 16), byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func treeConnect(path string) []byte {
+	p := utf16le(path)
+	b := put16(put16(body(8, 9), 4, headerLen+8), 6, uint16(len(p)))
+	return append(b, p...)
+}
+
+func create(name string) []byte {
+	n := utf16le(name)
+	b := put16(put16(body(56, 57), 44, headerLen+56), 46, uint16(len(n)))
+	return append(b, n...)
+}
+
+func fileID(id byte) []byte {
+	data := make([]byte, fileIDLen)
+	for i := range data {
+		data[i] = id
+	}
+
+	return data
+}
+
+func withFileID(b []byte, offset int, id byte) []byte {
+	copy(b[offset:], fileID(id))
+	return b
+}
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	const sid = 0x1234
+	const resp = flagResponse
+	const related = flagRelated
+
+	readResponse := message(command(cmdRead, resp, 0, 5, 5, sid,
+		append(put32(body(16, 17), 4, 65536), make([]byte, 65536)...)))
+
+	transform := make([]byte, transformHeaderLen+100)
+	copy(transform, protocolTransform)
+	binary.LittleEndian.PutUint64(transform[44:], sid)
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(message(command(cmdNegotiate, 0, 0, 0, 0, 0, body(36, 36)))),
+		analyzertest.FromServerBytes(message(command(cmdNegotiate, resp, 0, 0, 0, 0, put16(body(64, 65), 4, 0x0311)))),
+		analyzertest.FromClientBytes(message(command(cmdSessionSetup, 0, 0, 1, 0, 0, body(24, 25)))),
+		analyzertest.FromServerBytes(message(command(cmdSessionSetup, resp, statusMoreProcessingRequired, 1, 0, sid, body(8, 9)))),
+		analyzertest.FromClientBytes(message(command(cmdSessionSetup, 0, 0, 2, 0, sid, body(24, 25)))),
+		analyzertest.FromServerBytes(message(command(cmdSessionSetup, resp, 0, 2, 0, sid, body(8, 9)))),
+		analyzertest.FromClientBytes(message(command(cmdTreeConnect, 0, 0, 3, 0, sid, treeConnect(`\\srv\data`)))),
+		analyzertest.FromServerBytes(message(command(cmdTreeConnect, resp, 0, 3, 5, sid, body(16, 16)))),
+		analyzertest.FromClientBytes(message(command(cmdCreate, 0, 0, 4, 5, sid, create(`docs\report.txt`)))),
+		analyzertest.FromServerBytes(message(command(cmdCreate, resp, 0, 4, 5, sid, withFileID(body(88, 89), 64, 0x0f)))),
+		analyzertest.FromClientBytes(message(command(cmdRead, 0, 0, 5, 5, sid, withFileID(put32(body(48, 49), 4, 65536), 16, 0x0f)))),
+		analyzertest.FromServerBytes(readResponse[:5000]),
+		analyzertest.FromServerBytes(readResponse[5000:]),
+		analyzertest.FromClientBytes(message(compound(
+			command(cmdCreate, 0, 0, 6, 5, sid, create("notes.txt")),
+			command(cmdWrite, related, 0, 7, 5, sid,
+				append(withFileID(put32(body(48, 49), 4, 100), 16, 0xff), make([]byte, 100)...)),
+			command(cmdClose, related, 0, 8, 5, sid, withFileID(body(24, 24), 8, 0xff))))),
+		analyzertest.FromServerBytes(message(compound(
+			command(cmdCreate, resp, 0, 6, 5, sid, withFileID(body(88, 89), 64, 0x01)),
+			command(cmdWrite, resp|related, 0, 7, 5, sid, put32(body(16, 17), 4, 100)),
+			command(cmdClose, resp|related, 0, 8, 5, sid, body(60, 60))))),
+		analyzertest.FromClientBytes(message(command(cmdIoctl, 0, 0, 9, 5, sid, withFileID(put32(body(56, 57), 4, 0x00140204), 8, 0xff)))),
+		analyzertest.FromServerBytes(message(command(cmdIoctl, resp, 0, 9, 5, sid, body(48, 49)))),
+		analyzertest.FromClientBytes(message(command(cmdCreate, 0, 0, 10, 5, sid, create("missing.txt")))),
+		analyzertest.FromServerBytes(message(command(cmdCreate, resp, 0xc0000034, 10, 5, sid, body(8, 9)))),
+		analyzertest.FromClientBytes(message(command(cmdClose, 0, 0, 11, 5, sid, withFileID(body(24, 24), 8, 0x0f)))),
+		analyzertest.FromServerBytes(message(command(cmdClose, resp, 0, 11, 5, sid, body(60, 60)))),
+		analyzertest.FromClientBytes(message(transform)),
+		analyzertest.FromServerBytes(message(transform)),
+	})
+
+	share := `\\srv\data`
+	expected := []SessionBreakdown{
+		{SessionState: "SMBResponseComplete", MessageID: 0, Command: "NEGOTIATE", Dialect: "3.1.1",
+			Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 1, Command: "SESSION_SETUP", Dialect: "3.1.1", SessionID: sid,
+			StatusCode: statusMoreProcessingRequired, Status: "STATUS_MORE_PROCESSING_REQUIRED"},
+		{SessionState: "SMBResponseComplete", MessageID: 2, Command: "SESSION_SETUP", Dialect: "3.1.1", SessionID: sid,
+			Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 3, Command: "TREE_CONNECT", Dialect: "3.1.1", SessionID: sid,
+			Share: share, Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 4, Command: "CREATE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: `docs\report.txt`, Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 5, Command: "READ", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: `docs\report.txt`, Status: "STATUS_SUCCESS", BytesRead: 65536},
+		{SessionState: "SMBResponseComplete", MessageID: 6, Command: "CREATE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: "notes.txt", Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 7, Command: "WRITE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: "notes.txt", Status: "STATUS_SUCCESS", BytesWritten: 100},
+		{SessionState: "SMBResponseComplete", MessageID: 8, Command: "CLOSE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: "notes.txt", Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseComplete", MessageID: 9, Command: "IOCTL", Dialect: "3.1.1", SessionID: sid,
+			Share: share, Ioctl: "FSCTL_VALIDATE_NEGOTIATE_INFO", Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBResponseError", MessageID: 10, Command: "CREATE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: "missing.txt", StatusCode: 0xc0000034, Status: "STATUS_OBJECT_NAME_NOT_FOUND"},
+		{SessionState: "SMBResponseComplete", MessageID: 11, Command: "CLOSE", Dialect: "3.1.1", SessionID: sid,
+			Share: share, FileName: `docs\report.txt`, Status: "STATUS_SUCCESS"},
+		{SessionState: "SMBEncrypted", Dialect: "3.1.1", SessionID: sid, Encrypted: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("SMB Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	for i, sb := range breakdowns {
+		if !sb.Encrypted && sb.ServerLatency != 10 {
+			t.Errorf("SMB Analyzer: session breakdown %d get wrong server latency %d.", i, sb.ServerLatency)
+		}
+		if sb.Command == "READ" && sb.DownloadLatency != 10 {
+			t.Errorf("SMB Analyzer: session breakdown %d get wrong download latency %d.", i, sb.DownloadLatency)
+		}
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("SMB Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+}
+
+func TestAnalyzerReset(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromClientBytes(message(append(append([]byte{}, protocolSMB1...), smb1Negotiate))),
+		analyzertest.FromServerBytes(message(command(cmdNegotiate, flagResponse, 0, 0, 0, 0, put16(body(64, 65), 4, 0x02ff)))),
+		analyzertest.FromClientBytes(message(command(cmdCreate, 0, 0, 1, 0, 0, create("a.txt")))),
+		analyzertest.FromClientBytes(message(command(cmdCreate, 0, 0, 2, 0, 0, create("b.txt")))),
+	})
+
+	sb := a.HandleReset(false, time.Now())
+	expected := SessionBreakdown{SessionState: "Reset:SMBRequestSent", MessageID: 1, Command: "CREATE", Dialect: "2.???",
+		FileName: "a.txt"}
+	if sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("SMB Analyzer: session breakdown is %+v, expected %+v.", sb, expected)
+	}
+
+	// Outstanding request after the first one is queued
+	expected.MessageID, expected.FileName = 2, "b.txt"
+	if sb = a.PopSessionBreakdown(); sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("SMB Analyzer: queued session breakdown is %+v, expected %+v.", sb, expected)
+	}
+}
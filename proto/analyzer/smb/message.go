@@ -0,0 +1,301 @@
+package smb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Protocol IDs of SMB messages.
+var (
+	protocolSMB1        = []byte{0xff, 'S', 'M', 'B'}
+	protocolSMB2        = []byte{0xfe, 'S', 'M', 'B'}
+	protocolTransform   = []byte{0xfd, 'S', 'M', 'B'}
+	protocolCompression = []byte{0xfc, 'S', 'M', 'B'}
+)
+
+// NetBIOS session message types of direct TCP transport.
+const (
+	sessionMessage   = 0x00
+	sessionKeepAlive = 0x85
+)
+
+// Lengths of headers.
+const (
+	transportHeaderLen = 4
+	headerLen          = 64
+	transformHeaderLen = 52
+)
+
+// smb1Negotiate command of SMB1 negotiate request sent by multi-protocol
+// clients.
+const smb1Negotiate = 0x72
+
+// Header flags.
+const (
+	flagResponse = 0x00000001
+	flagAsync    = 0x00000002
+	flagRelated  = 0x00000004
+)
+
+// Commands.
+const (
+	cmdNegotiate      = 0
+	cmdSessionSetup   = 1
+	cmdLogoff         = 2
+	cmdTreeConnect    = 3
+	cmdTreeDisconnect = 4
+	cmdCreate         = 5
+	cmdClose          = 6
+	cmdFlush          = 7
+	cmdRead           = 8
+	cmdWrite          = 9
+	cmdLock           = 10
+	cmdIoctl          = 11
+	cmdCancel         = 12
+	cmdEcho           = 13
+	cmdQueryDirectory = 14
+	cmdChangeNotify   = 15
+	cmdQueryInfo      = 16
+	cmdSetInfo        = 17
+	cmdOplockBreak    = 18
+)
+
+var commandNames = []string{
+	"NEGOTIATE",
+	"SESSION_SETUP",
+	"LOGOFF",
+	"TREE_CONNECT",
+	"TREE_DISCONNECT",
+	"CREATE",
+	"CLOSE",
+	"FLUSH",
+	"READ",
+	"WRITE",
+	"LOCK",
+	"IOCTL",
+	"CANCEL",
+	"ECHO",
+	"QUERY_DIRECTORY",
+	"CHANGE_NOTIFY",
+	"QUERY_INFO",
+	"SET_INFO",
+	"OPLOCK_BREAK",
+}
+
+func commandName(command uint16) string {
+	if int(command) < len(commandNames) {
+		return commandNames[command]
+	}
+
+	return fmt.Sprintf("%d", command)
+}
+
+// fileIDOffsets offset of FileId in request body by command.
+var fileIDOffsets = map[uint16]int{
+	cmdClose:          8,
+	cmdFlush:          8,
+	cmdRead:           16,
+	cmdWrite:          16,
+	cmdLock:           8,
+	cmdIoctl:          8,
+	cmdQueryDirectory: 8,
+	cmdChangeNotify:   8,
+	cmdQueryInfo:      24,
+	cmdSetInfo:        16,
+}
+
+// fileIDLen length of FileId.
+const fileIDLen = 16
+
+var dialectNames = map[uint16]string{
+	0x0202: "2.0.2",
+	0x0210: "2.1",
+	0x02ff: "2.???",
+	0x0300: "3.0",
+	0x0302: "3.0.2",
+	0x0311: "3.1.1",
+}
+
+func dialectName(dialect uint16) string {
+	if name, ok := dialectNames[dialect]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", dialect)
+}
+
+var ioctlNames = map[uint32]string{
+	0x00060194: "FSCTL_DFS_GET_REFERRALS",
+	0x000900a8: "FSCTL_GET_REPARSE_POINT",
+	0x000900c4: "FSCTL_SET_SPARSE",
+	0x0011400c: "FSCTL_PIPE_PEEK",
+	0x00110018: "FSCTL_PIPE_WAIT",
+	0x0011c017: "FSCTL_PIPE_TRANSCEIVE",
+	0x00140078: "FSCTL_SRV_REQUEST_RESUME_KEY",
+	0x001401d4: "FSCTL_LMR_REQUEST_RESILIENCY",
+	0x001401fc: "FSCTL_QUERY_NETWORK_INTERFACE_INFO",
+	0x00140204: "FSCTL_VALIDATE_NEGOTIATE_INFO",
+	0x00144064: "FSCTL_SRV_ENUMERATE_SNAPSHOTS",
+	0x001440f2: "FSCTL_SRV_COPYCHUNK",
+	0x001480f2: "FSCTL_SRV_COPYCHUNK_WRITE",
+}
+
+func ioctlName(code uint32) string {
+	if name, ok := ioctlNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%08x", code)
+}
+
+// NT status codes.
+const (
+	statusSuccess                = 0x00000000
+	statusPending                = 0x00000103
+	statusMoreProcessingRequired = 0xc0000016
+)
+
+var statusNames = map[uint32]string{
+	0x00000000: "STATUS_SUCCESS",
+	0x00000103: "STATUS_PENDING",
+	0x0000010b: "STATUS_NOTIFY_CLEANUP",
+	0x0000010c: "STATUS_NOTIFY_ENUM_DIR",
+	0x80000005: "STATUS_BUFFER_OVERFLOW",
+	0x80000006: "STATUS_NO_MORE_FILES",
+	0xc0000001: "STATUS_UNSUCCESSFUL",
+	0xc0000002: "STATUS_NOT_IMPLEMENTED",
+	0xc0000003: "STATUS_INVALID_INFO_CLASS",
+	0xc0000008: "STATUS_INVALID_HANDLE",
+	0xc000000d: "STATUS_INVALID_PARAMETER",
+	0xc000000f: "STATUS_NO_SUCH_FILE",
+	0xc0000010: "STATUS_INVALID_DEVICE_REQUEST",
+	0xc0000011: "STATUS_END_OF_FILE",
+	0xc0000016: "STATUS_MORE_PROCESSING_REQUIRED",
+	0xc0000022: "STATUS_ACCESS_DENIED",
+	0xc0000023: "STATUS_BUFFER_TOO_SMALL",
+	0xc0000033: "STATUS_OBJECT_NAME_INVALID",
+	0xc0000034: "STATUS_OBJECT_NAME_NOT_FOUND",
+	0xc0000035: "STATUS_OBJECT_NAME_COLLISION",
+	0xc000003a: "STATUS_OBJECT_PATH_NOT_FOUND",
+	0xc0000043: "STATUS_SHARING_VIOLATION",
+	0xc0000054: "STATUS_FILE_LOCK_CONFLICT",
+	0xc0000055: "STATUS_LOCK_NOT_GRANTED",
+	0xc0000056: "STATUS_DELETE_PENDING",
+	0xc000006a: "STATUS_WRONG_PASSWORD",
+	0xc000006d: "STATUS_LOGON_FAILURE",
+	0xc000006e: "STATUS_ACCOUNT_RESTRICTION",
+	0xc000006f: "STATUS_INVALID_LOGON_HOURS",
+	0xc0000070: "STATUS_INVALID_WORKSTATION",
+	0xc0000071: "STATUS_PASSWORD_EXPIRED",
+	0xc0000072: "STATUS_ACCOUNT_DISABLED",
+	0xc000007f: "STATUS_DISK_FULL",
+	0xc00000ba: "STATUS_FILE_IS_A_DIRECTORY",
+	0xc00000bb: "STATUS_NOT_SUPPORTED",
+	0xc00000c9: "STATUS_NETWORK_NAME_DELETED",
+	0xc00000cc: "STATUS_BAD_NETWORK_NAME",
+	0xc0000101: "STATUS_DIRECTORY_NOT_EMPTY",
+	0xc0000103: "STATUS_NOT_A_DIRECTORY",
+	0xc0000120: "STATUS_CANCELLED",
+	0xc0000128: "STATUS_FILE_CLOSED",
+	0xc000015b: "STATUS_LOGON_TYPE_NOT_GRANTED",
+	0xc0000184: "STATUS_INVALID_DEVICE_STATE",
+	0xc0000193: "STATUS_ACCOUNT_EXPIRED",
+	0xc0000203: "STATUS_USER_SESSION_DELETED",
+	0xc0000224: "STATUS_PASSWORD_MUST_CHANGE",
+	0xc0000234: "STATUS_ACCOUNT_LOCKED_OUT",
+	0xc000035c: "STATUS_NETWORK_SESSION_EXPIRED",
+}
+
+func statusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%08x", status)
+}
+
+// isError check whether NT status is error, more processing required of
+// multi-leg session setup is not.
+func isError(status uint32) bool {
+	return status&0xc0000000 == 0xc0000000 && status != statusMoreProcessingRequired
+}
+
+// header SMB2 packet header.
+type header struct {
+	status      uint32
+	command     uint16
+	flags       uint32
+	nextCommand uint32
+	messageID   uint64
+	treeID      uint32
+	sessionID   uint64
+}
+
+// parseHeader parse SMB2 packet header.
+func parseHeader(data []byte) (*header, bool) {
+	if len(data) < headerLen || binary.LittleEndian.Uint16(data[4:]) != headerLen {
+		return nil, false
+	}
+
+	h := &header{
+		status:      binary.LittleEndian.Uint32(data[8:]),
+		command:     binary.LittleEndian.Uint16(data[12:]),
+		flags:       binary.LittleEndian.Uint32(data[16:]),
+		nextCommand: binary.LittleEndian.Uint32(data[20:]),
+		messageID:   binary.LittleEndian.Uint64(data[24:]),
+		sessionID:   binary.LittleEndian.Uint64(data[40:]),
+	}
+	// Async header has AsyncId in place of TreeId
+	if h.flags&flagAsync == 0 {
+		h.treeID = binary.LittleEndian.Uint32(data[36:])
+	}
+
+	return h, true
+}
+
+func uint16At(data []byte, offset int) uint16 {
+	if offset < 0 || offset+2 > len(data) {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint16(data[offset:])
+}
+
+func uint32At(data []byte, offset int) uint32 {
+	if offset < 0 || offset+4 > len(data) {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(data[offset:])
+}
+
+func bytesAt(data []byte, offset int, n int) []byte {
+	if offset < 0 || n < 0 || offset+n > len(data) {
+		return nil
+	}
+
+	return data[offset : offset+n]
+}
+
+// utf16String decode UTF-16LE string.
+func utf16String(data []byte) string {
+	u := make([]uint16, len(data)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+
+	return string(utf16.Decode(u))
+}
+
+// isRelatedFileID check whether FileId refers to file of previous related
+// operation in compound request.
+func isRelatedFileID(fileID []byte) bool {
+	for _, b := range fileID {
+		if b != 0xff {
+			return false
+		}
+	}
+
+	return len(fileID) == fileIDLen
+}
@@ -0,0 +1,489 @@
+package smtp
+
+import (
+	"bytes"
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/textline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	requestSent sessionState = iota
+	responseBegin
+	responseComplete
+	responseError
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case requestSent:
+		return "SMTPRequestSent"
+
+	case responseBegin:
+		return "SMTPResponseBegin"
+
+	case responseComplete:
+		return "SMTPResponseComplete"
+
+	case responseError:
+		return "SMTPResponseError"
+
+	default:
+		return "InvalidSMTPSessionState"
+	}
+}
+
+// replyStartMailInput reply to DATA command waiting for message.
+const replyStartMailInput = 354
+
+// replyAuthContinue reply to AUTH command waiting for client response.
+const replyAuthContinue = 334
+
+// replyServiceReady reply to STARTTLS command accepting TLS negotiation.
+const replyServiceReady = 220
+
+// session state of one command or one mail transaction.
+type session struct {
+	resetFlag bool
+	state     sessionState
+	// command verb of command, MAIL for mail transaction
+	command            string
+	sender             string
+	recipients         int
+	rejectedRecipients int
+	messageSize        int
+	replyCode          int
+	startTLS           bool
+	reqTime            time.Time
+	respBeginTime      time.Time
+	respCompleteTime   time.Time
+}
+
+func (s *session) toBreakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.Command = s.command
+	sb.Sender = s.sender
+	sb.Recipients = s.recipients
+	sb.RejectedRecipients = s.rejectedRecipients
+	sb.MessageSize = s.messageSize
+	sb.ReplyCode = s.replyCode
+	sb.StartTLS = s.startTLS
+
+	if s.respBeginTime.After(s.reqTime) {
+		sb.ServerLatency = uint(s.respBeginTime.Sub(s.reqTime).Nanoseconds() / 1000000)
+	}
+	if s.respCompleteTime.After(s.respBeginTime) {
+		sb.DownloadLatency = uint(s.respCompleteTime.Sub(s.respBeginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+// SessionBreakdown SMTP analyzer session breakdown of one command or one
+// mail transaction.
+type SessionBreakdown struct {
+	SessionState       string `json:"smtp_session_state"`
+	Command            string `json:"smtp_command"`
+	Sender             string `json:"smtp_sender,omitempty"`
+	Recipients         int    `json:"smtp_recipients"`
+	RejectedRecipients int    `json:"smtp_rejected_recipients"`
+	MessageSize        int    `json:"smtp_message_size"`
+	ReplyCode          int    `json:"smtp_reply_code"`
+	// StartTLS session is upgraded to TLS by this command
+	StartTLS bool `json:"smtp_starttls"`
+	// ServerLatency latency of reply to command, or reply to the end of
+	// message of mail transaction
+	ServerLatency   uint `json:"smtp_server_latency"`
+	DownloadLatency uint `json:"smtp_download_latency"`
+}
+
+// ApplicationLatency get SMTP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.ServerLatency+sb.DownloadLatency) * time.Millisecond
+}
+
+// command command waiting for reply.
+type command struct {
+	verb string
+	s    *session
+	// last the last chunk of BDAT
+	last bool
+}
+
+// Analyzer SMTP analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	// commands commands waiting for replies in order
+	commands list.List
+	// transaction mail transaction in progress
+	transaction *session
+	// inData client is sending message after DATA
+	inData bool
+	// lineStart message parsed so far ends with line break
+	lineStart bool
+	// skip bytes of BDAT chunk not received yet
+	skip int
+	// authData the next client line is response to AUTH challenge
+	authData bool
+	// upgraded session is upgraded to TLS and not parsable any more
+	upgraded bool
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+	// broken connection is not parsable any more
+	broken bool
+}
+
+// Init SMTP analyzer init function.
+func (a *Analyzer) Init() {
+	a.commands.Init()
+}
+
+// complete complete session with reply code and queue its session
+// breakdown.
+func (a *Analyzer) complete(s *session, replyCode int) {
+	s.replyCode = replyCode
+	s.respCompleteTime = a.timestamp
+	if replyCode < 400 {
+		s.state = responseComplete
+	} else {
+		s.state = responseError
+	}
+	a.Push(s.toBreakdown())
+}
+
+// abortTransaction complete mail transaction in progress as failed.
+func (a *Analyzer) abortTransaction() {
+	if t := a.transaction; t != nil {
+		a.transaction = nil
+		t.state = responseError
+		t.respCompleteTime = a.timestamp
+		a.Push(t.toBreakdown())
+	}
+}
+
+// endMessage mark end of message of mail transaction, the reply to the end
+// of message completes mail transaction.
+func (a *Analyzer) endMessage(last bool) {
+	t := a.transaction
+	if t == nil {
+		return
+	}
+
+	t.state = requestSent
+	t.reqTime = a.timestamp
+	t.respBeginTime = time.Time{}
+	a.commands.PushBack(&command{verb: "DATA", s: t, last: last})
+}
+
+// path get mailbox of reverse path or forward path parameter.
+func path(param string) string {
+	if start := strings.IndexByte(param, '<'); start >= 0 {
+		if end := strings.IndexByte(param[start:], '>'); end >= 0 {
+			return param[start+1 : start+end]
+		}
+	}
+
+	return strings.TrimSpace(param)
+}
+
+func (a *Analyzer) handleCommand(line string) {
+	verb, param := line, ""
+	if space := strings.IndexByte(line, ' '); space >= 0 {
+		verb, param = line[:space], line[space+1:]
+	}
+	verb = strings.ToUpper(verb)
+
+	c := &command{verb: verb}
+	switch verb {
+	case "MAIL":
+		a.abortTransaction()
+		a.transaction = &session{
+			state:   requestSent,
+			command: verb,
+			reqTime: a.timestamp,
+		}
+		if colon := strings.IndexByte(param, ':'); colon >= 0 {
+			a.transaction.sender = path(param[colon+1:])
+		}
+		c.s = a.transaction
+
+	case "RCPT", "DATA":
+		c.s = a.transaction
+
+	case "BDAT":
+		c.s = a.transaction
+		fields := strings.Fields(param)
+		if len(fields) > 0 {
+			size, err := strconv.Atoi(fields[0])
+			if err != nil || size < 0 {
+				log.Errorf("SMTP Analyzer: invalid BDAT chunk size %s.", fields[0])
+				a.broken = true
+				return
+			}
+			a.skip = size
+			if c.s != nil {
+				c.s.messageSize += size
+			}
+		}
+		c.last = len(fields) > 1 && strings.EqualFold(fields[1], "LAST")
+		if c.s != nil && c.last {
+			// Reply to the last chunk completes mail transaction
+			a.endMessage(true)
+			return
+		}
+
+	default:
+		c.s = &session{
+			state:   requestSent,
+			command: verb,
+			reqTime: a.timestamp,
+		}
+	}
+
+	a.commands.PushBack(c)
+}
+
+// handleReply handle reply line of reply code, only the last line of
+// multiline reply is final.
+func (a *Analyzer) handleReply(replyCode int, final bool) {
+	front := a.commands.Front()
+	// Greeting and unsolicited reply
+	if front == nil {
+		return
+	}
+
+	c := front.Value.(*command)
+	if c.s != nil && c.s.state == requestSent {
+		c.s.state = responseBegin
+		c.s.respBeginTime = a.timestamp
+	}
+	if !final {
+		return
+	}
+
+	if c.verb == "AUTH" && replyCode == replyAuthContinue {
+		a.authData = true
+		return
+	}
+	a.commands.Remove(front)
+
+	// Commands of mail transaction
+	if c.s != nil && c.s == a.transaction {
+		t := c.s
+		t.replyCode = replyCode
+		switch {
+		case c.verb == "RCPT" && replyCode < 400:
+			t.recipients++
+
+		case c.verb == "RCPT":
+			t.rejectedRecipients++
+
+		case c.verb == "DATA" && replyCode == replyStartMailInput:
+			a.inData = true
+			a.lineStart = true
+
+		case replyCode >= 400 || c.last:
+			a.transaction = nil
+			a.complete(t, replyCode)
+		}
+		return
+	}
+
+	switch c.verb {
+	case "RSET", "QUIT", "HELO", "EHLO":
+		a.abortTransaction()
+
+	case "STARTTLS":
+		if replyCode == replyServiceReady {
+			c.s.startTLS = true
+			a.upgraded = true
+		}
+	}
+
+	if c.s != nil {
+		a.complete(c.s, replyCode)
+	}
+}
+
+// parseMessage parse message of DATA until the line with single dot, it
+// returns bytes parsed.
+func (a *Analyzer) parseMessage(data []byte) int {
+	var parsed int
+	for parsed < len(data) {
+		rest := data[parsed:]
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			// The line with single dot may be incomplete
+			if a.lineStart && len(rest) < 3 && bytes.HasPrefix([]byte(".\r\n"), rest) {
+				break
+			}
+			a.addMessageSize(len(rest))
+			a.lineStart = false
+			parsed = len(data)
+			break
+		}
+
+		line := rest[:end+1]
+		parsed += len(line)
+		if a.lineStart && (string(line) == ".\r\n" || string(line) == ".\n") {
+			a.inData = false
+			a.endMessage(true)
+			break
+		}
+		a.addMessageSize(len(line))
+		a.lineStart = true
+	}
+
+	return parsed
+}
+
+func (a *Analyzer) addMessageSize(n int) {
+	if a.transaction != nil {
+		a.transaction.messageSize += n
+	}
+}
+
+// readLine read line without line break, it returns bytes of line including
+// line break, 0 if line is incomplete. Connection is broken if line is too
+// long.
+func (a *Analyzer) readLine(data []byte) (string, int) {
+	line, n, err := textline.Read(data)
+	if err != nil {
+		log.Errorf("SMTP Analyzer: %s.", err)
+		a.broken = true
+	}
+
+	return line, n
+}
+
+func (a *Analyzer) handleClientData(data []byte) int {
+	if a.skip > 0 {
+		n := len(data)
+		if n > a.skip {
+			n = a.skip
+		}
+		a.skip -= n
+		return n
+	}
+
+	if a.inData {
+		return a.parseMessage(data)
+	}
+
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	if a.authData {
+		a.authData = false
+	} else if line != "" {
+		a.handleCommand(line)
+	}
+
+	return n
+}
+
+func (a *Analyzer) handleServerData(data []byte) int {
+	line, n := a.readLine(data)
+	if n == 0 {
+		return 0
+	}
+
+	if len(line) < 3 {
+		log.Errorf("SMTP Analyzer: invalid reply %q.", line)
+		return n
+	}
+	replyCode, err := strconv.Atoi(line[:3])
+	if err != nil {
+		log.Errorf("SMTP Analyzer: invalid reply %q.", line)
+		return n
+	}
+
+	a.handleReply(replyCode, len(line) == 3 || line[3] != '-')
+	return n
+}
+
+// HandleEstb SMTP analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("SMTP Analyzer: HandleEstb.")
+}
+
+// HandleData SMTP analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	var parsed int
+	for !a.broken && !a.upgraded && a.Len() == 0 && parsed < len(payload) {
+		var n int
+		if fromClient {
+			n = a.handleClientData(payload[parsed:])
+		} else {
+			n = a.handleServerData(payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+	}
+
+	// Data after TLS upgrade is ignored
+	if a.broken || (a.upgraded && a.Len() == 0) {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset SMTP analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SMTP Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("SMTP Analyzer: HandleReset from server.")
+	}
+
+	// Commands of mail transaction share the same session
+	flushed := make(map[*session]bool)
+	for front := a.commands.Front(); front != nil; front = a.commands.Front() {
+		a.commands.Remove(front)
+
+		if s := front.Value.(*command).s; s != nil && !flushed[s] {
+			flushed[s] = true
+			s.resetFlag = true
+			a.Push(s.toBreakdown())
+		}
+	}
+
+	if t := a.transaction; t != nil && !flushed[t] {
+		t.resetFlag = true
+		a.Push(t.toBreakdown())
+	}
+	a.transaction = nil
+
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin SMTP analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SMTP Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("SMTP Analyzer: HandleFin from server.")
+	}
+
+	return nil
+}
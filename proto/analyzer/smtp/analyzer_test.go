@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, a *Analyzer, steps []analyzertest.Step) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Run(a, steps) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	message := "Subject: hi\r\n\r\n..leading dot\r\nbye\r\n"
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("220 mx.example.com ESMTP ready\r\n"),
+		analyzertest.FromClient("EHLO client.example.com\r\n"),
+		analyzertest.FromServer("250-mx.example.com\r\n250-PIPELINING\r\n250 CHUNKING\r\n"),
+		analyzertest.FromClient("AUTH LOGIN\r\n"),
+		analyzertest.FromServer("334 VXNlcm5hbWU6\r\n"),
+		analyzertest.FromClient("Ym9i\r\n"),
+		analyzertest.FromServer("334 UGFzc3dvcmQ6\r\n"),
+		analyzertest.FromClient("c2VjcmV0\r\n"),
+		analyzertest.FromServer("235 2.7.0 Authentication successful\r\n"),
+		// Pipelined envelope
+		analyzertest.FromClient("MAIL FROM:<alice@example.com> SIZE=100\r\nRCPT TO:<bob@example.com>\r\n" +
+			"RCPT TO:<nobody@example.com>\r\nRCPT TO:<carol@example.com>\r\nDATA\r\n"),
+		analyzertest.FromServer("250 OK\r\n250 OK\r\n550 5.1.1 No such user\r\n250 OK\r\n354 End data with <CR><LF>.<CR><LF>\r\n"),
+		analyzertest.FromClient(message),
+		analyzertest.FromClient(".\r\n"),
+		analyzertest.FromServer("250 2.0.0 Ok: queued\r\n"),
+		analyzertest.FromClient("MAIL FROM:<>\r\nRCPT TO:<bob@example.com>\r\nBDAT 5\r\n12345BDAT 3 LAST\r\nabc"),
+		analyzertest.FromServer("250 OK\r\n250 OK\r\n250 5 bytes\r\n"),
+		analyzertest.FromServer("452 4.3.1 Insufficient storage\r\n"),
+		analyzertest.FromClient("MAIL FROM:<eve@example.com>\r\n"),
+		analyzertest.FromServer("250 OK\r\n"),
+		analyzertest.FromClient("RSET\r\n"),
+		analyzertest.FromServer("250 OK\r\n"),
+		analyzertest.FromClient("STARTTLS\r\n"),
+		analyzertest.FromServer("220 Ready to start TLS\r\n"),
+		analyzertest.FromClient("\x16\x03\x01\x00\x05hello"),
+	})
+
+	expected := []SessionBreakdown{
+		{SessionState: "SMTPResponseComplete", Command: "EHLO", ReplyCode: 250},
+		{SessionState: "SMTPResponseComplete", Command: "AUTH", ReplyCode: 235},
+		{SessionState: "SMTPResponseComplete", Command: "MAIL", Sender: "alice@example.com", Recipients: 2,
+			RejectedRecipients: 1, MessageSize: len(message), ReplyCode: 250},
+		{SessionState: "SMTPResponseError", Command: "MAIL", Recipients: 1, MessageSize: 8, ReplyCode: 452},
+		{SessionState: "SMTPResponseError", Command: "MAIL", Sender: "eve@example.com", ReplyCode: 250},
+		{SessionState: "SMTPResponseComplete", Command: "RSET", ReplyCode: 250},
+		{SessionState: "SMTPResponseComplete", Command: "STARTTLS", ReplyCode: 220, StartTLS: true},
+	}
+	if len(breakdowns) != len(expected) {
+		t.Fatalf("SMTP Analyzer: get %d session breakdowns, expected %d.", len(breakdowns), len(expected))
+	}
+	if breakdowns[2].ServerLatency != 10 {
+		t.Errorf("SMTP Analyzer: get wrong server latency %d of mail transaction.", breakdowns[2].ServerLatency)
+	}
+	for i, sb := range breakdowns {
+		sb.ServerLatency = 0
+		sb.DownloadLatency = 0
+		if *sb != expected[i] {
+			t.Errorf("SMTP Analyzer: session breakdown %d is %+v, expected %+v.", i, *sb, expected[i])
+		}
+	}
+
+	if sb := a.HandleReset(false, time.Now()); sb != nil {
+		t.Errorf("SMTP Analyzer: get session breakdown %v on reset after TLS upgrade.", sb)
+	}
+}
+
+func TestAnalyzerLargeMessage(t *testing.T) {
+	line := strings.Repeat("x", 998) + "\r\n"
+
+	a := new(Analyzer)
+	a.Init()
+	breakdowns := run(t, a, []analyzertest.Step{
+		analyzertest.FromClient("MAIL FROM:<alice@example.com>\r\nRCPT TO:<bob@example.com>\r\nDATA\r\n"),
+		analyzertest.FromServer("250 OK\r\n250 OK\r\n354 Go ahead\r\n"),
+		analyzertest.FromClient(strings.Repeat(line, 100) + strings.Repeat("y", 100*1000) + "\r\n.\r\n"),
+		analyzertest.FromServer("250 OK\r\n"),
+	})
+
+	if len(breakdowns) != 1 || breakdowns[0].MessageSize != 100*1000+100*1000+2 {
+		t.Fatalf("SMTP Analyzer: get wrong session breakdowns %v of large message.", breakdowns)
+	}
+}
+
+func TestAnalyzerResetPending(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+	run(t, a, []analyzertest.Step{
+		analyzertest.FromServer("220 mx.example.com ESMTP ready\r\n"),
+		analyzertest.FromClient("MAIL FROM:<alice@example.com>\r\nRCPT TO:<bob@example.com>\r\nNOOP\r\n"),
+	})
+
+	var breakdowns []*SessionBreakdown
+	for sb := a.HandleReset(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Command != "MAIL" || breakdowns[0].Sender != "alice@example.com" ||
+		breakdowns[1].Command != "NOOP" {
+		t.Fatalf("SMTP Analyzer: get wrong session breakdowns %v on reset.", breakdowns)
+	}
+	for _, sb := range breakdowns {
+		if !strings.HasPrefix(sb.SessionState, "Reset:") {
+			t.Errorf("SMTP Analyzer: get wrong reset session breakdown %+v.", *sb)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package sql
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dialect SQL dialect which decides how quoted text is normalized.
+type Dialect int
+
+const (
+	// MySQL double quoted text is string literal.
+	MySQL Dialect = iota
+	// PostgreSQL double quoted text is identifier and dollar quoted text is
+	// string literal.
+	PostgreSQL
+)
+
+// maxNormalizedLength max length of normalized SQL, it can be changed by
+// SQL_NORMALIZED_MAX_LENGTH env.
+var maxNormalizedLength = 4096
+
+func init() {
+	if length, err := strconv.Atoi(os.Getenv("SQL_NORMALIZED_MAX_LENGTH")); err == nil && length > 0 {
+		maxNormalizedLength = length
+	}
+}
+
+var (
+	// placeholderListRegexp lists of placeholders like "IN (?, ?, ?)"
+	placeholderListRegexp = regexp.MustCompile(`\( ?\?(?: ?, ?\?)+ ?\)`)
+	// tupleListRegexp lists of tuples like "VALUES (?), (?)"
+	tupleListRegexp = regexp.MustCompile(`\(\?\)(?: ?, ?\(\?\))+`)
+)
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c == '$' || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// skipQuoted return index after closing quote of text beginning at i,
+// doubled quote is escaped and backslash escapes as well if allowed.
+func skipQuoted(query string, i int, backslash bool) int {
+	quote := query[i]
+	for i++; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\\' && backslash:
+			i++
+
+		case c == quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return len(query)
+}
+
+// skipNumber return index after numeric literal beginning at i.
+func skipNumber(query string, i int) int {
+	if strings.HasPrefix(query[i:], "0x") || strings.HasPrefix(query[i:], "0X") {
+		for i += 2; i < len(query) && strings.IndexByte("0123456789abcdefABCDEF", query[i]) >= 0; i++ {
+		}
+		return i
+	}
+
+	for ; i < len(query) && (isDigit(query[i]) || query[i] == '.'); i++ {
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+		if j < len(query) && isDigit(query[j]) {
+			for i = j; i < len(query) && isDigit(query[i]); i++ {
+			}
+		}
+	}
+
+	return i
+}
+
+// dollarQuoteTag return tag like "$tag$" of PostgreSQL dollar quoted text
+// beginning at i, empty if it's not dollar quoted.
+func dollarQuoteTag(query string, i int) string {
+	j := i + 1
+	for ; j < len(query) && query[j] != '$'; j++ {
+		if !isIdentChar(query[j]) || query[j] == '$' || (j == i+1 && isDigit(query[j])) {
+			return ""
+		}
+	}
+	if j == len(query) {
+		return ""
+	}
+
+	return query[i : j+1]
+}
+
+// Normalize normalize SQL by replacing literals with "?", collapsing lists
+// of placeholders, removing comments and collapsing whitespace, so that
+// the same statement with different values gets the same text.
+func Normalize(query string, dialect Dialect) string {
+	var b strings.Builder
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case isSpace(c):
+			space = true
+			i++
+
+		case strings.HasPrefix(query[i:], "--") || (c == '#' && dialect == MySQL):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			space = true
+			i += end
+
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			space = true
+			i += end + 4
+
+		case c == '\'':
+			emit("?")
+			i = skipQuoted(query, i, dialect == MySQL)
+
+		case c == '"' && dialect == MySQL:
+			emit("?")
+			i = skipQuoted(query, i, true)
+
+		case c == '"' || c == '`':
+			end := skipQuoted(query, i, false)
+			emit(query[i:end])
+			i = end
+
+		case c == '$' && dialect == PostgreSQL:
+			// Positional parameter like "$1"
+			if i+1 < len(query) && isDigit(query[i+1]) {
+				end := i + 1
+				for ; end < len(query) && isDigit(query[end]); end++ {
+				}
+				emit(query[i:end])
+				i = end
+				break
+			}
+
+			tag := dollarQuoteTag(query, i)
+			if tag == "" {
+				emit("$")
+				i++
+				break
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			emit("?")
+
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			emit("?")
+			i = skipNumber(query, i)
+
+		case isIdentStart(c):
+			// Prefixed string literals like X'ff', N'text' and E'text'
+			if i+1 < len(query) && query[i+1] == '\'' && strings.IndexByte("xXbBnNeE", c) >= 0 {
+				emit("?")
+				i = skipQuoted(query, i+1, dialect == MySQL || c == 'e' || c == 'E')
+				break
+			}
+
+			end := i + 1
+			for ; end < len(query) && isIdentChar(query[end]); end++ {
+			}
+			emit(query[i:end])
+			i = end
+
+		default:
+			emit(string(c))
+			i++
+		}
+	}
+
+	normalized := strings.TrimRight(b.String(), "; ")
+	normalized = placeholderListRegexp.ReplaceAllString(normalized, "(?)")
+	normalized = tupleListRegexp.ReplaceAllString(normalized, "(?)")
+	if len(normalized) > maxNormalizedLength {
+		// Cut at rune boundary to keep normalized SQL valid UTF-8
+		end := maxNormalizedLength
+		for end > 0 && !utf8.RuneStart(normalized[end]) {
+			end--
+		}
+		normalized = normalized[:end]
+	}
+
+	return normalized
+}
@@ -0,0 +1,38 @@
+package sql
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		query      string
+		dialect    Dialect
+		normalized string
+	}{
+		{"SELECT * FROM users WHERE id = 42", MySQL, "SELECT * FROM users WHERE id = ?"},
+		{"select  name\n from t1 where name='o''brien' and x = \"a\\\"b\";", MySQL, "select name from t1 where name=? and x = ?"},
+		{"SELECT * FROM t WHERE id IN (1, 2, 3) AND f > -1.5e3", MySQL, "SELECT * FROM t WHERE id IN (?) AND f > -?"},
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", MySQL, "INSERT INTO t (a, b) VALUES (?)"},
+		{"SELECT /* hint */ 1 -- trailing\n# mysql comment\nFROM dual", MySQL, "SELECT ? FROM dual"},
+		{"SELECT x'ff', 0x1F, `order` FROM t", MySQL, "SELECT ?, ?, `order` FROM t"},
+		{`SELECT "Name" FROM t WHERE a = $1 AND b = E'x\'y' AND c = $tag$it's$tag$`, PostgreSQL, `SELECT "Name" FROM t WHERE a = $1 AND b = ? AND c = ?`},
+	}
+
+	for _, c := range cases {
+		if normalized := Normalize(c.query, c.dialect); normalized != c.normalized {
+			t.Errorf("Normalize(%q) = %q, expected %q.", c.query, normalized, c.normalized)
+		}
+	}
+}
+
+func TestNormalizeTruncate(t *testing.T) {
+	defer func(length int) { maxNormalizedLength = length }(maxNormalizedLength)
+	maxNormalizedLength = 12
+
+	// "表" is 3 bytes, the second one crosses the length limit
+	if normalized := Normalize("SELECT 表表", MySQL); normalized != "SELECT 表" || !utf8.ValidString(normalized) {
+		t.Errorf("Normalize truncated = %q, expected %q.", normalized, "SELECT 表")
+	}
+}
@@ -0,0 +1,321 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+type sessionState uint16
+
+const (
+	sessionInit sessionState = iota
+	versionExchanged
+	keyExchangeComplete
+	sessionComplete
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionInit:
+		return "SSHSessionInit"
+
+	case versionExchanged:
+		return "SSHVersionExchanged"
+
+	case keyExchangeComplete:
+		return "SSHKeyExchangeComplete"
+
+	case sessionComplete:
+		return "SSHSessionComplete"
+
+	default:
+		return "InvalidSSHSessionState"
+	}
+}
+
+const (
+	// maxLineLen max length of identification string and lines before it
+	maxLineLen = 1024
+	// maxPacketLen max length of binary packet before encryption
+	maxPacketLen = 256 * 1024
+)
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	// version identification string
+	version string
+	kexInit *kexInit
+	// encrypted packets following NEWKEYS are not parsable
+	encrypted      bool
+	encryptedBytes uint
+}
+
+type session struct {
+	resetFlag    bool
+	state        sessionState
+	beginTime    time.Time
+	newKeysTime  time.Time
+	completeTime time.Time
+}
+
+// SessionBreakdown SSH analyzer session breakdown, only byte counts of
+// encrypted packets are reported after key exchange.
+type SessionBreakdown struct {
+	SessionState  string `json:"ssh_session_state"`
+	ClientVersion string `json:"ssh_client_version,omitempty"`
+	ServerVersion string `json:"ssh_server_version,omitempty"`
+	// HASSH fingerprint of algorithms offered by client and its MD5
+	HASSHAlgorithms string `json:"ssh_hassh_algorithms,omitempty"`
+	HASSH           string `json:"ssh_hassh,omitempty"`
+	// HASSHServer fingerprint of algorithms offered by server and its MD5
+	HASSHServerAlgorithms   string `json:"ssh_hassh_server_algorithms,omitempty"`
+	HASSHServer             string `json:"ssh_hassh_server,omitempty"`
+	ClientHostKeyAlgorithms string `json:"ssh_client_host_key_algorithms,omitempty"`
+	ServerHostKeyAlgorithms string `json:"ssh_server_host_key_algorithms,omitempty"`
+	// Algorithms chosen by both sides
+	KexAlgorithm     string `json:"ssh_kex_algorithm,omitempty"`
+	HostKeyAlgorithm string `json:"ssh_host_key_algorithm,omitempty"`
+	CipherC2S        string `json:"ssh_cipher_c2s,omitempty"`
+	CipherS2C        string `json:"ssh_cipher_s2c,omitempty"`
+	MACC2S           string `json:"ssh_mac_c2s,omitempty"`
+	MACS2C           string `json:"ssh_mac_s2c,omitempty"`
+	CompressionC2S   string `json:"ssh_compression_c2s,omitempty"`
+	CompressionS2C   string `json:"ssh_compression_s2c,omitempty"`
+	// NewKeysLatency time from connection establishment to NEWKEYS of both
+	// sides
+	NewKeysLatency       uint `json:"ssh_newkeys_latency"`
+	ClientEncryptedBytes uint `json:"ssh_client_encrypted_bytes"`
+	ServerEncryptedBytes uint `json:"ssh_server_encrypted_bytes"`
+	SessionLatency       uint `json:"ssh_session_latency"`
+}
+
+// ApplicationLatency get SSH key exchange latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.NewKeysLatency) * time.Millisecond
+}
+
+// Analyzer SSH analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	client    halfConn
+	server    halfConn
+	session   session
+	// broken connection is not SSH or not parsable any more
+	broken    bool
+	finCount  int
+	completed bool
+}
+
+// Init SSH analyzer init function.
+func (a *Analyzer) Init() {
+	*a = Analyzer{}
+}
+
+func (a *Analyzer) toBreakdown() *SessionBreakdown {
+	s := &a.session
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	sb.ClientVersion = a.client.version
+	sb.ServerVersion = a.server.version
+
+	client, server := a.client.kexInit, a.server.kexInit
+	if client != nil {
+		sb.HASSHAlgorithms = hassh(client)
+		sb.HASSH = md5Hex(sb.HASSHAlgorithms)
+		sb.ClientHostKeyAlgorithms = strings.Join(client.hostKeyAlgorithms, ",")
+	}
+	if server != nil {
+		sb.HASSHServerAlgorithms = hasshServer(server)
+		sb.HASSHServer = md5Hex(sb.HASSHServerAlgorithms)
+		sb.ServerHostKeyAlgorithms = strings.Join(server.hostKeyAlgorithms, ",")
+	}
+	if client != nil && server != nil {
+		sb.KexAlgorithm = negotiate(client.kexAlgorithms, server.kexAlgorithms)
+		sb.HostKeyAlgorithm = negotiate(client.hostKeyAlgorithms, server.hostKeyAlgorithms)
+		sb.CipherC2S = negotiate(client.ciphersC2S, server.ciphersC2S)
+		sb.CipherS2C = negotiate(client.ciphersS2C, server.ciphersS2C)
+		sb.MACC2S = negotiateMAC(sb.CipherC2S, client.macsC2S, server.macsC2S)
+		sb.MACS2C = negotiateMAC(sb.CipherS2C, client.macsS2C, server.macsS2C)
+		sb.CompressionC2S = negotiate(client.compressionC2S, server.compressionC2S)
+		sb.CompressionS2C = negotiate(client.compressionS2C, server.compressionS2C)
+	}
+
+	if s.newKeysTime.After(s.beginTime) {
+		sb.NewKeysLatency = uint(s.newKeysTime.Sub(s.beginTime).Nanoseconds() / 1000000)
+	}
+	sb.ClientEncryptedBytes = a.client.encryptedBytes
+	sb.ServerEncryptedBytes = a.server.encryptedBytes
+	if s.completeTime.After(s.beginTime) {
+		sb.SessionLatency = uint(s.completeTime.Sub(s.beginTime).Nanoseconds() / 1000000)
+	}
+
+	return sb
+}
+
+func (a *Analyzer) halfConn(fromClient bool) *halfConn {
+	if fromClient {
+		return &a.client
+	}
+
+	return &a.server
+}
+
+// handleVersion handle identification string, server may send other lines
+// before it.
+func (a *Analyzer) handleVersion(hc *halfConn, data []byte) int {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		if len(data) > maxLineLen {
+			log.Errorf("SSH Analyzer: line is longer than %d.", maxLineLen)
+			a.broken = true
+		}
+		return 0
+	}
+
+	line := strings.TrimRight(string(data[:end]), "\r")
+	if !strings.HasPrefix(line, "SSH-") {
+		return end + 1
+	}
+
+	if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+		log.Errorf("SSH Analyzer: unsupported identification string %q.", line)
+		a.broken = true
+	}
+	hc.version = line
+	if a.client.version != "" && a.server.version != "" {
+		a.session.state = versionExchanged
+	}
+
+	return end + 1
+}
+
+// handlePacket handle binary packet before NEWKEYS, MAC is not used yet.
+func (a *Analyzer) handlePacket(hc *halfConn, data []byte) int {
+	if len(data) < 5 {
+		return 0
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	padding := uint32(data[4])
+	if length > maxPacketLen || padding+1 >= length {
+		log.Errorf("SSH Analyzer: invalid packet length=%d, padding length=%d.", length, padding)
+		a.broken = true
+		return 0
+	}
+	if uint32(len(data)-4) < length {
+		return 0
+	}
+
+	payload := data[5 : 4+length-padding]
+	switch payload[0] {
+	case msgKexInit:
+		// Key re-exchange is encrypted, only the first KEXINIT is parsable
+		kex, ok := parseKexInit(payload[1:])
+		if !ok {
+			log.Error("SSH Analyzer: parse KEXINIT error.")
+			a.broken = true
+			return 0
+		}
+		hc.kexInit = kex
+
+	case msgNewKeys:
+		hc.encrypted = true
+		if a.client.encrypted && a.server.encrypted {
+			a.session.state = keyExchangeComplete
+			a.session.newKeysTime = a.timestamp
+		}
+	}
+
+	return int(4 + length)
+}
+
+// HandleEstb SSH analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("SSH Analyzer: HandleEstb.")
+
+	a.session.beginTime = timestamp
+}
+
+// HandleData SSH analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+	if a.session.beginTime.IsZero() {
+		a.session.beginTime = timestamp
+	}
+
+	hc := a.halfConn(fromClient)
+
+	var parsed int
+	for !a.broken && parsed < len(payload) {
+		if hc.encrypted {
+			hc.encryptedBytes += uint(len(payload) - parsed)
+			parsed = len(payload)
+			break
+		}
+
+		var n int
+		if hc.version == "" {
+			n = a.handleVersion(hc, payload[parsed:])
+		} else {
+			n = a.handlePacket(hc, payload[parsed:])
+		}
+		if n == 0 {
+			break
+		}
+		parsed += n
+	}
+
+	if a.broken {
+		return uint(len(payload)), nil
+	}
+
+	return uint(parsed), nil
+}
+
+// HandleReset SSH analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SSH Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("SSH Analyzer: HandleReset from server.")
+	}
+
+	if a.completed {
+		return nil
+	}
+
+	a.completed = true
+	a.session.resetFlag = true
+	a.session.completeTime = timestamp
+	return a.toBreakdown()
+}
+
+// HandleFin SSH analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("SSH Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("SSH Analyzer: HandleFin from server.")
+	}
+
+	// Session completes when both sides close connection
+	if a.finCount++; a.finCount < 2 || a.completed {
+		return nil
+	}
+
+	a.completed = true
+	if a.session.state == keyExchangeComplete {
+		a.session.state = sessionComplete
+	}
+	a.session.completeTime = timestamp
+	return a.toBreakdown()
+}
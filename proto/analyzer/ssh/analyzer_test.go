@@ -0,0 +1,145 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packet build binary packet of payload without MAC.
+func packet(payload []byte) []byte {
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+
+	data := make([]byte, 5, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(data, uint32(1+len(payload)+padding))
+	data[4] = byte(padding)
+	data = append(data, payload...)
+
+	return append(data, make([]byte, padding)...)
+}
+
+// kexInitPacket build KEXINIT packet of name lists.
+func kexInitPacket(lists ...string) []byte {
+	payload := append([]byte{msgKexInit}, make([]byte, kexInitCookieLen)...)
+	for i := 0; i < 10; i++ {
+		var list string
+		if i < len(lists) {
+			list = lists[i]
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(list)))
+		payload = append(payload, length...)
+		payload = append(payload, list...)
+	}
+	// first_kex_packet_follows and reserved
+	payload = append(payload, 0, 0, 0, 0, 0)
+
+	return packet(payload)
+}
+
+func TestAnalyzer(t *testing.T) {
+	timestamp := time.Now()
+
+	a := new(Analyzer)
+	a.Init()
+	a.HandleEstb(timestamp)
+
+	clientNewKeys := append(packet([]byte{msgNewKeys}), strings.Repeat("x", 100)...)
+	serverNewKeys := append(packet([]byte{31, 1, 2, 3}), packet([]byte{msgNewKeys})...)
+	steps := []analyzertest.Step{
+		analyzertest.FromServer("Authorized uses only\r\nSSH-2.0-OpenSSH_9.6\r\n"),
+		analyzertest.FromClient("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"),
+		analyzertest.FromClientBytes(kexInitPacket(
+			"curve25519-sha256,ext-info-c",
+			"ssh-ed25519,rsa-sha2-512",
+			"chacha20-poly1305@openssh.com,aes128-ctr",
+			"chacha20-poly1305@openssh.com,aes128-ctr",
+			"hmac-sha2-256",
+			"hmac-sha2-256",
+			"none,zlib@openssh.com",
+			"none,zlib@openssh.com")),
+		analyzertest.FromServerBytes(kexInitPacket(
+			"curve25519-sha256,diffie-hellman-group14-sha256",
+			"rsa-sha2-512,ssh-ed25519",
+			"aes128-ctr,chacha20-poly1305@openssh.com",
+			"aes128-ctr",
+			"hmac-sha2-256",
+			"hmac-sha2-256",
+			"none",
+			"none")),
+		analyzertest.FromClientBytes(packet([]byte{30, 1, 2, 3})),
+		analyzertest.FromServerBytes(serverNewKeys),
+		analyzertest.FromClientBytes(clientNewKeys),
+		analyzertest.FromServer(strings.Repeat("y", 200)),
+		analyzertest.FromClient(strings.Repeat("x", 50)),
+	}
+	for _, s := range steps {
+		timestamp = timestamp.Add(10 * time.Millisecond)
+		analyzertest.Feed(a, s.Data, s.FromClient, timestamp)
+	}
+
+	if sb := a.HandleFin(true, timestamp.Add(10*time.Millisecond)); sb != nil {
+		t.Errorf("SSH Analyzer: get session breakdown %v on the first fin.", sb)
+	}
+	sb := a.HandleFin(false, timestamp.Add(20*time.Millisecond))
+	if sb == nil {
+		t.Fatal("SSH Analyzer: get no session breakdown on the second fin.")
+	}
+
+	expected := SessionBreakdown{
+		SessionState:  "SSHSessionComplete",
+		ClientVersion: "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13",
+		ServerVersion: "SSH-2.0-OpenSSH_9.6",
+		HASSHAlgorithms: "curve25519-sha256,ext-info-c;chacha20-poly1305@openssh.com,aes128-ctr;" +
+			"hmac-sha2-256;none,zlib@openssh.com",
+		HASSH:                   "af7081e13d0bbb2f2e80082d363511d8",
+		HASSHServerAlgorithms:   "curve25519-sha256,diffie-hellman-group14-sha256;aes128-ctr;hmac-sha2-256;none",
+		HASSHServer:             "fccfa11c7d95c9b773dd0ba461c6a7ef",
+		ClientHostKeyAlgorithms: "ssh-ed25519,rsa-sha2-512",
+		ServerHostKeyAlgorithms: "rsa-sha2-512,ssh-ed25519",
+		KexAlgorithm:            "curve25519-sha256",
+		HostKeyAlgorithm:        "ssh-ed25519",
+		CipherC2S:               "chacha20-poly1305@openssh.com",
+		CipherS2C:               "aes128-ctr",
+		MACC2S:                  "<implicit>",
+		MACS2C:                  "hmac-sha2-256",
+		CompressionC2S:          "none",
+		CompressionS2C:          "none",
+		NewKeysLatency:          70,
+		ClientEncryptedBytes:    150,
+		ServerEncryptedBytes:    200,
+		SessionLatency:          110,
+	}
+	if *sb.(*SessionBreakdown) != expected {
+		t.Errorf("SSH Analyzer: session breakdown is %+v, expected %+v.", *sb.(*SessionBreakdown), expected)
+	}
+}
+
+func TestAnalyzerReset(t *testing.T) {
+	timestamp := time.Now()
+
+	a := new(Analyzer)
+	a.Init()
+	a.HandleEstb(timestamp)
+	analyzertest.Feed(a, "SSH-2.0-OpenSSH_9.6\r\n", false, timestamp)
+	analyzertest.Feed(a, "SSH-2.0-libssh_0.10\r\n", true, timestamp)
+
+	sb := a.HandleReset(false, timestamp.Add(10*time.Millisecond))
+	expected := SessionBreakdown{
+		SessionState:   "Reset:SSHVersionExchanged",
+		ClientVersion:  "SSH-2.0-libssh_0.10",
+		ServerVersion:  "SSH-2.0-OpenSSH_9.6",
+		SessionLatency: 10,
+	}
+	if sb == nil || *sb.(*SessionBreakdown) != expected {
+		t.Errorf("SSH Analyzer: session breakdown is %+v, expected %+v.", sb, expected)
+	}
+	if sb := a.HandleFin(true, time.Now()); sb != nil {
+		t.Errorf("SSH Analyzer: get session breakdown %v after reset.", sb)
+	}
+}
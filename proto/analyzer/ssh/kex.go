@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// Message numbers of transport layer.
+const (
+	msgKexInit = 20
+	msgNewKeys = 21
+)
+
+// kexInitCookieLen length of random cookie of KEXINIT.
+const kexInitCookieLen = 16
+
+// kexInit name lists of KEXINIT.
+type kexInit struct {
+	kexAlgorithms     []string
+	hostKeyAlgorithms []string
+	ciphersC2S        []string
+	ciphersS2C        []string
+	macsC2S           []string
+	macsS2C           []string
+	compressionC2S    []string
+	compressionS2C    []string
+}
+
+// parseKexInit parse KEXINIT payload following message number.
+func parseKexInit(data []byte) (*kexInit, bool) {
+	if len(data) < kexInitCookieLen {
+		return nil, false
+	}
+	data = data[kexInitCookieLen:]
+
+	// Language name lists are ignored
+	var lists [10][]string
+	for i := range lists {
+		if len(data) < 4 {
+			return nil, false
+		}
+		length := binary.BigEndian.Uint32(data)
+		if uint32(len(data)-4) < length {
+			return nil, false
+		}
+		if length > 0 {
+			lists[i] = strings.Split(string(data[4:4+length]), ",")
+		}
+		data = data[4+length:]
+	}
+
+	return &kexInit{
+		kexAlgorithms:     lists[0],
+		hostKeyAlgorithms: lists[1],
+		ciphersC2S:        lists[2],
+		ciphersS2C:        lists[3],
+		macsC2S:           lists[4],
+		macsS2C:           lists[5],
+		compressionC2S:    lists[6],
+		compressionS2C:    lists[7],
+	}, true
+}
+
+// hassh HASSH fingerprint string of client KEXINIT.
+func hassh(k *kexInit) string {
+	return strings.Join([]string{
+		strings.Join(k.kexAlgorithms, ","),
+		strings.Join(k.ciphersC2S, ","),
+		strings.Join(k.macsC2S, ","),
+		strings.Join(k.compressionC2S, ","),
+	}, ";")
+}
+
+// hasshServer HASSH-server fingerprint string of server KEXINIT.
+func hasshServer(k *kexInit) string {
+	return strings.Join([]string{
+		strings.Join(k.kexAlgorithms, ","),
+		strings.Join(k.ciphersS2C, ","),
+		strings.Join(k.macsS2C, ","),
+		strings.Join(k.compressionS2C, ","),
+	}, ";")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// negotiate choose the first algorithm of client supported by server.
+func negotiate(client []string, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+
+	return ""
+}
+
+// isAEAD return true if cipher authenticates data itself and MAC is not
+// used.
+func isAEAD(cipher string) bool {
+	return cipher == "chacha20-poly1305@openssh.com" ||
+		strings.HasSuffix(cipher, "-gcm@openssh.com")
+}
+
+// negotiateMAC choose MAC algorithm used with cipher.
+func negotiateMAC(cipher string, client []string, server []string) string {
+	if isAEAD(cipher) {
+		return "<implicit>"
+	}
+
+	return negotiate(client, server)
+}
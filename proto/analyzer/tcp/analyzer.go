@@ -60,6 +60,11 @@ type SessionBreakdown struct {
 	SessionLatency    uint   `json:"tcp_session_latency"`
 }
 
+// ApplicationLatency get TCP latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.SessionLatency) * time.Millisecond
+}
+
 // Analyzer TCP analyzer.
 type Analyzer struct {
 	session session
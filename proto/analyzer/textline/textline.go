@@ -0,0 +1,28 @@
+package textline
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MaxLen max length of command and reply line of text protocols.
+const MaxLen = 64 * 1024
+
+// ErrTooLong incomplete line is longer than MaxLen.
+var ErrTooLong = fmt.Errorf("line is longer than %d", MaxLen)
+
+// Read read line without line break, it returns bytes of line including
+// line break, 0 if line is incomplete. ErrTooLong is returned if line is
+// incomplete and longer than MaxLen.
+func Read(data []byte) (line string, n int, err error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		if len(data) > MaxLen {
+			return "", 0, ErrTooLong
+		}
+		return "", 0, nil
+	}
+
+	return strings.TrimRight(string(data[:end]), "\r"), end + 1, nil
+}
@@ -0,0 +1,28 @@
+package textline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		data string
+		line string
+		n    int
+		err  error
+	}{
+		{"EHLO test\r\nQUIT\r\n", "EHLO test", 11, nil},
+		{"NOOP\n", "NOOP", 5, nil},
+		{"\r\n", "", 2, nil},
+		{"QUI", "", 0, nil},
+		{strings.Repeat("x", MaxLen+1), "", 0, ErrTooLong},
+	}
+
+	for _, test := range tests {
+		line, n, err := Read([]byte(test.data))
+		if line != test.line || n != test.n || err != test.err {
+			t.Errorf("Read(%.16q) = %q, %d, %v, expected %q, %d, %v.", test.data, line, n, err, test.line, test.n, test.err)
+		}
+	}
+}
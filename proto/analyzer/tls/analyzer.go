@@ -0,0 +1,803 @@
+package tls
+
+import (
+	cryptotls "crypto/tls"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/proto/analyzer/breakdown"
+	"github.com/zhengyuli/ntrace/proto/analyzer/http"
+	"github.com/zhengyuli/ntrace/proto/analyzer/http2"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxPendingRecordBytes max bytes of encrypted records buffered while
+// waiting for session secrets to appear in key log, it can be changed by
+// TLS_KEYLOG_PENDING_BYTES env.
+var maxPendingRecordBytes = 1024 * 1024
+
+func init() {
+	if pendingBytes, err := strconv.Atoi(os.Getenv("TLS_KEYLOG_PENDING_BYTES")); err == nil && pendingBytes >= 0 {
+		maxPendingRecordBytes = pendingBytes
+	}
+}
+
+type sessionState uint16
+
+const (
+	sessionInit sessionState = iota
+	clientHelloSent
+	serverHelloSent
+	handshakeComplete
+	sessionComplete
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionInit:
+		return "TLSSessionInit"
+
+	case clientHelloSent:
+		return "TLSClientHello"
+
+	case serverHelloSent:
+		return "TLSServerHello"
+
+	case handshakeComplete:
+		return "TLSHandshakeComplete"
+
+	case sessionComplete:
+		return "TLSSessionComplete"
+
+	default:
+		return "InvalidTLSSessionState"
+	}
+}
+
+func versionName(version uint16) string {
+	switch version {
+	case versionSSL30:
+		return "SSL 3.0"
+
+	case versionTLS10:
+		return "TLS 1.0"
+
+	case versionTLS11:
+		return "TLS 1.1"
+
+	case versionTLS12:
+		return "TLS 1.2"
+
+	case versionTLS13:
+		return "TLS 1.3"
+
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+var alertDescriptions = map[uint8]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	22:  "record_overflow",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func alertName(level uint8, description uint8) string {
+	levelName := "warning"
+	if level == 2 {
+		levelName = "fatal"
+	}
+
+	if name, ok := alertDescriptions[description]; ok {
+		return levelName + ":" + name
+	}
+
+	return fmt.Sprintf("%s:%d", levelName, description)
+}
+
+// halfConn parse state of one direction.
+type halfConn struct {
+	fromClient bool
+	// handshake buffer of handshake messages split into records
+	handshake []byte
+	// encrypted handshake messages are not parsable
+	encrypted bool
+	ccsSeen   bool
+	// cipher decrypts records once session secrets are found in key log
+	cipher *recordCipher
+	// trafficKeys TLS 1.3 application traffic keys are in use
+	trafficKeys bool
+	// plaintext decrypted application data not consumed by inner analyzer
+	plaintext []byte
+}
+
+// pendingRecord encrypted record waiting for session secrets.
+type pendingRecord struct {
+	fromClient bool
+	header     []byte
+	payload    []byte
+	timestamp  time.Time
+}
+
+// InnerAnalyzer analyzer of decrypted application data.
+type InnerAnalyzer interface {
+	HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{})
+	HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{})
+	HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{})
+}
+
+// sessionBreakdownQueue optional interface of inner analyzer which may
+// generate more than one session breakdown by one call.
+type sessionBreakdownQueue interface {
+	PopSessionBreakdown() (sessionBreakdown interface{})
+}
+
+// newInnerAnalyzer create analyzer of application protocol negotiated by
+// ALPN, returns nil if protocol is not supported.
+func newInnerAnalyzer(alpnProtocol string) InnerAnalyzer {
+	switch alpnProtocol {
+	case "h2":
+		a := new(http2.Analyzer)
+		a.Init()
+
+		return a
+
+	case "", "http/1.1", "http/1.0":
+		a := new(http.Analyzer)
+		a.Init()
+
+		return a
+
+	default:
+		return nil
+	}
+}
+
+type session struct {
+	resetFlag       bool
+	state           sessionState
+	clientHello     *clientHello
+	serverHello     *serverHello
+	helloRetry      bool
+	version         uint16
+	resumed         bool
+	certificate     *certificateInfo
+	alert           string
+	alertFrom       string
+	encryptedAlerts uint
+	clientHelloTime time.Time
+	handshakeTime   time.Time
+	clientAppData   uint
+	serverAppData   uint
+	decrypted       bool
+	ja3             string
+	ja3s            string
+	ja4fp           string
+}
+
+type certificateInfo struct {
+	subject   string
+	issuer    string
+	notBefore time.Time
+	notAfter  time.Time
+	dnsNames  []string
+	chainLen  int
+}
+
+func (s *session) session2Breakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if s.resetFlag {
+		sb.SessionState = "Reset:" + s.state.String()
+	} else {
+		sb.SessionState = s.state.String()
+	}
+
+	if s.clientHello != nil {
+		sb.ServerName = s.clientHello.serverName
+		sb.ClientALPN = s.clientHello.alpnProtocols
+		sb.JA3 = s.ja3
+		sb.JA3Hash = md5Hex(s.ja3)
+		sb.JA4 = s.ja4fp
+	}
+
+	if s.serverHello != nil {
+		sb.Version = versionName(s.version)
+		sb.CipherSuite = cryptotls.CipherSuiteName(s.serverHello.cipherSuite)
+		sb.ALPN = s.serverHello.alpnProtocol
+		sb.JA3S = s.ja3s
+		sb.JA3SHash = md5Hex(s.ja3s)
+		sb.Resumed = s.resumed
+	}
+
+	if s.certificate != nil {
+		sb.CertSubject = s.certificate.subject
+		sb.CertIssuer = s.certificate.issuer
+		sb.CertDNSNames = s.certificate.dnsNames
+		sb.CertChainLength = s.certificate.chainLen
+		if !s.certificate.notBefore.IsZero() {
+			sb.CertNotBefore = s.certificate.notBefore.UTC().Format(time.RFC3339)
+			sb.CertNotAfter = s.certificate.notAfter.UTC().Format(time.RFC3339)
+		}
+	}
+
+	sb.Alert = s.alert
+	sb.AlertFrom = s.alertFrom
+	sb.EncryptedAlerts = s.encryptedAlerts
+
+	if s.handshakeTime.After(s.clientHelloTime) {
+		sb.HandshakeLatency = uint(s.handshakeTime.Sub(s.clientHelloTime).Nanoseconds() / 1000000)
+	}
+	sb.ClientAppDataBytes = s.clientAppData
+	sb.ServerAppDataBytes = s.serverAppData
+	sb.Decrypted = s.decrypted
+
+	return sb
+}
+
+// SessionBreakdown TLS analyzer session breakdown. Application data bytes
+// of TLS 1.3 include encrypted handshake messages. Sessions decrypted by
+// key log generate session breakdowns of application protocol as well.
+type SessionBreakdown struct {
+	SessionState       string   `json:"tls_session_state"`
+	Version            string   `json:"tls_version,omitempty"`
+	CipherSuite        string   `json:"tls_cipher_suite,omitempty"`
+	ServerName         string   `json:"tls_server_name,omitempty"`
+	ClientALPN         []string `json:"tls_client_alpn,omitempty"`
+	ALPN               string   `json:"tls_alpn,omitempty"`
+	Resumed            bool     `json:"tls_resumed,omitempty"`
+	JA3                string   `json:"tls_ja3,omitempty"`
+	JA3Hash            string   `json:"tls_ja3_hash,omitempty"`
+	JA3S               string   `json:"tls_ja3s,omitempty"`
+	JA3SHash           string   `json:"tls_ja3s_hash,omitempty"`
+	JA4                string   `json:"tls_ja4,omitempty"`
+	CertSubject        string   `json:"tls_cert_subject,omitempty"`
+	CertIssuer         string   `json:"tls_cert_issuer,omitempty"`
+	CertDNSNames       []string `json:"tls_cert_dns_names,omitempty"`
+	CertNotBefore      string   `json:"tls_cert_not_before,omitempty"`
+	CertNotAfter       string   `json:"tls_cert_not_after,omitempty"`
+	CertChainLength    int      `json:"tls_cert_chain_length,omitempty"`
+	Alert              string   `json:"tls_alert,omitempty"`
+	AlertFrom          string   `json:"tls_alert_from,omitempty"`
+	EncryptedAlerts    uint     `json:"tls_encrypted_alerts,omitempty"`
+	HandshakeLatency   uint     `json:"tls_handshake_latency"`
+	ClientAppDataBytes uint     `json:"tls_client_app_data_bytes"`
+	ServerAppDataBytes uint     `json:"tls_server_app_data_bytes"`
+	Decrypted          bool     `json:"tls_decrypted,omitempty"`
+}
+
+// ApplicationLatency get TLS handshake latency of session breakdown.
+func (sb *SessionBreakdown) ApplicationLatency() time.Duration {
+	return time.Duration(sb.HandshakeLatency) * time.Millisecond
+}
+
+// Analyzer TLS analyzer.
+type Analyzer struct {
+	timestamp time.Time
+	client    halfConn
+	server    halfConn
+	session   session
+	// broken connection is not TLS or not parsable any more
+	broken    bool
+	finCount  int
+	completed bool
+	// secrets session secrets found in key log
+	secrets *sessionSecrets
+	// decryption is not possible for the session
+	noDecrypt      bool
+	pendingRecords []pendingRecord
+	pendingBytes   int
+	inner          InnerAnalyzer
+	innerChecked   bool
+	// Queue session breakdowns not returned yet
+	breakdown.Queue
+}
+
+// Init TLS analyzer init function.
+func (a *Analyzer) Init() {
+	*a = Analyzer{}
+	a.client.fromClient = true
+}
+
+func (a *Analyzer) onClientHello(data []byte) {
+	hello, ok := parseClientHello(data)
+	if !ok {
+		log.Error("TLS Analyzer: parse ClientHello error.")
+		a.broken = true
+		return
+	}
+
+	// Second ClientHello after HelloRetryRequest keeps the first fingerprint
+	if a.session.clientHello == nil {
+		a.session.clientHello = hello
+		a.session.clientHelloTime = a.timestamp
+		a.session.ja3 = ja3(hello)
+		a.session.ja4fp = ja4(hello)
+	}
+	a.session.state = clientHelloSent
+}
+
+func (a *Analyzer) onServerHello(data []byte) {
+	hello, ok := parseServerHello(data)
+	if !ok {
+		log.Error("TLS Analyzer: parse ServerHello error.")
+		a.broken = true
+		return
+	}
+
+	if hello.isHelloRetryRequest() {
+		a.session.helloRetry = true
+		return
+	}
+
+	a.session.serverHello = hello
+	a.session.version = hello.negotiatedVersion()
+	a.session.ja3s = ja3s(hello)
+	a.session.state = serverHelloSent
+
+	if a.session.version == versionTLS13 {
+		// The rest of handshake is encrypted
+		a.client.encrypted = true
+		a.server.encrypted = true
+	} else if ch := a.session.clientHello; ch != nil && len(hello.sessionID) > 0 &&
+		string(hello.sessionID) == string(ch.sessionID) {
+		// Abbreviated handshake resumes session by session id
+		a.session.resumed = true
+	}
+}
+
+func (a *Analyzer) onEncryptedExtensions(data []byte) {
+	alpnProtocol, ok := parseEncryptedExtensions(data)
+	if !ok {
+		log.Error("TLS Analyzer: parse EncryptedExtensions error.")
+		return
+	}
+
+	if a.session.serverHello != nil {
+		a.session.serverHello.alpnProtocol = alpnProtocol
+	}
+}
+
+func (a *Analyzer) onCertificate(data []byte) {
+	leaf, chainLen, ok := parseCertificates(data, a.session.version == versionTLS13)
+	if !ok {
+		log.Error("TLS Analyzer: parse Certificate error.")
+		return
+	}
+
+	info := &certificateInfo{chainLen: chainLen}
+	if leaf != nil {
+		info.subject = leaf.Subject.String()
+		info.issuer = leaf.Issuer.String()
+		info.notBefore = leaf.NotBefore
+		info.notAfter = leaf.NotAfter
+		info.dnsNames = leaf.DNSNames
+	}
+	a.session.certificate = info
+}
+
+// handleHandshake parse complete handshake messages in buffer.
+func (a *Analyzer) handleHandshake(hc *halfConn) {
+	for len(hc.handshake) >= 4 && !a.broken {
+		msgLen := int(hc.handshake[1])<<16 | int(hc.handshake[2])<<8 | int(hc.handshake[3])
+		if len(hc.handshake) < 4+msgLen {
+			return
+		}
+
+		msgType := hc.handshake[0]
+		msg := hc.handshake[4 : 4+msgLen]
+		hc.handshake = hc.handshake[4+msgLen:]
+
+		switch {
+		case hc.fromClient && msgType == handshakeClientHello:
+			a.onClientHello(msg)
+
+		case !hc.fromClient && msgType == handshakeServerHello:
+			a.onServerHello(msg)
+
+		case !hc.fromClient && msgType == handshakeEncryptedExtensions:
+			a.onEncryptedExtensions(msg)
+
+		case !hc.fromClient && msgType == handshakeCertificate:
+			a.onCertificate(msg)
+
+		case msgType == handshakeFinished && a.session.version == versionTLS13:
+			a.onFinished(hc)
+
+		case msgType == handshakeKeyUpdate && hc.cipher != nil:
+			next, err := hc.cipher.update()
+			if err != nil {
+				log.Errorf("TLS Analyzer: update traffic keys with error: %s.", err)
+				a.noDecrypt = true
+				return
+			}
+			hc.cipher = next
+		}
+
+		// TLS 1.3 encrypts messages after ServerHello
+		if msgType == handshakeServerHello && hc.encrypted {
+			hc.handshake = nil
+			return
+		}
+	}
+}
+
+// onFinished switch to application traffic keys after Finished of TLS 1.3.
+func (a *Analyzer) onFinished(hc *halfConn) {
+	if hc.cipher == nil || a.secrets == nil {
+		return
+	}
+
+	secret := a.secrets.serverTrafficSecret
+	if hc.fromClient {
+		secret = a.secrets.clientTrafficSecret
+	}
+
+	cipher, err := newRecordCipher13(hc.cipher.suite, secret)
+	if err != nil {
+		log.Errorf("TLS Analyzer: create traffic keys with error: %s.", err)
+		a.noDecrypt = true
+		return
+	}
+	hc.cipher = cipher
+	hc.trafficKeys = true
+}
+
+func (a *Analyzer) onHandshakeComplete() {
+	if a.session.state < handshakeComplete {
+		a.session.state = handshakeComplete
+		a.session.handshakeTime = a.timestamp
+	}
+}
+
+func (a *Analyzer) halfConn(fromClient bool) *halfConn {
+	if fromClient {
+		return &a.client
+	}
+
+	return &a.server
+}
+
+func (a *Analyzer) onAlert(hc *halfConn, level uint8, description uint8) {
+	if a.session.alert == "" || level == 2 {
+		a.session.alert = alertName(level, description)
+		if hc.fromClient {
+			a.session.alertFrom = "client"
+		} else {
+			a.session.alertFrom = "server"
+		}
+	}
+}
+
+// loadSecrets look up session secrets in key log and create record
+// ciphers, returns false if secrets are not available yet.
+func (a *Analyzer) loadSecrets() bool {
+	ch, sh := a.session.clientHello, a.session.serverHello
+	if ch == nil {
+		// Handshake is not captured
+		a.noDecrypt = true
+		return false
+	}
+
+	suite := cipherSuites[sh.cipherSuite]
+	if suite == nil {
+		log.Debugf("TLS Analyzer: cipher suite 0x%04x is not decryptable.", sh.cipherSuite)
+		a.noDecrypt = true
+		return false
+	}
+
+	secrets := keyLog.lookup(ch.random)
+	if secrets == nil {
+		return false
+	}
+
+	var err error
+	if a.session.version == versionTLS13 {
+		// Traffic secrets are logged after handshake secrets
+		if secrets.clientHandshakeSecret == nil || secrets.serverHandshakeSecret == nil ||
+			secrets.clientTrafficSecret == nil || secrets.serverTrafficSecret == nil {
+			return false
+		}
+		if a.client.cipher, err = newRecordCipher13(suite, secrets.clientHandshakeSecret); err == nil {
+			a.server.cipher, err = newRecordCipher13(suite, secrets.serverHandshakeSecret)
+		}
+	} else {
+		if secrets.masterSecret == nil {
+			return false
+		}
+		a.client.cipher, a.server.cipher, err = newRecordCipher12(suite, secrets.masterSecret, ch.random, sh.random)
+	}
+	if err != nil {
+		log.Errorf("TLS Analyzer: create record ciphers with error: %s.", err)
+		a.noDecrypt = true
+		return false
+	}
+
+	a.secrets = secrets
+	a.session.decrypted = true
+	return true
+}
+
+// handleEncrypted decrypt encrypted record if session secrets are logged,
+// records are buffered until secrets appear in key log.
+func (a *Analyzer) handleEncrypted(hc *halfConn, header []byte, payload []byte) {
+	// Early data sent before ServerHello is not decryptable
+	if keyLog == nil || a.noDecrypt || a.session.serverHello == nil {
+		return
+	}
+
+	if a.secrets == nil {
+		if !a.loadSecrets() {
+			if a.noDecrypt {
+				a.pendingRecords = nil
+				return
+			}
+
+			a.pendingBytes += len(payload)
+			if a.pendingBytes > maxPendingRecordBytes {
+				log.Debug("TLS Analyzer: session secrets are not found in key log.")
+				a.noDecrypt = true
+				a.pendingRecords = nil
+				return
+			}
+			a.pendingRecords = append(a.pendingRecords, pendingRecord{
+				fromClient: hc.fromClient,
+				header:     append([]byte(nil), header...),
+				payload:    append([]byte(nil), payload...),
+				timestamp:  a.timestamp,
+			})
+			return
+		}
+
+		pendingRecords := a.pendingRecords
+		a.pendingRecords = nil
+		for _, r := range pendingRecords {
+			a.decryptRecord(a.halfConn(r.fromClient), r.header, r.payload, r.timestamp)
+		}
+	}
+
+	a.decryptRecord(hc, header, payload, a.timestamp)
+}
+
+// decryptRecord decrypt record and handle its plaintext.
+func (a *Analyzer) decryptRecord(hc *halfConn, header []byte, payload []byte, timestamp time.Time) {
+	if a.noDecrypt {
+		return
+	}
+
+	contentType, plaintext, err := hc.cipher.decrypt(header, payload)
+	if err != nil {
+		// Early data rejected by server is not decryptable by handshake keys
+		if a.session.version == versionTLS13 && hc.fromClient && !hc.trafficKeys {
+			return
+		}
+
+		log.Errorf("TLS Analyzer: decrypt record with error: %s.", err)
+		a.noDecrypt = true
+		return
+	}
+
+	switch contentType {
+	case recordHandshake:
+		// Messages after handshake of TLS 1.2 are renegotiation
+		if a.session.version == versionTLS13 {
+			hc.handshake = append(hc.handshake, plaintext...)
+			a.handleHandshake(hc)
+		}
+
+	case recordAlert:
+		if len(plaintext) == 2 && plaintext[1] != 0 {
+			a.onAlert(hc, plaintext[0], plaintext[1])
+		}
+
+	case recordApplicationData:
+		a.handleAppData(hc, plaintext, timestamp)
+	}
+}
+
+// SetInnerAnalyzer set analyzer of decrypted application data instead of
+// the one chosen by ALPN, it's used by protocols which negotiate TLS in
+// band.
+func (a *Analyzer) SetInnerAnalyzer(inner InnerAnalyzer) {
+	a.inner = inner
+	a.innerChecked = true
+}
+
+// pushInner queue session breakdown returned by inner analyzer followed by
+// the ones queued by inner analyzer itself.
+func (a *Analyzer) pushInner(sessionBreakdown interface{}) {
+	if sessionBreakdown != nil {
+		a.Push(sessionBreakdown)
+	}
+
+	if queue, ok := a.inner.(sessionBreakdownQueue); ok {
+		for sb := queue.PopSessionBreakdown(); sb != nil; sb = queue.PopSessionBreakdown() {
+			a.Push(sb)
+		}
+	}
+}
+
+// handleAppData feed decrypted application data to inner analyzer.
+func (a *Analyzer) handleAppData(hc *halfConn, plaintext []byte, timestamp time.Time) {
+	if !a.innerChecked {
+		a.innerChecked = true
+		a.inner = newInnerAnalyzer(a.session.serverHello.alpnProtocol)
+	}
+	if a.inner == nil {
+		return
+	}
+
+	hc.plaintext = append(hc.plaintext, plaintext...)
+	for len(hc.plaintext) > 0 {
+		parseBytes, sb := a.inner.HandleData(hc.plaintext, hc.fromClient, timestamp)
+		hc.plaintext = hc.plaintext[parseBytes:]
+		if sb == nil {
+			break
+		}
+
+		a.pushInner(sb)
+		if parseBytes == 0 {
+			break
+		}
+	}
+	if len(hc.plaintext) == 0 {
+		hc.plaintext = nil
+	}
+}
+
+// handleRecord handle one TLS record.
+func (a *Analyzer) handleRecord(hc *halfConn, header []byte, payload []byte) {
+	switch header[0] {
+	case recordHandshake:
+		if hc.encrypted {
+			a.handleEncrypted(hc, header, payload)
+			return
+		}
+		hc.handshake = append(hc.handshake, payload...)
+		a.handleHandshake(hc)
+
+	case recordChangeCipherSpec:
+		// Middlebox compatibility CCS of TLS 1.3 is ignored
+		if a.session.version == versionTLS13 {
+			return
+		}
+		hc.ccsSeen = true
+		hc.encrypted = true
+		if a.client.ccsSeen && a.server.ccsSeen {
+			a.onHandshakeComplete()
+		}
+
+	case recordAlert:
+		if len(payload) != 2 || hc.encrypted {
+			a.session.encryptedAlerts++
+			a.handleEncrypted(hc, header, payload)
+			return
+		}
+		a.onAlert(hc, payload[0], payload[1])
+
+	case recordApplicationData:
+		// Client Finished is the first encrypted record from client
+		if a.session.version == versionTLS13 && hc.fromClient {
+			a.onHandshakeComplete()
+		}
+
+		if hc.fromClient {
+			a.session.clientAppData += uint(len(payload))
+		} else {
+			a.session.serverAppData += uint(len(payload))
+		}
+		a.handleEncrypted(hc, header, payload)
+	}
+}
+
+// HandleEstb TLS analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("TLS Analyzer: HandleEstb.")
+}
+
+// HandleData TLS analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := a.halfConn(fromClient)
+
+	var parsed int
+	for !a.broken && len(payload)-parsed >= recordHeaderLen {
+		header := payload[parsed : parsed+recordHeaderLen]
+		contentType := header[0]
+		length := int(header[3])<<8 | int(header[4])
+
+		if contentType < recordChangeCipherSpec || contentType > recordHeartbeat ||
+			header[1] != 3 || length > maxRecordLen {
+			log.Errorf("TLS Analyzer: invalid record header %x.", header)
+			a.broken = true
+			break
+		}
+		if len(payload)-parsed < recordHeaderLen+length {
+			break
+		}
+
+		record := payload[parsed+recordHeaderLen : parsed+recordHeaderLen+length]
+		parsed += recordHeaderLen + length
+		a.handleRecord(hc, header, record)
+	}
+
+	if a.broken {
+		return uint(len(payload)), a.PopSessionBreakdown()
+	}
+
+	return uint(parsed), a.PopSessionBreakdown()
+}
+
+// HandleReset TLS analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("TLS Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("TLS Analyzer: HandleReset from server.")
+	}
+
+	if a.completed {
+		return nil
+	}
+
+	if a.inner != nil {
+		a.pushInner(a.inner.HandleReset(fromClient, timestamp))
+	}
+
+	a.completed = true
+	a.session.resetFlag = true
+	a.Push(a.session.session2Breakdown())
+	return a.PopSessionBreakdown()
+}
+
+// HandleFin TLS analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("TLS Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("TLS Analyzer: HandleFin from server.")
+	}
+
+	if a.inner != nil && !a.completed {
+		a.pushInner(a.inner.HandleFin(fromClient, timestamp))
+	}
+
+	// Session completes when both sides close connection
+	if a.finCount++; a.finCount < 2 || a.completed {
+		return a.PopSessionBreakdown()
+	}
+
+	a.completed = true
+	if a.session.state == handshakeComplete {
+		a.session.state = sessionComplete
+	}
+	a.Push(a.session.session2Breakdown())
+	return a.PopSessionBreakdown()
+}
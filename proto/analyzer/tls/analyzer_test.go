@@ -0,0 +1,190 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	hello := &clientHello{
+		version:           versionTLS12,
+		cipherSuites:      []uint16{0x0a0a, 0x1301, 0xc02b},
+		extensions:        []uint16{0x0a0a, extServerName, extALPN, extSupportedGroups, extECPointFormats, extSignatureAlgorithms, extSupportedVersions},
+		serverName:        "example.com",
+		alpnProtocols:     []string{"h2", "http/1.1"},
+		supportedVersions: []uint16{0x1a1a, versionTLS13, versionTLS12},
+		supportedGroups:   []uint16{0x2a2a, 29, 23},
+		pointFormats:      []uint8{0},
+		signatureAlgs:     []uint16{0x0403, 0x0804},
+	}
+
+	if s := ja3(hello); s != "771,4865-49195,0-16-10-11-13-43,29-23,0" {
+		t.Errorf("Fingerprint: get wrong JA3 %s.", s)
+	}
+
+	expected := "t13d0206h2_" + ja4Hash("1301,c02b") + "_" + ja4Hash("000a,000b,000d,002b_0403,0804")
+	if s := ja4(hello); s != expected {
+		t.Errorf("Fingerprint: get JA4 %s, expected %s.", s, expected)
+	}
+
+	if s := ja3s(&serverHello{version: versionTLS12, cipherSuite: 0xc02f, extensions: []uint16{0xff01, extALPN}}); s != "771,49199,65281-16" {
+		t.Errorf("Fingerprint: get wrong JA3S %s.", s)
+	}
+
+	if ja4ALPN(nil) != "00" || ja4ALPN([]string{"\x01x"}) != "08" {
+		t.Error("Fingerprint: get wrong JA4 ALPN.")
+	}
+}
+
+// recorder record data written to connection in order.
+type recorder struct {
+	sync.Mutex
+	steps []analyzertest.Step
+}
+
+type recordConn struct {
+	net.Conn
+	fromClient bool
+	recorder   *recorder
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.recorder.Lock()
+	c.recorder.steps = append(c.recorder.steps, analyzertest.Step{FromClient: c.fromClient, Data: string(b)})
+	c.recorder.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+func testCertificate(t *testing.T) cryptotls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test.local"},
+		DNSNames:     []string{"test.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cryptotls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// exchange application data exchanged by recorded TLS session.
+type exchange struct {
+	nextProto string
+	request   string
+	response  string
+	keyLog    io.Writer
+}
+
+// recordSession run TLS session over pipe and record transcript.
+func recordSession(t *testing.T, cert cryptotls.Certificate, maxVersion uint16, ex exchange) []analyzertest.Step {
+	rec := new(recorder)
+	clientConn, serverConn := net.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server := cryptotls.Server(&recordConn{serverConn, false, rec}, &cryptotls.Config{
+			Certificates: []cryptotls.Certificate{cert},
+			NextProtos:   []string{ex.nextProto},
+		})
+		buf := make([]byte, len(ex.request))
+		if _, err := io.ReadFull(server, buf); err == nil {
+			server.Write([]byte(ex.response))
+		}
+		serverConn.Close()
+	}()
+
+	client := cryptotls.Client(&recordConn{clientConn, true, rec}, &cryptotls.Config{
+		ServerName:         "test.local",
+		NextProtos:         []string{ex.nextProto},
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+		// Cipher suite of TLS 1.3 is not configurable
+		CipherSuites: []uint16{cryptotls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		KeyLogWriter: ex.keyLog,
+	})
+	if _, err := client.Write([]byte(ex.request)); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(client, make([]byte, len(ex.response)))
+
+	// Closing TLS connection blocks on close_notify write to unread pipe
+	clientConn.Close()
+	wg.Wait()
+
+	return rec.steps
+}
+
+func TestAnalyzer(t *testing.T) {
+	cert := testCertificate(t)
+
+	for _, maxVersion := range []uint16{versionTLS12, versionTLS13} {
+		segments := recordSession(t, cert, maxVersion, exchange{nextProto: "h2", request: "ping", response: "pong"})
+
+		a := new(Analyzer)
+		a.Init()
+
+		timestamp := time.Now()
+		analyzertest.Replay(a, segments, false, timestamp)
+
+		if a.HandleFin(true, timestamp) != nil {
+			t.Error("TLS Analyzer: get session breakdown before both sides close.")
+		}
+		sb := a.HandleFin(false, timestamp).(*SessionBreakdown)
+
+		name := versionName(maxVersion)
+		if sb.SessionState != "TLSSessionComplete" || sb.Version != name ||
+			sb.ServerName != "test.local" || sb.CipherSuite == "" || sb.HandshakeLatency == 0 ||
+			len(sb.ClientALPN) != 1 || sb.ClientALPN[0] != "h2" ||
+			sb.JA3Hash == "" || sb.JA3SHash == "" || !strings.HasPrefix(sb.JA4, "t"+ja4Version(maxVersion)+"d") ||
+			sb.ClientAppDataBytes == 0 || sb.ServerAppDataBytes == 0 {
+			t.Errorf("TLS Analyzer(%s): get wrong session breakdown %+v.", name, *sb)
+		}
+
+		// ALPN and certificates are encrypted since TLS 1.3
+		if maxVersion == versionTLS12 &&
+			(sb.ALPN != "h2" || sb.CertChainLength != 1 || sb.CertSubject != "CN=test.local" ||
+				len(sb.CertDNSNames) != 1 || sb.CertNotAfter == "") {
+			t.Errorf("TLS Analyzer(%s): get wrong certificate %+v.", name, *sb)
+		}
+	}
+}
+
+func TestAnalyzerAlert(t *testing.T) {
+	a := new(Analyzer)
+	a.Init()
+
+	a.HandleData([]byte("\x15\x03\x03\x00\x02\x02\x28"), false, time.Now())
+	sb := a.HandleReset(false, time.Now()).(*SessionBreakdown)
+	if sb.Alert != "fatal:handshake_failure" || sb.AlertFrom != "server" || sb.SessionState != "Reset:TLSSessionInit" {
+		t.Errorf("TLS Analyzer: get wrong alert session breakdown %+v.", *sb)
+	}
+
+	a.Init()
+	if parseBytes, _ := a.HandleData([]byte("GET / HTTP/1.1\r\n\r\n"), true, time.Now()); parseBytes != 18 || !a.broken {
+		t.Error("TLS Analyzer: non TLS data should break analyzer.")
+	}
+}
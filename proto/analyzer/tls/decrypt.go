@@ -0,0 +1,219 @@
+package tls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"hash"
+)
+
+// cipherSuite parameters of AEAD cipher suite which can be decrypted.
+type cipherSuite struct {
+	keyLen int
+	// fixed IV length of TLS 1.2 key block
+	ivLen int
+	// explicit nonce carried by TLS 1.2 records
+	explicitNonce bool
+	hash          func() hash.Hash
+	aead          func(key []byte) (cipher.AEAD, error)
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+var (
+	suiteAES128GCM = &cipherSuite{16, 4, true, sha256.New, aesGCM}
+	suiteAES256GCM = &cipherSuite{32, 4, true, sha512.New384, aesGCM}
+	suiteChaCha20  = &cipherSuite{32, 12, false, sha256.New, chacha20poly1305.New}
+)
+
+// cipherSuites decryptable cipher suites, CBC and other non AEAD suites
+// are not supported.
+var cipherSuites = map[uint16]*cipherSuite{
+	// TLS 1.3
+	0x1301: suiteAES128GCM,
+	0x1302: suiteAES256GCM,
+	0x1303: suiteChaCha20,
+	// TLS 1.2
+	0x009c: suiteAES128GCM,
+	0x009d: suiteAES256GCM,
+	0x009e: suiteAES128GCM,
+	0x009f: suiteAES256GCM,
+	0xc02b: suiteAES128GCM,
+	0xc02c: suiteAES256GCM,
+	0xc02f: suiteAES128GCM,
+	0xc030: suiteAES256GCM,
+	0xcca8: suiteChaCha20,
+	0xcca9: suiteChaCha20,
+	0xccaa: suiteChaCha20,
+}
+
+var errDecrypt = errors.New("record decryption failed")
+
+// prf12 TLS 1.2 pseudorandom function of RFC 5246.
+func prf12(newHash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(newHash, secret)
+
+	var out []byte
+	a := labelSeed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+	}
+
+	return out[:length]
+}
+
+// hkdfExpandLabel TLS 1.3 HKDF-Expand-Label of RFC 8446 with empty context.
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(newHash, secret)
+	var out, t []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:length]
+}
+
+// recordCipher decryption state of one direction.
+type recordCipher struct {
+	suite *cipherSuite
+	aead  cipher.AEAD
+	iv    []byte
+	seq   uint64
+	// traffic secret of TLS 1.3 for key update
+	secret []byte
+}
+
+// newRecordCipher12 create client and server record ciphers of TLS 1.2 by
+// master secret.
+func newRecordCipher12(suite *cipherSuite, masterSecret, clientRandom, serverRandom []byte) (client, server *recordCipher, err error) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	keyBlock := prf12(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+
+	clientKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	serverKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	clientIV, serverIV := keyBlock[:suite.ivLen], keyBlock[suite.ivLen:]
+
+	client = &recordCipher{suite: suite, iv: clientIV}
+	if client.aead, err = suite.aead(clientKey); err != nil {
+		return nil, nil, err
+	}
+	server = &recordCipher{suite: suite, iv: serverIV}
+	if server.aead, err = suite.aead(serverKey); err != nil {
+		return nil, nil, err
+	}
+
+	return client, server, nil
+}
+
+// newRecordCipher13 create record cipher of TLS 1.3 by traffic secret.
+func newRecordCipher13(suite *cipherSuite, secret []byte) (*recordCipher, error) {
+	aead, err := suite.aead(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordCipher{
+		suite:  suite,
+		aead:   aead,
+		iv:     hkdfExpandLabel(suite.hash, secret, "iv", 12),
+		secret: secret,
+	}, nil
+}
+
+// update derive next generation record cipher of TLS 1.3 KeyUpdate.
+func (c *recordCipher) update() (*recordCipher, error) {
+	return newRecordCipher13(c.suite, hkdfExpandLabel(c.suite.hash, c.secret, "traffic upd", c.suite.hash().Size()))
+}
+
+// xorNonce nonce of fixed IV XORed with sequence number.
+func xorNonce(iv []byte, seq []byte) []byte {
+	nonce := append([]byte(nil), iv...)
+	for i := range seq {
+		nonce[len(nonce)-len(seq)+i] ^= seq[i]
+	}
+
+	return nonce
+}
+
+// decrypt decrypt record and return its content type and plaintext, inner
+// content type of TLS 1.3 record is unwrapped.
+func (c *recordCipher) decrypt(header []byte, payload []byte) (uint8, []byte, error) {
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+
+	var nonce, additionalData []byte
+	contentType := header[0]
+
+	switch {
+	case c.secret != nil:
+		nonce = xorNonce(c.iv, seq[:])
+		additionalData = header
+
+	default:
+		if c.suite.explicitNonce {
+			if len(payload) < 8 {
+				return 0, nil, errDecrypt
+			}
+			nonce = append(append([]byte(nil), c.iv...), payload[:8]...)
+			payload = payload[8:]
+		} else {
+			nonce = xorNonce(c.iv, seq[:])
+		}
+
+		plaintextLen := len(payload) - c.aead.Overhead()
+		if plaintextLen < 0 {
+			return 0, nil, errDecrypt
+		}
+		additionalData = append(seq[:], contentType, header[1], header[2], byte(plaintextLen>>8), byte(plaintextLen))
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, payload, additionalData)
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	c.seq++
+
+	if c.secret != nil {
+		// Strip padding and unwrap inner content type
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, errDecrypt
+		}
+		contentType, plaintext = plaintext[i], plaintext[:i]
+	}
+
+	return contentType, plaintext, nil
+}
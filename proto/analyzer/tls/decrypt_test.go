@@ -0,0 +1,135 @@
+package tls
+
+import (
+	"bytes"
+	"github.com/zhengyuli/ntrace/proto/analyzer/http"
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylog")
+	random := strings.Repeat("ab", 32)
+
+	os.WriteFile(path, []byte("# comment\nCLIENT_RANDOM "+random+" 0102\nSERVER_TRAFFIC_SECRET_0 "+random), 0644)
+	store := newKeyLogStore(path)
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := store.lookup(bytes.Repeat([]byte{0xab}, 32))
+	if secrets == nil || !bytes.Equal(secrets.masterSecret, []byte{1, 2}) || secrets.serverTrafficSecret != nil {
+		t.Fatalf("Key log: get wrong secrets %+v.", secrets)
+	}
+
+	// Partial line is completed by appended data
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(" 0304\n")
+	f.Close()
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if secrets.serverTrafficSecret != nil {
+		t.Errorf("Key log: secrets looked up before append are changed %+v.", secrets)
+	}
+
+	secrets = store.lookup(bytes.Repeat([]byte{0xab}, 32))
+	if secrets == nil || !bytes.Equal(secrets.masterSecret, []byte{1, 2}) ||
+		!bytes.Equal(secrets.serverTrafficSecret, []byte{3, 4}) {
+		t.Errorf("Key log: get wrong secrets %+v after append.", secrets)
+	}
+}
+
+func TestAnalyzerDecrypt(t *testing.T) {
+	defer func(store *keyLogStore) { keyLog = store }(keyLog)
+
+	cert := testCertificate(t)
+	request := "GET /users/42 HTTP/1.1\r\nHost: test.local\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	for _, maxVersion := range []uint16{versionTLS12, versionTLS13} {
+		name := versionName(maxVersion)
+		keyLogData := new(bytes.Buffer)
+		segments := recordSession(t, cert, maxVersion, exchange{"http/1.1", request, response, keyLogData})
+
+		// Secrets appear in key log after the session
+		path := filepath.Join(t.TempDir(), "keylog")
+		os.WriteFile(path, nil, 0644)
+		keyLog = newKeyLogStore(path)
+
+		a := new(Analyzer)
+		a.Init()
+		breakdowns := analyzertest.Replay(a, segments[:len(segments)-1], false, time.Now())
+		if len(breakdowns) != 0 {
+			t.Fatalf("TLS Analyzer(%s): get session breakdowns before secrets are logged.", name)
+		}
+
+		os.WriteFile(path, keyLogData.Bytes(), 0644)
+		if err := keyLog.load(); err != nil {
+			t.Fatal(err)
+		}
+		breakdowns = analyzertest.Replay(a, segments[len(segments)-1:], false, time.Now())
+		if len(breakdowns) != 1 {
+			t.Fatalf("TLS Analyzer(%s): get %d session breakdowns of decrypted data.", name, len(breakdowns))
+		}
+
+		hsb, ok := breakdowns[0].(*http.SessionBreakdown)
+		if !ok || hsb.ReqMethod != "GET" || hsb.ReqURI != "/users/42" || hsb.StatusCode != 200 {
+			t.Errorf("TLS Analyzer(%s): get wrong HTTP session breakdown %+v.", name, breakdowns[0])
+		}
+
+		a.HandleFin(true, time.Now())
+		sb := a.HandleFin(false, time.Now()).(*SessionBreakdown)
+		if !sb.Decrypted || sb.ALPN != "http/1.1" || sb.CertSubject != "CN=test.local" || sb.Alert != "" {
+			t.Errorf("TLS Analyzer(%s): get wrong session breakdown %+v.", name, *sb)
+		}
+	}
+}
+
+func TestAnalyzerDecryptPipelined(t *testing.T) {
+	defer func(store *keyLogStore) { keyLog = store }(keyLog)
+
+	cert := testCertificate(t)
+	request := "GET /a HTTP/1.1\r\nHost: test.local\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: test.local\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: test.local\r\n\r\n"
+
+	keyLogData := new(bytes.Buffer)
+	segments := recordSession(t, cert, versionTLS13, exchange{"http/1.1", request, "", keyLogData})
+
+	path := filepath.Join(t.TempDir(), "keylog")
+	os.WriteFile(path, keyLogData.Bytes(), 0644)
+	keyLog = newKeyLogStore(path)
+	if err := keyLog.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(Analyzer)
+	a.Init()
+	if breakdowns := analyzertest.Replay(a, segments, false, time.Now()); len(breakdowns) != 0 {
+		t.Fatalf("TLS Analyzer: get %d session breakdowns before requests are answered.", len(breakdowns))
+	}
+
+	// Requests pending at connection close are all flushed by inner analyzer
+	a.HandleFin(true, time.Now())
+	var breakdowns []interface{}
+	for sb := a.HandleFin(false, time.Now()); sb != nil; sb = a.PopSessionBreakdown() {
+		breakdowns = append(breakdowns, sb)
+	}
+	if len(breakdowns) != 4 {
+		t.Fatalf("TLS Analyzer: get %d session breakdowns on close, expected 4.", len(breakdowns))
+	}
+
+	for i, uri := range []string{"/a", "/b", "/c"} {
+		if hsb, ok := breakdowns[i].(*http.SessionBreakdown); !ok || hsb.ReqURI != uri {
+			t.Errorf("TLS Analyzer: get wrong HTTP session breakdown %d %+v.", i, breakdowns[i])
+		}
+	}
+	if sb, ok := breakdowns[3].(*SessionBreakdown); !ok || !sb.Decrypted {
+		t.Errorf("TLS Analyzer: get wrong session breakdown %+v.", breakdowns[3])
+	}
+}
@@ -0,0 +1,155 @@
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func joinUint16(values []uint16, sep string) string {
+	items := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			items = append(items, strconv.Itoa(int(v)))
+		}
+	}
+
+	return strings.Join(items, sep)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3 JA3 fingerprint string of client hello, GREASE values are ignored.
+func ja3(hello *clientHello) string {
+	formats := make([]string, len(hello.pointFormats))
+	for i, f := range hello.pointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+
+	return fmt.Sprintf("%d,%s,%s,%s,%s",
+		hello.version,
+		joinUint16(hello.cipherSuites, "-"),
+		joinUint16(hello.extensions, "-"),
+		joinUint16(hello.supportedGroups, "-"),
+		strings.Join(formats, "-"))
+}
+
+// ja3s JA3S fingerprint string of server hello.
+func ja3s(hello *serverHello) string {
+	return fmt.Sprintf("%d,%d,%s", hello.version, hello.cipherSuite, joinUint16(hello.extensions, "-"))
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case versionTLS13:
+		return "13"
+
+	case versionTLS12:
+		return "12"
+
+	case versionTLS11:
+		return "11"
+
+	case versionTLS10:
+		return "10"
+
+	case versionSSL30:
+		return "s3"
+
+	default:
+		return "00"
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ja4ALPN first and last characters of the first ALPN value, hex digits
+// are used if either of them is not alphanumeric.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	proto := protocols[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+// ja4Hash first 12 hex characters of SHA256 hash, all zero for empty input.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func hexList(values []uint16, sorted bool) []string {
+	items := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			items = append(items, fmt.Sprintf("%04x", v))
+		}
+	}
+	if sorted {
+		sort.Strings(items)
+	}
+
+	return items
+}
+
+// ja4 JA4 fingerprint of client hello over TCP.
+func ja4(hello *clientHello) string {
+	version := hello.version
+	for _, v := range hello.supportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	if hello.serverName != "" {
+		sni = "d"
+	}
+
+	ciphers := hexList(hello.cipherSuites, true)
+	extensions := hexList(hello.extensions, true)
+
+	count := func(n int) int {
+		if n > 99 {
+			return 99
+		}
+		return n
+	}
+	partA := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(version), sni, count(len(ciphers)), count(len(extensions)), ja4ALPN(hello.alpnProtocols))
+
+	// SNI and ALPN extensions are excluded from extension hash
+	var hashedExtensions []string
+	for _, ext := range extensions {
+		if ext != "0000" && ext != "0010" {
+			hashedExtensions = append(hashedExtensions, ext)
+		}
+	}
+	partC := strings.Join(hashedExtensions, ",")
+	if sigAlgs := hexList(hello.signatureAlgs, false); len(sigAlgs) > 0 && partC != "" {
+		partC += "_" + strings.Join(sigAlgs, ",")
+	}
+
+	return partA + "_" + ja4Hash(strings.Join(ciphers, ",")) + "_" + ja4Hash(partC)
+}
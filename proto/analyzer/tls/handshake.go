@@ -0,0 +1,311 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/x509"
+)
+
+// Record content types.
+const (
+	recordChangeCipherSpec uint8 = 20
+	recordAlert            uint8 = 21
+	recordHandshake        uint8 = 22
+	recordApplicationData  uint8 = 23
+	recordHeartbeat        uint8 = 24
+)
+
+// recordHeaderLen TLS record header length.
+const recordHeaderLen = 5
+
+// maxRecordLen max TLS record payload length including expansion of
+// encryption.
+const maxRecordLen = 16384 + 2048
+
+// Handshake message types.
+const (
+	handshakeClientHello         uint8 = 1
+	handshakeServerHello         uint8 = 2
+	handshakeEncryptedExtensions uint8 = 8
+	handshakeCertificate         uint8 = 11
+	handshakeFinished            uint8 = 20
+	handshakeKeyUpdate           uint8 = 24
+)
+
+// Extension types.
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extECPointFormats      uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+)
+
+// TLS versions.
+const (
+	versionSSL30 uint16 = 0x0300
+	versionTLS10 uint16 = 0x0301
+	versionTLS11 uint16 = 0x0302
+	versionTLS12 uint16 = 0x0303
+	versionTLS13 uint16 = 0x0304
+)
+
+// helloRetryRequestRandom random of ServerHello which is HelloRetryRequest.
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// isGREASE return true if value is GREASE value of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// reader bounds checked big endian reader, any read out of bounds marks
+// reader as failed and returns zero value.
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.failed || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+
+	return 0
+}
+
+func (r *reader) uint24() int {
+	if b := r.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+
+	return 0
+}
+
+func (r *reader) vector8() *reader {
+	return &reader{data: r.bytes(int(r.uint8())), failed: r.failed}
+}
+
+func (r *reader) vector16() *reader {
+	return &reader{data: r.bytes(int(r.uint16())), failed: r.failed}
+}
+
+func (r *reader) vector24() *reader {
+	return &reader{data: r.bytes(r.uint24()), failed: r.failed}
+}
+
+func (r *reader) empty() bool {
+	return len(r.data) == 0
+}
+
+type clientHello struct {
+	version           uint16
+	random            []byte
+	sessionID         []byte
+	cipherSuites      []uint16
+	extensions        []uint16
+	serverName        string
+	alpnProtocols     []string
+	supportedVersions []uint16
+	supportedGroups   []uint16
+	pointFormats      []uint8
+	signatureAlgs     []uint16
+}
+
+func parseClientHello(data []byte) (*clientHello, bool) {
+	r := &reader{data: data}
+	hello := new(clientHello)
+
+	hello.version = r.uint16()
+	hello.random = r.bytes(32)
+	hello.sessionID = r.vector8().data
+
+	for ciphers := r.vector16(); !ciphers.failed && !ciphers.empty(); {
+		hello.cipherSuites = append(hello.cipherSuites, ciphers.uint16())
+	}
+	r.vector8()
+
+	// Extensions are optional
+	if r.failed || r.empty() {
+		return hello, !r.failed
+	}
+
+	extensions := r.vector16()
+	for !extensions.failed && !extensions.empty() {
+		typ := extensions.uint16()
+		ext := extensions.vector16()
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case extServerName:
+			for names := ext.vector16(); !names.failed && !names.empty(); {
+				nameType := names.uint8()
+				name := names.vector16()
+				if nameType == 0 && !name.failed {
+					hello.serverName = string(name.data)
+				}
+			}
+
+		case extALPN:
+			for protos := ext.vector16(); !protos.failed && !protos.empty(); {
+				if proto := protos.vector8(); !proto.failed {
+					hello.alpnProtocols = append(hello.alpnProtocols, string(proto.data))
+				}
+			}
+
+		case extSupportedVersions:
+			for versions := ext.vector8(); !versions.failed && !versions.empty(); {
+				hello.supportedVersions = append(hello.supportedVersions, versions.uint16())
+			}
+
+		case extSupportedGroups:
+			for groups := ext.vector16(); !groups.failed && !groups.empty(); {
+				hello.supportedGroups = append(hello.supportedGroups, groups.uint16())
+			}
+
+		case extECPointFormats:
+			if formats := ext.vector8(); !formats.failed {
+				hello.pointFormats = append(hello.pointFormats, formats.data...)
+			}
+
+		case extSignatureAlgorithms:
+			for algs := ext.vector16(); !algs.failed && !algs.empty(); {
+				hello.signatureAlgs = append(hello.signatureAlgs, algs.uint16())
+			}
+		}
+	}
+
+	return hello, !r.failed && !extensions.failed
+}
+
+type serverHello struct {
+	version          uint16
+	random           []byte
+	sessionID        []byte
+	cipherSuite      uint16
+	extensions       []uint16
+	supportedVersion uint16
+	alpnProtocol     string
+}
+
+// isHelloRetryRequest return true if server hello is HelloRetryRequest.
+func (hello *serverHello) isHelloRetryRequest() bool {
+	return bytes.Equal(hello.random, helloRetryRequestRandom)
+}
+
+// negotiatedVersion negotiated version which is in supported_versions
+// extension since TLS 1.3.
+func (hello *serverHello) negotiatedVersion() uint16 {
+	if hello.supportedVersion != 0 {
+		return hello.supportedVersion
+	}
+
+	return hello.version
+}
+
+func parseServerHello(data []byte) (*serverHello, bool) {
+	r := &reader{data: data}
+	hello := new(serverHello)
+
+	hello.version = r.uint16()
+	hello.random = r.bytes(32)
+	hello.sessionID = r.vector8().data
+	hello.cipherSuite = r.uint16()
+	r.uint8()
+
+	if r.failed || r.empty() {
+		return hello, !r.failed
+	}
+
+	extensions := r.vector16()
+	for !extensions.failed && !extensions.empty() {
+		typ := extensions.uint16()
+		ext := extensions.vector16()
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case extSupportedVersions:
+			hello.supportedVersion = ext.uint16()
+
+		case extALPN:
+			hello.alpnProtocol = parseALPN(ext)
+		}
+	}
+
+	return hello, !r.failed && !extensions.failed
+}
+
+// parseALPN parse selected protocol of server ALPN extension.
+func parseALPN(ext *reader) string {
+	if protos := ext.vector16(); !protos.failed && !protos.empty() {
+		return string(protos.vector8().data)
+	}
+
+	return ""
+}
+
+// parseEncryptedExtensions parse selected ALPN protocol of TLS 1.3
+// EncryptedExtensions message.
+func parseEncryptedExtensions(data []byte) (alpnProtocol string, ok bool) {
+	r := &reader{data: data}
+
+	extensions := r.vector16()
+	for !extensions.failed && !extensions.empty() {
+		typ := extensions.uint16()
+		ext := extensions.vector16()
+		if typ == extALPN {
+			alpnProtocol = parseALPN(ext)
+		}
+	}
+
+	return alpnProtocol, !r.failed && !extensions.failed
+}
+
+// parseCertificates parse certificate chain of Certificate message, only
+// the leaf certificate is decoded. Since TLS 1.3 the chain has request
+// context and each certificate has extensions.
+func parseCertificates(data []byte, tls13 bool) (leaf *x509.Certificate, chainLen int, ok bool) {
+	r := &reader{data: data}
+	if tls13 {
+		r.vector8()
+	}
+	certs := r.vector24()
+
+	for !certs.failed && !certs.empty() {
+		cert := certs.vector24()
+		if tls13 {
+			certs.vector16()
+		}
+		if cert.failed || certs.failed {
+			break
+		}
+
+		if chainLen == 0 {
+			leaf, _ = x509.ParseCertificate(cert.data)
+		}
+		chainLen++
+	}
+
+	return leaf, chainLen, !r.failed && !certs.failed
+}
@@ -0,0 +1,178 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyLogPollInterval interval to check key log file for new lines.
+var keyLogPollInterval = time.Second
+
+// sessionSecrets secrets of one TLS session logged in NSS key log format.
+type sessionSecrets struct {
+	// TLS 1.2 and earlier
+	masterSecret []byte
+	// TLS 1.3
+	clientHandshakeSecret []byte
+	serverHandshakeSecret []byte
+	clientTrafficSecret   []byte
+	serverTrafficSecret   []byte
+}
+
+// keyLogStore secrets of key log file indexed by client random.
+type keyLogStore struct {
+	sync.RWMutex
+	path    string
+	offset  int64
+	partial []byte
+	secrets map[string]*sessionSecrets
+}
+
+// keyLog key log loaded by LoadKeyLog, decryption is disabled if nil.
+var keyLog *keyLogStore
+
+func newKeyLogStore(path string) *keyLogStore {
+	return &keyLogStore{
+		path:    path,
+		secrets: make(map[string]*sessionSecrets),
+	}
+}
+
+// LoadKeyLog load key log file of SSLKEYLOGFILE format and watch it for new
+// lines, TLS sessions with logged secrets are decrypted afterwards.
+func LoadKeyLog(path string) error {
+	store := newKeyLogStore(path)
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	keyLog = store
+	go store.watch()
+
+	return nil
+}
+
+// lookup get a copy of secrets of session by client random, nil if secrets
+// are not logged.
+func (store *keyLogStore) lookup(clientRandom []byte) *sessionSecrets {
+	store.RLock()
+	defer store.RUnlock()
+
+	secrets := store.secrets[string(clientRandom)]
+	if secrets == nil {
+		return nil
+	}
+
+	copied := *secrets
+	return &copied
+}
+
+// load read lines appended to key log file since last load.
+func (store *keyLogStore) load() error {
+	f, err := os.Open(store.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Key log file is truncated or replaced
+	if info.Size() < store.offset {
+		store.offset = 0
+		store.partial = nil
+	}
+	if info.Size() == store.offset {
+		return nil
+	}
+
+	if _, err = f.Seek(store.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	store.offset += int64(len(data))
+
+	data = append(store.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	store.partial = append([]byte(nil), data[end+1:]...)
+
+	store.Lock()
+	defer store.Unlock()
+
+	for _, line := range strings.Split(string(data[:end+1]), "\n") {
+		store.addLine(line)
+	}
+
+	return nil
+}
+
+// addLine add one "<label> <client random> <secret>" line, comments and
+// unknown labels are ignored.
+func (store *keyLogStore) addLine(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+
+	clientRandom, err := hex.DecodeString(fields[1])
+	if err != nil || len(clientRandom) != 32 {
+		log.Warnf("TLS Analyzer: invalid client random of key log line %q.", line)
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		log.Warnf("TLS Analyzer: invalid secret of key log line %q.", line)
+		return
+	}
+
+	// Secrets shared with analyzers are never changed in place, new lines
+	// update a copy which replaces the old one.
+	secrets := new(sessionSecrets)
+	if old := store.secrets[string(clientRandom)]; old != nil {
+		*secrets = *old
+	}
+
+	switch fields[0] {
+	case "CLIENT_RANDOM":
+		secrets.masterSecret = secret
+
+	case "CLIENT_HANDSHAKE_TRAFFIC_SECRET":
+		secrets.clientHandshakeSecret = secret
+
+	case "SERVER_HANDSHAKE_TRAFFIC_SECRET":
+		secrets.serverHandshakeSecret = secret
+
+	case "CLIENT_TRAFFIC_SECRET_0":
+		secrets.clientTrafficSecret = secret
+
+	case "SERVER_TRAFFIC_SECRET_0":
+		secrets.serverTrafficSecret = secret
+
+	default:
+		return
+	}
+	store.secrets[string(clientRandom)] = secrets
+}
+
+func (store *keyLogStore) watch() {
+	ticker := time.NewTicker(keyLogPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := store.load(); err != nil {
+			log.Errorf("TLS Analyzer: load key log file %s with error: %s.", store.path, err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package websocket
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"strconv"
+	"time"
+)
+
+// breakdownInterval interval of session breakdown for long lived WebSocket
+// connection, default is 60 seconds, 0 disables interval breakdown, it can
+// be changed by WEBSOCKET_BREAKDOWN_INTERVAL env in seconds.
+var breakdownInterval = 60 * time.Second
+
+func init() {
+	if interval, err := strconv.Atoi(os.Getenv("WEBSOCKET_BREAKDOWN_INTERVAL")); err == nil && interval >= 0 {
+		breakdownInterval = time.Duration(interval) * time.Second
+	}
+}
+
+type opcode uint8
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+type sessionState uint16
+
+const (
+	sessionOpen sessionState = iota
+	sessionClosing
+	sessionClosed
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionOpen:
+		return "WebSocketOpen"
+
+	case sessionClosing:
+		return "WebSocketClosing"
+
+	case sessionClosed:
+		return "WebSocketClosed"
+
+	default:
+		return "InvalidWebSocketState"
+	}
+}
+
+// directionStats message stats of one direction.
+type directionStats struct {
+	frames       uint
+	messages     uint
+	messageBytes uint
+	pings        uint
+	pongs        uint
+}
+
+// halfConn frame parse state of one direction.
+type halfConn struct {
+	fromClient bool
+	stats      directionStats
+
+	// Data frame payload is consumed as it arrives since it could be large
+	payloadRemaining uint64
+	skipPayload      bool
+	frameFin         bool
+	inMessage        bool
+	closeSent        bool
+}
+
+// Analyzer WebSocket analyzer.
+type Analyzer struct {
+	timestamp      time.Time
+	lastBreakdown  time.Time
+	client         halfConn
+	server         halfConn
+	state          sessionState
+	resetFlag      bool
+	closeCode      uint16
+	closeReason    string
+	closeInitiator string
+	protocolErrors uint
+	// emitted final session breakdown has been generated
+	emitted bool
+}
+
+// SessionBreakdown WebSocket analyzer session breakdown.
+type SessionBreakdown struct {
+	SessionState       string `json:"websocket_session_state"`
+	ClientFrames       uint   `json:"websocket_client_frames"`
+	ClientMessages     uint   `json:"websocket_client_messages"`
+	ClientMessageBytes uint   `json:"websocket_client_message_bytes"`
+	ServerFrames       uint   `json:"websocket_server_frames"`
+	ServerMessages     uint   `json:"websocket_server_messages"`
+	ServerMessageBytes uint   `json:"websocket_server_message_bytes"`
+	Pings              uint   `json:"websocket_pings"`
+	Pongs              uint   `json:"websocket_pongs"`
+	CloseCode          uint16 `json:"websocket_close_code,omitempty"`
+	CloseReason        string `json:"websocket_close_reason,omitempty"`
+	CloseInitiator     string `json:"websocket_close_initiator,omitempty"`
+	ProtocolErrors     uint   `json:"websocket_protocol_errors,omitempty"`
+	Duration           uint   `json:"websocket_duration"`
+}
+
+// session2Breakdown generate session breakdown of stats since last session
+// breakdown.
+func (a *Analyzer) session2Breakdown() *SessionBreakdown {
+	sb := new(SessionBreakdown)
+
+	if a.resetFlag {
+		sb.SessionState = "Reset:" + a.state.String()
+	} else {
+		sb.SessionState = a.state.String()
+	}
+
+	sb.ClientFrames = a.client.stats.frames
+	sb.ClientMessages = a.client.stats.messages
+	sb.ClientMessageBytes = a.client.stats.messageBytes
+	sb.ServerFrames = a.server.stats.frames
+	sb.ServerMessages = a.server.stats.messages
+	sb.ServerMessageBytes = a.server.stats.messageBytes
+	sb.Pings = a.client.stats.pings + a.server.stats.pings
+	sb.Pongs = a.client.stats.pongs + a.server.stats.pongs
+	sb.CloseCode = a.closeCode
+	sb.CloseReason = a.closeReason
+	sb.CloseInitiator = a.closeInitiator
+	sb.ProtocolErrors = a.protocolErrors
+
+	if a.timestamp.After(a.lastBreakdown) {
+		sb.Duration = uint(a.timestamp.Sub(a.lastBreakdown).Nanoseconds() / 1000000)
+	}
+
+	a.client.stats = directionStats{}
+	a.server.stats = directionStats{}
+	a.protocolErrors = 0
+	a.lastBreakdown = a.timestamp
+
+	return sb
+}
+
+// Init WebSocket analyzer init function.
+func (a *Analyzer) Init() {
+	*a = Analyzer{}
+	a.client.fromClient = true
+}
+
+// HandleUpgrade init WebSocket analyzer for connection upgraded from HTTP.
+func (a *Analyzer) HandleUpgrade(timestamp time.Time) {
+	a.lastBreakdown = timestamp
+}
+
+func (a *Analyzer) onClose(hc *halfConn, payload []byte) {
+	hc.closeSent = true
+
+	if a.closeInitiator == "" {
+		if hc.fromClient {
+			a.closeInitiator = "client"
+		} else {
+			a.closeInitiator = "server"
+		}
+
+		if len(payload) >= 2 {
+			a.closeCode = uint16(payload[0])<<8 | uint16(payload[1])
+			a.closeReason = string(payload[2:])
+		} else if len(payload) == 1 {
+			a.protocolErrors++
+		}
+	}
+
+	if a.client.closeSent && a.server.closeSent {
+		a.state = sessionClosed
+	} else {
+		a.state = sessionClosing
+	}
+}
+
+// parseFrame parse one frame, returns 0 if more data is needed.
+func (a *Analyzer) parseFrame(hc *halfConn, payload []byte) (parseBytes int) {
+	// Consume payload of data frame in progress
+	if hc.payloadRemaining > 0 {
+		n := uint64(len(payload))
+		if n > hc.payloadRemaining {
+			n = hc.payloadRemaining
+		}
+		hc.payloadRemaining -= n
+		if hc.skipPayload {
+			hc.skipPayload = hc.payloadRemaining > 0
+			return int(n)
+		}
+
+		hc.stats.messageBytes += uint(n)
+		if hc.payloadRemaining == 0 && hc.frameFin {
+			hc.stats.messages++
+			hc.inMessage = false
+		}
+
+		return int(n)
+	}
+
+	if len(payload) < 2 {
+		return 0
+	}
+
+	fin := payload[0]&0x80 != 0
+	op := opcode(payload[0] & 0x0f)
+	masked := payload[1]&0x80 != 0
+	headerLen := 2
+	length := uint64(payload[1] & 0x7f)
+
+	switch length {
+	case 126:
+		headerLen += 2
+		if len(payload) < headerLen {
+			return 0
+		}
+		length = uint64(payload[2])<<8 | uint64(payload[3])
+
+	case 127:
+		headerLen += 8
+		if len(payload) < headerLen {
+			return 0
+		}
+		length = 0
+		for i := 2; i < 10; i++ {
+			length = length<<8 | uint64(payload[i])
+		}
+	}
+
+	var maskKey []byte
+	if masked {
+		if len(payload) < headerLen+4 {
+			return 0
+		}
+		maskKey = payload[headerLen : headerLen+4]
+		headerLen += 4
+	}
+
+	// Control frame is small and never fragmented, wait for the whole frame
+	if op.isControl() && length <= 125 && uint64(len(payload)) < uint64(headerLen)+length {
+		return 0
+	}
+
+	// Client must mask frames and server must not
+	if masked != hc.fromClient {
+		a.protocolErrors++
+	}
+
+	if op.isControl() && length <= 125 {
+		if !fin {
+			a.protocolErrors++
+		}
+
+		hc.stats.frames++
+		data := append([]byte(nil), payload[headerLen:headerLen+int(length)]...)
+		for i := range data {
+			if maskKey != nil {
+				data[i] ^= maskKey[i%4]
+			}
+		}
+
+		switch op {
+		case opClose:
+			a.onClose(hc, data)
+
+		case opPing:
+			hc.stats.pings++
+
+		case opPong:
+			hc.stats.pongs++
+
+		default:
+			a.protocolErrors++
+		}
+
+		return headerLen + int(length)
+	}
+
+	hc.stats.frames++
+
+	// Oversized control frame payload is skipped
+	if op.isControl() {
+		a.protocolErrors++
+		hc.payloadRemaining = length
+		hc.skipPayload = true
+		return headerLen
+	}
+
+	switch op {
+	case opContinuation:
+		if !hc.inMessage {
+			a.protocolErrors++
+		}
+
+	case opText, opBinary:
+		if hc.inMessage {
+			a.protocolErrors++
+		}
+
+	default:
+		a.protocolErrors++
+	}
+
+	hc.inMessage = true
+	hc.skipPayload = false
+	hc.frameFin = fin
+	hc.payloadRemaining = length
+	if length == 0 && fin {
+		hc.stats.messages++
+		hc.inMessage = false
+	}
+
+	return headerLen
+}
+
+// HandleEstb WebSocket analyzer handle TCP connection establishment function.
+func (a *Analyzer) HandleEstb(timestamp time.Time) {
+	log.Debug("WebSocket Analyzer: HandleEstb.")
+}
+
+// HandleData WebSocket analyzer handle TCP connection payload function.
+func (a *Analyzer) HandleData(payload []byte, fromClient bool, timestamp time.Time) (parseBytes uint, sessionBreakdown interface{}) {
+	a.timestamp = timestamp
+
+	hc := &a.server
+	if fromClient {
+		hc = &a.client
+	}
+
+	var parsed int
+	for !a.emitted {
+		n := a.parseFrame(hc, payload[parsed:])
+		parsed += n
+
+		if a.state == sessionClosed {
+			a.emitted = true
+			return uint(parsed), a.session2Breakdown()
+		}
+
+		if breakdownInterval > 0 && timestamp.Sub(a.lastBreakdown) >= breakdownInterval {
+			return uint(parsed), a.session2Breakdown()
+		}
+
+		if n == 0 {
+			return uint(parsed), nil
+		}
+	}
+
+	// Data after closing handshake is ignored
+	return uint(len(payload)), nil
+}
+
+// HandleReset WebSocket analyzer handle TCP connection reset function.
+func (a *Analyzer) HandleReset(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("WebSocket Analyzer: HandleReset from client.")
+	} else {
+		log.Debug("WebSocket Analyzer: HandleReset from server.")
+	}
+
+	if a.emitted {
+		return nil
+	}
+
+	a.timestamp = timestamp
+	a.emitted = true
+	a.resetFlag = true
+	return a.session2Breakdown()
+}
+
+// HandleFin WebSocket analyzer handle TCP connection fin function.
+func (a *Analyzer) HandleFin(fromClient bool, timestamp time.Time) (sessionBreakdown interface{}) {
+	if fromClient {
+		log.Debug("WebSocket Analyzer: HandleFin from client.")
+	} else {
+		log.Debug("WebSocket Analyzer: HandleFin from server.")
+	}
+
+	if a.emitted {
+		return nil
+	}
+
+	// Connection closed without closing handshake completes
+	a.timestamp = timestamp
+	a.emitted = true
+	a.state = sessionClosed
+	return a.session2Breakdown()
+}
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/internal/analyzertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// frame build WebSocket frame, client frame is masked.
+func frame(fin bool, op opcode, payload string, fromClient bool) string {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+
+	header := []byte{b0}
+	var maskBit byte
+	if fromClient {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		header = append(header, maskBit|byte(len(payload)))
+
+	default:
+		header = append(header, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+
+	data := []byte(payload)
+	if fromClient {
+		mask := []byte{1, 2, 3, 4}
+		header = append(header, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+
+	return string(header) + string(data)
+}
+
+// feed feed data byte by byte to exercise partial frames and collect
+// WebSocket session breakdowns.
+func feed(a *Analyzer, data string, fromClient bool, timestamp time.Time) []*SessionBreakdown {
+	var breakdowns []*SessionBreakdown
+	for _, sb := range analyzertest.Feed(a, data, fromClient, timestamp) {
+		breakdowns = append(breakdowns, sb.(*SessionBreakdown))
+	}
+
+	return breakdowns
+}
+
+func TestAnalyzer(t *testing.T) {
+	timestamp := time.Now()
+	a := new(Analyzer)
+	a.Init()
+	a.HandleUpgrade(timestamp)
+
+	large := strings.Repeat("x", 300)
+	var breakdowns []*SessionBreakdown
+	breakdowns = append(breakdowns, feed(a, frame(true, opText, "hello", true)+frame(true, opPing, "p", true), true, timestamp)...)
+	breakdowns = append(breakdowns, feed(a,
+		frame(false, opBinary, large, false)+
+			frame(true, opPong, "p", false)+
+			frame(true, opContinuation, "tail", false)+
+			frame(true, opClose, "\x03\xe8bye", false), false, timestamp.Add(time.Second))...)
+	if len(breakdowns) != 0 {
+		t.Fatalf("WebSocket: get session breakdown before closing handshake completes.")
+	}
+
+	breakdowns = feed(a, frame(true, opClose, "\x03\xe8", true), true, timestamp.Add(2*time.Second))
+	if len(breakdowns) != 1 {
+		t.Fatalf("WebSocket: get %d session breakdowns after closing handshake.", len(breakdowns))
+	}
+
+	sb := breakdowns[0]
+	expected := SessionBreakdown{
+		SessionState:       "WebSocketClosed",
+		ClientFrames:       3,
+		ClientMessages:     1,
+		ClientMessageBytes: 5,
+		ServerFrames:       4,
+		ServerMessages:     1,
+		ServerMessageBytes: 304,
+		Pings:              1,
+		Pongs:              1,
+		CloseCode:          1000,
+		CloseReason:        "bye",
+		CloseInitiator:     "server",
+		Duration:           2000,
+	}
+	if *sb != expected {
+		t.Errorf("WebSocket: session breakdown is %+v, expected %+v.", *sb, expected)
+	}
+
+	if a.HandleFin(true, timestamp.Add(3*time.Second)) != nil {
+		t.Error("WebSocket: get session breakdown again on fin.")
+	}
+}
+
+func TestAnalyzerInterval(t *testing.T) {
+	defer func(interval time.Duration) { breakdownInterval = interval }(breakdownInterval)
+	breakdownInterval = time.Minute
+
+	timestamp := time.Now()
+	a := new(Analyzer)
+	a.Init()
+	a.HandleUpgrade(timestamp)
+
+	// Interval session breakdown is generated before the late frame
+	feed(a, frame(true, opText, "a", true), true, timestamp)
+	breakdowns := feed(a, frame(true, opText, "b", true), true, timestamp.Add(time.Minute))
+	if len(breakdowns) != 1 || breakdowns[0].SessionState != "WebSocketOpen" || breakdowns[0].ClientMessages != 1 {
+		t.Fatalf("WebSocket: get wrong interval session breakdowns %v.", breakdowns)
+	}
+
+	sb := a.HandleReset(false, timestamp.Add(90*time.Second)).(*SessionBreakdown)
+	if sb.SessionState != "Reset:WebSocketOpen" || sb.ClientMessages != 1 || sb.Duration != 30000 {
+		t.Errorf("WebSocket: get wrong reset session breakdown %+v.", *sb)
+	}
+}
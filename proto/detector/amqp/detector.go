@@ -0,0 +1,14 @@
+package amqp
+
+import (
+	"bytes"
+)
+
+// protocolHeader protocol header of AMQP 0-9-1.
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// DetectProto AMQP proto detect function, client begins connection with
+// protocol header of AMQP 0-9-1.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	return fromClient && bytes.HasPrefix(payload, protocolHeader)
+}
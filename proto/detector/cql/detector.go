@@ -0,0 +1,31 @@
+package cql
+
+import (
+	"encoding/binary"
+)
+
+// Opcodes of the first request.
+const (
+	opStartup = 0x01
+	opOptions = 0x05
+)
+
+// maxStartupLen max length of body of OPTIONS or STARTUP.
+const maxStartupLen = 64 * 1024
+
+// DetectProto Cassandra CQL native protocol proto detect function, client
+// begins with OPTIONS or STARTUP request of protocol v3 to v5.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 9 {
+		return false
+	}
+
+	// Frame header of version, flags, stream, opcode and body length
+	version := payload[0]
+	flags := payload[1]
+	opcode := payload[4]
+	length := binary.BigEndian.Uint32(payload[5:])
+
+	return version >= 3 && version <= 5 && flags&0xe0 == 0 &&
+		(opcode == opOptions || opcode == opStartup) && length <= maxStartupLen
+}
@@ -3,7 +3,27 @@ package detector
 import (
 	"fmt"
 	"github.com/zhengyuli/ntrace/proto"
+	"github.com/zhengyuli/ntrace/proto/detector/amqp"
+	"github.com/zhengyuli/ntrace/proto/detector/cql"
+	"github.com/zhengyuli/ntrace/proto/detector/ftp"
 	"github.com/zhengyuli/ntrace/proto/detector/http"
+	"github.com/zhengyuli/ntrace/proto/detector/http2"
+	"github.com/zhengyuli/ntrace/proto/detector/imap"
+	"github.com/zhengyuli/ntrace/proto/detector/kafka"
+	"github.com/zhengyuli/ntrace/proto/detector/kerberos"
+	"github.com/zhengyuli/ntrace/proto/detector/ldap"
+	"github.com/zhengyuli/ntrace/proto/detector/memcached"
+	"github.com/zhengyuli/ntrace/proto/detector/mongodb"
+	"github.com/zhengyuli/ntrace/proto/detector/mqtt"
+	"github.com/zhengyuli/ntrace/proto/detector/mysql"
+	"github.com/zhengyuli/ntrace/proto/detector/nfs"
+	"github.com/zhengyuli/ntrace/proto/detector/pop3"
+	"github.com/zhengyuli/ntrace/proto/detector/postgresql"
+	"github.com/zhengyuli/ntrace/proto/detector/redis"
+	"github.com/zhengyuli/ntrace/proto/detector/smb"
+	"github.com/zhengyuli/ntrace/proto/detector/smtp"
+	"github.com/zhengyuli/ntrace/proto/detector/ssh"
+	"github.com/zhengyuli/ntrace/proto/detector/tls"
 	"sync"
 )
 
@@ -30,6 +50,14 @@ func AddProto(protoName string, ip string, port uint16) {
 	detectedProtos[fmt.Sprintf("%s:%d", ip, port)] = protoName
 }
 
+// RemoveProto remove TCP application layer proto name by ip and port.
+func RemoveProto(ip string, port uint16) {
+	detectedProtosLock.Lock()
+	defer detectedProtosLock.Unlock()
+
+	delete(detectedProtos, fmt.Sprintf("%s:%d", ip, port))
+}
+
 // GetProto get TCP application layer proto name by ip and port.
 func GetProto(ip string, port uint16) string {
 	detectedProtosLock.Lock()
@@ -50,6 +78,13 @@ func DetectProto(payload []byte, fromClient bool) (parseBytes uint, protoName st
 }
 
 func init() {
+	// Register HTTP/2 detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.HTTP2ProtoName,
+			Detect:    http2.DetectProto})
+
 	// Register HTTP detector
 	protoDetectors = append(
 		protoDetectors,
@@ -57,5 +92,138 @@ func init() {
 			ProtoName: proto.HTTPProtoName,
 			Detect:    http.DetectProto})
 
+	// Register TLS detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.TLSProtoName,
+			Detect:    tls.DetectProto})
+
+	// Register MySQL detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.MySQLProtoName,
+			Detect:    mysql.DetectProto})
+
+	// Register PostgreSQL detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.PostgreSQLProtoName,
+			Detect:    postgresql.DetectProto})
+
+	// Register Redis detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.RedisProtoName,
+			Detect:    redis.DetectProto})
+
+	// Register memcached detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.MemcachedProtoName,
+			Detect:    memcached.DetectProto})
+
+	// Register MongoDB detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.MongoDBProtoName,
+			Detect:    mongodb.DetectProto})
+
+	// Register AMQP detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.AMQPProtoName,
+			Detect:    amqp.DetectProto})
+
+	// Register MQTT detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.MQTTProtoName,
+			Detect:    mqtt.DetectProto})
+
+	// Register SMTP detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.SMTPProtoName,
+			Detect:    smtp.DetectProto})
+
+	// Register IMAP detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.IMAPProtoName,
+			Detect:    imap.DetectProto})
+
+	// Register POP3 detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.POP3ProtoName,
+			Detect:    pop3.DetectProto})
+
+	// Register Kafka detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.KafkaProtoName,
+			Detect:    kafka.DetectProto})
+
+	// Register FTP detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.FTPProtoName,
+			Detect:    ftp.DetectProto})
+
+	// Register SSH detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.SSHProtoName,
+			Detect:    ssh.DetectProto})
+
+	// Register LDAP detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.LDAPProtoName,
+			Detect:    ldap.DetectProto})
+
+	// Register Kerberos detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.KerberosProtoName,
+			Detect:    kerberos.DetectProto})
+
+	// Register NFS detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.NFSProtoName,
+			Detect:    nfs.DetectProto})
+
+	// Register SMB detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.SMBProtoName,
+			Detect:    smb.DetectProto})
+
+	// Register CQL detector
+	protoDetectors = append(
+		protoDetectors,
+		Detector{
+			ProtoName: proto.CQLProtoName,
+			Detect:    cql.DetectProto})
+
 	detectedProtos = make(map[string]string)
 }
@@ -0,0 +1,36 @@
+package ftp
+
+import (
+	"bytes"
+)
+
+// clientCommands commands beginning FTP connection.
+var clientCommands = [][]byte{
+	[]byte("FEAT"),
+	[]byte("SYST"),
+	[]byte("AUTH TLS"),
+	[]byte("AUTH SSL"),
+}
+
+// DetectProto FTP proto detect function, server greets with 220 reply
+// mentioning FTP, client begins with FEAT, SYST or AUTH TLS.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return false
+	}
+	line := bytes.ToUpper(bytes.TrimRight(payload[:end], "\r"))
+
+	if !fromClient {
+		return len(line) > 4 && bytes.HasPrefix(line, []byte("220")) && (line[3] == ' ' || line[3] == '-') &&
+			bytes.Contains(line, []byte("FTP"))
+	}
+
+	for _, c := range clientCommands {
+		if bytes.Equal(line, c) {
+			return true
+		}
+	}
+
+	return false
+}
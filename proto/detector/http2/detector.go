@@ -0,0 +1,13 @@
+package http2
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/http2"
+)
+
+// DetectProto HTTP/2 proto detect function, only prior knowledge HTTP/2
+// connection begins with client connection preface.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	return fromClient &&
+		len(payload) >= len(http2.ClientPreface) &&
+		string(payload[:len(http2.ClientPreface)]) == http2.ClientPreface
+}
@@ -0,0 +1,42 @@
+package imap
+
+import (
+	"bytes"
+)
+
+// clientCommands commands beginning IMAP connection.
+var clientCommands = [][]byte{
+	[]byte("CAPABILITY"),
+	[]byte("LOGIN "),
+	[]byte("STARTTLS"),
+	[]byte("AUTHENTICATE "),
+	[]byte("ID "),
+}
+
+// DetectProto IMAP proto detect function, server greets with untagged OK or
+// PREAUTH mentioning IMAP, client begins with tagged CAPABILITY, LOGIN,
+// STARTTLS, AUTHENTICATE or ID.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return false
+	}
+	line := bytes.ToUpper(bytes.TrimRight(payload[:end], "\r"))
+
+	if !fromClient {
+		return (bytes.HasPrefix(line, []byte("* OK")) || bytes.HasPrefix(line, []byte("* PREAUTH"))) &&
+			bytes.Contains(line, []byte("IMAP"))
+	}
+
+	space := bytes.IndexByte(line, ' ')
+	if space <= 0 {
+		return false
+	}
+	for _, c := range clientCommands {
+		if bytes.HasPrefix(line[space+1:], c) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"encoding/binary"
+)
+
+// Max API key and version of requests beginning connection, the caps are
+// loose so that requests of newer clients are still detected.
+const (
+	maxAPIKey     = 127
+	maxAPIVersion = 63
+)
+
+// DetectProto Kafka proto detect function, client begins connection with
+// request like ApiVersions or Metadata whose header has printable client id.
+// Since detected protocol is cached per server, the request must fill the
+// whole payload if it's complete.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 14 {
+		return false
+	}
+
+	length := int(int32(binary.BigEndian.Uint32(payload)))
+	apiKey := int16(binary.BigEndian.Uint16(payload[4:]))
+	apiVersion := int16(binary.BigEndian.Uint16(payload[6:]))
+	correlationID := int32(binary.BigEndian.Uint32(payload[8:]))
+	clientIDLen := int(int16(binary.BigEndian.Uint16(payload[12:])))
+	if length < 10 || length > 100*1024*1024 ||
+		apiKey < 0 || apiKey > maxAPIKey ||
+		apiVersion < 0 || apiVersion > maxAPIVersion || correlationID < 0 ||
+		clientIDLen < -1 || clientIDLen > length-10 {
+		return false
+	}
+
+	// Client waits for response of the first request, so nothing follows it
+	if len(payload) >= length+4 && len(payload) != length+4 {
+		return false
+	}
+
+	// Null client id or the received part of client id
+	clientID := payload[14:]
+	if clientIDLen < 0 {
+		clientID = nil
+	} else if len(clientID) > clientIDLen {
+		clientID = clientID[:clientIDLen]
+	}
+	for _, c := range clientID {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,45 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// request build request of API key and version with client id.
+func request(apiKey int16, apiVersion int16, clientID string, body string) []byte {
+	header := make([]byte, 14)
+	binary.BigEndian.PutUint32(header, uint32(10+len(clientID)+len(body)))
+	binary.BigEndian.PutUint16(header[4:], uint16(apiKey))
+	binary.BigEndian.PutUint16(header[6:], uint16(apiVersion))
+	binary.BigEndian.PutUint32(header[8:], 1)
+	binary.BigEndian.PutUint16(header[12:], uint16(len(clientID)))
+
+	return append(append(header, clientID...), body...)
+}
+
+func TestDetectProto(t *testing.T) {
+	apiVersions := request(18, 3, "app", "\x00")
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		fromClient bool
+		detected   bool
+	}{
+		{"ApiVersions", apiVersions, true, true},
+		{"partial request", apiVersions[:15], true, true},
+		{"version newer than known", request(0, 20, "app", ""), true, true},
+		{"API key newer than known", request(90, 0, "app", ""), true, true},
+		{"version above cap", request(0, maxAPIVersion+1, "app", ""), true, false},
+		{"API key above cap", request(maxAPIKey+1, 0, "app", ""), true, false},
+		{"data after request", append(append([]byte(nil), apiVersions...), 0), true, false},
+		{"binary client id", request(18, 3, "a\x01", ""), true, false},
+		{"from server", apiVersions, false, false},
+	}
+
+	for _, test := range tests {
+		if DetectProto(test.payload, test.fromClient) != test.detected {
+			t.Errorf("Kafka detector(%s): should be detected=%t.", test.name, test.detected)
+		}
+	}
+}
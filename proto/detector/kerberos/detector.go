@@ -0,0 +1,33 @@
+package kerberos
+
+import (
+	"encoding/binary"
+)
+
+// maxMessageLen max length of Kerberos message.
+const maxMessageLen = 1024 * 1024
+
+// DetectProto Kerberos over TCP proto detect function, client begins with
+// record of AS-REQ or TGS-REQ.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 7 {
+		return false
+	}
+
+	length := binary.BigEndian.Uint32(payload)
+	if length < 3 || length > maxMessageLen {
+		return false
+	}
+
+	// [APPLICATION 10] AS-REQ or [APPLICATION 12] TGS-REQ containing sequence
+	if payload[4] != 0x6a && payload[4] != 0x6c {
+		return false
+	}
+
+	offset := 6
+	if payload[5] >= 0x80 {
+		offset += int(payload[5] & 0x7f)
+	}
+
+	return offset < len(payload) && payload[offset] == 0x30
+}
@@ -0,0 +1,47 @@
+package ldap
+
+// requestTags identifiers of requests beginning LDAP connection, bind,
+// search and extended request.
+var requestTags = map[byte]bool{
+	0x60: true,
+	0x63: true,
+	0x77: true,
+}
+
+// skipHeader skip identifier and definite length octets of BER element, it
+// returns -1 if header is invalid or incomplete.
+func skipHeader(data []byte, offset int) int {
+	if offset+2 > len(data) {
+		return -1
+	}
+
+	length := data[offset+1]
+	if length < 0x80 {
+		return offset + 2
+	}
+
+	n := int(length & 0x7f)
+	if n == 0 || n > 4 || offset+2+n > len(data) {
+		return -1
+	}
+
+	return offset + 2 + n
+}
+
+// DetectProto LDAP proto detect function, client begins with bind, search or
+// extended request message.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 7 || payload[0] != 0x30 {
+		return false
+	}
+
+	// Message ID is INTEGER of 1 to 4 bytes
+	offset := skipHeader(payload, 0)
+	if offset < 0 || offset+2 > len(payload) || payload[offset] != 0x02 ||
+		payload[offset+1] < 1 || payload[offset+1] > 4 {
+		return false
+	}
+	offset += 2 + int(payload[offset+1])
+
+	return offset < len(payload) && requestTags[payload[offset]] && skipHeader(payload, offset) > 0
+}
@@ -0,0 +1,63 @@
+package memcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// textCommands commands of text protocol, commands which are common in
+// other text protocols like "version" and "quit" are excluded.
+var textCommands = map[string]bool{
+	"get":       true,
+	"gets":      true,
+	"gat":       true,
+	"gats":      true,
+	"set":       true,
+	"add":       true,
+	"replace":   true,
+	"append":    true,
+	"prepend":   true,
+	"cas":       true,
+	"delete":    true,
+	"incr":      true,
+	"decr":      true,
+	"touch":     true,
+	"flush_all": true,
+	"mg":        true,
+	"ms":        true,
+	"md":        true,
+	"ma":        true,
+	"mn":        true,
+}
+
+// DetectProto memcached proto detect function, client begins connection
+// with binary request header or text command line.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) == 0 {
+		return false
+	}
+
+	// Binary request header
+	if payload[0] == 0x80 {
+		if len(payload) < 24 {
+			return false
+		}
+		keyLen := int(binary.BigEndian.Uint16(payload[2:4]))
+		extrasLen := int(payload[4])
+		bodyLen := int(binary.BigEndian.Uint32(payload[8:12]))
+		return payload[5] == 0 && keyLen <= 250 && keyLen+extrasLen <= bodyLen
+	}
+
+	end := bytes.Index(payload, []byte("\r\n"))
+	if end <= 0 || end > 2048 {
+		return false
+	}
+	fields := strings.Fields(string(payload[:end]))
+	if len(fields) == 0 || !textCommands[fields[0]] {
+		return false
+	}
+
+	// Commands except mn and flush_all have key
+	return len(fields) > 1 || fields[0] == "mn" || fields[0] == "flush_all"
+}
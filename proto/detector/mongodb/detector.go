@@ -0,0 +1,47 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Opcodes of requests beginning connection.
+const (
+	opQuery      = 2004
+	opCompressed = 2012
+	opMsg        = 2013
+)
+
+// DetectProto MongoDB proto detect function, client begins connection with
+// OP_MSG or OP_QUERY hello command, or compressed one.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 21 {
+		return false
+	}
+
+	length := binary.LittleEndian.Uint32(payload)
+	responseTo := binary.LittleEndian.Uint32(payload[8:])
+	if length < 21 || length > 48*1000*1000 || responseTo != 0 {
+		return false
+	}
+
+	body := payload[16:]
+	switch binary.LittleEndian.Uint32(payload[12:]) {
+	case opMsg:
+		// Flag bits, section kind and document length
+		return len(body) >= 9 && body[4] <= 1 && binary.LittleEndian.Uint32(body[5:]) >= 5
+
+	case opQuery:
+		// Flag bits and full collection name
+		end := bytes.IndexByte(body[4:], 0)
+		return end > 0 && bytes.IndexByte(body[4:4+end], '.') > 0
+
+	case opCompressed:
+		// Original opcode and compressor id
+		original := binary.LittleEndian.Uint32(body)
+		return len(body) >= 9 && (original == opMsg || original == opQuery) && body[8] <= 3
+
+	default:
+		return false
+	}
+}
@@ -0,0 +1,36 @@
+package mqtt
+
+import (
+	"bytes"
+)
+
+// Protocol names and levels of MQTT 3.1, 3.1.1 and 5.
+var (
+	protocolMQIsdp = []byte("\x00\x06MQIsdp\x03")
+	protocolMQTT   = []byte("\x00\x04MQTT")
+)
+
+// DetectProto MQTT proto detect function, client begins connection with
+// CONNECT packet.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 2 || payload[0] != 0x10 {
+		return false
+	}
+
+	// Remaining length of up to 4 bytes
+	n := 1
+	for n < len(payload) && n <= 4 && payload[n]&0x80 != 0 {
+		n++
+	}
+	if n > 4 || n+1 > len(payload) {
+		return false
+	}
+
+	variableHeader := payload[n+1:]
+	if bytes.HasPrefix(variableHeader, protocolMQIsdp) {
+		return true
+	}
+
+	return bytes.HasPrefix(variableHeader, protocolMQTT) && len(variableHeader) > len(protocolMQTT) &&
+		(variableHeader[len(protocolMQTT)] == 4 || variableHeader[len(protocolMQTT)] == 5)
+}
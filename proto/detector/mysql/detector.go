@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"bytes"
+)
+
+// DetectProto MySQL proto detect function, server begins connection with
+// initial handshake packet of protocol version 10 and NUL terminated
+// server version.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if fromClient || len(payload) < 5 {
+		return false
+	}
+
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	if payload[3] != 0 || payload[4] != 10 || length < 32 || length > 1024 {
+		return false
+	}
+
+	body := payload[5:]
+	if len(body) > length-1 {
+		body = body[:length-1]
+	}
+	end := bytes.IndexByte(body, 0)
+	if end <= 0 {
+		return false
+	}
+	for _, c := range body[:end] {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,27 @@
+package nfs
+
+import (
+	"encoding/binary"
+)
+
+// nfsProgram RPC program number of NFS.
+const nfsProgram = 100003
+
+// DetectProto NFS over TCP proto detect function, client begins with record
+// of RPC call to NFS program.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 28 {
+		return false
+	}
+
+	// Record marking header, XID, message type, RPC version, program and
+	// program version
+	length := binary.BigEndian.Uint32(payload) &^ 0x80000000
+	msgType := binary.BigEndian.Uint32(payload[8:])
+	rpcVersion := binary.BigEndian.Uint32(payload[12:])
+	program := binary.BigEndian.Uint32(payload[16:])
+	version := binary.BigEndian.Uint32(payload[20:])
+
+	return length >= 24 && msgType == 0 && rpcVersion == 2 &&
+		program == nfsProgram && version >= 2 && version <= 4
+}
@@ -0,0 +1,35 @@
+package pop3
+
+import (
+	"bytes"
+)
+
+// clientCommands commands beginning POP3 connection.
+var clientCommands = [][]byte{
+	[]byte("CAPA"),
+	[]byte("USER "),
+	[]byte("APOP "),
+	[]byte("STLS"),
+}
+
+// DetectProto POP3 proto detect function, server greets with +OK mentioning
+// POP, client begins with CAPA, USER, APOP or STLS.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return false
+	}
+	line := bytes.ToUpper(bytes.TrimRight(payload[:end], "\r"))
+
+	if !fromClient {
+		return bytes.HasPrefix(line, []byte("+OK")) && bytes.Contains(line, []byte("POP"))
+	}
+
+	for _, c := range clientCommands {
+		if bytes.Equal(line, bytes.TrimSpace(c)) || bytes.HasPrefix(line, c) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+package postgresql
+
+import (
+	"encoding/binary"
+)
+
+// Codes of untyped messages from client.
+const (
+	protocolVersion3 uint32 = 196608
+	sslRequest       uint32 = 80877103
+	gssEncRequest    uint32 = 80877104
+)
+
+// DetectProto PostgreSQL proto detect function, client begins connection
+// with startup message of protocol 3.0, or SSLRequest and GSSENCRequest
+// before it.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient || len(payload) < 8 {
+		return false
+	}
+
+	length := binary.BigEndian.Uint32(payload)
+	switch code := binary.BigEndian.Uint32(payload[4:]); code {
+	case sslRequest, gssEncRequest:
+		return length == 8
+
+	case protocolVersion3:
+		// Startup message ends with NUL after parameter pairs
+		if length < 9 || length > 10000 || uint32(len(payload)) < length {
+			return false
+		}
+		return payload[length-1] == 0
+
+	default:
+		return false
+	}
+}
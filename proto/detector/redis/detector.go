@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// maxCommandLen max length of Redis command name.
+const maxCommandLen = 32
+
+// readLength read length of RESP line like "*3\r\n" beginning with typ.
+func readLength(data []byte, typ byte) (int, []byte, bool) {
+	if len(data) == 0 || data[0] != typ {
+		return 0, nil, false
+	}
+
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 2 || end > 11 {
+		return 0, nil, false
+	}
+	length, err := strconv.Atoi(string(data[1:end]))
+	if err != nil {
+		return 0, nil, false
+	}
+
+	return length, data[end+2:], true
+}
+
+// DetectProto Redis proto detect function, client begins connection with
+// command of RESP array of bulk strings whose first bulk string is command
+// name.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if !fromClient {
+		return false
+	}
+
+	count, rest, ok := readLength(payload, '*')
+	if !ok || count < 1 || count > 1024*1024 {
+		return false
+	}
+	length, rest, ok := readLength(rest, '$')
+	if !ok || length < 1 || length > maxCommandLen || len(rest) < length+2 {
+		return false
+	}
+	if rest[length] != '\r' || rest[length+1] != '\n' {
+		return false
+	}
+	for _, c := range rest[:length] {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,34 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var (
+	protocolSMB1 = []byte{0xff, 'S', 'M', 'B'}
+	protocolSMB2 = []byte{0xfe, 'S', 'M', 'B'}
+)
+
+// DetectProto SMB2/SMB3 over direct TCP proto detect function, client begins
+// with SMB2 negotiate request or SMB1 multi-protocol negotiate request.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	// Direct TCP transport header of session message
+	if !fromClient || len(payload) < 9 || payload[0] != 0x00 {
+		return false
+	}
+
+	msg := payload[4:]
+	switch {
+	case bytes.HasPrefix(msg, protocolSMB2):
+		// Header structure size 64 and command NEGOTIATE
+		return len(msg) >= 14 && binary.LittleEndian.Uint16(msg[4:]) == 64 &&
+			binary.LittleEndian.Uint16(msg[12:]) == 0
+
+	case bytes.HasPrefix(msg, protocolSMB1):
+		return msg[4] == 0x72
+
+	default:
+		return false
+	}
+}
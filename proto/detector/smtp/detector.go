@@ -0,0 +1,25 @@
+package smtp
+
+import (
+	"bytes"
+)
+
+// DetectProto SMTP proto detect function, server greets with 220 reply
+// mentioning SMTP, client begins with EHLO or HELO.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	line := payload
+	if end := bytes.IndexByte(payload, '\n'); end >= 0 {
+		line = payload[:end]
+	}
+
+	if fromClient {
+		if len(line) < 5 {
+			return false
+		}
+		verb := bytes.ToUpper(line[:5])
+		return bytes.Equal(verb, []byte("EHLO ")) || bytes.Equal(verb, []byte("HELO "))
+	}
+
+	return len(line) > 4 && bytes.HasPrefix(line, []byte("220")) && (line[3] == ' ' || line[3] == '-') &&
+		bytes.Contains(bytes.ToUpper(line), []byte("SMTP"))
+}
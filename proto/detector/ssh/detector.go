@@ -0,0 +1,11 @@
+package ssh
+
+import (
+	"bytes"
+)
+
+// DetectProto SSH proto detect function, both sides begin with SSH-2.0 or
+// SSH-1.99 identification string.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	return bytes.HasPrefix(payload, []byte("SSH-2.0-")) || bytes.HasPrefix(payload, []byte("SSH-1.99-"))
+}
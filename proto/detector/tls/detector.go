@@ -0,0 +1,20 @@
+package tls
+
+// DetectProto TLS proto detect function, connection begins with handshake
+// record of ClientHello from client or ServerHello from server.
+func DetectProto(payload []byte, fromClient bool) (detected bool) {
+	if len(payload) < 6 {
+		return false
+	}
+
+	// Record type is handshake and record version is SSL 3.0 to TLS 1.3
+	if payload[0] != 22 || payload[1] != 3 || payload[2] > 4 {
+		return false
+	}
+
+	if fromClient {
+		return payload[5] == 1
+	}
+
+	return payload[5] == 2
+}
@@ -7,6 +7,69 @@ const (
 	// HTTPProtoName HTTP proto name.
 	HTTPProtoName = "HTTP"
 
+	// HTTP2ProtoName HTTP/2 proto name.
+	HTTP2ProtoName = "HTTP2"
+
+	// TLSProtoName TLS proto name.
+	TLSProtoName = "TLS"
+
+	// MySQLProtoName MySQL proto name.
+	MySQLProtoName = "MYSQL"
+
+	// PostgreSQLProtoName PostgreSQL proto name.
+	PostgreSQLProtoName = "POSTGRESQL"
+
+	// RedisProtoName Redis proto name.
+	RedisProtoName = "REDIS"
+
+	// MemcachedProtoName memcached proto name.
+	MemcachedProtoName = "MEMCACHED"
+
+	// MongoDBProtoName MongoDB proto name.
+	MongoDBProtoName = "MONGODB"
+
+	// KafkaProtoName Kafka proto name.
+	KafkaProtoName = "KAFKA"
+
+	// AMQPProtoName AMQP proto name.
+	AMQPProtoName = "AMQP"
+
+	// MQTTProtoName MQTT proto name.
+	MQTTProtoName = "MQTT"
+
+	// SMTPProtoName SMTP proto name.
+	SMTPProtoName = "SMTP"
+
+	// IMAPProtoName IMAP proto name.
+	IMAPProtoName = "IMAP"
+
+	// POP3ProtoName POP3 proto name.
+	POP3ProtoName = "POP3"
+
+	// FTPProtoName FTP control connection proto name.
+	FTPProtoName = "FTP"
+
+	// FTPDataProtoName FTP data connection proto name.
+	FTPDataProtoName = "FTP-DATA"
+
+	// SSHProtoName SSH proto name.
+	SSHProtoName = "SSH"
+
+	// LDAPProtoName LDAP proto name.
+	LDAPProtoName = "LDAP"
+
+	// KerberosProtoName Kerberos proto name.
+	KerberosProtoName = "KERBEROS"
+
+	// NFSProtoName NFS proto name.
+	NFSProtoName = "NFS"
+
+	// SMBProtoName SMB2/SMB3 proto name.
+	SMBProtoName = "SMB"
+
+	// CQLProtoName Cassandra CQL native protocol proto name.
+	CQLProtoName = "CQL"
+
 	// DefaultProtoName default proto name.
 	DefaultProtoName = TCPProtoName
 )
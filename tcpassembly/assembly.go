@@ -221,6 +221,9 @@ type Stream struct {
 	// TCP application layer analyzer
 	Analyzer analyzer.Analyzer
 
+	// TCP stream packet ring for pcap export
+	PacketRing *PacketRing
+
 	// Streams list node
 	StreamsListElement *list.Element
 
@@ -323,6 +326,7 @@ type SessionBreakdown struct {
 	ClientZeroWindows                 uint               `json:"tcp_client_zero_windows"`
 	ServerZeroWindows                 uint               `json:"tcp_server_zero_windows"`
 	ApplicationSessionBreakdown       interface{}        `json:"application_session_breakdown"`
+	PcapFile                          string             `json:"pcap_file,omitempty"`
 }
 
 // Assembler TCP stream Assembler.
@@ -332,6 +336,25 @@ type Assembler struct {
 	StreamsList        list.List
 	ClosingStreamsList list.List
 	SessionBreakdowns  []interface{}
+	PcapExport         *PcapExportConfig
+}
+
+// addSessionBreakdown add new session breakdown of TCP stream.
+func (a *Assembler) addSessionBreakdown(stream *Stream, appSessionBreakdown interface{}, timestamp time.Time) {
+	sb := stream.Session2Breakdown(appSessionBreakdown)
+	a.exportPcap(stream, sb, timestamp)
+	a.SessionBreakdowns = append(a.SessionBreakdowns, sb)
+
+	// Analyzer may queue more session breakdowns generated by the same call
+	if queue, ok := stream.Analyzer.(analyzer.SessionBreakdownQueue); ok {
+		for next := queue.PopSessionBreakdown(); next != nil; next = queue.PopSessionBreakdown() {
+			sb = stream.Session2Breakdown(next)
+			a.exportPcap(stream, sb, timestamp)
+			a.SessionBreakdowns = append(a.SessionBreakdowns, sb)
+		}
+	}
+
+	a.resetPacketRing(stream)
 }
 
 // handleEstb TCP stream connection establishment handler.
@@ -363,17 +386,27 @@ func (a *Assembler) handleData(stream *Stream, snd *HalfStream, rcv *HalfStream,
 	if stream.Analyzer != nil {
 		var appSessionBreakdown interface{}
 
-		if direction == FromClient {
-			parseBytes, appSessionBreakdown = stream.Analyzer.HandleData(rcv.RecvData, true, timestamp)
-		} else {
-			parseBytes, appSessionBreakdown = stream.Analyzer.HandleData(rcv.RecvData, false, timestamp)
-		}
-		rcv.RecvData = rcv.RecvData[parseBytes:]
-		rcv.TotalRecvDataBytes += uint32(parseBytes)
+		// Analyzer returns after each session breakdown, feed the rest of
+		// data again for pipelined sessions.
+		for {
+			if direction == FromClient {
+				parseBytes, appSessionBreakdown = stream.Analyzer.HandleData(rcv.RecvData, true, timestamp)
+			} else {
+				parseBytes, appSessionBreakdown = stream.Analyzer.HandleData(rcv.RecvData, false, timestamp)
+			}
+			rcv.RecvData = rcv.RecvData[parseBytes:]
+			rcv.TotalRecvDataBytes += uint32(parseBytes)
+
+			if appSessionBreakdown == nil {
+				break
+			}
 
-		if appSessionBreakdown != nil {
 			log.Debugf("TCP assembly: TCP connection %s generate new session breakdown by Data %s.", stream.Addr, direction)
-			a.SessionBreakdowns = append(a.SessionBreakdowns, stream.Session2Breakdown(appSessionBreakdown))
+			a.addSessionBreakdown(stream, appSessionBreakdown, timestamp)
+
+			if parseBytes == 0 || len(rcv.RecvData) == 0 {
+				break
+			}
 		}
 	} else {
 		var protoName string
@@ -428,7 +461,7 @@ func (a *Assembler) handleReset(stream *Stream, snd *HalfStream, rcv *HalfStream
 		}
 		if appSessionBreakdown != nil {
 			log.Debugf("TCP assembly: TCP connection %s generate new session breakdown by Reset %s.", stream.Addr, direction)
-			a.SessionBreakdowns = append(a.SessionBreakdowns, stream.Session2Breakdown(appSessionBreakdown))
+			a.addSessionBreakdown(stream, appSessionBreakdown, timestamp)
 		}
 	}
 
@@ -461,7 +494,7 @@ func (a *Assembler) handleFin(stream *Stream, snd *HalfStream, rcv *HalfStream,
 		}
 		if appSessionBreakdown != nil {
 			log.Debugf("TCP assembly: TCP connection %s generate new session breakdown by Fin %s.", stream.Addr, direction)
-			a.SessionBreakdowns = append(a.SessionBreakdowns, stream.Session2Breakdown(appSessionBreakdown))
+			a.addSessionBreakdown(stream, appSessionBreakdown, timestamp)
 		}
 	}
 }
@@ -530,7 +563,7 @@ func (a *Assembler) findStream(ipDecoder layers.Decoder, tcp *layers.TCP) (*Stre
 	return nil, FromClient
 }
 
-func (a *Assembler) addStream(ipDecoder layers.Decoder, tcp *layers.TCP, timestamp time.Time) {
+func (a *Assembler) addStream(ipDecoder layers.Decoder, tcp *layers.TCP, timestamp time.Time) *Stream {
 	var srcIP, dstIP net.IP
 
 	if ip4, ok := ipDecoder.(*layers.IPv4); ok {
@@ -538,7 +571,7 @@ func (a *Assembler) addStream(ipDecoder layers.Decoder, tcp *layers.TCP, timesta
 		dstIP = ip4.DstIP
 	} else {
 		log.Errorf("TCP assembly: unsupported network decoder=%s.", reflect.TypeOf(ipDecoder))
-		return
+		return nil
 	}
 
 	addr := Tuple4{
@@ -570,19 +603,29 @@ func (a *Assembler) addStream(ipDecoder layers.Decoder, tcp *layers.TCP, timesta
 
 	stream.ProtoName = detector.GetProto(dstIP.String(), tcp.DstPort)
 	stream.Analyzer = analyzer.GetAnalyzer(stream.ProtoName)
+	if setter, ok := stream.Analyzer.(analyzer.ConnAddrSetter); ok {
+		setter.SetConnAddr(addr.SrcIP, addr.SrcPort, addr.DstIP, addr.DstPort)
+	}
+	if setter, ok := stream.Analyzer.(analyzer.ProtoRegistrySetter); ok {
+		setter.SetProtoRegistry(detector.AddProto, detector.RemoveProto)
+	}
 
-	if stream.Analyzer != nil || a.StreamsList.Len() < maxTCPStreamsCount {
-		if stream.Analyzer != nil {
-			a.Count++
-		}
-		a.Streams[addr] = stream
-		stream.StreamsListElement = a.StreamsList.PushBack(stream)
+	if stream.Analyzer == nil && a.StreamsList.Len() >= maxTCPStreamsCount {
+		return nil
 	}
 
+	if stream.Analyzer != nil {
+		a.Count++
+	}
+	a.Streams[addr] = stream
+	stream.StreamsListElement = a.StreamsList.PushBack(stream)
+
 	for a.StreamsList.Len() > maxTCPStreamsCount {
-		stream := a.StreamsList.Front().Value.(*Stream)
-		a.handleCloseAbnormally(stream, timestamp)
+		oldest := a.StreamsList.Front().Value.(*Stream)
+		a.handleCloseAbnormally(oldest, timestamp)
 	}
+
+	return stream
 }
 
 func (a *Assembler) removeStream(stream *Stream) {
@@ -740,11 +783,17 @@ func (a *Assembler) Assemble(ipDecoder layers.Decoder, tcpDecoder layers.Decoder
 	if stream == nil {
 		// The first packet of tcp three-way handshakes
 		if tcp.SYN && !tcp.ACK && !tcp.RST {
-			a.addStream(ipDecoder, tcp, timestamp)
+			if stream = a.addStream(ipDecoder, tcp, timestamp); stream != nil && stream.Analyzer != nil {
+				a.recordPacket(stream, ipDecoder, timestamp)
+			}
 		}
 		return
 	}
 
+	if stream.Analyzer != nil {
+		a.recordPacket(stream, ipDecoder, timestamp)
+	}
+
 	if tcp.SYN {
 		// The second packet of tcp three-way handshakes
 		if direction == FromServer && tcp.ACK &&
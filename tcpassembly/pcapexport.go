@@ -0,0 +1,275 @@
+package tcpassembly
+
+import (
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/zhengyuli/ntrace/layers"
+	"github.com/zhengyuli/ntrace/proto/analyzer"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pcapRingPackets per-stream packet ring size, default is 256 packets, it
+// can be changed by PCAP_RING_PACKETS env.
+var pcapRingPackets = 256
+
+func init() {
+	if ringPackets, err := strconv.Atoi(os.Getenv("PCAP_RING_PACKETS")); err == nil && ringPackets > 0 {
+		pcapRingPackets = ringPackets
+	}
+}
+
+const (
+	// pcapLinkTypeIPv4 pcap link type for raw IPv4 packets.
+	pcapLinkTypeIPv4 = 228
+	// pcapSnapLen pcap snapshot length.
+	pcapSnapLen = 65535
+)
+
+// RingPacket packet kept in per-stream packet ring.
+type RingPacket struct {
+	Time time.Time
+	Data []byte
+}
+
+// PacketRing bounded per-stream packet ring, the oldest packet will be
+// overwritten when ring is full.
+type PacketRing struct {
+	Packets []RingPacket
+	Next    int
+	Full    bool
+}
+
+// NewPacketRing create a new packet ring with size packets.
+func NewPacketRing(size int) *PacketRing {
+	return &PacketRing{
+		Packets: make([]RingPacket, size),
+	}
+}
+
+// Add add packet to packet ring, data will be copied.
+func (r *PacketRing) Add(data []byte, timestamp time.Time) {
+	r.Packets[r.Next] = RingPacket{
+		Time: timestamp,
+		Data: append([]byte(nil), data...),
+	}
+
+	r.Next++
+	if r.Next == len(r.Packets) {
+		r.Next = 0
+		r.Full = true
+	}
+}
+
+// Len get packets count of packet ring.
+func (r *PacketRing) Len() int {
+	if r.Full {
+		return len(r.Packets)
+	}
+
+	return r.Next
+}
+
+// Walk walk all packets of packet ring from the oldest to the newest.
+func (r *PacketRing) Walk(fn func(pkt *RingPacket)) {
+	if r.Full {
+		for i := r.Next; i < len(r.Packets); i++ {
+			fn(&r.Packets[i])
+		}
+	}
+	for i := 0; i < r.Next; i++ {
+		fn(&r.Packets[i])
+	}
+}
+
+// Reset drop all packets of packet ring.
+func (r *PacketRing) Reset() {
+	r.Keep(0)
+}
+
+// Keep drop all packets of packet ring except the newest n packets.
+func (r *PacketRing) Keep(n int) {
+	if n > r.Len() {
+		n = r.Len()
+	}
+
+	kept := make([]RingPacket, 0, n)
+	skip := r.Len() - n
+	r.Walk(func(pkt *RingPacket) {
+		if skip > 0 {
+			skip--
+			return
+		}
+		kept = append(kept, *pkt)
+	})
+
+	for i := 0; i < len(r.Packets); i++ {
+		r.Packets[i] = RingPacket{}
+	}
+	copy(r.Packets, kept)
+	r.Next = len(kept)
+	r.Full = false
+	if r.Next == len(r.Packets) {
+		r.Next = 0
+		r.Full = true
+	}
+}
+
+// WritePcap write all packets of packet ring to pcap file.
+func (r *PacketRing) WritePcap(filePath string) error {
+	out, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeIPv4)
+	if _, err = out.Write(hdr); err != nil {
+		return err
+	}
+
+	r.Walk(func(pkt *RingPacket) {
+		if err != nil {
+			return
+		}
+
+		recHdr := make([]byte, 16)
+		binary.LittleEndian.PutUint32(recHdr[0:4], uint32(pkt.Time.Unix()))
+		binary.LittleEndian.PutUint32(recHdr[4:8], uint32(pkt.Time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(recHdr[8:12], uint32(len(pkt.Data)))
+		binary.LittleEndian.PutUint32(recHdr[12:16], uint32(len(pkt.Data)))
+		if _, err = out.Write(recHdr); err != nil {
+			return
+		}
+		_, err = out.Write(pkt.Data)
+	})
+
+	return err
+}
+
+// PcapExportConfig config of exporting stream packets to pcap file for
+// flagged session breakdowns.
+type PcapExportConfig struct {
+	// Dir pcap files output directory.
+	Dir string
+	// MinStatusCode/MaxStatusCode application status code range to flag,
+	// disabled if MinStatusCode is 0.
+	MinStatusCode uint16
+	MaxStatusCode uint16
+	// MinLatency application latency in milliseconds to flag, disabled
+	// if 0.
+	MinLatency uint
+	// MinRetransmits TCP retransmitted packets count to flag, disabled
+	// if 0.
+	MinRetransmits uint
+	// Reset flag session breakdowns which are reset.
+	Reset bool
+}
+
+// Match return true if session breakdown of stream should be exported to
+// pcap file.
+func (c *PcapExportConfig) Match(stream *Stream, sb *SessionBreakdown) bool {
+	if c.MinRetransmits > 0 &&
+		sb.Client2ServerRetransmittedPackets+sb.Server2ClientRetransmittedPackets >= c.MinRetransmits {
+		return true
+	}
+
+	if c.Reset && (stream.State == StreamResetByClientAferConn || stream.State == StreamResetByServerAferConn) {
+		return true
+	}
+
+	if status, ok := sb.ApplicationSessionBreakdown.(analyzer.SessionBreakdownStatusCode); ok &&
+		c.MinStatusCode > 0 && status.ApplicationStatusCode() >= c.MinStatusCode &&
+		status.ApplicationStatusCode() <= c.MaxStatusCode {
+		return true
+	}
+
+	if latency, ok := sb.ApplicationSessionBreakdown.(analyzer.SessionBreakdownLatency); ok &&
+		c.MinLatency > 0 && latency.ApplicationLatency() >= time.Duration(c.MinLatency)*time.Millisecond {
+		return true
+	}
+
+	return false
+}
+
+// ParseStatusCodeRange parse status code range like "500-599" or "404".
+func ParseStatusCodeRange(codeRange string) (minCode uint16, maxCode uint16, err error) {
+	items := strings.SplitN(codeRange, "-", 2)
+
+	min, err := strconv.ParseUint(strings.TrimSpace(items[0]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status code range %q", codeRange)
+	}
+	max := min
+	if len(items) == 2 {
+		if max, err = strconv.ParseUint(strings.TrimSpace(items[1]), 10, 16); err != nil || max < min {
+			return 0, 0, fmt.Errorf("invalid status code range %q", codeRange)
+		}
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+// recordPacket add packet to stream packet ring if pcap export is enabled.
+func (a *Assembler) recordPacket(stream *Stream, ipDecoder layers.Decoder, timestamp time.Time) {
+	if a.PcapExport == nil {
+		return
+	}
+
+	if stream.PacketRing == nil {
+		stream.PacketRing = NewPacketRing(pcapRingPackets)
+	}
+
+	data := make([]byte, 0, len(ipDecoder.LayerContents())+len(ipDecoder.LayerPayload()))
+	data = append(data, ipDecoder.LayerContents()...)
+	data = append(data, ipDecoder.LayerPayload()...)
+	stream.PacketRing.Add(data, timestamp)
+}
+
+// exportPcap export stream packet ring to pcap file if session breakdown
+// is flagged.
+func (a *Assembler) exportPcap(stream *Stream, sb *SessionBreakdown, timestamp time.Time) {
+	if a.PcapExport == nil || stream.PacketRing == nil || stream.PacketRing.Len() == 0 {
+		return
+	}
+
+	if !a.PcapExport.Match(stream, sb) {
+		return
+	}
+
+	fileName := strings.NewReplacer(":", "_", "-", "_").Replace(stream.Addr.String())
+	filePath := path.Join(a.PcapExport.Dir, fmt.Sprintf("%s_%d.pcap", fileName, timestamp.UnixNano()))
+	if err := stream.PacketRing.WritePcap(filePath); err != nil {
+		log.Errorf("TCP assembly: TCP connection %s export pcap file %s error: %s.", stream.Addr, filePath, err)
+		return
+	}
+
+	log.Debugf("TCP assembly: TCP connection %s export %d packets to pcap file %s.", stream.Addr, stream.PacketRing.Len(), filePath)
+	sb.PcapFile = filePath
+}
+
+// resetPacketRing drop packets of finished sessions from stream packet ring
+// after session breakdowns are generated whether or not they are exported,
+// so that keep-alive and pipelined sessions won't export packets of earlier
+// sessions. The newest packet is kept if stream still has data not parsed,
+// since it carries the beginning of the next session.
+func (a *Assembler) resetPacketRing(stream *Stream) {
+	if stream.PacketRing == nil {
+		return
+	}
+
+	if len(stream.Client.RecvData) > 0 || len(stream.Server.RecvData) > 0 {
+		stream.PacketRing.Keep(1)
+	} else {
+		stream.PacketRing.Reset()
+	}
+}
@@ -0,0 +1,97 @@
+package tcpassembly
+
+import (
+	"github.com/zhengyuli/ntrace/proto/analyzer/http"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPacketRing(t *testing.T) {
+	ring := NewPacketRing(3)
+	timestamp := time.Now()
+	for i := 0; i < 5; i++ {
+		ring.Add([]byte{byte(i)}, timestamp)
+	}
+
+	if ring.Len() != 3 {
+		t.Errorf("Packet ring: get wrong length %d.", ring.Len())
+	}
+
+	var data []byte
+	ring.Walk(func(pkt *RingPacket) {
+		data = append(data, pkt.Data...)
+	})
+	if string(data) != string([]byte{2, 3, 4}) {
+		t.Errorf("Packet ring: get wrong packets %v.", data)
+	}
+
+	dir, err := ioutil.TempDir("", "ntrace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "test.pcap")
+	if err := ring.WritePcap(filePath); err != nil {
+		t.Fatalf("Packet ring: write pcap error: %s.", err)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.Size() != 24+3*(16+1) {
+		t.Error("Packet ring: write pcap with wrong size.")
+	}
+
+	ring.Reset()
+	if ring.Len() != 0 {
+		t.Error("Packet ring: reset doesn't drop packets.")
+	}
+}
+
+func TestPacketRingKeep(t *testing.T) {
+	ring := NewPacketRing(3)
+	timestamp := time.Now()
+	for i := 0; i < 4; i++ {
+		ring.Add([]byte{byte(i)}, timestamp)
+	}
+
+	ring.Keep(1)
+	ring.Add([]byte{4}, timestamp)
+
+	var data []byte
+	ring.Walk(func(pkt *RingPacket) {
+		data = append(data, pkt.Data...)
+	})
+	if string(data) != string([]byte{3, 4}) {
+		t.Errorf("Packet ring: keep get wrong packets %v.", data)
+	}
+}
+
+func TestPcapExportConfigMatch(t *testing.T) {
+	config := &PcapExportConfig{
+		MinStatusCode:  500,
+		MaxStatusCode:  599,
+		MinLatency:     1000,
+		MinRetransmits: 10,
+		Reset:          true,
+	}
+
+	tests := []struct {
+		state   StreamState
+		sb      *SessionBreakdown
+		matched bool
+	}{
+		{StreamDataExchanging, &SessionBreakdown{ApplicationSessionBreakdown: &http.SessionBreakdown{StatusCode: 200}}, false},
+		{StreamDataExchanging, &SessionBreakdown{ApplicationSessionBreakdown: &http.SessionBreakdown{StatusCode: 503}}, true},
+		{StreamDataExchanging, &SessionBreakdown{ApplicationSessionBreakdown: &http.SessionBreakdown{StatusCode: 200, ServerLatency: 1200}}, true},
+		{StreamResetByClientAferConn, &SessionBreakdown{ApplicationSessionBreakdown: &http.SessionBreakdown{}}, true},
+		{StreamResetByServerBeforeConn, &SessionBreakdown{}, false},
+		{StreamDataExchanging, &SessionBreakdown{Client2ServerRetransmittedPackets: 6, Server2ClientRetransmittedPackets: 4}, true},
+	}
+
+	for i, test := range tests {
+		if config.Match(&Stream{State: test.state}, test.sb) != test.matched {
+			t.Errorf("Pcap export: case %d should be matched=%t.", i, test.matched)
+		}
+	}
+}